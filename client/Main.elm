@@ -13,17 +13,19 @@ import Html exposing (..)
 import Html.Attributes exposing (href)
 import Http exposing (Error(..), emptyBody)
 import Loading
+import Messages exposing (loadMessageThread, pageMessageThread, replyToMessageThread)
 import Login exposing (loggedIn, login, loginUpdateForm, loginValidate, pageLogin, userIsEditor)
 import Ports exposing (storeExpire, storeToken)
 import Profile exposing (pageProfile, profile, profileUpdateForm, profileValidate)
 import Register exposing (pageRegister, register, registerUpdateForm, registerValidate)
+import ResetPassword exposing (pageResetPassword, resetPassword)
 import Set
 import Task
 import Time
 import Transaction exposing (loadTransactions, loadTxUsers, pageTransactionList)
 import TransactionCreate exposing (pageTransactionCreate, transaction, transactionCheckBalance, transactionUpdateForm, transactionValidate)
-import TransactionPending exposing (acceptTransaction, pageTransactionPending, rejectTransaction)
-import Types exposing (LoginForm, Model, Msg(..), Page(..), Problem(..), Session, Transaction, TransactionFromType(..), TransactionType(..), User, authHeader, conceptDecoder, displayableTagsListFrom, emptyConcept, emptyConceptForm, emptyProfileForm, emptySession, emptyTransactionForm, emptyUser, indexUser, intHoursFromTgs, intMinutesFromTgs, intSecondsFromTgs, isNot, padAndCapTimePart, profileDecoder, tgsFromTimeHMSAndMultiplier, txFeeFromTgs, userDecoder)
+import TransactionPending exposing (acceptTransaction, cancelTransaction, pageTransactionPending, rejectTransaction)
+import Types exposing (LoginForm, Model, Msg(..), Page(..), Problem(..), Session, Transaction, TransactionFromType(..), TransactionType(..), User, authHeader, conceptDecoder, displayableTagsListFrom, emptyConcept, emptyConceptForm, emptyMessageThread, emptyProfileForm, emptySession, emptyTransactionForm, emptyUser, indexUser, intHoursFromTgs, intMinutesFromTgs, intSecondsFromTgs, isNot, padAndCapTimePart, profileDecoder, tgsFromTimeHMSAndMultiplier, txFeeFromTgs, userDecoder)
 import Url exposing (Url)
 import Url.Parser as UrlParser exposing ((</>), (<?>), Parser, s, string, top)
 import Url.Parser.Query as Query
@@ -90,6 +92,8 @@ init flags url key =
                 , conceptTagsList = []
                 , displayableTagsList = []
                 , conceptShowTagModel = Modal.hidden
+                , messageThread = emptyMessageThread
+                , messageReply = ""
                 }
     in
     ( model
@@ -197,6 +201,9 @@ mainContent model =
             Register email _ ->
                 pageRegister model email
 
+            ResetPassword _ _ ->
+                pageResetPassword model
+
             Profile ->
                 pageProfile model
 
@@ -224,6 +231,9 @@ mainContent model =
             AddConcept ->
                 pageAddConcept model
 
+            Messages _ ->
+                pageMessageThread model
+
 
 pageLogout : Model -> List (Html Msg)
 pageLogout model =
@@ -314,6 +324,55 @@ update msg model =
                     , Cmd.none
                     )
 
+        SubmittedResetPasswordForm ->
+            case registerValidate model.registerForm of
+                Ok validForm ->
+                    ( { model | problems = [], loading = Loading.On }
+                    , resetPassword validForm
+                    )
+
+                Err problems ->
+                    ( { model | problems = problems, loading = Loading.Off }
+                    , Cmd.none
+                    )
+
+        SubmittedMessageReplyForm ->
+            if String.isEmpty (String.trim model.messageReply) then
+                ( { model | problems = [ ServerError "reply can't be blank." ] }, Cmd.none )
+
+            else
+                ( { model | problems = [], loading = Loading.On }
+                , replyToMessageThread model
+                )
+
+        EnteredMessageReply body ->
+            ( { model | messageReply = body }, Cmd.none )
+
+        LoadedMessageThread (Err error) ->
+            ( { model | loading = Loading.Off, session = sessionGivenAuthError error model }
+            , Cmd.none
+            )
+
+        LoadedMessageThread (Ok res) ->
+            ( { model | messageThread = res, loading = Loading.Off }
+            , Cmd.none
+            )
+
+        SentMessageReply result ->
+            case result of
+                Ok _ ->
+                    ( { model | messageReply = "", loading = Loading.Off }, loadMessageThread model model.messageThread.id )
+
+                Err error ->
+                    let
+                        serverErrors =
+                            decodeErrors error
+                                |> List.map ServerError
+                    in
+                    ( { model | problems = List.append model.problems serverErrors, loading = Loading.Off, session = sessionGivenAuthError error model }
+                    , Cmd.none
+                    )
+
         SubmittedProfileForm ->
             case profileValidate model.profileForm of
                 Ok validForm ->
@@ -723,6 +782,21 @@ update msg model =
                     , Cmd.none
                     )
 
+        GotResetPasswordJson result ->
+            case result of
+                Ok res ->
+                    ( { model | apiActionResponse = res, loading = Loading.Off }, Cmd.none )
+
+                Err error ->
+                    let
+                        serverErrors =
+                            decodeErrors error
+                                |> List.map ServerError
+                    in
+                    ( { model | problems = List.append model.problems serverErrors, loading = Loading.Off }
+                    , Cmd.none
+                    )
+
         GotUpdateProfileJson result ->
             case result of
                 Ok res ->
@@ -860,6 +934,24 @@ update msg model =
                     , loadTransactions model
                     )
 
+        CancelledTransaction result ->
+            case result of
+                Ok res ->
+                    ( { model | apiActionResponse = res, loading = Loading.Off }, loadTransactions model )
+
+                Err error ->
+                    let
+                        serverErrors =
+                            decodeErrors error
+                                |> List.map ServerError
+
+                        newSession =
+                            sessionGivenAuthError error model
+                    in
+                    ( { model | problems = List.append model.problems serverErrors, loading = Loading.Off, session = newSession }
+                    , loadTransactions model
+                    )
+
         AcceptTransaction txId ->
             ( { model | loading = Loading.On }
             , acceptTransaction model txId
@@ -870,6 +962,11 @@ update msg model =
             , rejectTransaction model txId
             )
 
+        CancelTransaction txId ->
+            ( { model | loading = Loading.On }
+            , cancelTransaction model txId
+            )
+
         AdjustTimeZone zone ->
             ( { model | timeZone = zone }, Cmd.none )
 
@@ -931,6 +1028,9 @@ urlForPage page =
         Register _ _ ->
             "/register"
 
+        ResetPassword _ _ ->
+            "/reset_password"
+
         Transactions ->
             "/transactions/pending"
 
@@ -955,6 +1055,9 @@ urlForPage page =
         AddConcept ->
             "/add_concept"
 
+        Messages string ->
+            "/messages/" ++ string
+
 
 urlUpdate : Url -> Model -> ( Model, Cmd Msg )
 urlUpdate url model =
@@ -972,6 +1075,13 @@ urlUpdate url model =
                         , conceptTagForm = { tag = "" }
                     }
 
+                Messages _ ->
+                    { model
+                        | page = page
+                        , messageThread = emptyMessageThread
+                        , messageReply = ""
+                    }
+
                 Register email verification ->
                     { model
                         | page = page
@@ -983,6 +1093,17 @@ urlUpdate url model =
                             }
                     }
 
+                ResetPassword email verification ->
+                    { model
+                        | page = page
+                        , registerForm =
+                            { email = Maybe.withDefault "" email
+                            , password = ""
+                            , password_confirm = ""
+                            , verification = Maybe.withDefault "" verification
+                            }
+                    }
+
                 _ ->
                     { model | page = page }
             , case page of
@@ -1023,9 +1144,15 @@ urlUpdate url model =
                 Register _ _ ->
                     Cmd.none
 
+                ResetPassword _ _ ->
+                    Cmd.none
+
                 AddConcept ->
                     Cmd.none
 
+                Messages id ->
+                    loadMessageThread model (Maybe.withDefault 0 (String.toInt id))
+
                 NotFound ->
                     Cmd.none
             )
@@ -1038,6 +1165,7 @@ routeParser =
         , UrlParser.map Login (s "login")
         , UrlParser.map Logout (s "logout")
         , UrlParser.map Register (s "register" <?> Query.string "email" <?> Query.string "verification")
+        , UrlParser.map ResetPassword (s "reset_password" <?> Query.string "email" <?> Query.string "verification")
         , UrlParser.map Transactions (s "transactions" </> s "pending")
         , UrlParser.map TransactionsList (s "transactions")
         , UrlParser.map AddTransaction (s "add_transaction")
@@ -1046,6 +1174,7 @@ routeParser =
         , UrlParser.map ConceptsEdit (s "concepts" </> string </> s "edit")
         , UrlParser.map ConceptsList (s "concepts")
         , UrlParser.map AddConcept (s "add_concept")
+        , UrlParser.map Messages (s "messages" </> string)
         ]
 
 
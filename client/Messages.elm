@@ -0,0 +1,96 @@
+module Messages exposing (loadMessageThread, pageMessageThread, replyToMessageThread)
+
+import Bootstrap.Button as Button
+import Bootstrap.Form as Form
+import Bootstrap.Form.Textarea as Textarea
+import FormValidation exposing (viewProblem)
+import Html exposing (Html, div, h1, h4, p, text, ul)
+import Html.Attributes exposing (class, for)
+import Html.Events exposing (onSubmit)
+import Http exposing (emptyBody)
+import Json.Encode as Encode
+import Loading
+import Types exposing (Message, Model, Msg(..), apiActionDecoder, authHeader, messageThreadDecoder)
+
+
+pageMessageThread : Model -> List (Html Msg)
+pageMessageThread model =
+    [ div [ class "container page" ]
+        [ div [ class "row" ]
+            [ div [ class "col-md-8 offset-md-2 col-xs-12" ]
+                (h1 [ class "text-xs-center" ] [ text model.messageThread.subject ]
+                    :: List.map (viewMessage model) model.messageThread.messages
+                    ++ [ viewReplyForm model ]
+                )
+            ]
+        ]
+    ]
+
+
+viewMessage : Model -> Message -> Html Msg
+viewMessage model message =
+    div [ class "message" ]
+        [ h4 []
+            [ if message.fromUserId == model.loggedInUser.id then
+                text "You"
+
+              else
+                text "Them"
+            ]
+        , p [] [ text message.body ]
+        ]
+
+
+viewReplyForm : Model -> Html Msg
+viewReplyForm model =
+    Form.form [ onSubmit SubmittedMessageReplyForm ]
+        [ Form.group []
+            [ Form.label [ for "reply" ] [ text "Reply" ]
+            , Textarea.textarea
+                [ Textarea.id "reply"
+                , Textarea.rows 4
+                , Textarea.onInput EnteredMessageReply
+                , Textarea.value model.messageReply
+                ]
+            ]
+        , ul [ class "error-messages" ]
+            (List.map viewProblem model.problems)
+        , Button.button [ Button.primary ]
+            [ text "Send" ]
+        , Loading.render Loading.DoubleBounce Loading.defaultConfig model.loading
+        ]
+
+
+
+-- HTTP
+
+
+loadMessageThread : Model -> Int -> Cmd Msg
+loadMessageThread model threadId =
+    Http.request
+        { method = "GET"
+        , url = "/api/message_threads/" ++ String.fromInt threadId
+        , expect = Http.expectJson LoadedMessageThread messageThreadDecoder
+        , headers = [ authHeader model.session.loginToken ]
+        , body = emptyBody
+        , timeout = Nothing
+        , tracker = Nothing
+        }
+
+
+replyToMessageThread : Model -> Cmd Msg
+replyToMessageThread model =
+    let
+        body =
+            Encode.object [ ( "Body", Encode.string model.messageReply ) ]
+                |> Http.jsonBody
+    in
+    Http.request
+        { method = "POST"
+        , url = "/api/message_threads/" ++ String.fromInt model.messageThread.id ++ "/messages"
+        , expect = Http.expectJson SentMessageReply apiActionDecoder
+        , headers = [ authHeader model.session.loginToken ]
+        , body = body
+        , timeout = Nothing
+        , tracker = Nothing
+        }
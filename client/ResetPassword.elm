@@ -0,0 +1,100 @@
+module ResetPassword exposing (pageResetPassword, resetPassword, viewResetPasswordForm)
+
+import Bootstrap.Button as Button
+import Bootstrap.Form as Form
+import Bootstrap.Form.Input as Input
+import FormValidation exposing (viewProblem)
+import Html exposing (Html, a, div, h1, p, text, ul)
+import Html.Attributes exposing (class, for, href)
+import Html.Events exposing (onSubmit)
+import Http
+import Json.Encode as Encode
+import Loading
+import Register exposing (RegisterTrimmedForm(..))
+import Types exposing (Model, Msg(..), apiActionDecoder)
+
+
+pageResetPassword : Model -> List (Html Msg)
+pageResetPassword model =
+    [ div [ class "container page" ]
+        [ div [ class "row" ]
+            [ div [ class "col-md-6 offset-md-3 col-xs-12" ]
+                [ h1 [ class "text-xs-center" ] [ text "Reset Password" ]
+                , if model.apiActionResponse.resourceId == 0 then
+                    viewResetPasswordForm model
+
+                  else
+                    p [ class "text-xs-center" ]
+                        [ text "Your password has been reset, "
+                        , a [ href "/login" ] [ text "please login" ]
+                        ]
+                ]
+            ]
+        ]
+    ]
+
+
+viewResetPasswordForm : Model -> Html Msg
+viewResetPasswordForm model =
+    Form.form [ onSubmit SubmittedResetPasswordForm ]
+        [ Form.group []
+            [ Form.label [ for "email" ] [ text "Email address" ]
+            , Input.email
+                [ Input.id "email"
+                , Input.value model.registerForm.email
+                , Input.disabled True
+                ]
+            ]
+        , Form.group []
+            [ Form.label [ for "password" ] [ text "New Password" ]
+            , Input.password
+                [ Input.id "password"
+                , Input.placeholder "Password"
+                , Input.onInput EnteredRegisterPassword
+                , Input.value model.registerForm.password
+                ]
+            , Form.invalidFeedback [] [ text "Please enter your new password" ]
+            ]
+        , Form.group []
+            [ Form.label [ for "passwordConfirm" ] [ text "Confirm Password" ]
+            , Input.password
+                [ Input.id "passwordConfirm"
+                , Input.placeholder "Confirm your password"
+                , Input.onInput EnteredRegisterConfirmPassword
+                , Input.value model.registerForm.password_confirm
+                ]
+            , Form.invalidFeedback [] [ text "Please enter your new password again" ]
+            ]
+        , ul [ class "error-messages" ]
+            (List.map viewProblem model.problems)
+        , Button.button [ Button.primary ]
+            [ text "Reset Password" ]
+        , Loading.render Loading.DoubleBounce Loading.defaultConfig model.loading
+        ]
+
+
+
+-- HTTP
+
+
+resetPassword : RegisterTrimmedForm -> Cmd Msg
+resetPassword (RegisterTrimmed form) =
+    let
+        body =
+            Encode.object
+                [ ( "email", Encode.string form.email )
+                , ( "verification", Encode.string form.verification )
+                , ( "password", Encode.string form.password )
+                , ( "password_confirmation", Encode.string form.password_confirm )
+                ]
+                |> Http.jsonBody
+    in
+    Http.request
+        { method = "POST"
+        , url = "/api/auth/reset_password"
+        , expect = Http.expectJson GotResetPasswordJson apiActionDecoder
+        , headers = []
+        , body = body
+        , timeout = Nothing
+        , tracker = Nothing
+        }
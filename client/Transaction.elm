@@ -82,6 +82,21 @@ transactionSummary model tx =
                 6 ->
                     "Request Rejected"
 
+                7 ->
+                    "Offer Cancelled"
+
+                8 ->
+                    "Request Cancelled"
+
+                9 ->
+                    "Offer Expired"
+
+                10 ->
+                    "Request Expired"
+
+                11 ->
+                    "Reversal"
+
                 _ ->
                     ""
 
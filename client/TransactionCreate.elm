@@ -13,7 +13,6 @@ import Html.Events exposing (onSubmit)
 import Http exposing (emptyBody)
 import Json.Encode as Encode
 import Loading
-import Time
 import Types exposing (ApiActionResponse, Concept, ConceptTag, Model, Msg(..), Page(..), Problem(..), Transaction, TransactionForm, TransactionFromType(..), TransactionType(..), User, ValidatedField(..), apiActionDecoder, authHeader, creatingTransactionSummary, formatBalance, secondsFromTgs, txFeeIntFromTgs, userDecoder)
 
 
@@ -348,7 +347,6 @@ transaction model (TransactionTrimmed form) =
         body =
             Encode.object
                 [ ( "Email", Encode.string form.email )
-                , ( "InitiatedDate", Encode.int (Time.posixToMillis model.time) )
                 , ( "Seconds", Encode.int seconds )
                 , ( "Multiplier", Encode.float multiplier )
                 , ( "Status", Encode.int status )
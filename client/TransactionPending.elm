@@ -1,4 +1,4 @@
-module TransactionPending exposing (acceptTransaction, pageTransactionPending, pendingTransactionSummary, rejectTransaction)
+module TransactionPending exposing (acceptTransaction, cancelTransaction, pageTransactionPending, pendingTransactionSummary, rejectTransaction)
 
 import Bootstrap.Button as Button
 import Bootstrap.Table as Table exposing (Row)
@@ -135,6 +135,9 @@ pendingTransactionSummary model tx =
             [ if (tx.status == 1 && tx.toUserId == model.loggedInUser.id) || (tx.status == 2 && tx.fromUserId == model.loggedInUser.id) then
                 Button.button [ Button.primary, Button.onClick <| RejectTransaction tx.id ] [ text "Reject" ]
 
+              else if (tx.status == 1 && tx.fromUserId == model.loggedInUser.id) || (tx.status == 2 && tx.toUserId == model.loggedInUser.id) then
+                Button.button [ Button.secondary, Button.onClick <| CancelTransaction tx.id ] [ text "Cancel" ]
+
               else
                 text ""
             ]
@@ -199,3 +202,16 @@ rejectTransaction model txId =
         , timeout = Nothing
         , tracker = Nothing
         }
+
+
+cancelTransaction : Model -> Int -> Cmd Msg
+cancelTransaction model txId =
+    Http.request
+        { method = "PATCH"
+        , url = "/api/transactions/" ++ String.fromInt txId ++ "/cancel"
+        , expect = Http.expectJson CancelledTransaction apiActionDecoder
+        , headers = [ authHeader model.session.loginToken ]
+        , body = emptyBody
+        , timeout = Nothing
+        , tracker = Nothing
+        }
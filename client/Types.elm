@@ -1,4 +1,4 @@
-module Types exposing (ApiActionResponse, Concept, ConceptForm, ConceptTag, ConceptTagForm, DisplayableTag, LoginForm, Model, Msg(..), Page(..), Problem(..), ProfileForm, RegisterForm, Session, Tag, Transaction, TransactionForm, TransactionFromType(..), TransactionType(..), User, ValidatedField(..), apiActionDecoder, authHeader, conceptDecoder, conceptIdFromConceptTag, conceptTagDecoder, conceptTagsListDecoder, creatingTransactionSummary, displayableTagFrom, displayableTagsListFrom, emptyConcept, emptyConceptForm, emptyProfileForm, emptySession, emptyTransactionForm, emptyUser, formatBalance, formatBalanceFloat, formatBalancePlusFee, formatBalanceWithMultiplier, formatDate, idFromConcept, idFromDisplayable, indexUser, intHoursFromTgs, intMinutesFromTgs, intSecondsFromTgs, isDigitOrPlace, isNot, padAndCapTimePart, posixTime, profileDecoder, resourceIdsDecoder, secondsFromTgs, secondsFromTgsFloat, secondsFromTime, secondsFromTimeHMS, tagDecoder, tagFromConceptTagIfMatching, tgsFromTimeAndMultiplier, tgsFromTimeHMSAndMultiplier, tgsLocale, timeFromTgs, timeFromTime, toIntMonth, transactionDecoder, txFeeFromTgs, txFeeIntFromTgs, userDecoder)
+module Types exposing (ApiActionResponse, Concept, ConceptForm, ConceptTag, ConceptTagForm, DisplayableTag, LoginForm, Message, MessageThread, Model, Msg(..), Page(..), Problem(..), ProfileForm, RegisterForm, Session, Tag, Transaction, TransactionForm, TransactionFromType(..), TransactionType(..), User, ValidatedField(..), apiActionDecoder, authHeader, conceptDecoder, conceptIdFromConceptTag, conceptTagDecoder, conceptTagsListDecoder, creatingTransactionSummary, displayableTagFrom, displayableTagsListFrom, emptyConcept, emptyConceptForm, emptyMessageThread, emptyProfileForm, emptySession, emptyTransactionForm, emptyUser, formatBalance, formatBalanceFloat, formatBalancePlusFee, formatBalanceWithMultiplier, formatDate, idFromConcept, idFromDisplayable, indexUser, intHoursFromTgs, intMinutesFromTgs, intSecondsFromTgs, isDigitOrPlace, isNot, messageThreadDecoder, padAndCapTimePart, posixTime, profileDecoder, resourceIdsDecoder, secondsFromTgs, secondsFromTgsFloat, secondsFromTime, secondsFromTimeHMS, tagDecoder, tagFromConceptTagIfMatching, tgsFromTimeAndMultiplier, tgsFromTimeHMSAndMultiplier, tgsLocale, timeFromTgs, timeFromTime, toIntMonth, transactionDecoder, txFeeFromTgs, txFeeIntFromTgs, userDecoder)
 
 import Array exposing (Array)
 import Bootstrap.Modal as Modal
@@ -48,6 +48,8 @@ type alias Model =
     , conceptTagsList : List ConceptTag
     , displayableTagsList : List DisplayableTag
     , conceptShowTagModel : Modal.Visibility
+    , messageThread : MessageThread
+    , messageReply : String
     }
 
 
@@ -56,6 +58,7 @@ type Page
     | Login
     | Logout
     | Register (Maybe String) (Maybe String)
+    | ResetPassword (Maybe String) (Maybe String)
     | Profile
     | Transactions
     | TransactionsList
@@ -64,6 +67,7 @@ type Page
     | ConceptsEdit String
     | ConceptsList
     | AddConcept
+    | Messages String
     | NotFound
 
 
@@ -141,6 +145,20 @@ type alias Transaction =
     }
 
 
+type alias MessageThread =
+    { id : Int
+    , subject : String
+    , messages : List Message
+    }
+
+
+type alias Message =
+    { id : Int
+    , fromUserId : Int
+    , body : String
+    }
+
+
 type alias LoginForm =
     { email : String
     , password : String
@@ -229,10 +247,12 @@ type Msg
     | NavMsg Navbar.State
     | SubmittedLoginForm
     | SubmittedRegisterForm
+    | SubmittedResetPasswordForm
     | SubmittedProfileForm
     | SubmittedTransactionForm
     | SubmittedConceptForm
     | SubmittedAddConceptTagForm
+    | SubmittedMessageReplyForm
     | EnteredLoginEmail String
     | EnteredLoginPassword String
     | EnteredRegisterEmail String
@@ -256,8 +276,10 @@ type Msg
     | EnteredConceptSummary String
     | EnteredConceptFull String
     | EnteredAddConceptTag String
+    | EnteredMessageReply String
     | CompletedLogin (Result Http.Error Session)
     | GotRegisterJson (Result Http.Error ApiActionResponse)
+    | GotResetPasswordJson (Result Http.Error ApiActionResponse)
     | LoadedUser (Result Http.Error User)
     | LoadedProfile (Result Http.Error ProfileForm)
     | LoadedConcept (Result Http.Error Concept)
@@ -274,10 +296,14 @@ type Msg
     | LoadedTransactionUserWithBalance (Result Http.Error User)
     | AcceptedTransaction (Result Http.Error ApiActionResponse)
     | RejectedTransaction (Result Http.Error ApiActionResponse)
+    | CancelledTransaction (Result Http.Error ApiActionResponse)
     | LoadedConcepts (Result Http.Error (List Concept))
     | LoadedConceptTagsList (Result Http.Error (List ConceptTag))
+    | LoadedMessageThread (Result Http.Error MessageThread)
+    | SentMessageReply (Result Http.Error ApiActionResponse)
     | AcceptTransaction Int
     | RejectTransaction Int
+    | CancelTransaction Int
     | ButtonTransactionCheckBalance
     | AdjustTimeZone Time.Zone
     | TimeTick Time.Posix
@@ -759,6 +785,14 @@ emptySession =
     { loginExpire = "", loginToken = "" }
 
 
+emptyMessageThread : MessageThread
+emptyMessageThread =
+    { id = 0
+    , subject = ""
+    , messages = []
+    }
+
+
 emptyConcept : Concept
 emptyConcept =
     { id = 0
@@ -879,6 +913,22 @@ conceptTagDecoder =
         |> required "Order" int
 
 
+messageThreadDecoder : Decoder MessageThread
+messageThreadDecoder =
+    Decode.succeed MessageThread
+        |> required "ID" int
+        |> required "Subject" string
+        |> optional "Messages" (list messageDecoder) []
+
+
+messageDecoder : Decoder Message
+messageDecoder =
+    Decode.succeed Message
+        |> required "ID" int
+        |> required "FromUserId" int
+        |> required "Body" string
+
+
 posixTime : Decode.Decoder Time.Posix
 posixTime =
     Decode.int
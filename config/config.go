@@ -0,0 +1,490 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultFileName = "thinkglobally.json"
+
+// minEventRetention keeps the interval of the event pruner, a quarter of the retention, well above zero
+const minEventRetention = time.Minute
+
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value string
+	err := json.Unmarshal(b, &value)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(value)
+	return err
+}
+
+type DatabaseConfig struct {
+	DSN         string
+	Name        string
+	AutoMigrate bool
+}
+
+type JWTConfig struct {
+	Secret     string
+	Timeout    Duration
+	MaxRefresh Duration
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	StartTLS bool
+	Username string
+	Password string
+}
+
+type MailConfig struct {
+	Backend       string
+	From          string
+	SMTP          SMTPConfig
+	Maildir       string
+	TemplateDir   string
+	DefaultLocale string
+}
+
+type LoginConfig struct {
+	MaxAttempts          int
+	BackoffBase          Duration
+	LockoutDuration      Duration
+	RecoverTokenLifetime Duration
+	RateLimitRequests    int
+	RateLimitPer         Duration
+}
+
+type OutboxConfig struct {
+	Interval    Duration
+	BatchSize   int
+	MaxAttempts int
+	BackoffBase Duration
+	BackoffMax  Duration
+}
+
+type FeeConfig struct {
+	AccountEmail string
+}
+
+type CreditConfig struct {
+	DefaultLimit      int64
+	DefaultBalanceCap int64
+}
+
+type TransactionConfig struct {
+	PendingExpiry     Duration
+	SweepInterval     Duration
+	PerformedMaxAge   Duration
+	RecurringInterval Duration
+	MultiplierMode    string
+	FeedbackWindow    Duration
+}
+
+type EventConfig struct {
+	Retention Duration
+}
+
+type GeoConfig struct {
+	PublicPrecision int
+	MaxRadiusKm     float64
+}
+
+type Config struct {
+	ListenAddr   string
+	BaseURL      string
+	Debugging    bool
+	Database     DatabaseConfig
+	JWT          JWTConfig
+	Mail         MailConfig
+	Login        LoginConfig
+	Outbox       OutboxConfig
+	Fees         FeeConfig
+	Credit       CreditConfig
+	Transactions TransactionConfig
+	Geo          GeoConfig
+	Events       EventConfig
+}
+
+func Default() *Config {
+	return &Config{
+		ListenAddr: ":3030",
+		BaseURL:    "https://www.thinkglobally.org",
+		JWT: JWTConfig{
+			Timeout:    Duration{time.Hour * 24 * 7},
+			MaxRefresh: Duration{time.Hour},
+		},
+		Mail: MailConfig{
+			Backend:       "smtp",
+			From:          "ThinkGlobally <no-reply@thinkglobally.org>",
+			SMTP:          SMTPConfig{Host: "localhost", Port: 25},
+			DefaultLocale: "en",
+		},
+		Login: LoginConfig{
+			MaxAttempts:          5,
+			BackoffBase:          Duration{time.Second},
+			LockoutDuration:      Duration{15 * time.Minute},
+			RecoverTokenLifetime: Duration{time.Hour},
+			RateLimitRequests:    20,
+			RateLimitPer:         Duration{time.Minute},
+		},
+		Outbox: OutboxConfig{
+			Interval:    Duration{30 * time.Second},
+			BatchSize:   20,
+			MaxAttempts: 8,
+			BackoffBase: Duration{time.Minute},
+			BackoffMax:  Duration{6 * time.Hour},
+		},
+		Fees: FeeConfig{
+			AccountEmail: "community@thinkglobally.org",
+		},
+		Credit: CreditConfig{
+			DefaultLimit:      40 * 60 * 60,
+			DefaultBalanceCap: -1,
+		},
+		Transactions: TransactionConfig{
+			PendingExpiry:     Duration{30 * 24 * time.Hour},
+			SweepInterval:     Duration{time.Hour},
+			PerformedMaxAge:   Duration{90 * 24 * time.Hour},
+			RecurringInterval: Duration{5 * time.Minute},
+			MultiplierMode:    "record",
+			FeedbackWindow:    Duration{30 * 24 * time.Hour},
+		},
+		Events: EventConfig{
+			Retention: Duration{24 * time.Hour},
+		},
+		Geo: GeoConfig{
+			PublicPrecision: 2,
+			MaxRadiusKm:     200,
+		},
+	}
+}
+
+// setting binds a config field to the flag -<name> and the environment variable TG_<NAME>
+type setting struct {
+	name  string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen-addr", "address to listen for http requests on", (*stringValue)(&c.ListenAddr)},
+		{"base-url", "public url of the site, used for links in emails", (*stringValue)(&c.BaseURL)},
+		{"debugging", "if true, we start in debug mode", (*boolValue)(&c.Debugging)},
+		{"database-dsn", "postgres connection string", (*stringValue)(&c.Database.DSN)},
+		{"database-name", "database name, overrides the dbname in the connection string", (*stringValue)(&c.Database.Name)},
+		{"database-auto-migrate", "if true, apply pending migrations at start up instead of refusing to start", (*boolValue)(&c.Database.AutoMigrate)},
+		{"jwt-secret", "secret used to sign login tokens, at least 32 characters", (*stringValue)(&c.JWT.Secret)},
+		{"jwt-timeout", "how long a login token is valid", (*durationValue)(&c.JWT.Timeout)},
+		{"jwt-max-refresh", "how long after expiry a login token can be refreshed", (*durationValue)(&c.JWT.MaxRefresh)},
+		{"mail-backend", "smtp or maildir", (*stringValue)(&c.Mail.Backend)},
+		{"mail-from", "address emails are sent from", (*stringValue)(&c.Mail.From)},
+		{"smtp-host", "SMTP server to send email through", (*stringValue)(&c.Mail.SMTP.Host)},
+		{"smtp-port", "SMTP server port", (*intValue)(&c.Mail.SMTP.Port)},
+		{"smtp-starttls", "if true, require STARTTLS before sending", (*boolValue)(&c.Mail.SMTP.StartTLS)},
+		{"smtp-username", "SMTP username", (*stringValue)(&c.Mail.SMTP.Username)},
+		{"smtp-password", "SMTP password", (*stringValue)(&c.Mail.SMTP.Password)},
+		{"maildir", "directory the maildir backend delivers into", (*stringValue)(&c.Mail.Maildir)},
+		{"email-templates", "directory of <locale>/<name>.subject.txt, .txt and .html email templates", (*stringValue)(&c.Mail.TemplateDir)},
+		{"email-locale", "locale used for members that have not chosen one", (*stringValue)(&c.Mail.DefaultLocale)},
+		{"login-max-attempts", "failed logins before an account is locked", (*intValue)(&c.Login.MaxAttempts)},
+		{"login-backoff", "wait after the first failed login, doubling after each further failure", (*durationValue)(&c.Login.BackoffBase)},
+		{"login-lockout", "how long an account stays locked", (*durationValue)(&c.Login.LockoutDuration)},
+		{"recover-token-lifetime", "how long a password reset link is valid", (*durationValue)(&c.Login.RecoverTokenLifetime)},
+		{"auth-rate-limit", "login, registration and password reset requests allowed per ip address each auth-rate-period, 0 for no limit", (*intValue)(&c.Login.RateLimitRequests)},
+		{"auth-rate-period", "period for auth-rate-limit", (*durationValue)(&c.Login.RateLimitPer)},
+		{"outbox-interval", "how often queued emails are retried, 0 disables delivery", (*durationValue)(&c.Outbox.Interval)},
+		{"outbox-max-attempts", "delivery attempts before an email is dead lettered", (*intValue)(&c.Outbox.MaxAttempts)},
+		{"outbox-batch-size", "queued emails sent on each delivery run", (*intValue)(&c.Outbox.BatchSize)},
+		{"outbox-backoff", "wait before retrying an email that failed to send, doubling after each further failure", (*durationValue)(&c.Outbox.BackoffBase)},
+		{"outbox-backoff-max", "longest wait between retries of an email that failed to send", (*durationValue)(&c.Outbox.BackoffMax)},
+		{"credit-limit", "seconds a member's balance may go below zero unless set for them or their tier, -1 for no limit", (*int64Value)(&c.Credit.DefaultLimit)},
+		{"balance-cap", "highest balance in seconds a member may hold unless set for them or their tier, -1 for no cap", (*int64Value)(&c.Credit.DefaultBalanceCap)},
+		{"pending-expiry", "how long an offer or request can wait to be accepted before it expires, 0 for never", (*durationValue)(&c.Transactions.PendingExpiry)},
+		{"expiry-sweep-interval", "how often pending transactions are checked for expiry, 0 disables the sweeper", (*durationValue)(&c.Transactions.SweepInterval)},
+		{"performed-max-age", "how far back the date work was performed on can be when recording a transaction", (*durationValue)(&c.Transactions.PerformedMaxAge)},
+		{"recurring-interval", "how often recurring transactions are checked for occurrences that are due, 0 disables the scheduler", (*durationValue)(&c.Transactions.RecurringInterval)},
+		{"multiplier-mode", "record keeps a transaction's multiplier for reporting only, scale credits its seconds times the multiplier", (*stringValue)(&c.Transactions.MultiplierMode)},
+		{"feedback-window", "how long after a transaction is confirmed its parties can leave feedback on each other", (*durationValue)(&c.Transactions.FeedbackWindow)},
+		{"event-retention", "how long events are kept for clients reconnecting to /api/events to catch up on", (*durationValue)(&c.Events.Retention)},
+		{"location-precision", "decimal places of latitude and longitude shown to other members, 2 is about a kilometre", (*intValue)(&c.Geo.PublicPrecision)},
+		{"max-search-radius", "largest radius in km members can search for people and listings near a point", (*float64Value)(&c.Geo.MaxRadiusKm)},
+		{"fee-account", "email of the community account transaction fees are credited to, created if missing", (*stringValue)(&c.Fees.AccountEmail)},
+	}
+}
+
+func envName(name string) string {
+	return "TG_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Load builds the config from the defaults, then the config file, then TG_ environment variables and finally the
+// command line flags in args. The config file is -config, TG_CONFIG or thinkglobally.json in the current or parent
+// directory. Any remaining command line arguments are returned.
+func Load(args []string) (*Config, []string, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	flagSet := flag.NewFlagSet("thinkglobally", flag.ContinueOnError)
+	configPath := flagSet.String("config", os.Getenv("TG_CONFIG"), "path to the JSON config file")
+	flagValues := map[string]*rawValue{}
+	for _, s := range settings {
+		_, isBool := s.value.(*boolValue)
+		flagValues[s.name] = &rawValue{isBool: isBool}
+		flagSet.Var(flagValues[s.name], s.name, s.usage+" (env "+envName(s.name)+")")
+	}
+	err := flagSet.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cfg.loadFile(*configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(envName(s.name)); ok {
+			err = s.value.Set(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", envName(s.name), err.Error())
+			}
+		}
+	}
+	for _, s := range settings {
+		if flagValues[s.name].set {
+			err = s.value.Set(flagValues[s.name].value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("-%s: %s", s.name, err.Error())
+			}
+		}
+	}
+	cfg.loadLegacyFiles()
+	return cfg, flagSet.Args(), nil
+}
+
+func (c *Config) loadFile(path string) error {
+	explicit := len(path) > 0
+	if !explicit {
+		path = DefaultFileName
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path = "../" + DefaultFileName
+		}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !explicit && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err = json.Unmarshal(content, c)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// loadLegacyFiles keeps installs using postgres_args.txt, secret_key.txt and SMTP_PASSWORD working, the files are
+// only ever read
+func (c *Config) loadLegacyFiles() {
+	if len(c.Mail.SMTP.Password) == 0 {
+		c.Mail.SMTP.Password = os.Getenv("SMTP_PASSWORD")
+	}
+	if len(c.Database.DSN) == 0 {
+		c.Database.DSN = readLegacyFile("postgres_args.txt")
+	}
+	if len(c.JWT.Secret) == 0 {
+		c.JWT.Secret = readLegacyFile("secret_key.txt")
+	}
+}
+
+func readLegacyFile(name string) string {
+	for _, path := range []string{name, "../" + name} {
+		content, err := ioutil.ReadFile(path)
+		if err == nil {
+			return strings.TrimSpace(string(content))
+		}
+	}
+	return ""
+}
+
+func (c *Config) Validate() error {
+	var problems []string
+	if len(c.ListenAddr) == 0 {
+		problems = append(problems, "listen-addr is required")
+	}
+	baseURL, err := url.Parse(c.BaseURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || len(baseURL.Host) == 0 {
+		problems = append(problems, "base-url must be an absolute http or https url")
+	}
+	if len(c.Database.DSN) == 0 {
+		problems = append(problems, "database-dsn is required, for example \"host=localhost port=5432 sslmode=disable user=tgtest dbname=tgtest password=...\"")
+	}
+	if len(c.JWT.Secret) < 32 {
+		problems = append(problems, "jwt-secret is required and must be at least 32 characters")
+	}
+	if c.JWT.Timeout.Duration <= 0 {
+		problems = append(problems, "jwt-timeout must be positive")
+	}
+	switch c.Mail.Backend {
+	case "smtp":
+		if len(c.Mail.SMTP.Host) == 0 || c.Mail.SMTP.Port <= 0 || c.Mail.SMTP.Port > 65535 {
+			problems = append(problems, "smtp-host and a valid smtp-port are required for the smtp mail backend")
+		}
+	case "maildir":
+		if len(c.Mail.Maildir) == 0 {
+			problems = append(problems, "maildir is required for the maildir mail backend")
+		}
+	default:
+		problems = append(problems, "mail-backend must be smtp or maildir")
+	}
+	if len(c.Mail.From) == 0 {
+		problems = append(problems, "mail-from is required")
+	}
+	if c.Login.LockoutDuration.Duration <= 0 || c.Login.RecoverTokenLifetime.Duration <= 0 {
+		problems = append(problems, "login-lockout and recover-token-lifetime must be positive")
+	}
+	if c.Outbox.MaxAttempts <= 0 {
+		problems = append(problems, "outbox-max-attempts must be positive")
+	}
+	if c.Outbox.BatchSize <= 0 {
+		problems = append(problems, "outbox-batch-size must be positive")
+	}
+	if c.Outbox.BackoffBase.Duration <= 0 || c.Outbox.BackoffMax.Duration < c.Outbox.BackoffBase.Duration {
+		problems = append(problems, "outbox-backoff must be positive and no more than outbox-backoff-max")
+	}
+	if c.Transactions.PendingExpiry.Duration < 0 {
+		problems = append(problems, "pending-expiry must not be negative")
+	}
+	if c.Transactions.PerformedMaxAge.Duration <= 0 {
+		problems = append(problems, "performed-max-age must be positive")
+	}
+	if c.Transactions.FeedbackWindow.Duration <= 0 {
+		problems = append(problems, "feedback-window must be positive")
+	}
+	if c.Transactions.MultiplierMode != "record" && c.Transactions.MultiplierMode != "scale" {
+		problems = append(problems, "multiplier-mode must be record or scale")
+	}
+	if c.Events.Retention.Duration < minEventRetention {
+		problems = append(problems, fmt.Sprintf("event-retention must be at least %s", minEventRetention))
+	}
+	if c.Geo.PublicPrecision < 0 || c.Geo.PublicPrecision > 5 {
+		problems = append(problems, "location-precision must be between 0 and 5")
+	}
+	if c.Geo.MaxRadiusKm <= 0 {
+		problems = append(problems, "max-search-radius must be positive")
+	}
+	if c.Credit.DefaultLimit < -1 || c.Credit.DefaultBalanceCap < -1 {
+		problems = append(problems, "credit-limit and balance-cap must be -1 or more")
+	}
+	if !strings.Contains(c.Fees.AccountEmail, "@") {
+		problems = append(problems, "fee-account must be an email address")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// rawValue holds a command line flag until the file and environment have been applied
+type rawValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (v *rawValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+func (v *rawValue) Set(value string) error {
+	v.value = value
+	v.set = true
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as a bare -name on the command line
+func (v *rawValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *stringValue) Set(value string) error {
+	*v = stringValue(value)
+	return nil
+}
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(value string) error {
+	i, err := strconv.Atoi(value)
+	*v = intValue(i)
+	return err
+}
+
+type int64Value int64
+
+func (v *int64Value) String() string { return strconv.FormatInt(int64(*v), 10) }
+
+func (v *int64Value) Set(value string) error {
+	i, err := strconv.ParseInt(value, 10, 64)
+	*v = int64Value(i)
+	return err
+}
+
+type float64Value float64
+
+func (v *float64Value) String() string { return strconv.FormatFloat(float64(*v), 'f', -1, 64) }
+
+func (v *float64Value) Set(value string) error {
+	f, err := strconv.ParseFloat(value, 64)
+	*v = float64Value(f)
+	return err
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+func (v *boolValue) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	*v = boolValue(b)
+	return err
+}
+
+type durationValue Duration
+
+func (v *durationValue) String() string { return v.Duration.String() }
+
+func (v *durationValue) Set(value string) error {
+	d, err := time.ParseDuration(value)
+	v.Duration = d
+	return err
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	Convey("Given a config file", t, func() {
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldBeNil)
+		path := filepath.Join(dir, "test.json")
+		err = ioutil.WriteFile(path, []byte(`{"ListenAddr": ":4000", "Database": {"DSN": "host=file", "Name": "file-db"}, "Login": {"LockoutDuration": "20m"}}`), 0600)
+		So(err, ShouldBeNil)
+		Reset(func() {
+			_ = os.RemoveAll(dir)
+			_ = os.Unsetenv("TG_DATABASE_NAME")
+			_ = os.Unsetenv("TG_LISTEN_ADDR")
+		})
+
+		Convey("Values should come from the file over the defaults", func() {
+			cfg, _, err := Load([]string{"-config", path})
+			So(err, ShouldBeNil)
+			So(cfg.ListenAddr, ShouldEqual, ":4000")
+			So(cfg.Database.DSN, ShouldEqual, "host=file")
+			So(cfg.Login.LockoutDuration.Duration, ShouldEqual, 20*time.Minute)
+			So(cfg.Login.MaxAttempts, ShouldEqual, 5)
+		})
+
+		Convey("The environment should override the file and flags the environment", func() {
+			_ = os.Setenv("TG_DATABASE_NAME", "env-db")
+			_ = os.Setenv("TG_LISTEN_ADDR", ":5000")
+			cfg, args, err := Load([]string{"-config", path, "-listen-addr", ":6000", "-debugging", "extra"})
+			So(err, ShouldBeNil)
+			So(cfg.Database.Name, ShouldEqual, "env-db")
+			So(cfg.ListenAddr, ShouldEqual, ":6000")
+			So(cfg.Debugging, ShouldBeTrue)
+			So(args, ShouldResemble, []string{"extra"})
+		})
+
+		Convey("A missing explicit config file should be an error", func() {
+			_, _, err := Load([]string{"-config", filepath.Join(dir, "missing.json")})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestValidate(t *testing.T) {
+	Convey("The defaults without a database or secret", t, func() {
+		cfg := Default()
+		err := cfg.Validate()
+
+		Convey("Should be invalid, naming both settings", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "database-dsn")
+			So(err.Error(), ShouldContainSubstring, "jwt-secret")
+		})
+
+		Convey("With them set should be valid", func() {
+			cfg.Database.DSN = "host=localhost"
+			cfg.JWT.Secret = strings.Repeat("s", 32)
+			So(cfg.Validate(), ShouldBeNil)
+
+			cfg.Transactions.MultiplierMode = "double"
+			So(cfg.Validate().Error(), ShouldContainSubstring, "multiplier-mode")
+		})
+
+		Convey("An outbox without a batch size or with a backoff that shrinks should be invalid", func() {
+			cfg.Database.DSN = "host=localhost"
+			cfg.JWT.Secret = strings.Repeat("s", 32)
+			cfg.Outbox.BatchSize = 0
+			So(cfg.Validate().Error(), ShouldContainSubstring, "outbox-batch-size")
+
+			cfg.Outbox.BatchSize = 20
+			cfg.Outbox.BackoffMax.Duration = cfg.Outbox.BackoffBase.Duration - 1
+			So(cfg.Validate().Error(), ShouldContainSubstring, "outbox-backoff-max")
+
+			cfg.Outbox.BackoffMax = cfg.Outbox.BackoffBase
+			So(cfg.Validate(), ShouldBeNil)
+		})
+
+		Convey("An event retention too short for the pruner should be invalid", func() {
+			cfg.Database.DSN = "host=localhost"
+			cfg.JWT.Secret = strings.Repeat("s", 32)
+			cfg.Events.Retention.Duration = 3
+			So(cfg.Validate().Error(), ShouldContainSubstring, "event-retention")
+		})
+	})
+}
@@ -0,0 +1,114 @@
+package mailer
+
+var builtinTemplates = map[string]string{
+	"en/confirm_email.subject.txt": `Think Globally Confirm Email Address`,
+	"en/confirm_email.txt": `Thanks for signing up for a Think Globally - Trade Locally account
+
+Please click on the following link to confirm your email address {{.ConfirmURL}}
+`,
+	"en/confirm_email.html": `<!DOCTYPE html>
+<html>
+<head>
+</head>
+<body>
+<p>Thanks for signing up for a Think Globally - Trade Locally account</p>
+<p>Please click on the following link to confirm your email address <a href="{{.ConfirmURL}}">{{.ConfirmURL}}</a></p>
+</body>
+</html>
+`,
+
+	"en/invite.subject.txt": `Invite to Think Globally and Trade Locally`,
+	"en/invite.txt": `You've been invited to open a Think Globally - Trade Locally account
+
+{{.InviterName}} {{if .Offered}}offered{{else}}requested{{end}} the following transaction {{.Hours}}TGs
+Description: {{.Description}}
+
+Please click on the following link to confirm your email address and select a password {{.ConfirmURL}}
+`,
+	"en/invite.html": `<!DOCTYPE html>
+<html>
+<head>
+</head>
+<body>
+<p>You've been invited to open a Think Globally - Trade Locally account</p>
+<p>{{.InviterName}} {{if .Offered}}offered{{else}}requested{{end}} the following transaction {{.Hours}}TGs</p>
+<p>Description: {{.Description}}</p>
+<p>Please click on the following link to confirm your email address and select a password <a href="{{.ConfirmURL}}">{{.ConfirmURL}}</a></p>
+</body>
+</html>
+`,
+
+	"en/password_reset.subject.txt": `Think Globally Password Reset`,
+	"en/password_reset.txt": `A password reset was requested for your Think Globally - Trade Locally account
+
+Please click on the following link within {{.Lifetime}} to choose a new password {{.ResetURL}}
+
+If you did not request a password reset you can ignore this email
+`,
+	"en/password_reset.html": `<!DOCTYPE html>
+<html>
+<head>
+</head>
+<body>
+<p>A password reset was requested for your Think Globally - Trade Locally account</p>
+<p>Please click on the following link within {{.Lifetime}} to choose a new password <a href="{{.ResetURL}}">{{.ResetURL}}</a></p>
+<p>If you did not request a password reset you can ignore this email</p>
+</body>
+</html>
+`,
+
+	"en/account_locked.subject.txt": `Think Globally account locked`,
+	"en/account_locked.txt": `Your Think Globally - Trade Locally account was locked for {{.Lockout}} after {{.Attempts}} failed logins
+
+You can log in again once the lock ends. If the failed logins were not you, someone may be trying to guess your password.
+`,
+	"en/account_locked.html": `<!DOCTYPE html>
+<html>
+<head>
+</head>
+<body>
+<p>Your Think Globally - Trade Locally account was locked for {{.Lockout}} after {{.Attempts}} failed logins</p>
+<p>You can log in again once the lock ends. If the failed logins were not you, someone may be trying to guess your password.</p>
+</body>
+</html>
+`,
+
+	"en/transaction_expired.subject.txt": `Think Globally transaction expired`,
+	"en/transaction_expired.txt": `{{if .Initiator}}Your {{if .Offered}}offer to{{else}}request from{{end}} {{.OtherName}}{{else}}The {{if .Offered}}offer from{{else}}request by{{end}} {{.OtherName}}{{end}} was not accepted within {{.Expiry}} and has expired
+Transaction: {{.Hours}}TGs
+Description: {{.Description}}
+
+You can see your transactions at {{.TransactionsURL}}
+`,
+	"en/transaction_expired.html": `<!DOCTYPE html>
+<html>
+<head>
+</head>
+<body>
+<p>{{if .Initiator}}Your {{if .Offered}}offer to{{else}}request from{{end}} {{.OtherName}}{{else}}The {{if .Offered}}offer from{{else}}request by{{end}} {{.OtherName}}{{end}} was not accepted within {{.Expiry}} and has expired</p>
+<p>Transaction: {{.Hours}}TGs</p>
+<p>Description: {{.Description}}</p>
+<p>You can see your transactions at <a href="{{.TransactionsURL}}">{{.TransactionsURL}}</a></p>
+</body>
+</html>
+`,
+
+	"en/new_message.subject.txt": `Think Globally message from {{.SenderName}}`,
+	"en/new_message.txt": `{{.SenderName}} sent you a message{{if .Subject}} about {{.Subject}}{{end}}
+
+{{.Excerpt}}
+
+You can read and reply to it at {{.MessagesURL}}
+`,
+	"en/new_message.html": `<!DOCTYPE html>
+<html>
+<head>
+</head>
+<body>
+<p>{{.SenderName}} sent you a message{{if .Subject}} about {{.Subject}}{{end}}</p>
+<p>{{.Excerpt}}</p>
+<p>You can read and reply to it at <a href="{{.MessagesURL}}">{{.MessagesURL}}</a></p>
+</body>
+</html>
+`,
+}
@@ -0,0 +1,43 @@
+package mailer
+
+import "sync"
+
+// CaptureMailer keeps sent messages in memory for tests to inspect
+type CaptureMailer struct {
+	mutex    sync.Mutex
+	messages []Message
+	Err      error
+}
+
+func (m *CaptureMailer) Send(message Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Err != nil {
+		return m.Err
+	}
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func (m *CaptureMailer) Messages() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Message{}, m.messages...)
+}
+
+func (m *CaptureMailer) MessagesTo(emailAddress string) []Message {
+	var messages []Message
+	for _, message := range m.Messages() {
+		if message.To == emailAddress {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func (m *CaptureMailer) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = nil
+	m.Err = nil
+}
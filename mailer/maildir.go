@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// MaildirMailer delivers messages into a local maildir so they can be read with a mail client during development
+type MaildirMailer struct {
+	Dir  string
+	From string
+}
+
+var maildirSequence uint64
+
+func (m *MaildirMailer) Send(message Message) error {
+	now := time.Now()
+	data, err := Format(m.From, message, now)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		err = os.MkdirAll(filepath.Join(m.Dir, dir), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&maildirSequence, 1), hostname)
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(m.Dir, "new", name))
+}
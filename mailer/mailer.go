@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"time"
+)
+
+const DefaultFrom = "ThinkGlobally <no-reply@thinkglobally.org>"
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type Mailer interface {
+	Send(message Message) error
+}
+
+// Format renders the message as a multipart/alternative email with plain text and html parts
+func Format(from string, message Message, date time.Time) ([]byte, error) {
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	toAddress, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	err = writePart(writer, "text/plain; charset=utf-8", message.Text)
+	if err != nil {
+		return nil, err
+	}
+	err = writePart(writer, "text/html; charset=utf-8", message.HTML)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&buf, "From: %s\r\n", fromAddress.String())
+	fmt.Fprintf(&buf, "Reply-To: %s\r\n", fromAddress.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", toAddress.String())
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%d.%d@%s>\r\n", date.UnixNano(), os.Getpid(), hostname)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n", writer.Boundary())
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+func writePart(writer *multipart.Writer, contentType string, content string) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	encoder := quotedprintable.NewWriter(part)
+	_, err = encoder.Write([]byte(content))
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func envelopeAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Address, nil
+}
@@ -0,0 +1,95 @@
+package mailer
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMessage = Message{
+	To:      "joe@example.com",
+	Subject: "Think Globally Grüße",
+	Text:    "Hello Joe\r\nA line long enough to need wrapping by the quoted printable encoder, which is limited to seventy six characters",
+	HTML:    "<p>Hello Joe</p>",
+}
+
+func TestFormat(t *testing.T) {
+	Convey("Formatting a message", t, func() {
+		data, err := Format(DefaultFrom, testMessage, time.Now())
+		So(err, ShouldBeNil)
+
+		Convey("Should give a parseable email with both parts", func() {
+			email, err := mail.ReadMessage(strings.NewReader(string(data)))
+			So(err, ShouldBeNil)
+			So(email.Header.Get("To"), ShouldEqual, "<joe@example.com>")
+			subject, err := new(mime.WordDecoder).DecodeHeader(email.Header.Get("Subject"))
+			So(err, ShouldBeNil)
+			So(subject, ShouldEqual, testMessage.Subject)
+
+			mediaType, params, err := mime.ParseMediaType(email.Header.Get("Content-Type"))
+			So(err, ShouldBeNil)
+			So(mediaType, ShouldEqual, "multipart/alternative")
+			reader := multipart.NewReader(email.Body, params["boundary"])
+			textPart, err := reader.NextPart()
+			So(err, ShouldBeNil)
+			text, _ := ioutil.ReadAll(textPart)
+			So(string(text), ShouldEqual, testMessage.Text)
+			htmlPart, err := reader.NextPart()
+			So(err, ShouldBeNil)
+			html, _ := ioutil.ReadAll(htmlPart)
+			So(string(html), ShouldEqual, testMessage.HTML)
+		})
+	})
+
+	Convey("Formatting a message to an invalid address should fail", t, func() {
+		_, err := Format(DefaultFrom, Message{To: "not an address"}, time.Now())
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCaptureMailer(t *testing.T) {
+	Convey("Sending through the capture mailer", t, func() {
+		capture := &CaptureMailer{}
+		err := capture.Send(testMessage)
+		So(err, ShouldBeNil)
+
+		Convey("Should record the message", func() {
+			So(len(capture.Messages()), ShouldEqual, 1)
+			So(len(capture.MessagesTo("joe@example.com")), ShouldEqual, 1)
+			So(len(capture.MessagesTo("someone@example.com")), ShouldEqual, 0)
+		})
+
+		Convey("Reset should clear the messages", func() {
+			capture.Reset()
+			So(len(capture.Messages()), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestMaildirMailer(t *testing.T) {
+	Convey("Sending through the maildir mailer", t, func() {
+		dir, err := ioutil.TempDir("", "maildir")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			_ = os.RemoveAll(dir)
+		})
+		maildir := &MaildirMailer{Dir: dir, From: DefaultFrom}
+		err = maildir.Send(testMessage)
+		So(err, ShouldBeNil)
+
+		Convey("Should deliver the message into new", func() {
+			files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+			tmpFiles, _ := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+			So(len(tmpFiles), ShouldEqual, 0)
+		})
+	})
+}
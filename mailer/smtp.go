@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	StartTLS bool
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(message Message) error {
+	data, err := Format(m.From, message, time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := envelopeAddress(m.From)
+	if err != nil {
+		return err
+	}
+	to, err := envelopeAddress(message.To)
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.Dial(net.JoinHostPort(m.Host, strconv.Itoa(m.Port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if m.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		err = c.StartTLS(&tls.Config{ServerName: m.Host})
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.Username) > 0 {
+		err = c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(to)
+	if err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = wc.Write(data)
+	if err != nil {
+		_ = wc.Close()
+		return err
+	}
+	err = wc.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
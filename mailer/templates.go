@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Templates renders emails from a subject, plain text and html template. Each part is looked up first in Dir under
+// the recipients locale, then its base language, then the default locale, falling back to the built in templates.
+//
+//	<Dir>/<locale>/<name>.subject.txt
+//	<Dir>/<locale>/<name>.txt
+//	<Dir>/<locale>/<name>.html
+type Templates struct {
+	Dir           string
+	DefaultLocale string
+}
+
+const DefaultLocale = "en"
+
+func NormaliseLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+func (t *Templates) locales(locale string) []string {
+	defaultLocale := t.DefaultLocale
+	if len(defaultLocale) == 0 {
+		defaultLocale = DefaultLocale
+	}
+	var locales []string
+	locale = NormaliseLocale(locale)
+	if len(locale) > 0 {
+		locales = append(locales, locale)
+		if i := strings.Index(locale, "-"); i > 0 {
+			locales = append(locales, locale[:i])
+		}
+	}
+	return append(locales, NormaliseLocale(defaultLocale), DefaultLocale)
+}
+
+func (t *Templates) source(name string, locale string) (string, bool) {
+	for _, candidate := range t.locales(locale) {
+		if len(t.Dir) > 0 {
+			content, err := ioutil.ReadFile(filepath.Join(t.Dir, candidate, name))
+			if err == nil {
+				return string(content), true
+			}
+		}
+		if content, ok := builtinTemplates[candidate+"/"+name]; ok {
+			return content, true
+		}
+	}
+	return "", false
+}
+
+func (t *Templates) Render(name string, locale string, to string, data interface{}) (Message, error) {
+	message := Message{To: to}
+
+	subject, err := t.renderText(name+".subject.txt", locale, data)
+	if err != nil {
+		return message, err
+	}
+	message.Subject = strings.Join(strings.Fields(subject), " ")
+
+	message.Text, err = t.renderText(name+".txt", locale, data)
+	if err != nil {
+		return message, err
+	}
+
+	source, ok := t.source(name+".html", locale)
+	if !ok {
+		return message, os.ErrNotExist
+	}
+	htmlTemplate, err := htmltemplate.New(name).Parse(source)
+	if err != nil {
+		return message, err
+	}
+	var html bytes.Buffer
+	err = htmlTemplate.Execute(&html, data)
+	message.HTML = html.String()
+	return message, err
+}
+
+func (t *Templates) renderText(name string, locale string, data interface{}) (string, error) {
+	source, ok := t.source(name, locale)
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	textTemplate, err := template.New(name).Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var text bytes.Buffer
+	err = textTemplate.Execute(&text, data)
+	return text.String(), err
+}
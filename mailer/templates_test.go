@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testInvite struct {
+	ConfirmURL  string
+	InviterName string
+	Offered     bool
+	Hours       string
+	Description string
+}
+
+var invite = testInvite{
+	ConfirmURL:  "https://example.com/confirm?email=joe%40example.com",
+	InviterName: "Jane <b>Doe</b>",
+	Offered:     true,
+	Hours:       "1.5",
+	Description: "<script>alert('hi')</script>",
+}
+
+func TestBuiltinTemplates(t *testing.T) {
+	Convey("Rendering the built in invite template", t, func() {
+		templates := &Templates{}
+		message, err := templates.Render("invite", "", "joe@example.com", invite)
+		So(err, ShouldBeNil)
+
+		Convey("Should fill in the subject and both bodies", func() {
+			So(message.To, ShouldEqual, "joe@example.com")
+			So(message.Subject, ShouldEqual, "Invite to Think Globally and Trade Locally")
+			So(message.Text, ShouldContainSubstring, "Jane <b>Doe</b> offered the following transaction 1.5TGs")
+			So(message.Text, ShouldContainSubstring, invite.ConfirmURL)
+		})
+
+		Convey("Should escape member supplied text in the html body", func() {
+			So(message.HTML, ShouldNotContainSubstring, "<script>")
+			So(message.HTML, ShouldNotContainSubstring, "<b>Doe</b>")
+			So(message.HTML, ShouldContainSubstring, "&lt;script&gt;")
+		})
+	})
+
+	Convey("Rendering an unknown template should fail", t, func() {
+		templates := &Templates{}
+		_, err := templates.Render("unknown", "en", "joe@example.com", nil)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestTemplateOverrides(t *testing.T) {
+	Convey("Given a template directory with a french invite subject", t, func() {
+		dir, err := ioutil.TempDir("", "templates")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			_ = os.RemoveAll(dir)
+		})
+		So(os.MkdirAll(filepath.Join(dir, "fr"), 0700), ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(dir, "fr", "invite.subject.txt"), []byte("Invitation de {{.InviterName}}\n"), 0600)
+		So(err, ShouldBeNil)
+		templates := &Templates{Dir: dir, DefaultLocale: "en"}
+
+		Convey("A french recipient should get the french subject and the default bodies", func() {
+			message, err := templates.Render("invite", "fr", "joe@example.com", invite)
+			So(err, ShouldBeNil)
+			So(message.Subject, ShouldEqual, "Invitation de Jane <b>Doe</b>")
+			So(message.Text, ShouldContainSubstring, "offered the following transaction")
+		})
+
+		Convey("A regional locale should fall back to its base language", func() {
+			message, err := templates.Render("invite", "fr_CA", "joe@example.com", invite)
+			So(err, ShouldBeNil)
+			So(message.Subject, ShouldStartWith, "Invitation de")
+		})
+
+		Convey("Other locales should get the default", func() {
+			message, err := templates.Render("invite", "de", "joe@example.com", invite)
+			So(err, ShouldBeNil)
+			So(message.Subject, ShouldEqual, "Invite to Think Globally and Trade Locally")
+		})
+	})
+}
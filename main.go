@@ -1,21 +1,128 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/config"
 	"github.com/adamboardman/thinkglobally/server"
+	"github.com/adamboardman/thinkglobally/store"
 	"github.com/gin-gonic/gin"
+	"os"
+	"strconv"
 )
 
 func main() {
-	isDebugging := false
-	flag.BoolVar(&isDebugging, "debugging", false, "if true, we start in debug mode")
-	flag.Parse()
+	cfg, args, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		fmt.Println("\nCommands:\n  migrate up|down [steps]|status\n  places import <csv file of name,latitude,longitude>")
+		os.Exit(0)
+	}
+	if err == nil && len(args) > 0 && (args[0] == "migrate" || args[0] == "places") {
+		if args[0] == "migrate" {
+			err = migrate(cfg, args[1:])
+		} else {
+			err = places(cfg, args[1:])
+		}
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if err == nil && len(args) > 0 {
+		err = errors.New("unknown command " + args[0])
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
 
-	if !isDebugging {
+	if !cfg.Debugging {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	a := server.WebApp{}
-	a.Init("aye-social")
+	a.Init(cfg)
+
+	a.Run(cfg.ListenAddr)
+}
+
+func migrate(cfg *config.Config, args []string) error {
+	if len(cfg.Database.DSN) == 0 {
+		return errors.New("database-dsn is required")
+	}
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [steps]|status")
+	}
+	s := store.PostgresStore{}
+	s.StoreInit(cfg.Database.DSN, cfg.Database.Name)
 
-	a.Run(":3030")
+	switch args[0] {
+	case "up":
+		done, err := s.MigrateUp()
+		for _, migration := range done {
+			fmt.Printf("applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return errors.New("steps must be a positive number")
+			}
+		}
+		done, err := s.MigrateDown(steps)
+		for _, migration := range done {
+			fmt.Printf("reverted %d %s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		statuses, err := s.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d %-30s %s\n", status.Version, status.Name, state)
+		}
+		return nil
+	}
+	return errors.New("unknown migrate command " + args[0] + ", expected up, down or status")
+}
+
+// places loads a gazetteer of towns or postcodes so members can give a location without knowing its coordinates
+func places(cfg *config.Config, args []string) error {
+	if len(cfg.Database.DSN) == 0 {
+		return errors.New("database-dsn is required")
+	}
+	if len(args) != 2 || args[0] != "import" {
+		return errors.New("usage: places import <csv file>")
+	}
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gazetteer, err := store.ReadPlacesCSV(file)
+	if err != nil {
+		return err
+	}
+	s := store.PostgresStore{}
+	s.StoreInit(cfg.Database.DSN, cfg.Database.Name)
+	count, err := s.SavePlaces(gazetteer)
+	if err == nil {
+		fmt.Printf("imported %d places\n", count)
+	}
+	return err
 }
@@ -1,19 +1,20 @@
 package server
 
 import (
-	"bytes"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"github.com/adamboardman/thinkglobally/mailer"
 	"github.com/adamboardman/thinkglobally/store"
 	"github.com/appleboy/gin-jwt"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/argon2"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/smtp"
 	"net/url"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -64,22 +65,11 @@ func AllowOptions(c *gin.Context) {
 }
 
 func (a *WebApp) InitAuth(group *gin.RouterGroup) *jwt.GinJWTMiddleware {
-	const secretKeyFileName = "secret_key.txt"
-	secretKey, err := ioutil.ReadFile(secretKeyFileName)
-	if err != nil {
-		secretKey, err = ioutil.ReadFile("../" + secretKeyFileName)
-		if err != nil {
-			secretKey = []byte(RandomKey(30))
-			err = ioutil.WriteFile(secretKeyFileName, secretKey, 0666)
-			LogFatalError(err)
-		}
-	}
-
 	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
 		Realm:       "thinkglobally",
-		Key:         secretKey,
-		Timeout:     time.Hour * 24 * 7,
-		MaxRefresh:  time.Hour,
+		Key:         []byte(a.Config.JWT.Secret),
+		Timeout:     a.Config.JWT.Timeout.Duration,
+		MaxRefresh:  a.Config.JWT.MaxRefresh.Duration,
 		IdentityKey: identityKey,
 		PayloadFunc: func(data interface{}) jwt.MapClaims {
 			if v, ok := data.(*store.User); ok {
@@ -105,18 +95,7 @@ func (a *WebApp) InitAuth(group *gin.RouterGroup) *jwt.GinJWTMiddleware {
 				return "", jwt.ErrMissingLoginValues
 			}
 
-			user, err := a.Store.FindUser(loginVals.Email)
-			if err != nil {
-				return nil, err
-			}
-			salt, err := base64.StdEncoding.DecodeString(user.Salt)
-			encrypted := argon2.IDKey([]byte(loginVals.Password), salt, 1, 64*1024, 4, 32)
-			loginPassword := base64.StdEncoding.EncodeToString(encrypted)
-			if err == nil && loginPassword == user.Password {
-				return user, nil
-			}
-
-			return nil, jwt.ErrFailedAuthentication
+			return authenticateUser(c, loginVals.Email, loginVals.Password)
 		},
 		Authorizator: func(data interface{}, c *gin.Context) bool {
 			user, ok := data.(*LoggedInUser);
@@ -151,13 +130,18 @@ func (a *WebApp) InitAuth(group *gin.RouterGroup) *jwt.GinJWTMiddleware {
 		log.Fatal("JWT Error:" + err.Error())
 	}
 
+	authRateLimit := RateLimitByIP(RateLimit{Requests: a.Config.Login.RateLimitRequests, Per: a.Config.Login.RateLimitPer.Duration})
 	auth := group.Group("/auth")
 	auth.OPTIONS("/register", AllowOptions)
 	auth.OPTIONS("/login", AllowOptions)
 	auth.OPTIONS("/refresh_token", AllowOptions)
-	auth.POST("/register", RegisterUser)
-	auth.POST("/login", authMiddleware.LoginHandler)
+	auth.OPTIONS("/forgot_password", AllowOptions)
+	auth.OPTIONS("/reset_password", AllowOptions)
+	auth.POST("/register", authRateLimit, RegisterUser)
+	auth.POST("/login", authRateLimit, authMiddleware.LoginHandler)
 	auth.GET("/confirm_email", ConfirmEmail)
+	auth.POST("/forgot_password", authRateLimit, ForgotPassword)
+	auth.POST("/reset_password", authRateLimit, ResetPassword)
 	auth.GET("/refresh_token", authMiddleware.MiddlewareFunc(), authMiddleware.RefreshHandler)
 
 	return authMiddleware
@@ -218,6 +202,7 @@ func RegisterUser(c *gin.Context) {
 
 	user := store.User{}
 	user.Email = registerJSON.Email
+	user.Locale = localeFromRequest(c)
 	salt := RandomBytes(16)
 	encrypted := argon2.IDKey([]byte(registerJSON.Password), salt, 1, 64*1024, 4, 32)
 	user.Salt = base64.StdEncoding.EncodeToString(salt)
@@ -233,16 +218,17 @@ func RegisterUser(c *gin.Context) {
 		return
 	}
 
-	SendEmail(registerJSON.Email, base64.StdEncoding.EncodeToString(verification), "", "")
+	_ = SendConfirmEmail(registerJSON.Email, user.Locale, base64.StdEncoding.EncodeToString(verification))
 
 	c.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK, "message": "User registered successfully", "resourceId": user.ID,
 	})
 }
 
-func InviteUser(email string, invite string, description string) (error, *store.User) {
+func InviteUser(email string, locale string, invite InviteEmailData) (error, *store.User) {
 	user := store.User{}
 	user.Email = email
+	user.Locale = locale
 	salt := RandomBytes(16)
 	user.Salt = base64.StdEncoding.EncodeToString(salt)
 
@@ -254,78 +240,84 @@ func InviteUser(email string, invite string, description string) (error, *store.
 	if err != nil {
 		return err, &user
 	}
-	SendEmail(email, base64.StdEncoding.EncodeToString(verification), invite, description)
+	_ = SendInviteEmail(email, locale, base64.StdEncoding.EncodeToString(verification), invite)
 
 	return nil, &user
 }
 
-func SendEmail(emailAddress string, verificationKey string, invite string, description string) {
+type ConfirmEmailData struct {
+	ConfirmURL string
+}
+
+type InviteEmailData struct {
+	ConfirmURL  string
+	InviterName string
+	Offered     bool
+	Hours       string
+	Description string
+}
+
+type PasswordResetEmailData struct {
+	ResetURL string
+	Lifetime string
+}
+
+func confirmEmailUrl(emailAddress string, verificationKey string) string {
 	data := url.Values{}
 	data.Set("email", url.QueryEscape(emailAddress))
 	data.Set("verification", url.QueryEscape(verificationKey))
-	confirmUrl := "https://www.thinkglobally.org/api/auth/confirm_email?" + data.Encode()
-	log.Print(confirmUrl)
-	c, err := smtp.Dial("localhost:25")
+	return App.Config.BaseURL + "/api/auth/confirm_email?" + data.Encode()
+}
+
+func SendConfirmEmail(emailAddress string, locale string, verificationKey string) error {
+	return sendTemplatedEmail("confirm_email", emailAddress, locale, ConfirmEmailData{
+		ConfirmURL: confirmEmailUrl(emailAddress, verificationKey),
+	})
+}
+
+func SendInviteEmail(emailAddress string, locale string, verificationKey string, invite InviteEmailData) error {
+	invite.ConfirmURL = confirmEmailUrl(emailAddress, verificationKey)
+	return sendTemplatedEmail("invite", emailAddress, locale, invite)
+}
+
+func SendRecoveryEmail(emailAddress string, locale string, recoveryKey string) error {
+	data := url.Values{}
+	data.Set("email", emailAddress)
+	data.Set("verification", recoveryKey)
+	return sendTemplatedEmail("password_reset", emailAddress, locale, PasswordResetEmailData{
+		ResetURL: App.Config.BaseURL + "/reset_password?" + data.Encode(),
+		Lifetime: App.Config.Login.RecoverTokenLifetime.String(),
+	})
+}
+
+func sendTemplatedEmail(name string, emailAddress string, locale string, data interface{}) error {
+	message, err := App.Templates.Render(name, locale, emailAddress, data)
+	if err == nil {
+		err = QueueEmail(message)
+	}
 	if err != nil {
-		log.Print(err)
-		return
+		log.Printf("Queueing %s email to %s failed - err: %s", name, emailAddress, err.Error())
 	}
-	defer c.Close()
-	_ = c.Mail("no-reply@thinkglobally.org")
-	_ = c.Rcpt(emailAddress)
-	boundary := base64.StdEncoding.EncodeToString(RandomBytes(16))
-	wc, err := c.Data()
-	LogFatalError(err)
-	defer wc.Close()
-
-	subject := "Think Globally Confirm Email Address"
-	opening := "Thanks for signing up for a"
-	middling := ""
-	middlingHTML := ""
-	ending := ""
-	if len(invite) > 0 {
-		subject = "Invite to Think Globally and Trade Locally"
-		opening = "You've been invited open a"
-		middling = invite + "\r\nDescription: " + description + "\r\n"
-		middlingHTML = "<p>" + invite + "</p>" + "\r\n<p>Description: " + description + "</p>" + "\r\n"
-		ending = "and select a password "
+	return err
+}
+
+// localeFromRequest picks the first language the browser asks for, used until the member chooses one
+func localeFromRequest(c *gin.Context) string {
+	acceptLanguage := c.GetHeader("Accept-Language")
+	if i := strings.IndexAny(acceptLanguage, ",;"); i >= 0 {
+		acceptLanguage = acceptLanguage[:i]
+	}
+	locale := mailer.NormaliseLocale(acceptLanguage)
+	if !validLocale(locale) {
+		return ""
 	}
+	return locale
+}
 
-	buf := bytes.NewBufferString("" +
-		"Subject: " + subject + "\r\n" +
-		"From: ThinkGlobally <no-reply@thinkglobally.org>\r\n" +
-		"Reply-To: ThinkGlobally <no-reply@thinkglobally.org>\r\n" +
-		"MIME-Version: 1.0\r\n" +
-		"Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n" +
-		"\r\n" +
-		"--" + boundary + "\r\n" +
-		"Content-Type: text/plain; charset=utf-8\r\n" +
-		"Content-Transfer-Encoding: 7bit\r\n" +
-		"\r\n" +
-		opening + " Think Globally - Trade Locally account\r\n" +
-		"\r\n" +
-		middling +
-		"Please click on the following link to confirm your email address " + ending + confirmUrl + "\r\n" +
-		"\r\n" +
-		"--" + boundary + "\r\n" +
-		"Content-Type: text/html; charset=utf-8\r\n" +
-		"Content-Transfer-Encoding: 7bit\r\n" +
-		"\r\n" +
-		"<!DOCTYPE html>\r\n" +
-		"<html>\r\n" +
-		"<head>\r\n" +
-		"</head>\r\n" +
-		"<body>\r\n" +
-		"<p>" + opening + " Think Globally - Trade Locally account</p>\r\n" +
-		"\r\n" +
-		middlingHTML +
-		"<p>Please click on the following link to confirm your email address " + ending + "<a href=" + confirmUrl + ">" + confirmUrl + "</a></p>\r\n" +
-		"</body>\r\n" +
-		"</html>\r\n" +
-		"\r\n" +
-		"--" + boundary + "--\r\n")
-	_, err = buf.WriteTo(wc)
-	LogFatalError(err)
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+func validLocale(locale string) bool {
+	return localePattern.MatchString(locale)
 }
 
 func ConfirmEmail(c *gin.Context) {
@@ -356,3 +348,112 @@ func ConfirmEmail(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 	}
 }
+
+
+
+type ForgotPasswordJSON struct {
+	Email string
+}
+
+func ForgotPassword(c *gin.Context) {
+	forgotPasswordJSON := ForgotPasswordJSON{}
+	if c.ContentType() == "application/json" {
+		err := c.BindJSON(&forgotPasswordJSON)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+	} else {
+		forgotPasswordJSON.Email = c.PostForm("email")
+	}
+
+	recovery := RandomBytes(20)
+	user, err := App.Store.FindUser(forgotPasswordJSON.Email)
+	if err == nil && !isFeeAccount(user.ID) {
+		salt, _ := base64.StdEncoding.DecodeString(user.Salt)
+		user.RecoverVerifier = verifierFor(recovery, salt)
+		user.RecoverTokenExpiry = time.Now().Add(App.Config.Login.RecoverTokenLifetime.Duration).Format(time.RFC3339)
+		_, err = App.Store.UpdateUser(user)
+		if err == nil {
+			_ = SendRecoveryEmail(user.Email, user.Locale, base64.StdEncoding.EncodeToString(recovery))
+		}
+	} else {
+		// keep the response time similar whether or not the address is registered
+		verifierFor(recovery, RandomBytes(16))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "If the email address is registered a password reset link has been sent",
+	})
+}
+
+type ResetPasswordJSON struct {
+	Email                string
+	Verification         string
+	Password             string
+	PasswordConfirmation string `json:"password_confirmation"`
+}
+
+func ResetPassword(c *gin.Context) {
+	resetPasswordJSON := ResetPasswordJSON{}
+	if c.ContentType() == "application/json" {
+		err := c.BindJSON(&resetPasswordJSON)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+	} else {
+		resetPasswordJSON.Email = c.PostForm("email")
+		resetPasswordJSON.Verification = c.PostForm("verification")
+		resetPasswordJSON.Password = c.PostForm("password")
+		resetPasswordJSON.PasswordConfirmation = c.PostForm("password_confirmation")
+	}
+
+	if len(resetPasswordJSON.Password) == 0 || resetPasswordJSON.Password != resetPasswordJSON.PasswordConfirmation {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Passwords do not match"})
+		return
+	}
+
+	user, err := App.Store.FindUser(resetPasswordJSON.Email)
+	if err != nil || isFeeAccount(user.ID) || !recoveryTokenValid(user, resetPasswordJSON.Verification) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid or expired password reset link"})
+		return
+	}
+
+	salt, _ := base64.StdEncoding.DecodeString(user.Salt)
+	user.Password = verifierFor([]byte(resetPasswordJSON.Password), salt)
+	user.RecoverVerifier = ""
+	user.RecoverTokenExpiry = ""
+	user.Confirmed = true
+	user.ConfirmVerifier = ""
+	_, err = App.Store.UpdateUser(user)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Password reset failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Password reset successfully", "resourceId": user.ID,
+	})
+}
+
+func recoveryTokenValid(user *store.User, recoveryKey string) bool {
+	if len(user.RecoverVerifier) == 0 {
+		return false
+	}
+	expiry, err := time.Parse(time.RFC3339, user.RecoverTokenExpiry)
+	if err != nil || time.Now().After(expiry) {
+		return false
+	}
+	salt, _ := base64.StdEncoding.DecodeString(user.Salt)
+	recovery, err := base64.StdEncoding.DecodeString(recoveryKey)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(verifierFor(recovery, salt)), []byte(user.RecoverVerifier)) == 1
+}
+
+func verifierFor(secret []byte, salt []byte) string {
+	encrypted := argon2.IDKey(secret, salt, 1, 64*1024, 4, 32)
+	return base64.StdEncoding.EncodeToString(encrypted)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxDisputeTextLength = 2000
+
+type DisputeJSON struct {
+	Reason string
+}
+
+type DisputeReviewJSON struct {
+	Note string
+}
+
+// DisputeResolutionJSON upholds a dispute with the outcome "reverse" or turns it down with "dismiss"
+type DisputeResolutionJSON struct {
+	Outcome    string
+	Resolution string
+}
+
+var disputeStatusNames = map[string][]uint{
+	"open":         {store.DisputeOpen},
+	"under_review": {store.DisputeUnderReview},
+	"unresolved":   {store.DisputeOpen, store.DisputeUnderReview},
+	"reversed":     {store.DisputeReversed},
+	"dismissed":    {store.DisputeDismissed},
+	"resolved":     {store.DisputeReversed, store.DisputeDismissed},
+}
+
+func checkDisputeText(name string, text string, required bool) error {
+	if required && len(strings.TrimSpace(text)) == 0 {
+		return fmt.Errorf("%s is required", name)
+	}
+	if len(text) > maxDisputeTextLength {
+		return fmt.Errorf("%s must be at most %d characters", name, maxDisputeTextLength)
+	}
+	return nil
+}
+
+func AddDispute(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	transactionId, err := strconv.Atoi(c.Param("transactionID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid TransactionId"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	transaction, err := App.Store.LoadTransaction(uint(transactionId))
+	if err != nil || (transaction.FromUserId != loggedInUserId && transaction.ToUserId != loggedInUserId) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not found"})
+		return
+	}
+
+	disputeJSON := DisputeJSON{}
+	err = decodeStrictJSON(c, &disputeJSON)
+	if err == nil {
+		err = checkDisputeText("Reason", disputeJSON.Reason, true)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Dispute failed validation - error: %s", err.Error())})
+		return
+	}
+
+	dispute := store.Dispute{TransactionId: transaction.ID, RaisedById: loggedInUserId, Reason: disputeJSON.Reason}
+	disputeId, err := App.Store.RaiseDispute(&dispute)
+	if err == store.ErrTransactionNotPosted || err == store.ErrDisputeOpen || err == store.ErrTransactionReversed {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": fmt.Sprintf("Transaction can not be disputed - %s", err.Error())})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Dispute failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Dispute raised successfully", "resourceId": disputeId,
+	})
+}
+
+func DisputesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	claims := jwt.ExtractClaims(c)
+	disputes, err := App.Store.ListDisputesForUser(uint(claims["id"].(float64)))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Disputes not found"})
+		return
+	}
+	c.JSON(http.StatusOK, disputes)
+}
+
+func AdminDisputesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	var statuses []uint
+	if name := c.DefaultQuery("status", "unresolved"); name != "all" {
+		var ok bool
+		statuses, ok = disputeStatusNames[name]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Unknown status %s", name)})
+			return
+		}
+	}
+	disputes, err := App.Store.ListDisputes(statuses)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Disputes not found"})
+		return
+	}
+	c.JSON(http.StatusOK, disputes)
+}
+
+// loadDisputeForReviewer aborts unless the dispute exists and the logged in editor was not a party to it
+func loadDisputeForReviewer(c *gin.Context) (*store.Dispute, uint) {
+	c.Header("Content-Type", "application/json")
+
+	disputeId, err := strconv.Atoi(c.Param("disputeID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid DisputeId"})
+		return nil, 0
+	}
+	dispute, err := App.Store.LoadDispute(uint(disputeId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Dispute not found"})
+		return nil, 0
+	}
+	transaction, err := App.Store.LoadTransaction(dispute.TransactionId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not found"})
+		return nil, 0
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if transaction.FromUserId == loggedInUserId || transaction.ToUserId == loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can not review disputes on your own transactions"})
+		return nil, 0
+	}
+	return dispute, loggedInUserId
+}
+
+func abortWithDisputeError(c *gin.Context, err error) {
+	if err == store.ErrDisputeClosed {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": "Dispute has already been resolved"})
+		return
+	}
+	if limitErr, ok := err.(*store.LimitError); ok {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": fmt.Sprintf("Reversal failed - %s", limitErr.Error())})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Dispute failed update - err: %s", err.Error())})
+}
+
+func ReviewDispute(c *gin.Context) {
+	dispute, reviewerId := loadDisputeForReviewer(c)
+	if dispute == nil {
+		return
+	}
+	reviewJSON := DisputeReviewJSON{}
+	err := decodeStrictJSON(c, &reviewJSON)
+	if err == nil {
+		err = checkDisputeText("Note", reviewJSON.Note, false)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Review failed validation - error: %s", err.Error())})
+		return
+	}
+
+	dispute, err = App.Store.ReviewDispute(dispute.ID, reviewerId, reviewJSON.Note)
+	if err != nil {
+		abortWithDisputeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Dispute under review", "resourceId": dispute.ID,
+	})
+}
+
+func ResolveDispute(c *gin.Context) {
+	dispute, reviewerId := loadDisputeForReviewer(c)
+	if dispute == nil {
+		return
+	}
+	resolutionJSON := DisputeResolutionJSON{}
+	err := decodeStrictJSON(c, &resolutionJSON)
+	if err == nil && resolutionJSON.Outcome != "reverse" && resolutionJSON.Outcome != "dismiss" {
+		err = fmt.Errorf("Outcome must be reverse or dismiss")
+	}
+	if err == nil {
+		err = checkDisputeText("Resolution", resolutionJSON.Resolution, true)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Resolution failed validation - error: %s", err.Error())})
+		return
+	}
+
+	dispute, err = App.Store.ResolveDispute(dispute.ID, reviewerId, resolutionJSON.Outcome == "reverse", resolutionJSON.Resolution)
+	if err != nil {
+		abortWithDisputeError(c, err)
+		return
+	}
+	message := "Dispute dismissed"
+	if dispute.Status == store.DisputeReversed {
+		message = "Dispute upheld and transaction reversed"
+		reversal, err := App.Store.LoadTransaction(dispute.ReversalTId)
+		if err == nil {
+			publishBalancesChanged(*reversal)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": message, "resourceId": dispute.ID, "reversalId": dispute.ReversalTId,
+	})
+}
+
+func AuditEntriesList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	transactionId := 0
+	if value := c.Query("transaction"); len(value) > 0 {
+		var err error
+		transactionId, err = strconv.Atoi(value)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid TransactionId"})
+			return
+		}
+	}
+	entries, err := App.Store.ListAuditEntries(uint(transactionId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Audit entries not found"})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
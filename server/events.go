@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventTransactionPending  = "transaction_pending"
+	EventTransactionAccepted = "transaction_accepted"
+	EventTransactionRejected = "transaction_rejected"
+	EventBalanceChanged      = "balance_changed"
+)
+
+const maxReplayedEvents = 500
+const eventHeartbeat = 30 * time.Second
+const eventRetryMillis = 3000
+
+// BalanceChangedEvent tells a member their balance after a transaction was posted
+type BalanceChangedEvent struct {
+	TransactionId uint
+	Balance       int64
+}
+
+// EventHub fans events out to the streams each member has open on /api/events
+type EventHub struct {
+	mutex       sync.Mutex
+	subscribers map[uint]map[chan store.Event]bool
+	// publishing makes events get logged and published one at a time, so streams receive them in id order
+	publishing sync.Mutex
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: map[uint]map[chan store.Event]bool{}}
+}
+
+func (h *EventHub) Subscribe(userId uint) chan store.Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	events := make(chan store.Event, 16)
+	if h.subscribers[userId] == nil {
+		h.subscribers[userId] = map[chan store.Event]bool{}
+	}
+	h.subscribers[userId][events] = true
+	return events
+}
+
+func (h *EventHub) Unsubscribe(userId uint, events chan store.Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers[userId], events)
+	if len(h.subscribers[userId]) == 0 {
+		delete(h.subscribers, userId)
+	}
+}
+
+// Publish hands the event to the member's open streams. A stream that has fallen too far behind to take it is closed
+// and dropped instead, so its client reconnects and replays everything after the last event it was sent.
+func (h *EventHub) Publish(event store.Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for events := range h.subscribers[event.UserId] {
+		select {
+		case events <- event:
+		default:
+			close(events)
+			delete(h.subscribers[event.UserId], events)
+		}
+	}
+	if len(h.subscribers[event.UserId]) == 0 {
+		delete(h.subscribers, event.UserId)
+	}
+}
+
+func (h *EventHub) subscriberCount(userId uint) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.subscribers[userId])
+}
+
+// publishEvent logs the event for replay and then publishes it, failures are logged as the change itself has been made
+func publishEvent(userId uint, eventType string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	event := store.Event{UserId: userId, Type: eventType, Data: string(data)}
+	App.Events.publishing.Lock()
+	defer App.Events.publishing.Unlock()
+	if err == nil {
+		_, err = App.Store.InsertEvent(&event)
+	}
+	if err != nil {
+		log.Printf("Event %s for user %d could not be published - err: %s", eventType, userId, err.Error())
+		return
+	}
+	App.Events.Publish(event)
+}
+
+func publishTransactionPending(transaction store.Transaction) {
+	publishEvent(transaction.CounterpartyId(), EventTransactionPending, transaction)
+}
+
+// publishTransactionPosted tells the initiator their offer or request was accepted and everyone paid their new balance
+func publishTransactionPosted(transaction store.Transaction) {
+	publishEvent(transaction.InitiatorId(), EventTransactionAccepted, transaction)
+	publishBalancesChanged(transaction)
+}
+
+// publishBalancesChanged tells both parties, and the fee account if it was credited, their balance after a posting
+func publishBalancesChanged(transaction store.Transaction) {
+	userIds := []uint{transaction.FromUserId, transaction.ToUserId}
+	if transaction.FeeUserId != 0 && transaction.FeeUserId != transaction.FromUserId && transaction.FeeUserId != transaction.ToUserId {
+		userIds = append(userIds, transaction.FeeUserId)
+	}
+	for _, userId := range userIds {
+		publishEvent(userId, EventBalanceChanged, BalanceChangedEvent{TransactionId: transaction.ID, Balance: transaction.Balance(userId)})
+	}
+}
+
+func publishTransactionRejected(transaction store.Transaction) {
+	publishEvent(transaction.InitiatorId(), EventTransactionRejected, transaction)
+}
+
+func (a *WebApp) startEventPruner() {
+	retention := a.Config.Events.Retention.Duration
+	go func() {
+		ticker := time.NewTicker(retention / 4)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := a.Store.PurgeEventsBefore(time.Now().Add(-retention)); err != nil {
+				log.Printf("Purging events failed - err: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// tokenFromQuery lets EventSource clients, which can not set headers, pass their token to /api/events as ?token=.
+// It runs ahead of the request logger and moves the token into the Authorization header, so it is never logged.
+func tokenFromQuery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.URL.Path != "/api/events" {
+			c.Next()
+			return
+		}
+		query := c.Request.URL.Query()
+		token := query.Get("token")
+		if len(token) > 0 {
+			if len(c.GetHeader("Authorization")) == 0 {
+				c.Request.Header.Set("Authorization", "Bearer "+token)
+			}
+			query.Del("token")
+			c.Request.URL.RawQuery = query.Encode()
+		}
+		c.Next()
+	}
+}
+
+// lastEventId reads where a reconnecting client got up to, from the Last-Event-ID header or ?lastEventId=
+func lastEventId(c *gin.Context) (uint, bool) {
+	value := c.GetHeader("Last-Event-ID")
+	if len(value) == 0 {
+		value = c.Query("lastEventId")
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func writeEvent(c *gin.Context, event store.Event) {
+	_, _ = fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
+
+// EventStream streams the logged in member's events, first replaying any logged since the Last-Event-ID a
+// reconnecting client sends
+func EventStream(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	events := App.Events.Subscribe(loggedInUserId)
+	defer App.Events.Unsubscribe(loggedInUserId, events)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	_, _ = fmt.Fprintf(c.Writer, "retry: %d\n\n", eventRetryMillis)
+
+	// subscribing before reading the log means nothing is missed in between, and as events are published in id order
+	// anything seen twice can be skipped by id
+	sentId, replay := lastEventId(c)
+	for replay {
+		missed, err := App.Store.ListEventsSince(loggedInUserId, sentId, maxReplayedEvents)
+		if err != nil {
+			// ending the stream has the client reconnect and try the replay again
+			log.Printf("Replaying events for user %d failed - err: %s", loggedInUserId, err.Error())
+			return
+		}
+		for _, event := range missed {
+			writeEvent(c, event)
+			sentId = event.ID
+		}
+		replay = len(missed) == maxReplayedEvents
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			if event.ID <= sentId {
+				continue
+			}
+			writeEvent(c, event)
+			sentId = event.ID
+		case <-heartbeat.C:
+			_, _ = fmt.Fprint(c.Writer, ": heartbeat\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
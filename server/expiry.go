@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"log"
+	"time"
+)
+
+const expiryBatchSize = 100
+
+type TransactionExpiredEmailData struct {
+	OtherName       string
+	Initiator       bool
+	Offered         bool
+	Hours           string
+	Description     string
+	Expiry          string
+	TransactionsURL string
+}
+
+func (a *WebApp) startExpirySweeper() {
+	// an interval or expiry of zero disables the sweeper, leaving it to ExpirePendingTransactions
+	if a.Config.Transactions.SweepInterval.Duration <= 0 || a.Config.Transactions.PendingExpiry.Duration <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(a.Config.Transactions.SweepInterval.Duration)
+		defer ticker.Stop()
+		for range ticker.C {
+			a.ExpirePendingTransactions()
+		}
+	}()
+}
+
+// ExpirePendingTransactions expires the offers and requests that have waited longer than the pending expiry and
+// lets both parties know, returning how many expired
+func (a *WebApp) ExpirePendingTransactions() int {
+	expiry := a.Config.Transactions.PendingExpiry.Duration
+	if expiry <= 0 {
+		return 0
+	}
+	expired := 0
+	for {
+		transactions, err := a.Store.ExpirePendingTransactions(time.Now().Add(-expiry), expiryBatchSize)
+		if err != nil {
+			log.Printf("Expiring pending transactions failed - err: %s", err.Error())
+			return expired
+		}
+		for _, transaction := range transactions {
+			sendTransactionExpiredEmails(transaction)
+			if transaction.GroupId != 0 {
+				// the rest of the group expires with it, they were created together so are normally in this sweep
+				_, err = a.Store.CloseTransactionGroup(transaction.GroupId, store.TransactionGroupExpired)
+				if err != nil && err != store.ErrTransactionNotPending {
+					log.Printf("Expiring transaction group %d failed - err: %s", transaction.GroupId, err.Error())
+				}
+			}
+		}
+		expired += len(transactions)
+		if len(transactions) < expiryBatchSize {
+			return expired
+		}
+	}
+}
+
+func sendTransactionExpiredEmails(transaction store.Transaction) {
+	users := map[uint]*store.User{}
+	for _, userId := range []uint{transaction.FromUserId, transaction.ToUserId} {
+		user, err := App.Store.LoadUserAsSelf(userId, userId)
+		if err != nil {
+			log.Printf("Transaction %d expired but user %d could not be loaded - err: %s", transaction.ID, userId, err.Error())
+			return
+		}
+		users[userId] = user
+	}
+	for userId, user := range users {
+		otherId := transaction.FromUserId
+		if otherId == userId {
+			otherId = transaction.ToUserId
+		}
+		_ = sendTemplatedEmail("transaction_expired", user.Email, user.Locale, TransactionExpiredEmailData{
+			OtherName:       memberName(&users[otherId].PublicUser),
+			Initiator:       transaction.InitiatorId() == userId,
+			Offered:         !transaction.IsRequest(),
+			Hours:           fmt.Sprintf("%g", float64(transaction.Seconds)/3600.0),
+			Description:     transaction.Description,
+			Expiry:          App.Config.Transactions.PendingExpiry.String(),
+			TransactionsURL: App.Config.BaseURL + "/transactions",
+		})
+	}
+}
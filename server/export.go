@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Statement struct {
+	MemberId       uint
+	MemberName     string
+	From           time.Time
+	To             time.Time
+	Generated      time.Time
+	OpeningBalance int64
+	Lines          []StatementLine
+	ClosingBalance int64
+}
+
+type StatementLine struct {
+	Date          time.Time
+	TransactionId uint
+	Counterparty  string
+	Description   string
+	Seconds       uint64
+	Multiplier    float32
+	Fee           int64
+	Amount        int64
+	Balance       int64
+}
+
+func memberName(user *store.PublicUser) string {
+	name := strings.TrimSpace(strings.Join([]string{user.FirstName, user.MidNames, user.LastName}, " "))
+	name = strings.Join(strings.Fields(name), " ")
+	if len(name) == 0 {
+		return fmt.Sprintf("Member %d", user.ID)
+	}
+	return name
+}
+
+// buildStatement lists the postings between from and to using the running balances recorded in the ledger, the
+// opening balance is the balance after the last posting before from
+func buildStatement(member *store.PublicUser, transactions []store.Transaction, from time.Time, to time.Time) Statement {
+	statement := Statement{
+		MemberId:   member.ID,
+		MemberName: memberName(member),
+		From:       from,
+		To:         to,
+		Generated:  time.Now(),
+	}
+	counterparties := map[uint]string{}
+	for _, transaction := range transactions {
+		if !transaction.IsPosted() {
+			continue
+		}
+		date := time.Time(transaction.ConfirmedDate)
+		if date.Before(from) {
+			statement.OpeningBalance = transaction.Balance(member.ID)
+			continue
+		}
+		if date.After(to) {
+			continue
+		}
+		counterpartyId := transaction.ToUserId
+		if counterpartyId == member.ID {
+			counterpartyId = transaction.FromUserId
+		}
+		counterparty, ok := counterparties[counterpartyId]
+		if !ok {
+			counterparty = fmt.Sprintf("Member %d", counterpartyId)
+			if user, err := App.Store.LoadPublicUser(counterpartyId); err == nil {
+				counterparty = memberName(user)
+			}
+			counterparties[counterpartyId] = counterparty
+		}
+		statement.Lines = append(statement.Lines, StatementLine{
+			Date:          date,
+			TransactionId: transaction.ID,
+			Counterparty:  counterparty,
+			Description:   transaction.Description,
+			Seconds:       transaction.Seconds,
+			Multiplier:    transaction.Multiplier,
+			Fee:           transaction.FeeFor(member.ID),
+			Amount:        transaction.BalanceChange(member.ID),
+			Balance:       transaction.Balance(member.ID),
+		})
+	}
+	statement.ClosingBalance = statement.OpeningBalance
+	if len(statement.Lines) > 0 {
+		statement.ClosingBalance = statement.Lines[len(statement.Lines)-1].Balance
+	}
+	return statement
+}
+
+func ExportTransactions(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	from, to, err := timeRangeFromQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "ofx" && format != "html" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Format must be csv, ofx or html"})
+		return
+	}
+
+	member, err := App.Store.LoadPublicUser(loggedInUserId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "User not found"})
+		return
+	}
+	transactions, err := App.Store.ListTransactionsForUser(loggedInUserId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transactions not found"})
+		return
+	}
+	statement := buildStatement(member, transactions, from, to)
+
+	var body []byte
+	var contentType string
+	switch format {
+	case "csv":
+		body, err = statementCSV(statement)
+		contentType = "text/csv; charset=utf-8"
+	case "ofx":
+		body = statementOFX(statement)
+		contentType = "application/x-ofx"
+	case "html":
+		body, err = statementHTML(statement)
+		contentType = "text/html; charset=utf-8"
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": fmt.Sprintf("Statement failed - err: %s", err.Error())})
+		return
+	}
+	if format != "html" {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%s-%s.%s\"",
+			from.Format("20060102"), to.Format("20060102"), format))
+	}
+	c.Data(http.StatusOK, contentType, body)
+}
+
+func formatMultiplier(multiplier float32) string {
+	return strconv.FormatFloat(float64(multiplier), 'g', -1, 32)
+}
+
+// csvText stops text other members wrote from being run as a formula when the statement is opened in a spreadsheet
+func csvText(value string) string {
+	if len(value) > 0 && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func statementCSV(statement Statement) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	rows := [][]string{
+		{"Date", "Transaction", "Counterparty", "Description", "Seconds", "Multiplier", "Fee", "Amount", "Balance"},
+		{statement.From.UTC().Format(time.RFC3339), "", "", "Opening balance", "", "", "", "", strconv.FormatInt(statement.OpeningBalance, 10)},
+	}
+	for _, line := range statement.Lines {
+		rows = append(rows, []string{
+			line.Date.UTC().Format(time.RFC3339),
+			strconv.FormatUint(uint64(line.TransactionId), 10),
+			csvText(line.Counterparty),
+			csvText(line.Description),
+			strconv.FormatUint(line.Seconds, 10),
+			formatMultiplier(line.Multiplier),
+			strconv.FormatInt(line.Fee, 10),
+			strconv.FormatInt(line.Amount, 10),
+			strconv.FormatInt(line.Balance, 10),
+		})
+	}
+	rows = append(rows, []string{statement.To.UTC().Format(time.RFC3339), "", "", "Closing balance", "", "", "", "", strconv.FormatInt(statement.ClosingBalance, 10)})
+	err := writer.WriteAll(rows)
+	return buffer.Bytes(), err
+}
+
+func ofxText(value string, maxLength int) string {
+	if len([]rune(value)) > maxLength {
+		value = string([]rune(value)[:maxLength])
+	}
+	var buffer bytes.Buffer
+	_ = xml.EscapeText(&buffer, []byte(value))
+	return buffer.String()
+}
+
+func ofxDate(date time.Time) string {
+	return date.UTC().Format("20060102150405") + "[0:GMT]"
+}
+
+// statementOFX writes an OFX 2 bank statement, amounts are in seconds with the ISO 4217 code for no currency
+func statementOFX(statement Statement) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"no\"?>\n")
+	buffer.WriteString("<?OFX OFXHEADER=\"200\" VERSION=\"220\" SECURITY=\"NONE\" OLDFILEUID=\"NONE\" NEWFILEUID=\"NONE\"?>\n")
+	buffer.WriteString("<OFX>\n<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>")
+	fmt.Fprintf(&buffer, "<DTSERVER>%s</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>\n", ofxDate(statement.Generated))
+	buffer.WriteString("<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>\n")
+	buffer.WriteString("<STMTRS><CURDEF>XXX</CURDEF>\n")
+	fmt.Fprintf(&buffer, "<BANKACCTFROM><BANKID>THINKGLOBALLY</BANKID><ACCTID>%d</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>\n", statement.MemberId)
+	fmt.Fprintf(&buffer, "<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>\n", ofxDate(statement.From), ofxDate(statement.To))
+	for _, line := range statement.Lines {
+		transactionType := "CREDIT"
+		if line.Amount < 0 {
+			transactionType = "DEBIT"
+		}
+		fmt.Fprintf(&buffer, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%d</TRNAMT><FITID>%d</FITID><NAME>%s</NAME><MEMO>%s</MEMO></STMTTRN>\n",
+			transactionType, ofxDate(line.Date), line.Amount, line.TransactionId, ofxText(line.Counterparty, 32), ofxText(line.Description, 255))
+	}
+	buffer.WriteString("</BANKTRANLIST>\n")
+	fmt.Fprintf(&buffer, "<LEDGERBAL><BALAMT>%d</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>\n", statement.ClosingBalance, ofxDate(statement.To))
+	buffer.WriteString("</STMTRS></STMTTRNRS></BANKMSGSRSV1>\n</OFX>\n")
+	return buffer.Bytes()
+}
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"date":       func(date time.Time) string { return date.UTC().Format("2 Jan 2006 15:04") },
+	"multiplier": formatMultiplier,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Statement for {{.MemberName}}</title>
+<style>
+@page { size: A4; margin: 15mm; }
+body { font-family: sans-serif; font-size: 10pt; color: #000; }
+table { width: 100%; border-collapse: collapse; }
+th, td { padding: 3px 5px; border-bottom: 1px solid #ccc; text-align: left; vertical-align: top; }
+td.number, th.number { text-align: right; white-space: nowrap; }
+tr.balance td { font-weight: bold; }
+thead { display: table-header-group; }
+tr { page-break-inside: avoid; }
+@media print { a { color: #000; text-decoration: none; } }
+</style>
+</head>
+<body>
+<h1>ThinkGlobally statement</h1>
+<p>{{.MemberName}}, member {{.MemberId}}<br>
+{{date .From}} to {{date .To}} (UTC)<br>
+Amounts are in seconds of time, generated {{date .Generated}}</p>
+<table>
+<thead>
+<tr><th>Date</th><th>Transaction</th><th>Counterparty</th><th>Description</th><th class="number">Seconds</th><th class="number">Multiplier</th><th class="number">Fee</th><th class="number">Amount</th><th class="number">Balance</th></tr>
+</thead>
+<tbody>
+<tr class="balance"><td>{{date .From}}</td><td colspan="7">Opening balance</td><td class="number">{{.OpeningBalance}}</td></tr>
+{{range .Lines}}<tr><td>{{date .Date}}</td><td>{{.TransactionId}}</td><td>{{.Counterparty}}</td><td>{{.Description}}</td><td class="number">{{.Seconds}}</td><td class="number">{{multiplier .Multiplier}}</td><td class="number">{{.Fee}}</td><td class="number">{{.Amount}}</td><td class="number">{{.Balance}}</td></tr>
+{{end}}<tr class="balance"><td>{{date .To}}</td><td colspan="7">Closing balance</td><td class="number">{{.ClosingBalance}}</td></tr>
+</tbody>
+</table>
+</body>
+</html>
+`))
+
+func statementHTML(statement Statement) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := statementTemplate.Execute(&buffer, statement)
+	return buffer.Bytes(), err
+}
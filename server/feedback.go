@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxFeedbackCommentLength = 1000
+const maxFeedbackPageSize = 200
+
+// FeedbackJSON rates the other party to a transaction from 1 to 5
+type FeedbackJSON struct {
+	Rating  uint
+	Comment string
+}
+
+type FeedbackModerationJSON struct {
+	Reason string
+}
+
+// withoutModeration blanks what an editor hid, and who hid it, for members looking at feedback on their transactions
+func withoutModeration(feedback []store.Feedback) []store.Feedback {
+	for i := range feedback {
+		if feedback[i].Hidden {
+			feedback[i].Comment = ""
+		}
+		feedback[i].ModeratorId = 0
+		feedback[i].ModerationReason = ""
+	}
+	return feedback
+}
+
+func AddFeedback(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	transactionId, err := strconv.Atoi(c.Param("transactionID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid TransactionId"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	transaction, err := App.Store.LoadTransaction(uint(transactionId))
+	if err != nil || (transaction.FromUserId != loggedInUserId && transaction.ToUserId != loggedInUserId) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not found"})
+		return
+	}
+
+	feedbackJSON := FeedbackJSON{}
+	err = decodeStrictJSON(c, &feedbackJSON)
+	if err == nil && (feedbackJSON.Rating < store.MinRating || feedbackJSON.Rating > store.MaxRating) {
+		err = fmt.Errorf("Rating must be between %d and %d", store.MinRating, store.MaxRating)
+	}
+	if err == nil && len(feedbackJSON.Comment) > maxFeedbackCommentLength {
+		err = fmt.Errorf("Comment must be at most %d characters", maxFeedbackCommentLength)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Feedback failed validation - error: %s", err.Error())})
+		return
+	}
+
+	feedback := store.Feedback{TransactionId: transaction.ID, FromUserId: loggedInUserId, Rating: feedbackJSON.Rating, Comment: feedbackJSON.Comment}
+	feedbackId, err := App.Store.LeaveFeedback(&feedback, time.Now().Add(-App.Config.Transactions.FeedbackWindow.Duration))
+	if err == store.ErrFeedbackNotAllowed || err == store.ErrFeedbackClosed || err == store.ErrFeedbackExists {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"statusText": fmt.Sprintf("Feedback can not be left - %s", err.Error())})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Feedback failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Feedback left successfully", "resourceId": feedbackId,
+	})
+}
+
+// TransactionFeedbackList shows the parties to ?transaction=<id> the feedback they left each other
+func TransactionFeedbackList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	transactionId, err := strconv.Atoi(c.Query("transaction"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid TransactionId"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	transaction, err := App.Store.LoadTransaction(uint(transactionId))
+	if err != nil || (transaction.FromUserId != loggedInUserId && transaction.ToUserId != loggedInUserId) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not found"})
+		return
+	}
+	feedback, err := App.Store.ListFeedbackForTransaction(transaction.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Feedback not found"})
+		return
+	}
+	c.JSON(http.StatusOK, withoutModeration(feedback))
+}
+
+// UserFeedbackList shows the feedback that counts towards a member's reputation, hidden feedback is left out
+func UserFeedbackList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	feedback, err := App.Store.ListFeedbackForUser(uint(userId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Feedback not found"})
+		return
+	}
+	visible := []store.Feedback{}
+	for _, f := range feedback {
+		if !f.Hidden {
+			visible = append(visible, f)
+		}
+	}
+	c.JSON(http.StatusOK, withoutModeration(visible))
+}
+
+func AdminFeedbackList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	hiddenOnly, err := strconv.ParseBool(c.DefaultQuery("hidden", "false"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Hidden must be true or false"})
+		return
+	}
+	feedback, err := App.Store.ListFeedback(hiddenOnly, maxFeedbackPageSize)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Feedback not found"})
+		return
+	}
+	c.JSON(http.StatusOK, feedback)
+}
+
+func HideFeedback(c *gin.Context) {
+	moderateFeedback(c, true)
+}
+
+func ShowFeedback(c *gin.Context) {
+	moderateFeedback(c, false)
+}
+
+// moderateFeedback hides or shows feedback, editors can not moderate feedback they left or received
+func moderateFeedback(c *gin.Context, hidden bool) {
+	c.Header("Content-Type", "application/json")
+
+	feedbackId, err := strconv.Atoi(c.Param("feedbackID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid FeedbackId"})
+		return
+	}
+	feedback, err := App.Store.LoadFeedback(uint(feedbackId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Feedback not found"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if feedback.FromUserId == loggedInUserId || feedback.ToUserId == loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can not moderate feedback you left or received"})
+		return
+	}
+
+	moderationJSON := FeedbackModerationJSON{}
+	if c.Request.ContentLength != 0 {
+		err = decodeStrictJSON(c, &moderationJSON)
+	}
+	if err == nil {
+		err = checkDisputeText("Reason", moderationJSON.Reason, hidden)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Moderation failed validation - error: %s", err.Error())})
+		return
+	}
+
+	feedback, err = App.Store.ModerateFeedback(feedback.ID, loggedInUserId, hidden, moderationJSON.Reason)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Feedback failed update - err: %s", err.Error())})
+		return
+	}
+	message := "Feedback shown"
+	if feedback.Hidden {
+		message = "Feedback hidden"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": message, "resourceId": feedback.ID,
+	})
+}
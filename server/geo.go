@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultSearchRadiusKm = 10
+const maxNearbyUsers = 200
+
+// minRadiusCells is the smallest search radius in blurred location cells, so repeated small searches cannot tell
+// where in its cell a member is
+const minRadiusCells = 3
+
+// locate works out where a profile or listing is, from its latitude and longitude when given, otherwise from the
+// gazetteer entry for its location. A location that is not in the gazetteer is left without coordinates.
+func locate(latitude *float64, longitude *float64, location string) (*float64, *float64, error) {
+	if latitude != nil || longitude != nil {
+		if latitude == nil || longitude == nil {
+			return nil, nil, errors.New("Latitude and Longitude must be given together")
+		}
+		if !store.ValidCoordinates(*latitude, *longitude) {
+			return nil, nil, errors.New("Latitude must be between -90 and 90 and Longitude between -180 and 180")
+		}
+		return latitude, longitude, nil
+	}
+	if len(strings.TrimSpace(location)) == 0 {
+		return nil, nil, nil
+	}
+	place, err := App.Store.LookupPlace(location)
+	if err != nil {
+		return nil, nil, nil
+	}
+	return &place.Latitude, &place.Longitude, nil
+}
+
+func roundTo(value float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(value*scale) / scale
+}
+
+// publicCoordinates blurs a point to the precision other members are allowed to see
+func publicCoordinates(latitude float64, longitude float64) (float64, float64) {
+	return store.BlurPoint(latitude, longitude, App.Config.Geo.PublicPrecision)
+}
+
+// minSearchRadiusKm is a few blurred location cells across, or the largest radius allowed if that is smaller
+func minSearchRadiusKm() float64 {
+	return math.Min(minRadiusCells*store.BlurCellKm(App.Config.Geo.PublicPrecision), App.Config.Geo.MaxRadiusKm)
+}
+
+// nearFromQuery reads near=lat,lng, or near=<place or postcode>, and radius=km. ok is false without a near parameter.
+// The radius is at least minSearchRadiusKm.
+func nearFromQuery(c *gin.Context) (latitude float64, longitude float64, radiusKm float64, ok bool, err error) {
+	near := strings.TrimSpace(c.Query("near"))
+	radius := c.Query("radius")
+	if len(near) == 0 {
+		if len(radius) > 0 {
+			err = errors.New("A radius needs a near point")
+		}
+		return
+	}
+	latitude, longitude, ok = parsePoint(near)
+	if !ok {
+		place, lookupErr := App.Store.LookupPlace(near)
+		if lookupErr != nil {
+			err = fmt.Errorf("Unknown place %s, near must be latitude,longitude or a known place", near)
+			return
+		}
+		latitude, longitude = place.Latitude, place.Longitude
+	}
+	if !store.ValidCoordinates(latitude, longitude) {
+		err = errors.New("Near must be a latitude between -90 and 90 and a longitude between -180 and 180")
+		return
+	}
+	ok = false
+	minRadiusKm := minSearchRadiusKm()
+	radiusKm = math.Max(defaultSearchRadiusKm, minRadiusKm)
+	if len(radius) > 0 {
+		radiusKm, err = strconv.ParseFloat(radius, 64)
+		if err != nil || radiusKm < minRadiusKm || radiusKm > App.Config.Geo.MaxRadiusKm {
+			err = fmt.Errorf("Radius must be at least %.1f and at most %g km", minRadiusKm, App.Config.Geo.MaxRadiusKm)
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+func parsePoint(text string) (float64, float64, bool) {
+	parts := strings.Split(text, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	latitude, latErr := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	longitude, lngErr := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	return latitude, longitude, latErr == nil && lngErr == nil
+}
+
+// usersNear finds the members within radius of the near point, showing their location only as precisely as
+// location-precision allows and searching and measuring the distance from that blurred point so it gives nothing
+// more away
+func usersNear(c *gin.Context, latitude float64, longitude float64, radiusKm float64) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	users, err := App.Store.ListUsersNear(latitude, longitude, radiusKm, App.Config.Geo.PublicPrecision, maxNearbyUsers+1)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Invalid users search"})
+		return
+	}
+	nearbyUsers := []store.NearbyUser{}
+	for _, user := range users {
+		if user.ID == loggedInUserId || len(nearbyUsers) == maxNearbyUsers {
+			continue
+		}
+		user.Latitude, user.Longitude = publicCoordinates(user.Latitude, user.Longitude)
+		user.DistanceKm = roundTo(store.DistanceKm(latitude, longitude, user.Latitude, user.Longitude), 1)
+		nearbyUsers = append(nearbyUsers, user)
+	}
+	c.JSON(http.StatusOK, nearbyUsers)
+}
+
+// listingForViewer blurs the location of listings posted by other members the same way as usersNear
+func listingForViewer(listing *store.Listing, viewerId uint, filter store.ListingFilter) {
+	if listing.Latitude == nil || listing.Longitude == nil {
+		return
+	}
+	latitude, longitude := *listing.Latitude, *listing.Longitude
+	if listing.UserId != viewerId {
+		latitude, longitude = publicCoordinates(latitude, longitude)
+		listing.Latitude, listing.Longitude = &latitude, &longitude
+	}
+	if filter.RadiusKm > 0 {
+		listing.DistanceKm = roundTo(store.DistanceKm(filter.NearLatitude, filter.NearLongitude, latitude, longitude), 1)
+	}
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxTransactionGroupLegs = 20
+
+// TransactionGroupLegJSON is one counterparty of a group, by id or, for someone not yet a member, by email
+type TransactionGroupLegJSON struct {
+	UserId      uint
+	Email       string
+	Seconds     uint64
+	Multiplier  float32
+	TxFee       uint
+	Description string
+}
+
+// TransactionGroupJSON offers from the logged in member to every leg, or requests from every leg to them
+type TransactionGroupJSON struct {
+	Status        uint
+	Description   string
+	Location      string
+	PerformedDate *store.PosixDateTime `json:",omitempty"`
+	Legs          []TransactionGroupLegJSON
+}
+
+var transactionGroupStatusNames = map[uint]string{
+	store.TransactionGroupPending:   "pending",
+	store.TransactionGroupPosted:    "posted",
+	store.TransactionGroupRejected:  "rejected",
+	store.TransactionGroupCancelled: "cancelled",
+	store.TransactionGroupExpired:   "expired",
+}
+
+// readJSONIntoTransactionGroup checks every leg of the group without inviting anyone, the counterparties of legs given
+// by the email of someone who is not yet a member are left as 0 for inviteGroupCounterparties
+func readJSONIntoTransactionGroup(group *store.TransactionGroup, c *gin.Context) ([]store.Transaction, []CreateTransactionJSON, error) {
+	groupJSON := TransactionGroupJSON{}
+	err := decodeStrictJSON(c, &groupJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(groupJSON.Legs) < 2 || len(groupJSON.Legs) > maxTransactionGroupLegs {
+		return nil, nil, fmt.Errorf("A transaction group must have between 2 and %d counterparties", maxTransactionGroupLegs)
+	}
+
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	now := time.Now()
+	group.UserId = loggedInUserId
+	group.Description = groupJSON.Description
+	var legs []store.Transaction
+	var legJSONs []CreateTransactionJSON
+	counterparties := map[uint]bool{}
+	invited := map[string]bool{}
+	for _, legJSON := range groupJSON.Legs {
+		description := legJSON.Description
+		if len(description) == 0 {
+			description = groupJSON.Description
+		}
+		transactionJSON := CreateTransactionJSON{
+			Email:         legJSON.Email,
+			Seconds:       legJSON.Seconds,
+			Multiplier:    legJSON.Multiplier,
+			TxFee:         legJSON.TxFee,
+			Description:   description,
+			Location:      groupJSON.Location,
+			Status:        groupJSON.Status,
+			PerformedDate: groupJSON.PerformedDate,
+		}
+		if groupJSON.Status == store.TransactionRequested {
+			transactionJSON.FromUserId = legJSON.UserId
+			transactionJSON.ToUserId = loggedInUserId
+		} else {
+			transactionJSON.FromUserId = loggedInUserId
+			transactionJSON.ToUserId = legJSON.UserId
+		}
+		leg := store.Transaction{}
+		err = checkNewTransaction(&leg, transactionJSON, loggedInUserId, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		counterpartyId := leg.CounterpartyId()
+		if counterpartyId == 0 && len(legJSON.Email) == 0 {
+			return nil, nil, errors.New("Counterparty not found")
+		}
+		if counterpartyId == 0 {
+			user, err := App.Store.FindUser(legJSON.Email)
+			if err == nil {
+				counterpartyId = user.ID
+				setCounterparty(&leg, counterpartyId)
+			}
+		}
+		if counterpartyId == loggedInUserId {
+			return nil, nil, errors.New("You can not create transactions from and to yourself")
+		}
+		if counterparties[counterpartyId] || (counterpartyId == 0 && invited[legJSON.Email]) {
+			return nil, nil, errors.New("Each counterparty can only be in a transaction group once")
+		}
+		if counterpartyId != 0 {
+			counterparties[counterpartyId] = true
+		} else {
+			invited[legJSON.Email] = true
+		}
+		legs = append(legs, leg)
+		legJSONs = append(legJSONs, transactionJSON)
+	}
+	return legs, legJSONs, nil
+}
+
+func setCounterparty(transaction *store.Transaction, userId uint) {
+	if transaction.IsRequest() {
+		transaction.FromUserId = userId
+	} else {
+		transaction.ToUserId = userId
+	}
+}
+
+// inviteGroupCounterparties invites whoever is not yet a member, once the whole group is known to be valid
+func inviteGroupCounterparties(legs []store.Transaction, legJSONs []CreateTransactionJSON, loggedInUserId uint) error {
+	for i := range legs {
+		if legs[i].CounterpartyId() == 0 {
+			fillCounterparty(&legs[i], legJSONs[i], loggedInUserId)
+		}
+		if legs[i].CounterpartyId() == 0 {
+			return errors.New("Counterparty not found")
+		}
+	}
+	return nil
+}
+
+func AddTransactionGroup(c *gin.Context) {
+	group := store.TransactionGroup{}
+	legs, legJSONs, err := readJSONIntoTransactionGroup(&group, c)
+	if err == nil {
+		err = inviteGroupCounterparties(legs, legJSONs, group.UserId)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Transaction group failed validation - error: %s", err.Error())})
+		return
+	}
+
+	groupId, err := App.Store.InsertTransactionGroup(&group, legs)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Transaction Group failed"})
+		return
+	}
+	for _, leg := range group.Legs {
+		publishTransactionPending(leg)
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Transaction group created successfully", "resourceId": groupId,
+	})
+}
+
+// loadTransactionGroupForParty aborts unless the logged in member is the initiator or a counterparty of the group
+func loadTransactionGroupForParty(c *gin.Context, groupId uint, loggedInUserId uint) *store.TransactionGroup {
+	group, err := App.Store.LoadTransactionGroup(groupId)
+	if err == nil && group.UserId != loggedInUserId && legForCounterparty(group, loggedInUserId) == nil {
+		err = errors.New("not a party")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction group not found"})
+		return nil
+	}
+	return group
+}
+
+func legForCounterparty(group *store.TransactionGroup, userId uint) *store.Transaction {
+	for i := range group.Legs {
+		if group.Legs[i].CounterpartyId() == userId {
+			return &group.Legs[i]
+		}
+	}
+	return nil
+}
+
+func transactionGroupIdFromParam(c *gin.Context) (uint, uint, bool) {
+	c.Header("Content-Type", "application/json")
+
+	groupId, err := strconv.Atoi(c.Param("groupID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid TransactionGroupId"})
+		return 0, 0, false
+	}
+	claims := jwt.ExtractClaims(c)
+	return uint(groupId), uint(claims["id"].(float64)), true
+}
+
+func LoadTransactionGroup(c *gin.Context) {
+	groupId, loggedInUserId, ok := transactionGroupIdFromParam(c)
+	if !ok {
+		return
+	}
+	group := loadTransactionGroupForParty(c, groupId, loggedInUserId)
+	if group == nil {
+		return
+	}
+	for i := range group.Legs {
+		group.Legs[i].GroupStatus = group.Status
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+func ApproveTransactionGroup(c *gin.Context) {
+	groupId, loggedInUserId, ok := transactionGroupIdFromParam(c)
+	if ok {
+		approveTransactionGroup(c, groupId, loggedInUserId)
+	}
+}
+
+func RejectTransactionGroup(c *gin.Context) {
+	groupId, loggedInUserId, ok := transactionGroupIdFromParam(c)
+	if ok {
+		closeTransactionGroup(c, groupId, loggedInUserId, store.TransactionGroupRejected)
+	}
+}
+
+func CancelTransactionGroup(c *gin.Context) {
+	groupId, loggedInUserId, ok := transactionGroupIdFromParam(c)
+	if ok {
+		closeTransactionGroup(c, groupId, loggedInUserId, store.TransactionGroupCancelled)
+	}
+}
+
+// approveTransactionGroup approves the logged in member's leg, posting the group once everyone has approved
+func approveTransactionGroup(c *gin.Context, groupId uint, loggedInUserId uint) {
+	group := loadTransactionGroupForParty(c, groupId, loggedInUserId)
+	if group == nil {
+		return
+	}
+	leg := legForCounterparty(group, loggedInUserId)
+	if leg == nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only approve your own part of a transaction group"})
+		return
+	}
+
+	group, err := App.Store.ApproveGroupTransaction(leg.ID)
+	if err == store.ErrTransactionNotPending {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction group not pending"})
+		return
+	}
+	if limitErr, ok := err.(*store.LimitError); ok {
+		abortWithLimitError(c, limitErr, loggedInUserId)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Transaction group failed update - err: %s", err.Error())})
+		return
+	}
+
+	message := "Transaction group approval recorded"
+	if group.Status == store.TransactionGroupPosted {
+		message = "Transaction group posted successfully"
+		for _, leg := range group.Legs {
+			publishTransactionPosted(leg)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": message, "resourceId": group.ID, "groupStatus": transactionGroupStatusNames[group.Status],
+	})
+}
+
+// closeTransactionGroup lets a counterparty reject, or the initiator cancel, the whole group
+func closeTransactionGroup(c *gin.Context, groupId uint, loggedInUserId uint, status uint) {
+	group := loadTransactionGroupForParty(c, groupId, loggedInUserId)
+	if group == nil {
+		return
+	}
+	if status == store.TransactionGroupCancelled && group.UserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only cancel transaction groups you created"})
+		return
+	}
+	if status == store.TransactionGroupRejected && legForCounterparty(group, loggedInUserId) == nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only reject transaction groups you are part of"})
+		return
+	}
+
+	group, err := App.Store.CloseTransactionGroup(groupId, status)
+	if err == store.ErrTransactionNotPending {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction group not pending"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Transaction group failed update - err: %s", err.Error())})
+		return
+	}
+	if status == store.TransactionGroupRejected {
+		for _, leg := range group.Legs {
+			publishTransactionRejected(leg)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Transaction group " + transactionGroupStatusNames[status] + " successfully", "resourceId": group.ID, "groupStatus": transactionGroupStatusNames[group.Status],
+	})
+}
+
+// withGroupStatus fills in the status of the group each grouped transaction belongs to
+func withGroupStatus(transactions []store.Transaction) error {
+	var groupIds []uint
+	seen := map[uint]bool{}
+	for _, transaction := range transactions {
+		if transaction.GroupId != 0 && !seen[transaction.GroupId] {
+			seen[transaction.GroupId] = true
+			groupIds = append(groupIds, transaction.GroupId)
+		}
+	}
+	if len(groupIds) == 0 {
+		return nil
+	}
+	groups, err := App.Store.ListTransactionGroups(groupIds)
+	if err != nil {
+		return err
+	}
+	statuses := map[uint]uint{}
+	for _, group := range groups {
+		statuses[group.ID] = group.Status
+	}
+	for i := range transactions {
+		transactions[i].GroupStatus = statuses[transactions[i].GroupId]
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxListingLifetime = 365 * 24 * time.Hour
+const maxListingsPageSize = 200
+
+// ListingJSON is a new or replacement listing, Kind is 1 for an offer or 2 for a want. Without a ConceptId the
+// category is linked to the concept tagged with it, if there is one. Latitude and Longitude are optional and
+// otherwise looked up from the Location.
+type ListingJSON struct {
+	Kind             uint
+	Category         string
+	ConceptId        uint
+	Title            string
+	Description      string
+	EstimatedSeconds uint64
+	Multiplier       float32
+	Location         string
+	ExpiresAt        store.PosixDateTime
+	Latitude         *float64
+	Longitude        *float64
+}
+
+// ListingResponseJSON optionally adjusts the transaction a response pre-fills from the listing
+type ListingResponseJSON struct {
+	Seconds       uint64
+	TxFee         uint
+	Description   string
+	PerformedDate *store.PosixDateTime `json:",omitempty"`
+}
+
+var listingKindNames = map[string]uint{
+	"offer": store.ListingOffer,
+	"want":  store.ListingWant,
+}
+
+func readJSONIntoListing(listing *store.Listing, c *gin.Context, now time.Time) error {
+	listingJSON := ListingJSON{}
+	err := decodeStrictJSON(c, &listingJSON)
+	if err != nil {
+		return err
+	}
+	if listingJSON.Kind != store.ListingOffer && listingJSON.Kind != store.ListingWant {
+		return errors.New("A listing must be an offer or a want")
+	}
+	if len(strings.TrimSpace(listingJSON.Title)) == 0 || len(strings.TrimSpace(listingJSON.Category)) == 0 {
+		return errors.New("A listing needs a title and a category")
+	}
+	if listingJSON.EstimatedSeconds == 0 {
+		return errors.New("A listing needs an estimate of the time it takes")
+	}
+	if listingJSON.Multiplier < 1 || listingJSON.Multiplier > 3 {
+		return errors.New("Multiplier must be between 1 and 3")
+	}
+	expiresAt := time.Time(listingJSON.ExpiresAt)
+	if !expiresAt.After(now) || expiresAt.After(now.Add(maxListingLifetime)) {
+		return fmt.Errorf("A listing must expire within the next %g days", maxListingLifetime.Hours()/24)
+	}
+
+	conceptId := listingJSON.ConceptId
+	if conceptId != 0 {
+		_, err = App.Store.LoadConcept(conceptId)
+		if err != nil {
+			return errors.New("Concept not found")
+		}
+	} else {
+		conceptId = conceptIdForCategory(strings.TrimSpace(listingJSON.Category))
+	}
+	latitude, longitude, err := locate(listingJSON.Latitude, listingJSON.Longitude, listingJSON.Location)
+	if err != nil {
+		return err
+	}
+
+	listing.Kind = listingJSON.Kind
+	listing.Category = strings.TrimSpace(listingJSON.Category)
+	listing.ConceptId = conceptId
+	listing.Title = strings.TrimSpace(listingJSON.Title)
+	listing.Description = listingJSON.Description
+	listing.EstimatedSeconds = listingJSON.EstimatedSeconds
+	listing.Multiplier = listingJSON.Multiplier
+	listing.Location = listingJSON.Location
+	listing.ExpiresAt = listingJSON.ExpiresAt
+	listing.Latitude = latitude
+	listing.Longitude = longitude
+	return nil
+}
+
+// conceptIdForCategory finds the concept tagged with the category, as written or in lower case
+func conceptIdForCategory(category string) uint {
+	for _, tag := range []string{category, strings.ToLower(category)} {
+		conceptTag, err := App.Store.FindConceptTag(tag)
+		if err == nil {
+			return conceptTag.ConceptId
+		}
+	}
+	return 0
+}
+
+func AddListing(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	listing := store.Listing{UserId: uint(claims["id"].(float64))}
+	err := readJSONIntoListing(&listing, c, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Listing failed validation - error: %s", err.Error())})
+		return
+	}
+
+	listingId, err := App.Store.InsertListing(&listing)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Listing failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Listing created successfully", "resourceId": listingId,
+	})
+}
+
+// listingFilterFromQuery reads the optional kind, category, concept, user, q (text), location, near, radius and limit
+// parameters
+func listingFilterFromQuery(c *gin.Context) (store.ListingFilter, error) {
+	filter := store.ListingFilter{
+		Category: c.Query("category"),
+		Query:    c.Query("q"),
+		Location: c.Query("location"),
+		Now:      time.Now(),
+		Limit:    maxListingsPageSize,
+	}
+	if name := c.Query("kind"); len(name) > 0 {
+		kind, ok := listingKindNames[name]
+		if !ok {
+			return filter, errors.New("Kind must be offer or want")
+		}
+		filter.Kind = kind
+	}
+	for name, value := range map[string]*uint{"concept": &filter.ConceptId, "user": &filter.UserId} {
+		if param := c.Query(name); len(param) > 0 {
+			parsed, err := strconv.ParseUint(param, 10, 32)
+			if err != nil {
+				return filter, errors.New("Invalid " + name)
+			}
+			*value = uint(parsed)
+		}
+	}
+	if param := c.Query("limit"); len(param) > 0 {
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxListingsPageSize {
+			return filter, fmt.Errorf("Limit must be between 1 and %d", maxListingsPageSize)
+		}
+		filter.Limit = limit
+	}
+	latitude, longitude, radiusKm, near, err := nearFromQuery(c)
+	if err != nil {
+		return filter, err
+	}
+	if near {
+		filter.NearLatitude, filter.NearLongitude, filter.RadiusKm = latitude, longitude, radiusKm
+		filter.Precision = App.Config.Geo.PublicPrecision
+	}
+	return filter, nil
+}
+
+func ListingsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	filter, err := listingFilterFromQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
+	}
+	listings, err := App.Store.SearchListings(filter)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Listings not found"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	for i := range listings {
+		listingForViewer(&listings[i], uint(claims["id"].(float64)), filter)
+	}
+	c.JSON(http.StatusOK, listings)
+}
+
+func listingFromParam(c *gin.Context) *store.Listing {
+	c.Header("Content-Type", "application/json")
+
+	listingId, err := strconv.Atoi(c.Param("listingID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid ListingId"})
+		return nil
+	}
+	listing, err := App.Store.LoadListing(uint(listingId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Listing not found"})
+		return nil
+	}
+	return listing
+}
+
+// ownListingFromParam aborts unless the logged in member posted the listing
+func ownListingFromParam(c *gin.Context) *store.Listing {
+	listing := listingFromParam(c)
+	if listing == nil {
+		return nil
+	}
+	claims := jwt.ExtractClaims(c)
+	if listing.UserId != uint(claims["id"].(float64)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only change your own listings"})
+		return nil
+	}
+	return listing
+}
+
+func LoadListing(c *gin.Context) {
+	listing := listingFromParam(c)
+	if listing != nil {
+		claims := jwt.ExtractClaims(c)
+		listingForViewer(listing, uint(claims["id"].(float64)), store.ListingFilter{})
+		c.JSON(http.StatusOK, listing)
+	}
+}
+
+func UpdateListing(c *gin.Context) {
+	listing := ownListingFromParam(c)
+	if listing == nil {
+		return
+	}
+	err := readJSONIntoListing(listing, c, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Listing failed validation - error: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.UpdateListing(listing)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Listing failed update - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Listing updated successfully", "resourceId": listing.ID,
+	})
+}
+
+func DeleteListing(c *gin.Context) {
+	listing := ownListingFromParam(c)
+	if listing == nil {
+		return
+	}
+	err := App.Store.DeleteListing(listing.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Listing not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Listing deleted successfully", "resourceId": listing.ID,
+	})
+}
+
+// listingTransactionJSON is the transaction the responder initiates and the lister accepts. Answering an offer the
+// responder pays the lister, answering a want the responder requests payment for helping.
+func listingTransactionJSON(listing *store.Listing, responderId uint, responseJSON ListingResponseJSON) CreateTransactionJSON {
+	transactionJSON := CreateTransactionJSON{
+		Seconds:       listing.EstimatedSeconds,
+		Multiplier:    listing.Multiplier,
+		Description:   listing.Title,
+		Location:      listing.Location,
+		PerformedDate: responseJSON.PerformedDate,
+	}
+	if responseJSON.Seconds > 0 {
+		transactionJSON.Seconds = responseJSON.Seconds
+	}
+	if len(responseJSON.Description) > 0 {
+		transactionJSON.Description = responseJSON.Description
+	}
+	transactionJSON.TxFee = responseJSON.TxFee
+	if transactionJSON.TxFee == 0 {
+		transactionJSON.TxFee = minimumTxFee(transactionJSON.Seconds)
+	}
+	if listing.Kind == store.ListingOffer {
+		transactionJSON.Status = store.TransactionOffered
+		transactionJSON.FromUserId = responderId
+		transactionJSON.ToUserId = listing.UserId
+	} else {
+		transactionJSON.Status = store.TransactionRequested
+		transactionJSON.FromUserId = listing.UserId
+		transactionJSON.ToUserId = responderId
+	}
+	return transactionJSON
+}
+
+func RespondToListing(c *gin.Context) {
+	listing := listingFromParam(c)
+	if listing == nil {
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	now := time.Now()
+	if listing.UserId == loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can not respond to your own listing"})
+		return
+	}
+	if listing.IsExpired(now) {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"statusText": "Listing has expired"})
+		return
+	}
+
+	responseJSON := ListingResponseJSON{}
+	var err error
+	if c.Request.ContentLength != 0 {
+		err = decodeStrictJSON(c, &responseJSON)
+	}
+	transaction := store.Transaction{ListingId: listing.ID}
+	if err == nil {
+		err = validateNewTransaction(&transaction, listingTransactionJSON(listing, loggedInUserId, responseJSON), loggedInUserId, now)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Transaction failed validation - error: %s", err.Error())})
+		return
+	}
+
+	transactionId, err := App.Store.InsertTransaction(&transaction)
+	if err != nil || transactionId == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Transaction failed"})
+		return
+	}
+	publishTransactionPending(transaction)
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Transaction created successfully", "resourceId": transactionId,
+	})
+}
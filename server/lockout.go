@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AccountLockedEmailData struct {
+	Attempts int
+	Lockout  string
+}
+
+func lockedUntil(user *store.User) (time.Time, bool) {
+	if len(user.Locked) == 0 {
+		return time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339, user.Locked)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// loginRetryAt doubles the wait after each consecutive failed login
+func loginRetryAt(user *store.User) time.Time {
+	if user.AttemptCount == 0 || len(user.LastAttempt) == 0 {
+		return time.Time{}
+	}
+	lastAttempt, err := time.Parse(time.RFC3339, user.LastAttempt)
+	if err != nil {
+		return time.Time{}
+	}
+	settings := App.Config.Login
+	backoff := settings.BackoffBase.Duration << uint(user.AttemptCount-1)
+	if backoff > settings.LockoutDuration.Duration || backoff < 0 {
+		backoff = settings.LockoutDuration.Duration
+	}
+	return lastAttempt.Add(backoff)
+}
+
+// authenticateUser checks the password, failing the same way for unknown emails and locked accounts as for a wrong
+// password so failed logins do not reveal which accounts exist. The owner is emailed when their account is locked.
+func authenticateUser(c *gin.Context, email string, password string) (*store.User, error) {
+	user, err := App.Store.FindUser(email)
+	if err != nil || isFeeAccount(user.ID) {
+		// keep the response time similar whether or not the address is registered
+		verifierFor([]byte(password), RandomBytes(16))
+		return nil, jwt.ErrFailedAuthentication
+	}
+	now := time.Now()
+	if until, locked := lockedUntil(user); (locked && now.Before(until)) || now.Before(loginRetryAt(user)) {
+		verifierFor([]byte(password), RandomBytes(16))
+		return nil, jwt.ErrFailedAuthentication
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(user.Salt)
+	if err == nil && verifierFor([]byte(password), salt) == user.Password {
+		if user.AttemptCount > 0 || len(user.Locked) > 0 {
+			_ = App.Store.ResetLoginAttempts(user.ID)
+		}
+		return user, nil
+	}
+
+	attempts, err := App.Store.RecordFailedLogin(user.ID, now)
+	if err == nil && App.Config.Login.MaxAttempts > 0 && attempts >= App.Config.Login.MaxAttempts {
+		until := now.Add(App.Config.Login.LockoutDuration.Duration)
+		err = App.Store.LockUser(user.ID, until)
+		if err == nil {
+			log.Printf("Locked user %d (%s) until %s after %d failed logins, last from %s", user.ID, user.Email, until.Format(time.RFC3339), attempts, c.ClientIP())
+			_ = sendTemplatedEmail("account_locked", user.Email, user.Locale, AccountLockedEmailData{
+				Attempts: attempts,
+				Lockout:  App.Config.Login.LockoutDuration.String(),
+			})
+		}
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	return nil, jwt.ErrFailedAuthentication
+}
+
+type UserLockoutJSON struct {
+	UserId       uint
+	Email        string
+	AttemptCount int
+	LastAttempt  string
+	LockedUntil  string
+	Locked       bool
+}
+
+func LockoutsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	users, err := App.Store.ListUsersWithFailedLogins()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Lockouts not found"})
+		return
+	}
+	now := time.Now()
+	lockouts := []UserLockoutJSON{}
+	for _, user := range users {
+		until, locked := lockedUntil(&user)
+		lockouts = append(lockouts, UserLockoutJSON{
+			UserId:       user.ID,
+			Email:        user.Email,
+			AttemptCount: user.AttemptCount,
+			LastAttempt:  user.LastAttempt,
+			LockedUntil:  user.Locked,
+			Locked:       locked && now.Before(until),
+		})
+	}
+	c.JSON(http.StatusOK, lockouts)
+}
+
+func UnlockUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	err = App.Store.ResetLoginAttempts(uint(userId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Unlock user failed - err: %s", err.Error())})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	log.Printf("User %d unlocked by user %d", userId, uint(claims[identityId].(float64)))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "User unlocked", "resourceId": userId,
+	})
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxMessageLength = 4000
+const maxSubjectLength = 200
+const messageEmailExcerptLength = 500
+
+// MessageJSON starts a thread with ToUserId, or continues the one already about the same transaction or listing
+type MessageJSON struct {
+	ToUserId      uint
+	TransactionId uint
+	ListingId     uint
+	Subject       string
+	Body          string
+}
+
+type ReplyJSON struct {
+	Body string
+}
+
+type ThreadWithMessages struct {
+	store.MessageThread
+	Messages []store.Message
+}
+
+type NewMessageEmailData struct {
+	SenderName  string
+	Subject     string
+	Excerpt     string
+	MessagesURL string
+}
+
+func checkMessageBody(body string) error {
+	if len(strings.TrimSpace(body)) == 0 {
+		return errors.New("Body is required")
+	}
+	if len(body) > maxMessageLength {
+		return fmt.Errorf("Body must be at most %d characters", maxMessageLength)
+	}
+	return nil
+}
+
+// threadFromJSON checks the members may talk about what the message is attached to, the transaction must be between
+// them and the listing must belong to one of them
+func threadFromJSON(messageJSON MessageJSON, loggedInUserId uint) (*store.MessageThread, error) {
+	if messageJSON.ToUserId == 0 || messageJSON.ToUserId == loggedInUserId {
+		return nil, errors.New("Messages must be sent to another member")
+	}
+	if _, err := App.Store.LoadPublicUser(messageJSON.ToUserId); err != nil {
+		return nil, errors.New("Member not found")
+	}
+	if len(messageJSON.Subject) > maxSubjectLength {
+		return nil, fmt.Errorf("Subject must be at most %d characters", maxSubjectLength)
+	}
+	thread := store.MessageThread{
+		UserId:        loggedInUserId,
+		OtherUserId:   messageJSON.ToUserId,
+		TransactionId: messageJSON.TransactionId,
+		ListingId:     messageJSON.ListingId,
+		Subject:       strings.TrimSpace(messageJSON.Subject),
+	}
+	if messageJSON.TransactionId != 0 {
+		transaction, err := App.Store.LoadTransaction(messageJSON.TransactionId)
+		if err != nil || !((transaction.FromUserId == loggedInUserId && transaction.ToUserId == messageJSON.ToUserId) ||
+			(transaction.ToUserId == loggedInUserId && transaction.FromUserId == messageJSON.ToUserId)) {
+			return nil, errors.New("Transaction not found between you")
+		}
+		if len(thread.Subject) == 0 {
+			thread.Subject = transaction.Description
+		}
+	}
+	if messageJSON.ListingId != 0 {
+		listing, err := App.Store.LoadListing(messageJSON.ListingId)
+		if err != nil || (listing.UserId != loggedInUserId && listing.UserId != messageJSON.ToUserId) {
+			return nil, errors.New("Listing not found for either of you")
+		}
+		if len(thread.Subject) == 0 {
+			thread.Subject = listing.Title
+		}
+	}
+	return &thread, nil
+}
+
+// postMessage adds the message to the thread and emails the recipient if it is the first one they have not read
+func postMessage(c *gin.Context, thread *store.MessageThread, fromUserId uint, body string) {
+	message := store.Message{ThreadId: thread.ID, FromUserId: fromUserId, Body: body}
+	messageId, err := App.Store.InsertMessage(&message)
+	if err == store.ErrBlocked {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can not message this member"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Message failed"})
+		return
+	}
+	sendNewMessageEmail(thread, message)
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Message sent successfully", "resourceId": messageId, "threadId": thread.ID,
+	})
+}
+
+func sendNewMessageEmail(thread *store.MessageThread, message store.Message) {
+	messages, err := App.Store.ListMessages(thread.ID)
+	if err != nil {
+		return
+	}
+	for _, other := range messages {
+		if other.ID != message.ID && other.ToUserId == message.ToUserId && other.ReadAt == nil {
+			return
+		}
+	}
+	sender, err := App.Store.LoadPublicUser(message.FromUserId)
+	if err == nil {
+		var recipient *store.User
+		recipient, err = App.Store.LoadUserAsSelf(message.ToUserId, message.ToUserId)
+		if err == nil {
+			excerpt := []rune(message.Body)
+			if len(excerpt) > messageEmailExcerptLength {
+				excerpt = append(excerpt[:messageEmailExcerptLength], []rune("...")...)
+			}
+			err = sendTemplatedEmail("new_message", recipient.Email, recipient.Locale, NewMessageEmailData{
+				SenderName:  memberName(sender),
+				Subject:     thread.Subject,
+				Excerpt:     string(excerpt),
+				MessagesURL: App.Config.BaseURL + "/messages/" + strconv.Itoa(int(thread.ID)),
+			})
+		}
+	}
+	if err != nil {
+		log.Printf("Message %d was sent but the email could not be - err: %s", message.ID, err.Error())
+	}
+}
+
+func AddMessage(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	messageJSON := MessageJSON{}
+	err := decodeStrictJSON(c, &messageJSON)
+	if err == nil {
+		err = checkMessageBody(messageJSON.Body)
+	}
+	var thread *store.MessageThread
+	if err == nil {
+		thread, err = threadFromJSON(messageJSON, loggedInUserId)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Message failed validation - error: %s", err.Error())})
+		return
+	}
+	_, err = App.Store.FindOrCreateMessageThread(thread)
+	if err == store.ErrBlocked {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can not message this member"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Message Thread failed"})
+		return
+	}
+	postMessage(c, thread, loggedInUserId, messageJSON.Body)
+}
+
+func MessageThreadsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	claims := jwt.ExtractClaims(c)
+	threads, err := App.Store.ListMessageThreadsForUser(uint(claims["id"].(float64)))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Message threads not found"})
+		return
+	}
+	c.JSON(http.StatusOK, threads)
+}
+
+// ownThreadFromParam aborts unless the logged in member is in the thread, other members are told it does not exist
+func ownThreadFromParam(c *gin.Context) (*store.MessageThread, uint) {
+	c.Header("Content-Type", "application/json")
+
+	threadId, err := strconv.Atoi(c.Param("threadID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid ThreadId"})
+		return nil, 0
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	thread, err := App.Store.LoadMessageThread(uint(threadId))
+	if err != nil || !thread.HasParticipant(loggedInUserId) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Message thread not found"})
+		return nil, 0
+	}
+	return thread, loggedInUserId
+}
+
+// LoadMessageThread shows the thread and its messages, marking the ones sent to the logged in member as read
+func LoadMessageThread(c *gin.Context) {
+	thread, loggedInUserId := ownThreadFromParam(c)
+	if thread == nil {
+		return
+	}
+	_, err := App.Store.MarkThreadRead(thread.ID, loggedInUserId, time.Now())
+	var messages []store.Message
+	if err == nil {
+		messages, err = App.Store.ListMessages(thread.ID)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Messages not found"})
+		return
+	}
+	c.JSON(http.StatusOK, ThreadWithMessages{MessageThread: *thread, Messages: messages})
+}
+
+func ReplyToMessageThread(c *gin.Context) {
+	thread, loggedInUserId := ownThreadFromParam(c)
+	if thread == nil {
+		return
+	}
+	replyJSON := ReplyJSON{}
+	err := decodeStrictJSON(c, &replyJSON)
+	if err == nil {
+		err = checkMessageBody(replyJSON.Body)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Message failed validation - error: %s", err.Error())})
+		return
+	}
+	postMessage(c, thread, loggedInUserId, replyJSON.Body)
+}
+
+func UnreadMessages(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	claims := jwt.ExtractClaims(c)
+	count, err := App.Store.UnreadMessageCount(uint(claims["id"].(float64)))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Messages not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"Unread": count})
+}
+
+func BlocksList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	claims := jwt.ExtractClaims(c)
+	blocks, err := App.Store.ListBlockedUsers(uint(claims["id"].(float64)))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Blocks not found"})
+		return
+	}
+	c.JSON(http.StatusOK, blocks)
+}
+
+func BlockUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, err := strconv.Atoi(c.Param("userID"))
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if err != nil || uint(userId) == loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	if _, err = App.Store.LoadPublicUser(uint(userId)); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "User not found"})
+		return
+	}
+	err = App.Store.BlockUser(loggedInUserId, uint(userId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Block failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "User blocked successfully", "resourceId": userId,
+	})
+}
+
+func UnblockUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	claims := jwt.ExtractClaims(c)
+	err = App.Store.UnblockUser(uint(claims["id"].(float64)), uint(userId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Block not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "User unblocked successfully", "resourceId": userId,
+	})
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/thinkglobally/config"
+	"github.com/adamboardman/thinkglobally/mailer"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const outboxLease = 5 * time.Minute
+
+// QueueEmail stores the message in the outbox so a failure to reach the mail server never loses it or fails the
+// request that sent it
+func QueueEmail(message mailer.Message) error {
+	email := store.OutboundEmail{
+		Recipient:   message.To,
+		Subject:     message.Subject,
+		Text:        message.Text,
+		HTML:        message.HTML,
+		Status:      store.OutboundEmailPending,
+		NextAttempt: time.Now(),
+	}
+	_, err := App.Store.InsertOutboundEmail(&email)
+	if err == nil {
+		App.kickOutbox()
+	}
+	return err
+}
+
+func (a *WebApp) startOutboxWorker() {
+	a.outboxKick = make(chan struct{}, 1)
+	// an interval of zero disables the worker, leaving delivery to DeliverDueEmails
+	if a.Config.Outbox.Interval.Duration <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(a.Config.Outbox.Interval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-a.outboxKick:
+			}
+			a.DeliverDueEmails()
+		}
+	}()
+}
+
+func (a *WebApp) kickOutbox() {
+	select {
+	case a.outboxKick <- struct{}{}:
+	default:
+	}
+}
+
+func newMailer(cfg config.MailConfig) mailer.Mailer {
+	if cfg.Backend == "maildir" {
+		return &mailer.MaildirMailer{Dir: cfg.Maildir, From: cfg.From}
+	}
+	return &mailer.SMTPMailer{
+		Host:     cfg.SMTP.Host,
+		Port:     cfg.SMTP.Port,
+		StartTLS: cfg.SMTP.StartTLS,
+		Username: cfg.SMTP.Username,
+		Password: cfg.SMTP.Password,
+		From:     cfg.From,
+	}
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	settings := App.Config.Outbox
+	backoff := settings.BackoffBase.Duration << uint(attempts-1)
+	if backoff > settings.BackoffMax.Duration || backoff <= 0 {
+		backoff = settings.BackoffMax.Duration
+	}
+	return backoff
+}
+
+// DeliverDueEmails sends the emails that are due, returning how many were sent
+func (a *WebApp) DeliverDueEmails() int {
+	now := time.Now()
+	emails, err := a.Store.ClaimDueOutboundEmails(now, a.Config.Outbox.BatchSize, outboxLease)
+	if err != nil {
+		log.Printf("Outbox claim failed - err: %s", err.Error())
+		return 0
+	}
+	sent := 0
+	for i := range emails {
+		email := &emails[i]
+		err = a.Mailer.Send(mailer.Message{To: email.Recipient, Subject: email.Subject, Text: email.Text, HTML: email.HTML})
+		email.Attempts++
+		if err == nil {
+			sentAt := time.Now()
+			email.Status = store.OutboundEmailSent
+			email.SentAt = &sentAt
+			email.LastError = ""
+			// the bodies can hold live confirmation and password reset links, they are not kept once delivered
+			email.Text = ""
+			email.HTML = ""
+			sent++
+		} else {
+			email.LastError = err.Error()
+			if email.Attempts >= a.Config.Outbox.MaxAttempts {
+				email.Status = store.OutboundEmailDead
+				log.Printf("Email %d to %s failed %d times, giving up - err: %s", email.ID, email.Recipient, email.Attempts, email.LastError)
+			} else {
+				email.NextAttempt = time.Now().Add(outboxBackoff(email.Attempts))
+			}
+		}
+		_, err = a.Store.UpdateOutboundEmail(email)
+		if err != nil {
+			log.Printf("Outbox update of email %d failed - err: %s", email.ID, err.Error())
+		}
+	}
+	return sent
+}
+
+var outboundEmailStatuses = map[string]uint{
+	"pending": store.OutboundEmailPending,
+	"sent":    store.OutboundEmailSent,
+	"dead":    store.OutboundEmailDead,
+}
+
+// OutboundEmailsList lists the outbox for editors without the email bodies, which can hold confirmation and password
+// reset links that would let an editor take over the recipient's account
+func OutboundEmailsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	status, ok := outboundEmailStatuses[c.DefaultQuery("status", "dead")]
+	if !ok && c.Query("status") != "all" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Status must be pending, sent, dead or all"})
+		return
+	}
+	emails, err := App.Store.ListOutboundEmails(status)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Emails not found"})
+		return
+	}
+	for i := range emails {
+		emails[i].Text = ""
+		emails[i].HTML = ""
+	}
+	c.JSON(http.StatusOK, emails)
+}
+
+func ResendOutboundEmail(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	emailId, err := strconv.Atoi(c.Param("emailID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid EmailID"})
+		return
+	}
+	email, err := App.Store.LoadOutboundEmail(uint(emailId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Email not found"})
+		return
+	}
+	if email.Status == store.OutboundEmailSent {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Sent emails are not kept and can not be resent"})
+		return
+	}
+	email.Status = store.OutboundEmailPending
+	email.Attempts = 0
+	email.NextAttempt = time.Now()
+	_, err = App.Store.UpdateOutboundEmail(email)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Email failed update - err: %s", err.Error())})
+		return
+	}
+	App.kickOutbox()
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Email queued for resending", "resourceId": emailId,
+	})
+}
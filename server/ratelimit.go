@@ -0,0 +1,77 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type ipRateLimiter struct {
+	limit   RateLimit
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newIPRateLimiter(limit RateLimit) *ipRateLimiter {
+	return &ipRateLimiter{limit: limit, buckets: map[string]*tokenBucket{}}
+}
+
+// allow refills the bucket for the ip address by the time passed since it was last used and takes a token from it,
+// when refused it returns how long until the next token is available
+func (l *ipRateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	if l.limit.Requests <= 0 || l.limit.Per <= 0 {
+		return true, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	rate := float64(l.limit.Requests) / float64(l.limit.Per)
+	if now.Sub(l.swept) > l.limit.Per {
+		for key, bucket := range l.buckets {
+			if now.Sub(bucket.updated) > l.limit.Per {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.limit.Requests), updated: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.limit.Requests), bucket.tokens+float64(now.Sub(bucket.updated))*rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate)
+	}
+	bucket.tokens -= 1
+	return true, 0
+}
+
+func RateLimitByIP(limit RateLimit) gin.HandlerFunc {
+	limiter := newIPRateLimiter(limit)
+	return func(c *gin.Context) {
+		allowed, retryAfter := limiter.allow(c.ClientIP(), time.Now())
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"statusText": "Too many requests, try again later"})
+			return
+		}
+		c.Next()
+	}
+}
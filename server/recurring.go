@@ -0,0 +1,254 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const recurringBatchSize = 100
+
+// RecurringTransactionJSON is a new transaction to create on each occurrence of Schedule, an RRULE such as
+// FREQ=WEEKLY;BYDAY=SA, from StartDate or now
+type RecurringTransactionJSON struct {
+	CreateTransactionJSON
+	Schedule  string
+	StartDate *store.PosixDateTime `json:",omitempty"`
+}
+
+// recurringTransactionJSON is what the initiator would send to create the transaction for the occurrence
+func recurringTransactionJSON(recurring store.RecurringTransaction, occurrence time.Time) CreateTransactionJSON {
+	performedDate := store.PosixDateTime(occurrence)
+	return CreateTransactionJSON{
+		FromUserId:    recurring.FromUserId,
+		ToUserId:      recurring.ToUserId,
+		Seconds:       recurring.Seconds,
+		Multiplier:    recurring.Multiplier,
+		TxFee:         recurring.TxFee,
+		Description:   recurring.Description,
+		Location:      recurring.Location,
+		Status:        recurring.Status,
+		PerformedDate: &performedDate,
+	}
+}
+
+func AddRecurringTransaction(c *gin.Context) {
+	recurringJSON := RecurringTransactionJSON{}
+	err := decodeStrictJSON(c, &recurringJSON)
+	if err == nil && recurringJSON.PerformedDate != nil {
+		err = errors.New("Each recurring transaction is performed on the day it is created")
+	}
+	var schedule store.Schedule
+	if err == nil {
+		schedule, err = store.ParseSchedule(recurringJSON.Schedule)
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Recurring transaction failed validation - error: %s", err.Error())})
+		return
+	}
+
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	now := time.Now()
+	transaction := store.Transaction{}
+	err = validateNewTransaction(&transaction, recurringJSON.CreateTransactionJSON, loggedInUserId, now)
+	if err == nil && (transaction.FromUserId == 0 || transaction.ToUserId == 0) {
+		err = errors.New("Counterparty not found")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Recurring transaction failed validation - error: %s", err.Error())})
+		return
+	}
+
+	startDate := store.PosixDateTime(now.Truncate(time.Second))
+	if recurringJSON.StartDate != nil {
+		startDate = *recurringJSON.StartDate
+	}
+	recurring := store.RecurringTransaction{
+		UserId:      loggedInUserId,
+		FromUserId:  transaction.FromUserId,
+		ToUserId:    transaction.ToUserId,
+		Status:      transaction.Status,
+		Seconds:     transaction.Seconds,
+		Multiplier:  transaction.Multiplier,
+		TxFee:       transaction.TxFee,
+		Description: transaction.Description,
+		Location:    transaction.Location,
+		Schedule:    schedule.String(),
+		StartDate:   startDate,
+	}
+	recurring.ScheduleNext(now.Truncate(time.Second))
+	if recurring.NextRunAt == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Schedule has no occurrences after now"})
+		return
+	}
+
+	recurringId, err := App.Store.InsertRecurringTransaction(&recurring)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Recurring Transaction failed"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"status": http.StatusCreated, "message": "Recurring transaction created successfully", "resourceId": recurringId,
+	})
+}
+
+func RecurringTransactionsList(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	c.Header("Content-Type", "application/json")
+	recurring, err := App.Store.ListRecurringTransactionsForUser(loggedInUserId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Recurring transactions not found"})
+		return
+	}
+	c.JSON(http.StatusOK, recurring)
+}
+
+// loadRecurringTransactionForParty aborts unless the logged in member is one of the parties
+func loadRecurringTransactionForParty(c *gin.Context) (*store.RecurringTransaction, uint) {
+	c.Header("Content-Type", "application/json")
+
+	recurringId, err := strconv.Atoi(c.Param("recurringID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid RecurringTransactionId"})
+		return nil, 0
+	}
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+
+	recurring, err := App.Store.LoadRecurringTransaction(uint(recurringId))
+	if err != nil || (recurring.FromUserId != loggedInUserId && recurring.ToUserId != loggedInUserId) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Recurring transaction not found"})
+		return nil, 0
+	}
+	return recurring, loggedInUserId
+}
+
+func PauseRecurringTransaction(c *gin.Context) {
+	recurring, _ := loadRecurringTransactionForParty(c)
+	if recurring == nil {
+		return
+	}
+	err := App.Store.PauseRecurringTransaction(recurring.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Recurring transaction failed update - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Recurring transaction paused successfully", "resourceId": recurring.ID,
+	})
+}
+
+// ResumeRecurringTransaction carries on from the next occurrence, those missed while paused are skipped
+func ResumeRecurringTransaction(c *gin.Context) {
+	recurring, loggedInUserId := loadRecurringTransactionForParty(c)
+	if recurring == nil {
+		return
+	}
+	if recurring.UserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "Only the member who set up a recurring transaction can resume it"})
+		return
+	}
+	recurring.Paused = false
+	recurring.ScheduleNext(time.Now())
+	_, err := App.Store.UpdateRecurringTransaction(recurring)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Recurring transaction failed update - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Recurring transaction resumed successfully", "resourceId": recurring.ID,
+	})
+}
+
+func DeleteRecurringTransaction(c *gin.Context) {
+	recurring, _ := loadRecurringTransactionForParty(c)
+	if recurring == nil {
+		return
+	}
+	err := App.Store.DeleteRecurringTransaction(recurring.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Recurring transaction not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Recurring transaction deleted successfully", "resourceId": recurring.ID,
+	})
+}
+
+func (a *WebApp) startRecurringScheduler() {
+	// an interval of zero disables the scheduler, leaving it to RunRecurringTransactions
+	if a.Config.Transactions.RecurringInterval.Duration <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(a.Config.Transactions.RecurringInterval.Duration)
+		defer ticker.Stop()
+		for range ticker.C {
+			a.RunRecurringTransactions()
+		}
+	}()
+}
+
+// RunRecurringTransactions creates the pending offers and requests for every recurring transaction that is due,
+// returning how many were created. Occurrences old enough to have expired already are skipped, and a template whose
+// transaction can not be created is left due to be tried again on the next run.
+func (a *WebApp) RunRecurringTransactions() int {
+	created := 0
+	for {
+		now := time.Now()
+		var transactions []*store.Transaction
+		inserted, advanced, err := a.Store.RunDueRecurringTransactions(now, recurringBatchSize, func(recurring store.RecurringTransaction) (*store.Transaction, error) {
+			transaction, err := a.recurringOccurrence(recurring, now)
+			if transaction != nil {
+				transactions = append(transactions, transaction)
+			}
+			return transaction, err
+		})
+		created += inserted
+		if err != nil {
+			log.Printf("Running recurring transactions failed - err: %s", err.Error())
+			return created
+		}
+		// a transaction the store did not insert, as its template had already moved on, has no id
+		for _, transaction := range transactions {
+			if transaction.ID != 0 {
+				publishTransactionPending(*transaction)
+			}
+		}
+		if advanced < recurringBatchSize {
+			return created
+		}
+	}
+}
+
+// recurringOccurrence builds the transaction for the occurrence at the template's NextRunAt, or nil to skip it
+func (a *WebApp) recurringOccurrence(recurring store.RecurringTransaction, now time.Time) (*store.Transaction, error) {
+	occurrence := time.Time(*recurring.NextRunAt)
+	// an occurrence too old to be a performed date would never validate, so it is skipped rather than retried
+	maxAge := a.Config.Transactions.PerformedMaxAge.Duration
+	if expiry := a.Config.Transactions.PendingExpiry.Duration; expiry > 0 && expiry < maxAge {
+		maxAge = expiry
+	}
+	if occurrence.Before(now.Add(-maxAge)) {
+		log.Printf("Recurring transaction %d skipped its occurrence at %s as it is more than %s old",
+			recurring.ID, occurrence.Format(time.RFC3339), maxAge)
+		return nil, nil
+	}
+	transaction := store.Transaction{RecurringTransactionId: recurring.ID}
+	err := validateNewTransaction(&transaction, recurringTransactionJSON(recurring, occurrence), recurring.UserId, now)
+	if err != nil {
+		log.Printf("Recurring transaction %d failed to create its transaction - err: %s", recurring.ID, err.Error())
+		return nil, err
+	}
+	return &transaction, nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"github.com/adamboardman/thinkglobally/store"
+	"github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+// valueReport replies with the hours worked against their multiplied value per period, period defaults to month
+func valueReport(c *gin.Context, userId uint) {
+	from, to, err := timeRangeFromQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
+	}
+	report, err := App.Store.ValueReport(userId, c.DefaultQuery("period", "month"), from, to)
+	if err == store.ErrUnknownPeriod {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Period must be week, month or year"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": fmt.Sprintf("Value report failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func MemberValueReport(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	claims := jwt.ExtractClaims(c)
+	valueReport(c, uint(claims["id"].(float64)))
+}
+
+// AdminValueReport covers every member, or just the one given by the user query parameter
+func AdminValueReport(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId := 0
+	if value := c.Query("user"); len(value) > 0 {
+		var err error
+		userId, err = strconv.Atoi(value)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserId"})
+			return
+		}
+	}
+	valueReport(c, uint(userId))
+}
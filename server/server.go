@@ -1,35 +1,66 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/adamboardman/thinkglobally/config"
+	"github.com/adamboardman/thinkglobally/mailer"
 	"github.com/adamboardman/thinkglobally/store"
 	"github.com/adamboardman/thinkglobally/tag_updater"
 	jwt "github.com/appleboy/gin-jwt"
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
+	"log"
 	"math"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type WebApp struct {
+	Config        *config.Config
 	Router        *gin.Engine
-	Store         *store.Store
+	Store         store.Store
 	JwtMiddleware *jwt.GinJWTMiddleware
+	Mailer        mailer.Mailer
+	Templates     *mailer.Templates
+	Events        *EventHub
+	outboxKick    chan struct{}
+	feeUserId     uint
 }
 
 var App *WebApp
 
-func (a *WebApp) Init(dbName string) {
+func (a *WebApp) Init(cfg *config.Config) {
 	App = a
-	a.Store = &store.Store{}
-	a.Store.StoreInit("test-db")
+	a.Config = cfg
+	if a.Store == nil {
+		a.Store = openPostgresStore(cfg.Database)
+	}
+	a.feeUserId = ensureFeeAccount(a.Store, cfg.Fees.AccountEmail)
+	a.Store.SetDefaultCreditLimit(cfg.Credit.DefaultLimit, cfg.Credit.DefaultBalanceCap)
+	a.Store.SetScaleByMultiplier(cfg.Transactions.MultiplierMode == "scale")
+	if a.Mailer == nil {
+		a.Mailer = newMailer(cfg.Mail)
+	}
+	if a.Templates == nil {
+		a.Templates = &mailer.Templates{Dir: cfg.Mail.TemplateDir, DefaultLocale: cfg.Mail.DefaultLocale}
+	}
+	if a.Events == nil {
+		a.Events = NewEventHub()
+	}
 
-	// Set the router as the default one shipped with Gin
-	router := gin.Default()
+	a.startOutboxWorker()
+	a.startExpirySweeper()
+	a.startRecurringScheduler()
+	a.startEventPruner()
+
+	// Set up the router like gin.Default, taking the event stream token out of the query before it is logged
+	router := gin.New()
+	router.Use(tokenFromQuery(), gin.Logger(), gin.Recovery())
 	a.Router = router
 
 	addWebAppStaticFiles(router)
@@ -38,6 +69,39 @@ func (a *WebApp) Init(dbName string) {
 	addDefaultRouteToWebApp(router)
 }
 
+func openPostgresStore(cfg config.DatabaseConfig) *store.PostgresStore {
+	postgresStore := &store.PostgresStore{}
+	postgresStore.StoreInit(cfg.DSN, cfg.Name)
+	if cfg.AutoMigrate {
+		_, err := postgresStore.MigrateUp()
+		LogFatalError(err)
+	} else if err := postgresStore.CheckSchema(); err != nil {
+		log.Fatal(err.Error() + ", run \"migrate up\" before starting the server")
+	}
+	return postgresStore
+}
+
+// ensureFeeAccount creates the community account that transaction fees are credited to, it has no password and is
+// refused password recovery, logins and new transactions so the fees can not be spent
+func ensureFeeAccount(s store.Store, email string) uint {
+	user, err := s.FindUser(email)
+	if err != nil {
+		user = &store.User{}
+		user.Email = email
+		user.FirstName = "ThinkGlobally"
+		user.LastName = "Community"
+		user.Permissions = store.UserPermissionsUser
+		_, err = s.InsertUser(user)
+		LogFatalError(err)
+	}
+	s.SetFeeAccount(user.ID)
+	return user.ID
+}
+
+func isFeeAccount(userId uint) bool {
+	return userId != 0 && userId == App.feeUserId
+}
+
 func addApiRoutes(a *WebApp, router *gin.Engine) {
 	api := router.Group("/api")
 	api.GET("/", func(c *gin.Context) {
@@ -64,7 +128,60 @@ func addApiRoutes(a *WebApp, router *gin.Engine) {
 	api.POST("/transactions", a.JwtMiddleware.MiddlewareFunc(), AddTransaction)
 	api.PATCH("/transactions/:transactionID/accept", a.JwtMiddleware.MiddlewareFunc(), AcceptTransaction)
 	api.PATCH("/transactions/:transactionID/reject", a.JwtMiddleware.MiddlewareFunc(), RejectTransaction)
+	api.PATCH("/transactions/:transactionID/cancel", a.JwtMiddleware.MiddlewareFunc(), CancelTransaction)
 	api.GET("/transactions", a.JwtMiddleware.MiddlewareFunc(), TransactionsList)
+	api.GET("/transactions/export", a.JwtMiddleware.MiddlewareFunc(), ExportTransactions)
+	api.POST("/transactions/:transactionID/disputes", a.JwtMiddleware.MiddlewareFunc(), AddDispute)
+	api.GET("/disputes", a.JwtMiddleware.MiddlewareFunc(), DisputesList)
+	api.POST("/transactions/:transactionID/feedback", a.JwtMiddleware.MiddlewareFunc(), AddFeedback)
+	api.GET("/feedback", a.JwtMiddleware.MiddlewareFunc(), TransactionFeedbackList)
+	api.GET("/users/:userID/feedback", a.JwtMiddleware.MiddlewareFunc(), UserFeedbackList)
+	api.POST("/messages", a.JwtMiddleware.MiddlewareFunc(), AddMessage)
+	api.GET("/messages/unread", a.JwtMiddleware.MiddlewareFunc(), UnreadMessages)
+	api.GET("/message_threads", a.JwtMiddleware.MiddlewareFunc(), MessageThreadsList)
+	api.GET("/message_threads/:threadID", a.JwtMiddleware.MiddlewareFunc(), LoadMessageThread)
+	api.POST("/message_threads/:threadID/messages", a.JwtMiddleware.MiddlewareFunc(), ReplyToMessageThread)
+	api.GET("/events", a.JwtMiddleware.MiddlewareFunc(), EventStream)
+	api.GET("/blocks", a.JwtMiddleware.MiddlewareFunc(), BlocksList)
+	api.PUT("/blocks/:userID", a.JwtMiddleware.MiddlewareFunc(), BlockUser)
+	api.DELETE("/blocks/:userID", a.JwtMiddleware.MiddlewareFunc(), UnblockUser)
+	api.GET("/reports/value", a.JwtMiddleware.MiddlewareFunc(), MemberValueReport)
+	api.GET("/listings", a.JwtMiddleware.MiddlewareFunc(), ListingsList)
+	api.GET("/listings/:listingID", a.JwtMiddleware.MiddlewareFunc(), LoadListing)
+	api.POST("/listings", a.JwtMiddleware.MiddlewareFunc(), AddListing)
+	api.PUT("/listings/:listingID", a.JwtMiddleware.MiddlewareFunc(), UpdateListing)
+	api.DELETE("/listings/:listingID", a.JwtMiddleware.MiddlewareFunc(), DeleteListing)
+	api.POST("/listings/:listingID/respond", a.JwtMiddleware.MiddlewareFunc(), RespondToListing)
+	api.POST("/transaction_groups", a.JwtMiddleware.MiddlewareFunc(), AddTransactionGroup)
+	api.GET("/transaction_groups/:groupID", a.JwtMiddleware.MiddlewareFunc(), LoadTransactionGroup)
+	api.PATCH("/transaction_groups/:groupID/approve", a.JwtMiddleware.MiddlewareFunc(), ApproveTransactionGroup)
+	api.PATCH("/transaction_groups/:groupID/reject", a.JwtMiddleware.MiddlewareFunc(), RejectTransactionGroup)
+	api.PATCH("/transaction_groups/:groupID/cancel", a.JwtMiddleware.MiddlewareFunc(), CancelTransactionGroup)
+	api.POST("/recurring_transactions", a.JwtMiddleware.MiddlewareFunc(), AddRecurringTransaction)
+	api.GET("/recurring_transactions", a.JwtMiddleware.MiddlewareFunc(), RecurringTransactionsList)
+	api.PATCH("/recurring_transactions/:recurringID/pause", a.JwtMiddleware.MiddlewareFunc(), PauseRecurringTransaction)
+	api.PATCH("/recurring_transactions/:recurringID/resume", a.JwtMiddleware.MiddlewareFunc(), ResumeRecurringTransaction)
+	api.DELETE("/recurring_transactions/:recurringID", a.JwtMiddleware.MiddlewareFunc(), DeleteRecurringTransaction)
+	api.GET("/admin/ledger/:userID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), VerifyUserLedger)
+	api.GET("/admin/ledger_totals", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), CheckLedgerTotals)
+	api.GET("/admin/fees", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), FeeIncome)
+	api.GET("/admin/reports/value", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AdminValueReport)
+	api.GET("/admin/credit_limits", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), CreditLimitsList)
+	api.PUT("/admin/credit_limits/users/:userID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), SaveCreditLimit)
+	api.DELETE("/admin/credit_limits/users/:userID", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), DeleteCreditLimit)
+	api.PUT("/admin/credit_limits/tiers/:permissions", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), SaveCreditLimit)
+	api.DELETE("/admin/credit_limits/tiers/:permissions", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), DeleteCreditLimit)
+	api.GET("/admin/disputes", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AdminDisputesList)
+	api.PATCH("/admin/disputes/:disputeID/review", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ReviewDispute)
+	api.PATCH("/admin/disputes/:disputeID/resolve", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ResolveDispute)
+	api.GET("/admin/audit", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AuditEntriesList)
+	api.GET("/admin/feedback", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), AdminFeedbackList)
+	api.PATCH("/admin/feedback/:feedbackID/hide", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), HideFeedback)
+	api.PATCH("/admin/feedback/:feedbackID/show", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ShowFeedback)
+	api.GET("/admin/lockouts", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), LockoutsList)
+	api.PATCH("/admin/users/:userID/unlock", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), UnlockUser)
+	api.GET("/admin/emails", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), OutboundEmailsList)
+	api.PATCH("/admin/emails/:emailID/resend", a.JwtMiddleware.MiddlewareFunc(), AdminPermissionsRequired(), ResendOutboundEmail)
 }
 
 func AdminPermissionsRequired() gin.HandlerFunc {
@@ -131,15 +248,19 @@ func LoadUser(c *gin.Context) {
 		transaction, err := App.Store.LastConfirmedTransactionForUser(loggedInUserId)
 		var balance int64 = 0
 		if err == nil {
-			if transaction.FromUserId == loggedInUserId {
-				balance = transaction.FromUserBalance
-			} else {
-				balance = transaction.ToUserBalance
-			}
+			balance = transaction.Balance(loggedInUserId)
+		}
+		limit, err := App.Store.CreditLimitFor(loggedInUserId)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "User not found"})
+			return
 		}
 		userWithBalance := store.PrivilegedUserWithBalance{
-			PrivilegedUser: *user,
-			Balance:        balance,
+			PrivilegedUser:  *user,
+			Balance:         balance,
+			CreditLimit:     limit.CreditLimit,
+			BalanceCap:      limit.BalanceCap,
+			AvailableCredit: limit.AvailableCredit(balance),
 		}
 		c.JSON(http.StatusOK, userWithBalance)
 	} else {
@@ -198,10 +319,19 @@ func readJSONIntoUser(id uint, c *gin.Context) (*store.User, error) {
 	user.PhotoID = userJson.PhotoID
 	user.Email = userJson.Email
 	user.Mobile = userJson.Mobile
+	user.Locale = mailer.NormaliseLocale(userJson.Locale)
+	if len(user.Locale) > 0 && !validLocale(user.Locale) {
+		return nil, errors.New("Locale must be a language tag such as en or pt-br")
+	}
+	user.Latitude, user.Longitude, err = locate(userJson.Latitude, userJson.Longitude, userJson.Location)
+	if err != nil {
+		return nil, err
+	}
 
 	return user, err
 }
 
+// UserJSON is a profile, Latitude and Longitude are optional and otherwise looked up from the Location
 type UserJSON struct {
 	FirstName string
 	MidNames  string
@@ -210,6 +340,9 @@ type UserJSON struct {
 	PhotoID   uint
 	Email     string
 	Mobile    string
+	Locale    string
+	Latitude  *float64
+	Longitude *float64
 }
 
 func ConceptsList(c *gin.Context) {
@@ -446,49 +579,91 @@ func LoadConceptTags(c *gin.Context) {
 	c.JSON(http.StatusOK, conceptTags)
 }
 
-type TransactionJSON struct {
-	ID              uint
-	FromUserId      uint
-	ToUserId        uint
-	InitiatedDate   store.PosixDateTime
-	ConfirmedDate   store.PosixDateTime
-	Email           string
-	Seconds         uint64
-	Multiplier      float32
-	TxFee           uint
-	Description     string
-	Location        string
-	ToPreviousTId   uint
-	FromPreviousTId uint
-	Status          uint
+// CreateTransactionJSON is all a member may say about a new transaction, the ledger dates, balances and chaining are
+// set by the server
+type CreateTransactionJSON struct {
+	FromUserId    uint
+	ToUserId      uint
+	Email         string
+	Seconds       uint64
+	Multiplier    float32
+	TxFee         uint
+	Description   string
+	Location      string
+	Status        uint
+	PerformedDate *store.PosixDateTime `json:",omitempty"`
 }
 
-func readJSONIntoTransaction(transaction *store.Transaction, c *gin.Context, forceUpdate bool) (error) {
-	transactionJSON := TransactionJSON{}
-	err := c.BindJSON(&transactionJSON)
-	if err != nil {
-		return err
+// decodeStrictJSON rejects fields the target does not have, so a client can not expect them to be honoured
+func decodeStrictJSON(c *gin.Context, target interface{}) error {
+	if c.Request.Body == nil {
+		return errors.New("Request body is empty")
 	}
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
 
-	if forceUpdate || transactionJSON.ID == 0 {
-		transaction.ID = transactionJSON.ID
-		transaction.FromUserId = transactionJSON.FromUserId
-		transaction.ToUserId = transactionJSON.ToUserId
-		transaction.InitiatedDate = transactionJSON.InitiatedDate
-		transaction.ConfirmedDate = transactionJSON.ConfirmedDate
-		transaction.Seconds = transactionJSON.Seconds
-		transaction.Multiplier = transactionJSON.Multiplier
-		transaction.TxFee = transactionJSON.TxFee
-		transaction.Description = transactionJSON.Description
-		transaction.Location = transactionJSON.Location
-		transaction.ToPreviousTId = transactionJSON.ToPreviousTId
-		transaction.FromPreviousTId = transactionJSON.FromPreviousTId
-		transaction.Status = transactionJSON.Status
+// checkPerformedDate allows the date work was performed on to be up to maxAge ago but not in the future
+func checkPerformedDate(performedDate *store.PosixDateTime, now time.Time, maxAge time.Duration) error {
+	if performedDate == nil {
+		return nil
+	}
+	performed := time.Time(*performedDate)
+	if performed.After(now) {
+		return errors.New("The date work was performed on can not be in the future")
+	}
+	if performed.Before(now.Add(-maxAge)) {
+		return fmt.Errorf("The date work was performed on can not be more than %g days ago", maxAge.Hours()/24)
+	}
+	return nil
+}
+
+func readJSONIntoTransaction(transaction *store.Transaction, c *gin.Context) (error) {
+	transactionJSON := CreateTransactionJSON{}
+	err := decodeStrictJSON(c, &transactionJSON)
+	if err != nil {
+		return err
 	}
 
 	claims := jwt.ExtractClaims(c)
 	loggedInUserId := uint(claims["id"].(float64))
 
+	return validateNewTransaction(transaction, transactionJSON, loggedInUserId, time.Now())
+}
+
+// validateNewTransaction fills in a new transaction initiated by loggedInUserId at now, every way of creating one goes
+// through here
+func validateNewTransaction(transaction *store.Transaction, transactionJSON CreateTransactionJSON, loggedInUserId uint, now time.Time) (error) {
+	err := checkNewTransaction(transaction, transactionJSON, loggedInUserId, now)
+	if err != nil {
+		return err
+	}
+	fillCounterparty(transaction, transactionJSON, loggedInUserId)
+	return nil
+}
+
+// checkNewTransaction is validateNewTransaction without looking up, or inviting, a counterparty given by email
+func checkNewTransaction(transaction *store.Transaction, transactionJSON CreateTransactionJSON, loggedInUserId uint, now time.Time) (error) {
+	if isFeeAccount(loggedInUserId) {
+		return errors.New("The community fee account can not make transactions")
+	}
+	err := checkPerformedDate(transactionJSON.PerformedDate, now, App.Config.Transactions.PerformedMaxAge.Duration)
+	if err != nil {
+		return err
+	}
+
+	transaction.FromUserId = transactionJSON.FromUserId
+	transaction.ToUserId = transactionJSON.ToUserId
+	transaction.InitiatedDate = store.PosixDateTime(now.Truncate(time.Microsecond))
+	transaction.PerformedDate = transactionJSON.PerformedDate
+	transaction.Seconds = transactionJSON.Seconds
+	transaction.Multiplier = transactionJSON.Multiplier
+	transaction.TxFee = transactionJSON.TxFee
+	transaction.Description = transactionJSON.Description
+	transaction.Location = transactionJSON.Location
+	transaction.Status = transactionJSON.Status
+
 	switch transaction.Status {
 	case store.TransactionOffered:
 		if transaction.FromUserId != loggedInUserId {
@@ -498,15 +673,23 @@ func readJSONIntoTransaction(transaction *store.Transaction, c *gin.Context, for
 		if transaction.ToUserId != loggedInUserId {
 			return errors.New("You can only request transactions to yourself")
 		}
+	default:
+		return errors.New("A new transaction must be an offer or a request")
 	}
 	if transaction.FromUserId == transaction.ToUserId {
 		return errors.New("You can not create transactions from and to yourself")
 	}
-	txFee := uint(math.Floor(0.0002 * float64(transaction.Seconds)))
-	if transaction.TxFee < 1 || transaction.TxFee < txFee {
+	if transaction.Multiplier < 1 || transaction.Multiplier > 3 {
+		return errors.New("Multiplier must be between 1 and 3")
+	}
+	if transaction.TxFee < minimumTxFee(transaction.Seconds) {
 		return errors.New("You must pay a 0.02% or greater transaction fee")
 	}
+	return nil
+}
 
+// fillCounterparty finds the counterparty of a transaction given by email, inviting them if they are not a member
+func fillCounterparty(transaction *store.Transaction, transactionJSON CreateTransactionJSON, loggedInUserId uint) {
 	switch transaction.Status {
 	case store.TransactionOffered:
 		if transaction.ToUserId == 0 {
@@ -519,24 +702,28 @@ func readJSONIntoTransaction(transaction *store.Transaction, c *gin.Context, for
 		}
 		break
 	}
+}
 
-	return nil
+// minimumTxFee is 0.02% of the seconds, and at least one second
+func minimumTxFee(seconds uint64) uint {
+	txFee := uint(math.Floor(0.0002 * float64(seconds)))
+	if txFee < 1 {
+		return 1
+	}
+	return txFee
 }
 
-func FindOrAddUserForTransaction(transactionJSON TransactionJSON, loggedInUserId uint) uint {
+func FindOrAddUserForTransaction(transactionJSON CreateTransactionJSON, loggedInUserId uint) uint {
 	user, err := App.Store.FindUser(transactionJSON.Email)
-	self, err2 := App.Store.LoadPublicUser(loggedInUserId)
+	self, err2 := App.Store.LoadPrivilegedUserAsSelf(loggedInUserId, loggedInUserId)
 	if err != nil && err2 == nil {
-		invite := self.FirstName + " " + self.LastName
-		if transactionJSON.Status == store.TransactionOffered {
-			invite += " offered "
-		} else {
-			invite += " requested "
+		invite := InviteEmailData{
+			InviterName: self.FirstName + " " + self.LastName,
+			Offered:     transactionJSON.Status == store.TransactionOffered,
+			Hours:       fmt.Sprintf("%g", float64(transactionJSON.Seconds)/3600.0),
+			Description: transactionJSON.Description,
 		}
-		invite += "the following transaction "
-		invite += fmt.Sprintf("%g", float64(transactionJSON.Seconds)/3600.0)
-		invite += "TGs"
-		err, user = InviteUser(transactionJSON.Email, invite, transactionJSON.Description)
+		err, user = InviteUser(transactionJSON.Email, self.Locale, invite)
 		if err != nil {
 			return 0
 		}
@@ -547,7 +734,7 @@ func FindOrAddUserForTransaction(transactionJSON TransactionJSON, loggedInUserId
 func AddTransaction(c *gin.Context) {
 	transaction := store.Transaction{}
 
-	err := readJSONIntoTransaction(&transaction, c, true)
+	err := readJSONIntoTransaction(&transaction, c)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Transaction failed validation - error: %s", err.Error())})
 		return
@@ -558,6 +745,7 @@ func AddTransaction(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Insert Transaction failed"})
 		return
 	}
+	publishTransactionPending(transaction)
 	c.JSON(http.StatusCreated, gin.H{
 		"status": http.StatusCreated, "message": "Transaction created successfully", "resourceId": transactionId,
 	})
@@ -581,43 +769,59 @@ func AcceptTransaction(c *gin.Context) {
 		return
 	}
 
-	fromUserLastTransaction, _ := App.Store.LastConfirmedTransactionForUser(transaction.FromUserId)
-	toUserLastTransaction, _ := App.Store.LastConfirmedTransactionForUser(transaction.ToUserId)
-
 	claims := jwt.ExtractClaims(c)
 	loggedInUserId := uint(claims["id"].(float64))
-	if transaction.Status == store.TransactionOffered {
-		if transaction.ToUserId != loggedInUserId {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only accept offer transactions offered to yourself"})
-			return
-		}
-
-		transaction.Status = store.TransactionOfferApproved
-		transaction.FromUserBalance = fromUserLastTransaction.Balance(transaction.FromUserId) - (int64(transaction.Seconds) + int64(transaction.TxFee))
-		transaction.ToUserBalance = toUserLastTransaction.Balance(transaction.ToUserId) + int64(transaction.Seconds)
+	if transaction.GroupId != 0 {
+		approveTransactionGroup(c, transaction.GroupId, loggedInUserId)
+		return
+	}
+	if transaction.Status == store.TransactionOffered && transaction.ToUserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only accept offer transactions offered to yourself"})
+		return
+	}
+	if transaction.Status == store.TransactionRequested && transaction.FromUserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only accept request transactions requested from yourself"})
+		return
 	}
-	if transaction.Status == store.TransactionRequested {
-		if transaction.FromUserId != loggedInUserId {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only accept request transactions requested from yourself"})
-			return
-		}
 
-		transaction.Status = store.TransactionRequestApproved
-		transaction.FromUserBalance = fromUserLastTransaction.Balance(transaction.FromUserId) - int64(transaction.Seconds)
-		transaction.ToUserBalance = toUserLastTransaction.Balance(transaction.ToUserId) + (int64(transaction.Seconds) - int64(transaction.TxFee))
+	posted, err := App.Store.PostTransaction(transaction.ID)
+	if err == store.ErrTransactionNotPending {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not offered or requested"})
+		return
+	}
+	if limitErr, ok := err.(*store.LimitError); ok {
+		abortWithLimitError(c, limitErr, loggedInUserId)
+		return
 	}
-	transaction.ConfirmedDate = store.PosixDateTime(time.Now())
-	_, err = App.Store.UpdateTransaction(transaction)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Transaction failed update - err: %s", err.Error())})
 		return
 	}
+	publishTransactionPosted(*posted)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"status": http.StatusAccepted, "message": "Transaction updated successfully", "resourceId": transactionId,
 	})
 }
 
+// abortWithLimitError explains which limit the transaction would break and by how much
+func abortWithLimitError(c *gin.Context, limitErr *store.LimitError, loggedInUserId uint) {
+	var statusText string
+	switch {
+	case limitErr.Kind == store.LimitKindBalanceCap && limitErr.UserId == loggedInUserId:
+		statusText = fmt.Sprintf("This transaction would take your balance %d seconds over your balance cap", limitErr.Shortfall)
+	case limitErr.Kind == store.LimitKindBalanceCap:
+		statusText = fmt.Sprintf("This transaction would take the other member %d seconds over their balance cap", limitErr.Shortfall)
+	case limitErr.UserId == loggedInUserId:
+		statusText = fmt.Sprintf("This transaction would take your balance %d seconds past your credit limit", limitErr.Shortfall)
+	default:
+		statusText = fmt.Sprintf("This transaction would take the other member %d seconds past their credit limit", limitErr.Shortfall)
+	}
+	c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+		"statusText": statusText, "limit": limitErr.Kind, "userId": limitErr.UserId, "shortfall": limitErr.Shortfall,
+	})
+}
+
 func RejectTransaction(c *gin.Context) {
 	c.Header("Content-Type", "application/json")
 
@@ -638,45 +842,345 @@ func RejectTransaction(c *gin.Context) {
 
 	claims := jwt.ExtractClaims(c)
 	loggedInUserId := uint(claims["id"].(float64))
-	if transaction.Status == store.TransactionOffered {
-		if transaction.ToUserId != loggedInUserId {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only reject transactions offered to yourself"})
-			return
-		}
-
-		transaction.Status = store.TransactionOfferRejected
+	if transaction.GroupId != 0 {
+		closeTransactionGroup(c, transaction.GroupId, loggedInUserId, store.TransactionGroupRejected)
+		return
+	}
+	if transaction.Status == store.TransactionOffered && transaction.ToUserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only reject transactions offered to yourself"})
+		return
+	}
+	if transaction.Status == store.TransactionRequested && transaction.FromUserId != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only reject transactions requested from yourself"})
+		return
 	}
-	if transaction.Status == store.TransactionRequested {
-		if transaction.FromUserId != loggedInUserId {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only reject transactions requested from yourself"})
-			return
-		}
 
-		transaction.Status = store.TransactionRequestRejected
+	rejected, err := App.Store.ClosePendingTransaction(transaction.ID, transaction.RejectedStatus())
+	if err == store.ErrTransactionNotPending {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not offered or requested"})
+		return
+	}
+	if err == store.ErrTransactionInGroup {
+		closeTransactionGroup(c, transaction.GroupId, loggedInUserId, store.TransactionGroupRejected)
+		return
 	}
-	transaction.ConfirmedDate = store.PosixDateTime(time.Now())
-	_, err = App.Store.UpdateTransaction(transaction)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Transaction failed update - err: %s", err.Error())})
 		return
 	}
+	publishTransactionRejected(*rejected)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"status": http.StatusAccepted, "message": "Transaction updated successfully", "resourceId": transactionId,
 	})
 }
 
+func CancelTransaction(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	transactionId, err := strconv.Atoi(c.Param("transactionID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid TransactionId"})
+		return
+	}
+	transaction, err := App.Store.LoadTransaction(uint(transactionId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not found"})
+		return
+	}
+	if !transaction.IsPending() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not offered or requested"})
+		return
+	}
+
+	claims := jwt.ExtractClaims(c)
+	loggedInUserId := uint(claims["id"].(float64))
+	if transaction.GroupId != 0 {
+		closeTransactionGroup(c, transaction.GroupId, loggedInUserId, store.TransactionGroupCancelled)
+		return
+	}
+	if transaction.InitiatorId() != loggedInUserId {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"statusText": "You can only cancel transactions you offered or requested"})
+		return
+	}
+
+	_, err = App.Store.ClosePendingTransaction(transaction.ID, transaction.CancelledStatus())
+	if err == store.ErrTransactionNotPending {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction not offered or requested"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Transaction failed update - err: %s", err.Error())})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Transaction cancelled successfully", "resourceId": transactionId,
+	})
+}
+
 func TransactionsList(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	loggedInUserId := uint(claims["id"].(float64))
 
 	c.Header("Content-Type", "application/json")
-	transactions, err := App.Store.ListTransactionsForUser(loggedInUserId)
+	filter, err := transactionFilterFromQuery(c, loggedInUserId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
+	}
+	page, err := App.Store.ListTransactions(filter)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transactions not found"})
-	} else {
-		c.JSON(http.StatusOK, transactions)
+		return
+	}
+	c.Header("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor")
+	c.Header("X-Total-Count", strconv.Itoa(page.Total))
+	if page.Next != nil {
+		c.Header("X-Next-Cursor", page.Next.Encode())
+	}
+	transactions := page.Transactions
+	if transactions == nil {
+		transactions = []store.Transaction{}
+	}
+	err = withGroupStatus(transactions)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Transaction groups not found"})
+		return
+	}
+	c.JSON(http.StatusOK, transactions)
+}
+
+const maxTransactionsPageSize = 500
+
+var transactionStatusNames = map[string][]uint{
+	"offered":           {store.TransactionOffered},
+	"requested":         {store.TransactionRequested},
+	"offer_approved":    {store.TransactionOfferApproved},
+	"request_approved":  {store.TransactionRequestApproved},
+	"offer_rejected":    {store.TransactionOfferRejected},
+	"request_rejected":  {store.TransactionRequestRejected},
+	"pending":           {store.TransactionOffered, store.TransactionRequested},
+	"posted":            {store.TransactionOfferApproved, store.TransactionRequestApproved, store.TransactionReversal},
+	"rejected":          {store.TransactionOfferRejected, store.TransactionRequestRejected},
+	"offer_cancelled":   {store.TransactionOfferCancelled},
+	"request_cancelled": {store.TransactionRequestCancelled},
+	"cancelled":         {store.TransactionOfferCancelled, store.TransactionRequestCancelled},
+	"offer_expired":     {store.TransactionOfferExpired},
+	"request_expired":   {store.TransactionRequestExpired},
+	"expired":           {store.TransactionOfferExpired, store.TransactionRequestExpired},
+	"reversal":          {store.TransactionReversal},
+}
+
+// transactionFilterFromQuery reads the optional status, counterparty, from, to (posix seconds), direction,
+// min_seconds, max_seconds, order, limit and cursor query parameters, without a limit every match is returned
+func transactionFilterFromQuery(c *gin.Context, userId uint) (store.TransactionFilter, error) {
+	filter := store.TransactionFilter{UserId: userId}
+	if statuses := c.Query("status"); len(statuses) > 0 {
+		for _, name := range strings.Split(statuses, ",") {
+			status, ok := transactionStatusNames[strings.TrimSpace(name)]
+			if !ok {
+				return filter, fmt.Errorf("Unknown status %s", name)
+			}
+			filter.Statuses = append(filter.Statuses, status...)
+		}
+	}
+	var err error
+	readUint := func(name string) uint64 {
+		value := c.Query(name)
+		if len(value) == 0 || err != nil {
+			return 0
+		}
+		var parsed uint64
+		parsed, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Invalid %s", name)
+		}
+		return parsed
+	}
+	filter.CounterpartyId = uint(readUint("counterparty"))
+	if from := readUint("from"); from > 0 {
+		filter.From = time.Unix(int64(from), 0)
+	}
+	if to := readUint("to"); to > 0 {
+		filter.To = time.Unix(int64(to), 0)
+	}
+	filter.MinSeconds = readUint("min_seconds")
+	filter.MaxSeconds = readUint("max_seconds")
+	filter.Limit = int(readUint("limit"))
+	if err != nil {
+		return filter, err
+	}
+	if filter.Limit > maxTransactionsPageSize {
+		filter.Limit = maxTransactionsPageSize
+	}
+
+	switch filter.Direction = c.Query("direction"); filter.Direction {
+	case store.TransactionDirectionAny, store.TransactionDirectionIn, store.TransactionDirectionOut:
+	default:
+		return filter, errors.New("Direction must be in or out")
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, errors.New("Order must be asc or desc")
+	}
+	if cursor := c.Query("cursor"); len(cursor) > 0 {
+		filter.After, err = store.DecodeTransactionCursor(cursor)
+		if err != nil {
+			return filter, errors.New("Invalid cursor")
+		}
+	}
+	return filter, nil
+}
+
+func VerifyUserLedger(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Invalid UserID"})
+		return
+	}
+	report, err := App.Store.VerifyLedger(uint(userId))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": fmt.Sprintf("Ledger verification failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func CheckLedgerTotals(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	totals, err := App.Store.LedgerTotals()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": fmt.Sprintf("Ledger totals failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, totals)
+}
+
+func FeeIncome(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	from, to, err := timeRangeFromQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
+	}
+	report, err := App.Store.FeeIncome(from, to)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": fmt.Sprintf("Fee income failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// timeRangeFromQuery reads the from and to posix seconds, by default everything up to now
+func timeRangeFromQuery(c *gin.Context) (time.Time, time.Time, error) {
+	from := time.Unix(0, 0)
+	to := time.Now()
+	for name, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		if param := c.Query(name); len(param) > 0 {
+			seconds, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				return from, to, errors.New("Invalid " + name)
+			}
+			*value = time.Unix(seconds, 0)
+		}
+	}
+	if to.Before(from) {
+		return from, to, errors.New("From must be before to")
+	}
+	return from, to, nil
+}
+
+type CreditLimitJSON struct {
+	CreditLimit int64
+	BalanceCap  int64
+}
+
+func CreditLimitsList(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	limits, err := App.Store.ListCreditLimits()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"statusText": fmt.Sprintf("Credit limits failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"Default": CreditLimitJSON{App.Config.Credit.DefaultLimit, App.Config.Credit.DefaultBalanceCap},
+		"Limits":  limits,
+	})
+}
+
+// creditLimitKey reads the member or permission tier a credit limit applies to from the route
+func creditLimitKey(c *gin.Context) (uint, store.UserPermissions, error) {
+	if len(c.Param("userID")) > 0 {
+		userId, err := strconv.Atoi(c.Param("userID"))
+		if err != nil || userId <= 0 {
+			return 0, 0, errors.New("Invalid UserID")
+		}
+		_, err = App.Store.LoadPublicUser(uint(userId))
+		if err != nil {
+			return 0, 0, errors.New("User not found")
+		}
+		return uint(userId), 0, nil
+	}
+	permissions, err := strconv.Atoi(c.Param("permissions"))
+	if err != nil || permissions < int(store.UserPermissionsUser) || permissions > int(store.UserPermissionsAdmin) {
+		return 0, 0, errors.New("Invalid permissions tier")
+	}
+	return 0, store.UserPermissions(permissions), nil
+}
+
+func SaveCreditLimit(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, permissions, err := creditLimitKey(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
+	}
+	limitJSON := CreditLimitJSON{}
+	err = c.BindJSON(&limitJSON)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Credit limit failed validation - err: %s", err.Error())})
+		return
+	}
+	if limitJSON.CreditLimit < store.NoLimit || limitJSON.BalanceCap < store.NoLimit {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": "Credit limit and balance cap must be -1 for no limit or more"})
+		return
+	}
+	limit := store.CreditLimit{
+		UserId:      userId,
+		Permissions: permissions,
+		CreditLimit: limitJSON.CreditLimit,
+		BalanceCap:  limitJSON.BalanceCap,
+	}
+	limitId, err := App.Store.SaveCreditLimit(&limit)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": fmt.Sprintf("Save credit limit failed - err: %s", err.Error())})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Credit limit saved successfully", "resourceId": limitId,
+	})
+}
+
+func DeleteCreditLimit(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	userId, permissions, err := creditLimitKey(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
 	}
+	err = App.Store.DeleteCreditLimit(userId, permissions)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"statusText": "Credit limit not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK, "message": "Credit limit deleted successfully",
+	})
 }
 
 func PublicUsersList(c *gin.Context) {
@@ -684,8 +1188,17 @@ func PublicUsersList(c *gin.Context) {
 	loggedInUserId := uint(claims["id"].(float64))
 
 	c.Header("Content-Type", "application/json")
+	latitude, longitude, radiusKm, near, err := nearFromQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"statusText": err.Error()})
+		return
+	}
+	if near {
+		usersNear(c, latitude, longitude, radiusKm)
+		return
+	}
 	userQuery := UserJSON{}
-	err := c.Bind(&userQuery)
+	err = c.Bind(&userQuery)
 	if err == nil && len(userQuery.Email) > 0 {
 		user, err := App.Store.FindUser(userQuery.Email)
 		if err == nil {
@@ -716,15 +1229,13 @@ func publicUserWithBalanceFromUser(publicUser *store.PublicUser) store.PublicUse
 	transaction, err := App.Store.LastConfirmedTransactionForUser(publicUser.ID)
 	var balance int64 = 0
 	if err == nil {
-		if transaction.FromUserId == publicUser.ID {
-			balance = transaction.FromUserBalance
-		} else {
-			balance = transaction.ToUserBalance
-		}
+		balance = transaction.Balance(publicUser.ID)
 	}
+	reputation, _ := App.Store.ReputationFor(publicUser.ID)
 	publicUserWithBalance := store.PublicUserWithBalance{
 		PublicUser: *publicUser,
 		Balance:    balance,
+		Reputation: reputation,
 	}
 	return publicUserWithBalance
 }
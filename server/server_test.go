@@ -2,12 +2,20 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adamboardman/thinkglobally/config"
+	"github.com/adamboardman/thinkglobally/mailer"
 	"github.com/adamboardman/thinkglobally/store"
+	"github.com/gin-gonic/gin"
 	. "github.com/smartystreets/goconvey/convey"
 	"golang.org/x/crypto/argon2"
 	"io/ioutil"
+	"log"
 	"math"
 	"net/http"
 	"net/http/httptest"
@@ -15,6 +23,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,10 +33,28 @@ type Response struct {
 }
 
 var a WebApp
+var testMailer = &mailer.CaptureMailer{}
 
 func TestMain(m *testing.M) {
-	a = WebApp{}
-	a.Init("test-db")
+	cfg, _, err := config.Load(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(cfg.JWT.Secret) == 0 {
+		cfg.JWT.Secret = RandomKey(32)
+	}
+	cfg.Database.AutoMigrate = true
+	cfg.Login.RateLimitRequests = 10000
+	cfg.Outbox.Interval = config.Duration{}
+	cfg.Credit.DefaultLimit = store.NoLimit
+	cfg.Transactions.SweepInterval = config.Duration{}
+	cfg.Transactions.RecurringInterval = config.Duration{}
+	a = WebApp{Mailer: testMailer}
+	if len(cfg.Database.DSN) == 0 {
+		log.Print("No database-dsn configured, testing against the in memory store")
+		a.Store = store.NewMemoryStore()
+	}
+	a.Init(cfg)
 
 	code := m.Run()
 
@@ -82,6 +109,10 @@ func TestRegisterUser(t *testing.T) {
 			Convey("Should send an email with verification code", func() {
 				savedUser, _ := a.Store.FindUser(emailAddress)
 				So(savedUser.ConfirmVerifier, ShouldNotBeNil)
+				a.DeliverDueEmails()
+				messages := testMailer.MessagesTo(emailAddress)
+				So(len(messages), ShouldBeGreaterThan, 0)
+				So(messages[len(messages)-1].Text, ShouldContainSubstring, a.Config.BaseURL+"/api/auth/confirm_email?")
 			})
 		})
 	})
@@ -570,7 +601,7 @@ func TestDeleteTagsAsAdmin(t *testing.T) {
 	})
 }
 
-func checkArrayForTransaction(transactions []store.Transaction, transactionJson TransactionJSON, ignoreToId bool) bool {
+func checkArrayForTransaction(transactions []store.Transaction, transactionJson CreateTransactionJSON, ignoreToId bool) bool {
 	found := false
 	for _, transaction := range transactions {
 		if transaction.Status == transactionJson.Status && transaction.FromUserId == transactionJson.FromUserId && transaction.Seconds == transactionJson.Seconds && transaction.Multiplier == transactionJson.Multiplier && (ignoreToId || transaction.ToUserId == transactionJson.ToUserId) {
@@ -601,7 +632,7 @@ func TestCreateTransactionOffer(t *testing.T) {
 			token := userTokenFromLoginResponse(response)
 
 			Convey("Offer transaction", func() {
-				transactionJSON := TransactionJSON{}
+				transactionJSON := CreateTransactionJSON{}
 				transactionJSON.FromUserId = user1.ID
 				transactionJSON.ToUserId = user2.ID
 				transactionJSON.Status = store.TransactionOffered
@@ -655,7 +686,7 @@ func TestCreateTransactionOfferAsSomeoneElse(t *testing.T) {
 			token := userTokenFromLoginResponse(response)
 
 			Convey("Offer transaction", func() {
-				transactionJSON := TransactionJSON{}
+				transactionJSON := CreateTransactionJSON{}
 				transactionJSON.FromUserId = user1.ID
 				transactionJSON.ToUserId = user2.ID
 				transactionJSON.Status = store.TransactionOffered
@@ -703,7 +734,7 @@ func TestCreateTransactionOfferToInvalidUser(t *testing.T) {
 			token := userTokenFromLoginResponse(response)
 
 			Convey("Offer transaction", func() {
-				transactionJSON := TransactionJSON{}
+				transactionJSON := CreateTransactionJSON{}
 				transactionJSON.FromUserId = user.ID
 				transactionJSON.Email = emailAddressNewRecipient
 				transactionJSON.Status = store.TransactionOffered
@@ -754,7 +785,7 @@ func TestCreateTransactionRequest(t *testing.T) {
 			token := userTokenFromLoginResponse(response)
 
 			Convey("Request transaction", func() {
-				transactionJSON := TransactionJSON{}
+				transactionJSON := CreateTransactionJSON{}
 				transactionJSON.FromUserId = user1.ID
 				transactionJSON.ToUserId = user2.ID
 				transactionJSON.Status = store.TransactionRequested
@@ -809,7 +840,7 @@ func TestCreateTransactionRequestAsSomeoneElse(t *testing.T) {
 			token := userTokenFromLoginResponse(response)
 
 			Convey("Request transaction", func() {
-				transactionJSON := TransactionJSON{}
+				transactionJSON := CreateTransactionJSON{}
 				transactionJSON.FromUserId = user1.ID
 				transactionJSON.ToUserId = user2.ID
 				transactionJSON.Status = store.TransactionRequested
@@ -838,7 +869,7 @@ func TestCreateTransactionRequestAsSomeoneElse(t *testing.T) {
 	})
 }
 
-func ClearTransactionsMatchingJSON(transactionJson TransactionJSON) {
+func ClearTransactionsMatchingJSON(transactionJson CreateTransactionJSON) {
 	userTransactions, _ := a.Store.ListTransactionsForUser(transactionJson.FromUserId)
 
 	for _, transaction := range userTransactions {
@@ -1253,7 +1284,7 @@ func TestCreateTransactionRequestToEmailAddress(t *testing.T) {
 			token := userTokenFromLoginResponse(response)
 
 			Convey("Request transaction", func() {
-				transactionJSON := TransactionJSON{}
+				transactionJSON := CreateTransactionJSON{}
 				transactionJSON.FromUserId = 0
 				transactionJSON.ToUserId = user2.ID
 				transactionJSON.Email = user1.Email
@@ -1396,7 +1427,7 @@ func TestRejectTransactionFromToSameUser(t *testing.T) {
 			token := userTokenFromLoginResponse(response)
 
 			Convey("Offer transaction", func() {
-				transactionJSON := TransactionJSON{}
+				transactionJSON := CreateTransactionJSON{}
 				transactionJSON.FromUserId = user1.ID
 				transactionJSON.ToUserId = user1.ID
 				transactionJSON.Status = store.TransactionOffered
@@ -1547,3 +1578,1606 @@ func TestCheckUsersBalanceIgnoresMultiplierInBalance(t *testing.T) {
 		})
 	})
 }
+
+func TestVerifyLedgerAsAdmin(t *testing.T) {
+	Convey("Given an admin user and a member with a posted transaction", t, func() {
+		admin := ensureTestUserExists("test-admin@example.com")
+		admin.Permissions = store.UserPermissionsEditor
+		_, _ = a.Store.UpdateUser(admin)
+		user1 := ensureTestUserExists("test-user1@example.com")
+		user2 := ensureTestUserExists("test-user2@example.com")
+		transaction := store.Transaction{
+			FromUserId:    user1.ID,
+			ToUserId:      user2.ID,
+			InitiatedDate: store.PosixDateTime(time.Now()),
+			Seconds:       1 * 60 * 60,
+			TxFee:         1,
+			Multiplier:    1,
+			Description:   "Test Transaction",
+			Status:        store.TransactionOffered,
+		}
+		transactionId, _ := a.Store.InsertTransaction(&transaction)
+		_, _ = a.Store.PostTransaction(transactionId)
+
+		Convey("The admin verifies the members ledger", func() {
+			token := userTokenFromLoginResponse(loginToUserJSON(admin.Email))
+			req, _ := http.NewRequest("GET", "/api/admin/ledger/"+uintToString(user1.ID), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+
+			Convey("The server should respond with the ledger report", func() {
+				So(response.Code, ShouldEqual, http.StatusOK)
+				report := store.LedgerReport{}
+				err := json.Unmarshal(response.Body.Bytes(), &report)
+				So(err, ShouldBeNil)
+				So(report.UserId, ShouldEqual, user1.ID)
+				So(report.Entries, ShouldBeGreaterThan, 0)
+			})
+		})
+
+		Convey("A member can not verify ledgers", func() {
+			token := userTokenFromLoginResponse(loginToUserJSON(user1.Email))
+			req, _ := http.NewRequest("GET", "/api/admin/ledger/"+uintToString(user1.ID), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
+
+func TestFeeAccount(t *testing.T) {
+	Convey("Given a posted transaction with a fee", t, func() {
+		admin := ensureTestUserExists("test-admin@example.com")
+		admin.Permissions = store.UserPermissionsEditor
+		_, _ = a.Store.UpdateUser(admin)
+		user1 := ensureTestUserExists("test-fee1@example.com")
+		user2 := ensureTestUserExists("test-fee2@example.com")
+		feeUser, err := a.Store.FindUser(a.Config.Fees.AccountEmail)
+		So(err, ShouldBeNil)
+		before, _ := a.Store.LastConfirmedTransactionForUser(feeUser.ID)
+		transaction := store.Transaction{
+			FromUserId:    user1.ID,
+			ToUserId:      user2.ID,
+			InitiatedDate: store.PosixDateTime(time.Now()),
+			Seconds:       10 * 60 * 60,
+			TxFee:         8,
+			Multiplier:    1,
+			Description:   "Fee Transaction",
+			Status:        store.TransactionOffered,
+		}
+		transactionId, _ := a.Store.InsertTransaction(&transaction)
+		posted, err := a.Store.PostTransaction(transactionId)
+		So(err, ShouldBeNil)
+		token := userTokenFromLoginResponse(loginToUserJSON(admin.Email))
+
+		Convey("The fee should be credited to the community account", func() {
+			So(posted.FeeUserId, ShouldEqual, feeUser.ID)
+			So(posted.FeeUserBalance, ShouldEqual, before.Balance(feeUser.ID)+8)
+			report, err := a.Store.VerifyLedger(feeUser.ID)
+			So(err, ShouldBeNil)
+			So(report.Valid, ShouldBeTrue)
+		})
+
+		Convey("The admin should see the fee income", func() {
+			from := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+			req, _ := http.NewRequest("GET", "/api/admin/fees?from="+from, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			report := store.FeeReport{}
+			err := json.Unmarshal(response.Body.Bytes(), &report)
+			So(err, ShouldBeNil)
+			So(report.FeeUserId, ShouldEqual, feeUser.ID)
+			So(report.Collected, ShouldBeGreaterThanOrEqualTo, 8)
+			So(report.Balance, ShouldEqual, posted.FeeUserBalance)
+		})
+
+		Convey("Nobody can reset the password of, log in to or spend from the fee account", func() {
+			recovery := RandomBytes(20)
+			salt := RandomBytes(16)
+			planted := *feeUser
+			planted.Salt = base64.StdEncoding.EncodeToString(salt)
+			planted.Password = verifierFor([]byte("5678"), salt)
+			planted.RecoverVerifier = verifierFor(recovery, salt)
+			planted.RecoverTokenExpiry = time.Now().Add(time.Hour).Format(time.RFC3339)
+			_, _ = a.Store.UpdateUser(&planted)
+			defer func() {
+				_, _ = a.Store.UpdateUser(feeUser)
+			}()
+
+			So(postResetPassword(ResetPasswordJSON{
+				Email:                feeUser.Email,
+				Verification:         base64.StdEncoding.EncodeToString(recovery),
+				Password:             "1234",
+				PasswordConfirmation: "1234",
+			}).Code, ShouldEqual, http.StatusBadRequest)
+			savedUser, _ := a.Store.FindUser(feeUser.Email)
+			So(savedUser.Password, ShouldEqual, planted.Password)
+			So(loginWithPassword(feeUser.Email, "5678").Code, ShouldEqual, http.StatusUnauthorized)
+
+			transaction := store.Transaction{}
+			err := validateNewTransaction(&transaction, CreateTransactionJSON{
+				FromUserId: feeUser.ID, ToUserId: user1.ID, Seconds: 60 * 60, TxFee: 1, Multiplier: 1, Status: store.TransactionOffered,
+			}, feeUser.ID, time.Now())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The admin should be able to check the ledger totals", func() {
+			req, _ := http.NewRequest("GET", "/api/admin/ledger_totals", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			totals := store.LedgerTotals{}
+			err := json.Unmarshal(response.Body.Bytes(), &totals)
+			So(err, ShouldBeNil)
+			So(totals.Accounts, ShouldBeGreaterThanOrEqualTo, 3)
+		})
+
+		Convey("A member can not see the fee income", func() {
+			req, _ := http.NewRequest("GET", "/api/admin/fees", nil)
+			req.Header.Set("Authorization", "Bearer "+userTokenFromLoginResponse(loginToUserJSON(user1.Email)))
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
+
+func TestCreditLimits(t *testing.T) {
+	Convey("Given a member limited by an admin to 100 seconds of credit", t, func() {
+		admin := ensureTestUserExists("test-admin@example.com")
+		admin.Permissions = store.UserPermissionsEditor
+		_, _ = a.Store.UpdateUser(admin)
+		user1 := ensureTestUserExists("test-limit1@example.com")
+		user2 := ensureTestUserExists("test-limit2@example.com")
+		for _, user := range []*store.User{user1, user2} {
+			userTransactions, _ := a.Store.ListTransactionsForUser(user.ID)
+			for _, transaction := range userTransactions {
+				a.Store.PurgeTransaction(transaction)
+			}
+		}
+		adminToken := userTokenFromLoginResponse(loginToUserJSON(admin.Email))
+		adminRequest := func(method string, path string, body string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest(method, "/api/admin/credit_limits"+path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			req.Header.Set("Content-Type", "application/json")
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			return response
+		}
+		response := adminRequest("PUT", "/users/"+uintToString(user1.ID), `{"CreditLimit":100,"BalanceCap":-1}`)
+		So(response.Code, ShouldEqual, http.StatusOK)
+		Reset(func() {
+			_ = a.Store.DeleteCreditLimit(user1.ID, 0)
+		})
+
+		transaction := store.Transaction{
+			FromUserId:    user1.ID,
+			ToUserId:      user2.ID,
+			InitiatedDate: store.PosixDateTime(time.Now()),
+			Seconds:       60 * 60,
+			Multiplier:    1,
+			Description:   "Limited Transaction",
+			Status:        store.TransactionOffered,
+		}
+		transactionId, _ := a.Store.InsertTransaction(&transaction)
+		accept := func() *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("PATCH", "/api/transactions/"+uintToString(transactionId)+"/accept", nil)
+			req.Header.Set("Authorization", "Bearer "+userTokenFromLoginResponse(loginToUserJSON(user2.Email)))
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			return response
+		}
+
+		Convey("The member should see their limit and available credit", func() {
+			req, _ := http.NewRequest("GET", "/api/users/0", nil)
+			req.Header.Set("Authorization", "Bearer "+userTokenFromLoginResponse(loginToUserJSON(user1.Email)))
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			user := store.PrivilegedUserWithBalance{}
+			_ = json.Unmarshal(response.Body.Bytes(), &user)
+			So(user.CreditLimit, ShouldEqual, 100)
+			So(user.BalanceCap, ShouldEqual, store.NoLimit)
+			So(user.AvailableCredit, ShouldEqual, 100)
+		})
+
+		Convey("Accepting an offer past the limit should conflict with the shortfall", func() {
+			response := accept()
+			So(response.Code, ShouldEqual, http.StatusConflict)
+			var body map[string]interface{}
+			_ = json.Unmarshal(response.Body.Bytes(), &body)
+			So(body["limit"], ShouldEqual, store.LimitKindCredit)
+			So(body["shortfall"], ShouldEqual, 60*60-100)
+		})
+
+		Convey("Once the admin removes the limit the offer can be accepted", func() {
+			response := adminRequest("DELETE", "/users/"+uintToString(user1.ID), "")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(accept().Code, ShouldEqual, http.StatusCreated)
+		})
+
+		Convey("Admins can list limits and set them per tier", func() {
+			response := adminRequest("PUT", "/tiers/"+strconv.Itoa(int(store.UserPermissionsAdmin)), `{"CreditLimit":0,"BalanceCap":360000}`)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			response = adminRequest("GET", "", "")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(response.Body.String(), ShouldContainSubstring, "360000")
+			So(adminRequest("DELETE", "/tiers/"+strconv.Itoa(int(store.UserPermissionsAdmin)), "").Code, ShouldEqual, http.StatusOK)
+			So(adminRequest("PUT", "/tiers/9", `{"CreditLimit":0,"BalanceCap":0}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(adminRequest("PUT", "/users/"+uintToString(user1.ID), `{"CreditLimit":-5,"BalanceCap":0}`).Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func apiRequest(token string, method string, path string, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "/api"+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+	return response
+}
+
+func patchTransaction(token string, transactionId uint, action string) *httptest.ResponseRecorder {
+	return apiRequest(token, "PATCH", "/transactions/"+uintToString(transactionId)+"/"+action, "")
+}
+
+func TestCancelAndExpireTransactions(t *testing.T) {
+	Convey("Given a pending offer and request", t, func() {
+		user1 := ensureTestUserExists("test-cancel1@example.com")
+		user1.FirstName = "Cancel"
+		user1.LastName = "Offerer"
+		_, _ = a.Store.UpdateUser(user1)
+		user2 := ensureTestUserExists("test-cancel2@example.com")
+		var transactionIds []uint
+		for _, status := range []uint{store.TransactionOffered, store.TransactionRequested} {
+			transaction := store.Transaction{
+				FromUserId:    user1.ID,
+				ToUserId:      user2.ID,
+				InitiatedDate: store.PosixDateTime(time.Now()),
+				Seconds:       30 * 60,
+				Multiplier:    1,
+				Description:   "Pending Transaction",
+				Status:        status,
+			}
+			transactionId, _ := a.Store.InsertTransaction(&transaction)
+			transactionIds = append(transactionIds, transactionId)
+		}
+		token1 := userTokenFromLoginResponse(loginToUserJSON(user1.Email))
+		token2 := userTokenFromLoginResponse(loginToUserJSON(user2.Email))
+
+		Convey("Only the initiator can cancel", func() {
+			So(patchTransaction(token2, transactionIds[0], "cancel").Code, ShouldEqual, http.StatusForbidden)
+			So(patchTransaction(token1, transactionIds[1], "cancel").Code, ShouldEqual, http.StatusForbidden)
+			So(patchTransaction(token1, transactionIds[0], "cancel").Code, ShouldEqual, http.StatusOK)
+			So(patchTransaction(token2, transactionIds[1], "cancel").Code, ShouldEqual, http.StatusOK)
+			offer, _ := a.Store.LoadTransaction(transactionIds[0])
+			So(offer.Status, ShouldEqual, store.TransactionOfferCancelled)
+			request, _ := a.Store.LoadTransaction(transactionIds[1])
+			So(request.Status, ShouldEqual, store.TransactionRequestCancelled)
+
+			Convey("A cancelled transaction can not be accepted or cancelled again", func() {
+				So(patchTransaction(token2, transactionIds[0], "accept").Code, ShouldEqual, http.StatusNotFound)
+				So(patchTransaction(token1, transactionIds[0], "cancel").Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("A rejected transaction is closed and an accepted one can no longer be rejected", func() {
+			So(patchTransaction(token1, transactionIds[1], "reject").Code, ShouldEqual, http.StatusCreated)
+			request, _ := a.Store.LoadTransaction(transactionIds[1])
+			So(request.Status, ShouldEqual, store.TransactionRequestRejected)
+			So(time.Time(request.ConfirmedDate).IsZero(), ShouldBeFalse)
+
+			So(patchTransaction(token2, transactionIds[0], "accept").Code, ShouldEqual, http.StatusCreated)
+			So(patchTransaction(token2, transactionIds[0], "reject").Code, ShouldEqual, http.StatusNotFound)
+			offer, _ := a.Store.LoadTransaction(transactionIds[0])
+			So(offer.Status, ShouldEqual, store.TransactionOfferApproved)
+		})
+
+		Convey("Stale transactions should expire and both parties be told", func() {
+			pendingExpiry := a.Config.Transactions.PendingExpiry
+			a.Config.Transactions.PendingExpiry = config.Duration{Duration: time.Nanosecond}
+			defer func() {
+				a.Config.Transactions.PendingExpiry = pendingExpiry
+			}()
+			testMailer.Reset()
+			So(a.ExpirePendingTransactions(), ShouldBeGreaterThanOrEqualTo, 2)
+			offer, _ := a.Store.LoadTransaction(transactionIds[0])
+			So(offer.Status, ShouldEqual, store.TransactionOfferExpired)
+			request, _ := a.Store.LoadTransaction(transactionIds[1])
+			So(request.Status, ShouldEqual, store.TransactionRequestExpired)
+
+			a.DeliverDueEmails()
+			messages := testMailer.MessagesTo(user2.Email)
+			So(len(messages), ShouldEqual, 2)
+			So(messages[0].Text, ShouldContainSubstring, "Cancel Offerer")
+			So(len(testMailer.MessagesTo(user1.Email)), ShouldEqual, 2)
+		})
+	})
+}
+
+func postResetPassword(resetPasswordJSON ResetPasswordJSON) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(resetPasswordJSON)
+	req, _ := http.NewRequest("POST", "/api/auth/reset_password", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+	return response
+}
+
+func TestForgotPassword(t *testing.T) {
+	Convey("Given a registered user", t, func() {
+		const emailAddress = "test-forgot@example.com"
+		a.Store.PurgeUser(emailAddress)
+		user := ensureTestUserExists(emailAddress)
+
+		Convey("Requesting a password reset for the user", func() {
+			data, _ := json.Marshal(ForgotPasswordJSON{Email: emailAddress})
+			req, _ := http.NewRequest("POST", "/api/auth/forgot_password", bytes.NewReader(data))
+			req.Header.Set("Content-Type", "application/json")
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+
+			Convey("Should respond OK and store a recovery verifier with an expiry", func() {
+				So(response.Code, ShouldEqual, http.StatusOK)
+				savedUser, _ := a.Store.FindUser(emailAddress)
+				So(savedUser.RecoverVerifier, ShouldNotEqual, "")
+				So(savedUser.RecoverTokenExpiry, ShouldNotEqual, "")
+				a.DeliverDueEmails()
+				messages := testMailer.MessagesTo(emailAddress)
+				So(len(messages), ShouldBeGreaterThan, 0)
+				So(messages[len(messages)-1].Text, ShouldContainSubstring, a.Config.BaseURL+"/reset_password?")
+			})
+
+			Convey("Requesting a reset for an unknown address should give the same response", func() {
+				data, _ := json.Marshal(ForgotPasswordJSON{Email: "test-unknown@example.com"})
+				req, _ := http.NewRequest("POST", "/api/auth/forgot_password", bytes.NewReader(data))
+				req.Header.Set("Content-Type", "application/json")
+				response2 := httptest.NewRecorder()
+				a.Router.ServeHTTP(response2, req)
+				So(response2.Code, ShouldEqual, response.Code)
+				So(response2.Body.String(), ShouldEqual, response.Body.String())
+			})
+		})
+
+		Convey("Resetting the password with a valid recovery key", func() {
+			salt, _ := base64.StdEncoding.DecodeString(user.Salt)
+			recovery := RandomBytes(20)
+			user.RecoverVerifier = verifierFor(recovery, salt)
+			user.RecoverTokenExpiry = time.Now().Add(time.Hour).Format(time.RFC3339)
+			_, _ = a.Store.UpdateUser(user)
+			resetPasswordJSON := ResetPasswordJSON{
+				Email:                emailAddress,
+				Verification:         base64.StdEncoding.EncodeToString(recovery),
+				Password:             "5678",
+				PasswordConfirmation: "5678",
+			}
+			response := postResetPassword(resetPasswordJSON)
+
+			Convey("Should change the password and clear the recovery verifier", func() {
+				So(response.Code, ShouldEqual, http.StatusOK)
+				savedUser, _ := a.Store.FindUser(emailAddress)
+				So(savedUser.Password, ShouldEqual, verifierFor([]byte("5678"), salt))
+				So(savedUser.RecoverVerifier, ShouldEqual, "")
+			})
+
+			Convey("The recovery key should only work once", func() {
+				response2 := postResetPassword(resetPasswordJSON)
+				So(response2.Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Convey("Resetting the password with an expired recovery key", func() {
+			salt, _ := base64.StdEncoding.DecodeString(user.Salt)
+			recovery := RandomBytes(20)
+			user.RecoverVerifier = verifierFor(recovery, salt)
+			user.RecoverTokenExpiry = time.Now().Add(-time.Minute).Format(time.RFC3339)
+			_, _ = a.Store.UpdateUser(user)
+			response := postResetPassword(ResetPasswordJSON{
+				Email:                emailAddress,
+				Verification:         base64.StdEncoding.EncodeToString(recovery),
+				Password:             "5678",
+				PasswordConfirmation: "5678",
+			})
+
+			Convey("Should be rejected", func() {
+				So(response.Code, ShouldEqual, http.StatusBadRequest)
+				savedUser, _ := a.Store.FindUser(emailAddress)
+				So(savedUser.Password, ShouldEqual, user.Password)
+			})
+		})
+	})
+}
+
+func loginWithPassword(emailAddress string, password string) *httptest.ResponseRecorder {
+	loginJSON := LoginJSON{Email: emailAddress, Password: password}
+	data, _ := json.Marshal(loginJSON)
+	req, _ := http.NewRequest("POST", "/api/auth/login", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+	return response
+}
+
+func TestLockoutAfterFailedLogins(t *testing.T) {
+	Convey("Given a user and no backoff between attempts", t, func() {
+		const emailAddress = "test-lockout@example.com"
+		a.Store.PurgeUser(emailAddress)
+		user := ensureTestUserExists(emailAddress)
+		savedLogin := a.Config.Login
+		a.Config.Login.BackoffBase = config.Duration{}
+		a.DeliverDueEmails()
+		testMailer.Reset()
+		Reset(func() {
+			a.Config.Login = savedLogin
+			testMailer.Reset()
+		})
+
+		Convey("Failing to log in too many times", func() {
+			for i := 0; i < a.Config.Login.MaxAttempts; i++ {
+				response := loginWithPassword(emailAddress, "wrong")
+				So(response.Code, ShouldEqual, http.StatusUnauthorized)
+			}
+
+			Convey("Should lock the account even for the right password", func() {
+				response := loginToUserJSON(emailAddress)
+				So(response.Code, ShouldEqual, http.StatusUnauthorized)
+			})
+
+			Convey("Should fail the same way as for an unknown email so the account is not revealed", func() {
+				locked := loginWithPassword(emailAddress, "wrong")
+				unknown := loginWithPassword("test-lockout-nobody@example.com", "wrong")
+				So(locked.Code, ShouldEqual, unknown.Code)
+				So(locked.Body.String(), ShouldEqual, unknown.Body.String())
+			})
+
+			Convey("Should tell the owner their account was locked", func() {
+				a.DeliverDueEmails()
+				messages := testMailer.MessagesTo(emailAddress)
+				So(len(messages), ShouldEqual, 1)
+				So(messages[0].Subject, ShouldEqual, "Think Globally account locked")
+			})
+
+			Convey("An admin should see the lockout and can unlock the account", func() {
+				admin := ensureTestUserExists("test-admin@example.com")
+				admin.Permissions = store.UserPermissionsEditor
+				_, _ = a.Store.UpdateUser(admin)
+				token := userTokenFromLoginResponse(loginToUserJSON(admin.Email))
+
+				req, _ := http.NewRequest("GET", "/api/admin/lockouts", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				response := httptest.NewRecorder()
+				a.Router.ServeHTTP(response, req)
+				So(response.Code, ShouldEqual, http.StatusOK)
+				var lockouts []UserLockoutJSON
+				_ = json.Unmarshal(response.Body.Bytes(), &lockouts)
+				found := false
+				for _, lockout := range lockouts {
+					if lockout.UserId == user.ID && lockout.Locked {
+						found = true
+					}
+				}
+				So(found, ShouldBeTrue)
+
+				req2, _ := http.NewRequest("PATCH", "/api/admin/users/"+uintToString(user.ID)+"/unlock", nil)
+				req2.Header.Set("Authorization", "Bearer "+token)
+				response2 := httptest.NewRecorder()
+				a.Router.ServeHTTP(response2, req2)
+				So(response2.Code, ShouldEqual, http.StatusOK)
+
+				response3 := loginToUserJSON(emailAddress)
+				So(response3.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
+
+func TestIPRateLimiter(t *testing.T) {
+	Convey("Given a limiter of 2 requests a minute", t, func() {
+		limiter := newIPRateLimiter(RateLimit{Requests: 2, Per: time.Minute})
+		now := time.Now()
+
+		Convey("The third request from one address should be refused", func() {
+			allowed, _ := limiter.allow("192.0.2.1", now)
+			So(allowed, ShouldBeTrue)
+			allowed, _ = limiter.allow("192.0.2.1", now)
+			So(allowed, ShouldBeTrue)
+			allowed, retryAfter := limiter.allow("192.0.2.1", now)
+			So(allowed, ShouldBeFalse)
+			So(retryAfter, ShouldBeGreaterThan, 0)
+
+			Convey("Other addresses are limited separately", func() {
+				allowed, _ := limiter.allow("192.0.2.2", now)
+				So(allowed, ShouldBeTrue)
+			})
+
+			Convey("The address is allowed again once the bucket refills", func() {
+				allowed, _ := limiter.allow("192.0.2.1", now.Add(30*time.Second))
+				So(allowed, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestOutboxRetriesAndResend(t *testing.T) {
+	Convey("Given the mail server is failing and emails are only tried once", t, func() {
+		const emailAddress = "test-outbox@example.com"
+		a.DeliverDueEmails()
+		testMailer.Reset()
+		testMailer.Err = errors.New("connection refused")
+		savedOutbox := a.Config.Outbox
+		a.Config.Outbox.MaxAttempts = 1
+		Reset(func() {
+			a.Config.Outbox = savedOutbox
+			testMailer.Reset()
+		})
+
+		err := QueueEmail(mailer.Message{To: emailAddress, Subject: "Outbox test", Text: "text", HTML: "<p>html</p>"})
+		So(err, ShouldBeNil)
+		a.DeliverDueEmails()
+
+		Convey("The email should be dead lettered and listed for admins", func() {
+			admin := ensureTestUserExists("test-admin@example.com")
+			admin.Permissions = store.UserPermissionsEditor
+			_, _ = a.Store.UpdateUser(admin)
+			token := userTokenFromLoginResponse(loginToUserJSON(admin.Email))
+
+			req, _ := http.NewRequest("GET", "/api/admin/emails?status=dead", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			response := httptest.NewRecorder()
+			a.Router.ServeHTTP(response, req)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			var emails []store.OutboundEmail
+			_ = json.Unmarshal(response.Body.Bytes(), &emails)
+			var deadEmail *store.OutboundEmail
+			for i := range emails {
+				if emails[i].Recipient == emailAddress {
+					deadEmail = &emails[i]
+					break
+				}
+			}
+			So(deadEmail, ShouldNotBeNil)
+			So(deadEmail.LastError, ShouldEqual, "connection refused")
+			So(deadEmail.Text, ShouldBeEmpty)
+			So(deadEmail.HTML, ShouldBeEmpty)
+
+			Convey("Resending once the mail server recovers should deliver it", func() {
+				testMailer.Err = nil
+				req, _ := http.NewRequest("PATCH", "/api/admin/emails/"+uintToString(deadEmail.ID)+"/resend", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				response := httptest.NewRecorder()
+				a.Router.ServeHTTP(response, req)
+				So(response.Code, ShouldEqual, http.StatusOK)
+
+				a.DeliverDueEmails()
+				So(len(testMailer.MessagesTo(emailAddress)), ShouldEqual, 1)
+				So(testMailer.MessagesTo(emailAddress)[0].Text, ShouldEqual, "text")
+				resentEmail, _ := a.Store.LoadOutboundEmail(deadEmail.ID)
+				So(resentEmail.Status, ShouldEqual, store.OutboundEmailSent)
+				So(resentEmail.Text, ShouldBeEmpty)
+				So(resentEmail.HTML, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func getTransactionsPage(token string, query string) (*httptest.ResponseRecorder, []store.Transaction) {
+	req, _ := http.NewRequest("GET", "/api/transactions?"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+	var transactions []store.Transaction
+	_ = json.Unmarshal(response.Body.Bytes(), &transactions)
+	return response, transactions
+}
+
+func TestListTransactionsPaged(t *testing.T) {
+	Convey("Given a user with three transactions", t, func() {
+		user1 := ensureTestUserExists("test-paged1@example.com")
+		user2 := ensureTestUserExists("test-paged2@example.com")
+		userTransactions, _ := a.Store.ListTransactionsForUser(user1.ID)
+		for _, transaction := range userTransactions {
+			a.Store.PurgeTransaction(transaction)
+		}
+		for i := 0; i < 3; i++ {
+			transaction := store.Transaction{
+				FromUserId:    user1.ID,
+				ToUserId:      user2.ID,
+				InitiatedDate: store.PosixDateTime(time.Now().Add(time.Duration(i) * time.Second)),
+				Seconds:       uint64(60 * (i + 1)),
+				Multiplier:    1,
+				Description:   "Paged Transaction",
+				Status:        store.TransactionOffered,
+			}
+			_, _ = a.Store.InsertTransaction(&transaction)
+		}
+		token := userTokenFromLoginResponse(loginToUserJSON(user1.Email))
+
+		Convey("Asking for two should return two, the total and a cursor for the rest", func() {
+			response, transactions := getTransactionsPage(token, "limit=2&direction=out&status=pending")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(len(transactions), ShouldEqual, 2)
+			So(response.Header().Get("X-Total-Count"), ShouldEqual, "3")
+			cursor := response.Header().Get("X-Next-Cursor")
+			So(cursor, ShouldNotEqual, "")
+
+			Convey("Following the cursor should return the last one", func() {
+				response, transactions := getTransactionsPage(token, "limit=2&direction=out&status=pending&cursor="+url.QueryEscape(cursor))
+				So(response.Code, ShouldEqual, http.StatusOK)
+				So(len(transactions), ShouldEqual, 1)
+				So(transactions[0].Seconds, ShouldEqual, 180)
+				So(response.Header().Get("X-Next-Cursor"), ShouldEqual, "")
+			})
+		})
+
+		Convey("Filtering by amount should narrow the results", func() {
+			_, transactions := getTransactionsPage(token, "min_seconds=100&max_seconds=150")
+			So(len(transactions), ShouldEqual, 1)
+			So(transactions[0].Seconds, ShouldEqual, 120)
+		})
+
+		Convey("Invalid filters should be rejected", func() {
+			response, _ := getTransactionsPage(token, "direction=sideways")
+			So(response.Code, ShouldEqual, http.StatusBadRequest)
+			response, _ = getTransactionsPage(token, "status=lost")
+			So(response.Code, ShouldEqual, http.StatusBadRequest)
+			response, _ = getTransactionsPage(token, "cursor=nonsense")
+			So(response.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func getTransactionsExport(token string, query string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/api/transactions/export?"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	a.Router.ServeHTTP(response, req)
+	return response
+}
+
+func TestExportTransactions(t *testing.T) {
+	Convey("Given a member with two posted transactions", t, func() {
+		user1 := ensureTestUserExists("test-export1@example.com")
+		user2 := ensureTestUserExists("test-export2@example.com")
+		user2.FirstName = "Export"
+		user2.LastName = "Partner"
+		_, _ = a.Store.UpdateUser(user2)
+		for _, user := range []*store.User{user1, user2} {
+			userTransactions, _ := a.Store.ListTransactionsForUser(user.ID)
+			for _, transaction := range userTransactions {
+				a.Store.PurgeTransaction(transaction)
+			}
+		}
+		for i, seconds := range []uint64{3600, 600} {
+			transaction := store.Transaction{
+				FromUserId:    user1.ID,
+				ToUserId:      user2.ID,
+				InitiatedDate: store.PosixDateTime(time.Now().Add(time.Duration(i) * time.Second)),
+				Seconds:       seconds,
+				Multiplier:    1,
+				Description:   "Export, \"quoted\" & <escaped>",
+				Status:        store.TransactionOffered,
+			}
+			transactionId, _ := a.Store.InsertTransaction(&transaction)
+			_, _ = a.Store.PostTransaction(transactionId)
+		}
+		token := userTokenFromLoginResponse(loginToUserJSON(user1.Email))
+
+		Convey("The CSV statement should have opening, posting and closing rows", func() {
+			response := getTransactionsExport(token, "format=csv")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(response.Header().Get("Content-Disposition"), ShouldContainSubstring, ".csv")
+			rows, err := csv.NewReader(response.Body).ReadAll()
+			So(err, ShouldBeNil)
+			So(len(rows), ShouldEqual, 5)
+			So(rows[1][3], ShouldEqual, "Opening balance")
+			So(rows[1][8], ShouldEqual, "0")
+			So(rows[2][2], ShouldEqual, "Export Partner")
+			So(rows[2][3], ShouldEqual, "Export, \"quoted\" & <escaped>")
+			So(rows[2][7], ShouldEqual, "-3600")
+			So(rows[3][8], ShouldEqual, "-4200")
+			So(rows[4][3], ShouldEqual, "Closing balance")
+			So(rows[4][8], ShouldEqual, "-4200")
+		})
+
+		Convey("Text that a spreadsheet would run as a formula is quoted in the CSV statement", func() {
+			statement := Statement{Lines: []StatementLine{
+				{Counterparty: "=HYPERLINK(\"http://example.com\")", Description: "+1+1", Amount: -60},
+				{Counterparty: "@SUM(A1)", Description: "-2", Amount: 60},
+				{Counterparty: "\tTab", Description: "\rReturn", Amount: 0},
+			}}
+			body, err := statementCSV(statement)
+			So(err, ShouldBeNil)
+			rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+			So(err, ShouldBeNil)
+			So(rows[2][2], ShouldEqual, "'=HYPERLINK(\"http://example.com\")")
+			So(rows[2][3], ShouldEqual, "'+1+1")
+			So(rows[2][7], ShouldEqual, "-60")
+			So(rows[3][2], ShouldEqual, "'@SUM(A1)")
+			So(rows[3][3], ShouldEqual, "'-2")
+			So(rows[4][2], ShouldEqual, "'\tTab")
+			So(rows[4][3], ShouldEqual, "'\rReturn")
+		})
+
+		Convey("A statement starting after the postings should carry the balance forward", func() {
+			from := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+			to := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+			response := getTransactionsExport(token, "format=csv&from="+from+"&to="+to)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			rows, _ := csv.NewReader(response.Body).ReadAll()
+			So(len(rows), ShouldEqual, 3)
+			So(rows[1][8], ShouldEqual, "-4200")
+			So(rows[2][8], ShouldEqual, "-4200")
+		})
+
+		Convey("The OFX statement should list each posting with escaped text", func() {
+			response := getTransactionsExport(token, "format=ofx")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			body := response.Body.String()
+			So(strings.Count(body, "<STMTTRN>"), ShouldEqual, 2)
+			So(body, ShouldContainSubstring, "<TRNAMT>-600</TRNAMT>")
+			So(body, ShouldContainSubstring, "&amp; &lt;escaped&gt;")
+			So(body, ShouldContainSubstring, "<BALAMT>-4200</BALAMT>")
+		})
+
+		Convey("The HTML statement should be printable", func() {
+			response := getTransactionsExport(token, "format=html")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			body := response.Body.String()
+			So(body, ShouldContainSubstring, "@page")
+			So(body, ShouldContainSubstring, "Export Partner")
+			So(body, ShouldContainSubstring, "Closing balance")
+		})
+
+		Convey("Unknown formats and dates should be rejected", func() {
+			So(getTransactionsExport(token, "format=xls").Code, ShouldEqual, http.StatusBadRequest)
+			So(getTransactionsExport(token, "from=yesterday").Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func postTransactionBody(token string, body string) *httptest.ResponseRecorder {
+	return apiRequest(token, "POST", "/transactions", body)
+}
+
+func TestCreateTransactionServerControlledFields(t *testing.T) {
+	Convey("Given a member offering time to another", t, func() {
+		user1 := ensureTestUserExists("test-strict1@example.com")
+		user2 := ensureTestUserExists("test-strict2@example.com")
+		token := userTokenFromLoginResponse(loginToUserJSON(user1.Email))
+		offer := func(extra string) string {
+			return fmt.Sprintf(`{"FromUserId":%d,"ToUserId":%d,"Seconds":3600,"Multiplier":1,"TxFee":1,"Status":%d%s}`,
+				user1.ID, user2.ID, store.TransactionOffered, extra)
+		}
+		created := func(response *httptest.ResponseRecorder) *store.Transaction {
+			body := map[string]interface{}{}
+			_ = json.Unmarshal(response.Body.Bytes(), &body)
+			transaction, err := a.Store.LoadTransaction(uint(body["resourceId"].(float64)))
+			So(err, ShouldBeNil)
+			return transaction
+		}
+
+		Convey("The server stamps the initiated date", func() {
+			response := postTransactionBody(token, offer(""))
+			So(response.Code, ShouldEqual, http.StatusCreated)
+			transaction := created(response)
+			So(time.Since(time.Time(transaction.InitiatedDate)), ShouldBeLessThan, time.Minute)
+			So(transaction.PerformedDate, ShouldBeNil)
+			So(transaction.Status, ShouldEqual, store.TransactionOffered)
+			a.Store.PurgeTransaction(*transaction)
+		})
+
+		Convey("Ledger fields can not be sent", func() {
+			for _, field := range []string{`,"InitiatedDate":1000`, `,"ConfirmedDate":1000`, `,"ID":5`, `,"FromPreviousTId":1`, `,"FromUserBalance":100`} {
+				response := postTransactionBody(token, offer(field))
+				So(response.Code, ShouldEqual, http.StatusBadRequest)
+			}
+		})
+
+		Convey("Only an offer or a request can be created", func() {
+			for _, status := range []uint{store.TransactionOfferApproved, store.TransactionRequestApproved, store.TransactionOfferRejected, store.TransactionOfferExpired} {
+				body := fmt.Sprintf(`{"FromUserId":%d,"ToUserId":%d,"Seconds":3600,"Multiplier":1,"TxFee":1,"Status":%d}`, user1.ID, user2.ID, status)
+				response := postTransactionBody(token, body)
+				So(response.Code, ShouldEqual, http.StatusBadRequest)
+			}
+		})
+
+		Convey("The date work was performed on is recorded separately", func() {
+			performed := time.Now().Add(-72 * time.Hour).Truncate(time.Second)
+			response := postTransactionBody(token, offer(fmt.Sprintf(`,"PerformedDate":%d`, performed.Unix())))
+			So(response.Code, ShouldEqual, http.StatusCreated)
+			transaction := created(response)
+			So(transaction.PerformedDate, ShouldNotBeNil)
+			So(time.Time(*transaction.PerformedDate).Equal(performed), ShouldBeTrue)
+			So(time.Since(time.Time(transaction.InitiatedDate)), ShouldBeLessThan, time.Minute)
+			a.Store.PurgeTransaction(*transaction)
+		})
+
+		Convey("The date work was performed on must be recent and not in the future", func() {
+			tooOld := time.Now().Add(-a.Config.Transactions.PerformedMaxAge.Duration - time.Hour)
+			response := postTransactionBody(token, offer(fmt.Sprintf(`,"PerformedDate":%d`, tooOld.Unix())))
+			So(response.Code, ShouldEqual, http.StatusBadRequest)
+			future := time.Now().Add(time.Hour)
+			response = postTransactionBody(token, offer(fmt.Sprintf(`,"PerformedDate":%d`, future.Unix())))
+			So(response.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestRecurringTransactions(t *testing.T) {
+	Convey("Given a member offering gardening every week", t, func() {
+		user1 := ensureTestUserExists("test-recurring1@example.com")
+		user2 := ensureTestUserExists("test-recurring2@example.com")
+		token1 := userTokenFromLoginResponse(loginToUserJSON(user1.Email))
+		token2 := userTokenFromLoginResponse(loginToUserJSON(user2.Email))
+		start := time.Now().Add(time.Hour)
+		body := fmt.Sprintf(`{"FromUserId":%d,"ToUserId":%d,"Seconds":7200,"Multiplier":1,"TxFee":2,"Status":%d,"Description":"Gardening","Schedule":"FREQ=WEEKLY;BYDAY=SA","StartDate":%d}`,
+			user1.ID, user2.ID, store.TransactionOffered, start.Unix())
+		response := apiRequest(token1, "POST", "/recurring_transactions", body)
+		So(response.Code, ShouldEqual, http.StatusCreated)
+		created := map[string]interface{}{}
+		_ = json.Unmarshal(response.Body.Bytes(), &created)
+		recurringId := uint(created["resourceId"].(float64))
+		path := "/recurring_transactions/" + uintToString(recurringId)
+
+		Convey("Both parties should see it with its next occurrence", func() {
+			for _, token := range []string{token1, token2} {
+				response := apiRequest(token, "GET", "/recurring_transactions", "")
+				So(response.Code, ShouldEqual, http.StatusOK)
+				var recurring []store.RecurringTransaction
+				_ = json.Unmarshal(response.Body.Bytes(), &recurring)
+				found := false
+				for _, r := range recurring {
+					if r.ID == recurringId {
+						found = true
+						So(r.Schedule, ShouldEqual, "FREQ=WEEKLY;BYDAY=SA")
+						So(r.NextRunAt, ShouldNotBeNil)
+						So(time.Time(*r.NextRunAt).Weekday(), ShouldEqual, time.Saturday)
+					}
+				}
+				So(found, ShouldBeTrue)
+			}
+		})
+
+		Convey("The scheduler should create a pending offer when it is due", func() {
+			recurring, _ := a.Store.LoadRecurringTransaction(recurringId)
+			due := store.PosixDateTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+			recurring.NextRunAt = &due
+			_, _ = a.Store.UpdateRecurringTransaction(recurring)
+			So(a.RunRecurringTransactions(), ShouldBeGreaterThanOrEqualTo, 1)
+			So(a.RunRecurringTransactions(), ShouldEqual, 0)
+
+			transactions, _ := a.Store.ListTransactionsForUser(user1.ID)
+			var offers []store.Transaction
+			for _, transaction := range transactions {
+				if transaction.RecurringTransactionId == recurringId {
+					offers = append(offers, transaction)
+				}
+			}
+			So(len(offers), ShouldEqual, 1)
+			So(offers[0].Status, ShouldEqual, store.TransactionOffered)
+			So(offers[0].Seconds, ShouldEqual, 7200)
+			So(time.Time(*offers[0].PerformedDate).Equal(time.Time(due)), ShouldBeTrue)
+			a.Store.PurgeTransaction(offers[0])
+		})
+
+		Convey("A paused template should not run and only its creator can resume it", func() {
+			So(apiRequest(token2, "PATCH", path+"/pause", "").Code, ShouldEqual, http.StatusOK)
+			recurring, _ := a.Store.LoadRecurringTransaction(recurringId)
+			So(recurring.Paused, ShouldBeTrue)
+			due := store.PosixDateTime(time.Now().Add(-time.Hour))
+			recurring.NextRunAt = &due
+			_, _ = a.Store.UpdateRecurringTransaction(recurring)
+			So(a.RunRecurringTransactions(), ShouldEqual, 0)
+
+			So(apiRequest(token2, "PATCH", path+"/resume", "").Code, ShouldEqual, http.StatusForbidden)
+			So(apiRequest(token1, "PATCH", path+"/resume", "").Code, ShouldEqual, http.StatusOK)
+			recurring, _ = a.Store.LoadRecurringTransaction(recurringId)
+			So(recurring.Paused, ShouldBeFalse)
+			So(time.Time(*recurring.NextRunAt).After(time.Now()), ShouldBeTrue)
+		})
+
+		Convey("Invalid schedules and offers from someone else are rejected", func() {
+			invalid := strings.Replace(body, "FREQ=WEEKLY;BYDAY=SA", "FREQ=HOURLY", 1)
+			So(apiRequest(token1, "POST", "/recurring_transactions", invalid).Code, ShouldEqual, http.StatusBadRequest)
+			So(apiRequest(token2, "POST", "/recurring_transactions", body).Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Reset(func() {
+			So(apiRequest(token1, "DELETE", path, "").Code, ShouldEqual, http.StatusOK)
+			So(apiRequest(token1, "DELETE", path, "").Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
+
+func TestTransactionGroups(t *testing.T) {
+	Convey("Given a member offering time to two volunteers who helped them move", t, func() {
+		payer := ensureTestUserExists("test-group-payer@example.com")
+		helper1 := ensureTestUserExists("test-group-helper1@example.com")
+		helper2 := ensureTestUserExists("test-group-helper2@example.com")
+		payerToken := userTokenFromLoginResponse(loginToUserJSON(payer.Email))
+		helper1Token := userTokenFromLoginResponse(loginToUserJSON(helper1.Email))
+		helper2Token := userTokenFromLoginResponse(loginToUserJSON(helper2.Email))
+		body := fmt.Sprintf(`{"Status":%d,"Description":"Moving house","Legs":[{"UserId":%d,"Seconds":10800,"Multiplier":1,"TxFee":3},{"UserId":%d,"Seconds":7200,"Multiplier":1,"TxFee":2}]}`,
+			store.TransactionOffered, helper1.ID, helper2.ID)
+		response := apiRequest(payerToken, "POST", "/transaction_groups", body)
+		So(response.Code, ShouldEqual, http.StatusCreated)
+		created := map[string]interface{}{}
+		_ = json.Unmarshal(response.Body.Bytes(), &created)
+		groupId := uint(created["resourceId"].(float64))
+		path := "/transaction_groups/" + uintToString(groupId)
+		group, err := a.Store.LoadTransactionGroup(groupId)
+		So(err, ShouldBeNil)
+		So(len(group.Legs), ShouldEqual, 2)
+		lastEventFor := func(userId uint) store.Event {
+			events, _ := a.Store.ListEventsSince(userId, 0, 10000)
+			So(len(events), ShouldBeGreaterThan, 0)
+			return events[len(events)-1]
+		}
+		So(lastEventFor(helper1.ID).Type, ShouldEqual, EventTransactionPending)
+		So(lastEventFor(helper2.ID).Data, ShouldContainSubstring, fmt.Sprintf(`"ID":%d,`, group.Legs[1].ID))
+		groupStatusFor := func(token string, transactionId uint) uint {
+			_, transactions := getTransactionsPage(token, "")
+			for _, transaction := range transactions {
+				if transaction.ID == transactionId {
+					return transaction.GroupStatus
+				}
+			}
+			return 0
+		}
+
+		Convey("Accepting one leg only records the approval", func() {
+			So(patchTransaction(helper1Token, group.Legs[0].ID, "accept").Code, ShouldEqual, http.StatusOK)
+			leg, _ := a.Store.LoadTransaction(group.Legs[0].ID)
+			So(leg.Status, ShouldEqual, store.TransactionOffered)
+			So(groupStatusFor(payerToken, leg.ID), ShouldEqual, store.TransactionGroupPending)
+
+			Convey("And the last approval posts every leg", func() {
+				response := apiRequest(helper2Token, "PATCH", path+"/approve", "")
+				So(response.Code, ShouldEqual, http.StatusOK)
+				So(response.Body.String(), ShouldContainSubstring, `"groupStatus":"posted"`)
+				for _, leg := range group.Legs {
+					posted, _ := a.Store.LoadTransaction(leg.ID)
+					So(posted.Status, ShouldEqual, store.TransactionOfferApproved)
+				}
+				So(groupStatusFor(helper2Token, group.Legs[1].ID), ShouldEqual, store.TransactionGroupPosted)
+				So(lastEventFor(helper2.ID).Type, ShouldEqual, EventBalanceChanged)
+			})
+		})
+
+		Convey("Rejecting one leg rejects the whole group", func() {
+			So(apiRequest(payerToken, "PATCH", path+"/reject", "").Code, ShouldEqual, http.StatusForbidden)
+			So(patchTransaction(helper2Token, group.Legs[1].ID, "reject").Code, ShouldEqual, http.StatusOK)
+			for _, leg := range group.Legs {
+				rejected, _ := a.Store.LoadTransaction(leg.ID)
+				So(rejected.Status, ShouldEqual, store.TransactionOfferRejected)
+			}
+			So(lastEventFor(payer.ID).Type, ShouldEqual, EventTransactionRejected)
+			So(apiRequest(helper1Token, "PATCH", path+"/approve", "").Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Only the initiator can cancel the group", func() {
+			So(apiRequest(helper1Token, "PATCH", path+"/cancel", "").Code, ShouldEqual, http.StatusForbidden)
+			So(patchTransaction(payerToken, group.Legs[0].ID, "cancel").Code, ShouldEqual, http.StatusOK)
+			response := apiRequest(helper1Token, "GET", path, "")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			loaded := store.TransactionGroup{}
+			_ = json.Unmarshal(response.Body.Bytes(), &loaded)
+			So(loaded.Status, ShouldEqual, store.TransactionGroupCancelled)
+			So(loaded.Legs[1].Status, ShouldEqual, store.TransactionOfferCancelled)
+		})
+
+		Convey("Groups need at least two different counterparties", func() {
+			single := fmt.Sprintf(`{"Status":%d,"Legs":[{"UserId":%d,"Seconds":3600,"Multiplier":1,"TxFee":1}]}`, store.TransactionOffered, helper1.ID)
+			So(apiRequest(payerToken, "POST", "/transaction_groups", single).Code, ShouldEqual, http.StatusBadRequest)
+			duplicate := fmt.Sprintf(`{"Status":%d,"Legs":[{"UserId":%d,"Seconds":3600,"Multiplier":1,"TxFee":1},{"UserId":%d,"Seconds":3600,"Multiplier":1,"TxFee":1}]}`,
+				store.TransactionOffered, helper1.ID, helper1.ID)
+			So(apiRequest(payerToken, "POST", "/transaction_groups", duplicate).Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Nobody is invited to a group that fails validation", func() {
+			const newcomer = "test-group-newcomer@example.com"
+			a.Store.PurgeUser(newcomer)
+			testMailer.Reset()
+			invalid := fmt.Sprintf(`{"Status":%d,"Legs":[{"Email":"%s","Seconds":3600,"Multiplier":1,"TxFee":1},{"UserId":%d,"Seconds":3600,"Multiplier":5,"TxFee":1}]}`,
+				store.TransactionOffered, newcomer, helper1.ID)
+			So(apiRequest(payerToken, "POST", "/transaction_groups", invalid).Code, ShouldEqual, http.StatusBadRequest)
+			duplicate := fmt.Sprintf(`{"Status":%d,"Legs":[{"Email":"%s","Seconds":3600,"Multiplier":1,"TxFee":1},{"Email":"%s","Seconds":3600,"Multiplier":1,"TxFee":1}]}`,
+				store.TransactionOffered, newcomer, newcomer)
+			So(apiRequest(payerToken, "POST", "/transaction_groups", duplicate).Code, ShouldEqual, http.StatusBadRequest)
+			_, err := a.Store.FindUser(newcomer)
+			So(err, ShouldNotBeNil)
+			a.DeliverDueEmails()
+			So(len(testMailer.MessagesTo(newcomer)), ShouldEqual, 0)
+		})
+
+		Reset(func() {
+			group, _ := a.Store.LoadTransactionGroup(groupId)
+			for _, leg := range group.Legs {
+				a.Store.PurgeTransaction(leg)
+			}
+		})
+	})
+}
+
+func TestDisputes(t *testing.T) {
+	Convey("Given a posted transaction and an editor", t, func() {
+		editor := ensureTestUserExists("test-dispute-editor@example.com")
+		editor.Permissions = store.UserPermissionsEditor
+		_, _ = a.Store.UpdateUser(editor)
+		payer := ensureTestUserExists("test-dispute-payer@example.com")
+		payee := ensureTestUserExists("test-dispute-payee@example.com")
+		outsider := ensureTestUserExists("test-dispute-outsider@example.com")
+		transaction := store.Transaction{
+			FromUserId:    payer.ID,
+			ToUserId:      payee.ID,
+			InitiatedDate: store.PosixDateTime(time.Now()),
+			Seconds:       1 * 60 * 60,
+			TxFee:         1,
+			Multiplier:    1,
+			Description:   "Test Transaction",
+			Status:        store.TransactionOffered,
+		}
+		transactionId, _ := a.Store.InsertTransaction(&transaction)
+		_, _ = a.Store.PostTransaction(transactionId)
+		editorToken := userTokenFromLoginResponse(loginToUserJSON(editor.Email))
+		payerToken := userTokenFromLoginResponse(loginToUserJSON(payer.Email))
+		payeeToken := userTokenFromLoginResponse(loginToUserJSON(payee.Email))
+		outsiderToken := userTokenFromLoginResponse(loginToUserJSON(outsider.Email))
+		disputesPath := "/transactions/" + uintToString(transactionId) + "/disputes"
+
+		Convey("Only a party can raise a dispute and it needs a reason", func() {
+			So(apiRequest(outsiderToken, "POST", disputesPath, `{"Reason":"Not mine"}`).Code, ShouldEqual, http.StatusNotFound)
+			So(apiRequest(payerToken, "POST", disputesPath, `{"Reason":" "}`).Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("A raised dispute is reviewed and upheld by the editor", func() {
+			response := apiRequest(payerToken, "POST", disputesPath, `{"Reason":"The work was never done"}`)
+			So(response.Code, ShouldEqual, http.StatusCreated)
+			created := map[string]interface{}{}
+			_ = json.Unmarshal(response.Body.Bytes(), &created)
+			disputePath := "/admin/disputes/" + uintToString(uint(created["resourceId"].(float64)))
+			So(apiRequest(payeeToken, "POST", disputesPath, `{"Reason":"Again"}`).Code, ShouldEqual, http.StatusConflict)
+
+			var disputes []store.Dispute
+			_ = json.Unmarshal(apiRequest(payeeToken, "GET", "/disputes", "").Body.Bytes(), &disputes)
+			So(len(disputes), ShouldEqual, 1)
+			So(apiRequest(payerToken, "GET", "/admin/disputes", "").Code, ShouldEqual, http.StatusForbidden)
+			So(apiRequest(editorToken, "GET", "/admin/disputes?status=open", "").Body.String(), ShouldContainSubstring, "The work was never done")
+
+			So(apiRequest(editorToken, "PATCH", disputePath+"/review", `{"Note":"Checking"}`).Code, ShouldEqual, http.StatusOK)
+			So(apiRequest(editorToken, "PATCH", disputePath+"/resolve", `{"Outcome":"refund","Resolution":"x"}`).Code, ShouldEqual, http.StatusBadRequest)
+			response = apiRequest(editorToken, "PATCH", disputePath+"/resolve", `{"Outcome":"reverse","Resolution":"Upheld"}`)
+			So(response.Code, ShouldEqual, http.StatusOK)
+			resolved := map[string]interface{}{}
+			_ = json.Unmarshal(response.Body.Bytes(), &resolved)
+			reversal, err := a.Store.LoadTransaction(uint(resolved["reversalId"].(float64)))
+			So(err, ShouldBeNil)
+			So(reversal.Status, ShouldEqual, store.TransactionReversal)
+			So(reversal.ToUserId, ShouldEqual, payer.ID)
+			So(apiRequest(editorToken, "PATCH", disputePath+"/resolve", `{"Outcome":"dismiss","Resolution":"x"}`).Code, ShouldEqual, http.StatusConflict)
+
+			var entries []store.AuditEntry
+			_ = json.Unmarshal(apiRequest(editorToken, "GET", "/admin/audit?transaction="+uintToString(transactionId), "").Body.Bytes(), &entries)
+			So(len(entries), ShouldEqual, 3)
+			_, transactions := getTransactionsPage(payerToken, "status=reversal")
+			So(len(transactions), ShouldEqual, 1)
+			a.Store.PurgeTransaction(*reversal)
+		})
+
+		Convey("An editor can not review a dispute on their own transaction", func() {
+			own := store.Transaction{
+				FromUserId:    editor.ID,
+				ToUserId:      payee.ID,
+				InitiatedDate: store.PosixDateTime(time.Now()),
+				Seconds:       60 * 60,
+				Multiplier:    1,
+				Status:        store.TransactionOffered,
+			}
+			ownId, _ := a.Store.InsertTransaction(&own)
+			_, _ = a.Store.PostTransaction(ownId)
+			dispute := store.Dispute{TransactionId: ownId, RaisedById: payee.ID, Reason: "Overcharged"}
+			disputeId, _ := a.Store.RaiseDispute(&dispute)
+			response := apiRequest(editorToken, "PATCH", "/admin/disputes/"+uintToString(disputeId)+"/resolve", `{"Outcome":"dismiss","Resolution":"Fine"}`)
+			So(response.Code, ShouldEqual, http.StatusForbidden)
+			a.Store.PurgeTransaction(own)
+		})
+
+		Reset(func() {
+			a.Store.PurgeTransaction(transaction)
+		})
+	})
+}
+
+func TestValueReports(t *testing.T) {
+	Convey("Given a skilled rate transaction posted while scaling by the multiplier", t, func() {
+		admin := ensureTestUserExists("test-admin@example.com")
+		admin.Permissions = store.UserPermissionsEditor
+		_, _ = a.Store.UpdateUser(admin)
+		payer := ensureTestUserExists("test-value-payer@example.com")
+		worker := ensureTestUserExists("test-value-worker@example.com")
+		transaction := store.Transaction{
+			FromUserId:    payer.ID,
+			ToUserId:      worker.ID,
+			InitiatedDate: store.PosixDateTime(time.Now()),
+			Seconds:       1 * 60 * 60,
+			TxFee:         1,
+			Multiplier:    1.5,
+			Description:   "Electrics",
+			Status:        store.TransactionOffered,
+		}
+		transactionId, _ := a.Store.InsertTransaction(&transaction)
+		a.Store.SetScaleByMultiplier(true)
+		_, _ = a.Store.PostTransaction(transactionId)
+		a.Store.SetScaleByMultiplier(false)
+		from := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+
+		Convey("The worker sees their own hours and value", func() {
+			token := userTokenFromLoginResponse(loginToUserJSON(worker.Email))
+			response := apiRequest(token, "GET", "/reports/value?period=week&from="+from, "")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			report := store.ValueReport{}
+			_ = json.Unmarshal(response.Body.Bytes(), &report)
+			So(len(report.Lines), ShouldEqual, 1)
+			So(report.Lines[0].Seconds, ShouldEqual, 60*60)
+			So(report.Lines[0].MultipliedSeconds, ShouldEqual, 90*60)
+			So(report.Lines[0].CreditedSeconds, ShouldEqual, 90*60)
+			So(report.Lines[0].Period.Weekday(), ShouldEqual, time.Monday)
+
+			So(apiRequest(token, "GET", "/reports/value?period=day", "").Code, ShouldEqual, http.StatusBadRequest)
+			So(apiRequest(token, "GET", "/admin/reports/value", "").Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("An editor sees every member's hours and value", func() {
+			token := userTokenFromLoginResponse(loginToUserJSON(admin.Email))
+			response := apiRequest(token, "GET", "/admin/reports/value?from="+from+"&user="+uintToString(worker.ID), "")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(response.Body.String(), ShouldContainSubstring, `"MultipliedSeconds":5400`)
+		})
+
+		Reset(func() {
+			a.Store.PurgeTransaction(transaction)
+		})
+	})
+}
+
+func TestListings(t *testing.T) {
+	Convey("Given a member offering guitar lessons in a category tagged to a concept", t, func() {
+		teacher := ensureTestUserExists("test-listing-teacher@example.com")
+		learner := ensureTestUserExists("test-listing-learner@example.com")
+		teacherToken := userTokenFromLoginResponse(loginToUserJSON(teacher.Email))
+		learnerToken := userTokenFromLoginResponse(loginToUserJSON(learner.Email))
+		concept := ensureTestConceptExists("testMusicConcept")
+		a.Store.PurgeConceptTag("music")
+		_, _ = a.Store.InsertConceptTag(&store.ConceptTag{Tag: "music", ConceptId: concept.ID})
+		expiresAt := time.Now().Add(24 * time.Hour).Unix()
+		body := fmt.Sprintf(`{"Kind":%d,"Category":"Music","Title":"Guitar lessons","Description":"Beginners welcome","EstimatedSeconds":3600,"Multiplier":1.5,"Location":"Bristol","ExpiresAt":%d}`,
+			store.ListingOffer, expiresAt)
+		response := apiRequest(teacherToken, "POST", "/listings", body)
+		So(response.Code, ShouldEqual, http.StatusCreated)
+		created := map[string]interface{}{}
+		_ = json.Unmarshal(response.Body.Bytes(), &created)
+		listingId := uint(created["resourceId"].(float64))
+		path := "/listings/" + uintToString(listingId)
+
+		Convey("The listing is linked to the concept and can be searched for", func() {
+			listing, err := a.Store.LoadListing(listingId)
+			So(err, ShouldBeNil)
+			So(listing.ConceptId, ShouldEqual, concept.ID)
+			var listings []store.Listing
+			_ = json.Unmarshal(apiRequest(learnerToken, "GET", "/listings?kind=offer&q=guitar&concept="+uintToString(concept.ID), "").Body.Bytes(), &listings)
+			So(len(listings), ShouldEqual, 1)
+			So(listings[0].ID, ShouldEqual, listingId)
+			So(apiRequest(learnerToken, "GET", "/listings?kind=barter", "").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Only the lister can change or delete it", func() {
+			updated := strings.Replace(body, "Guitar lessons", "Bass lessons", 1)
+			So(apiRequest(learnerToken, "PUT", path, updated).Code, ShouldEqual, http.StatusForbidden)
+			So(apiRequest(teacherToken, "PUT", path, updated).Code, ShouldEqual, http.StatusOK)
+			So(apiRequest(learnerToken, "DELETE", path, "").Code, ShouldEqual, http.StatusForbidden)
+			So(apiRequest(teacherToken, "DELETE", path, "").Code, ShouldEqual, http.StatusOK)
+			So(apiRequest(learnerToken, "GET", path, "").Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Listings must expire in the future", func() {
+			expired := strings.Replace(body, strconv.FormatInt(expiresAt, 10), strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10), 1)
+			So(apiRequest(teacherToken, "POST", "/listings", expired).Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Responding pre-fills an offer from the learner to the teacher", func() {
+			So(apiRequest(teacherToken, "POST", path+"/respond", "").Code, ShouldEqual, http.StatusForbidden)
+			response := apiRequest(learnerToken, "POST", path+"/respond", `{"Seconds":5400}`)
+			So(response.Code, ShouldEqual, http.StatusCreated)
+			responded := map[string]interface{}{}
+			_ = json.Unmarshal(response.Body.Bytes(), &responded)
+			transaction, err := a.Store.LoadTransaction(uint(responded["resourceId"].(float64)))
+			So(err, ShouldBeNil)
+			So(transaction.Status, ShouldEqual, store.TransactionOffered)
+			So(transaction.FromUserId, ShouldEqual, learner.ID)
+			So(transaction.ToUserId, ShouldEqual, teacher.ID)
+			So(transaction.Seconds, ShouldEqual, 5400)
+			So(transaction.Multiplier, ShouldEqual, 1.5)
+			So(transaction.ListingId, ShouldEqual, listingId)
+			a.Store.PurgeTransaction(*transaction)
+		})
+
+		Reset(func() {
+			_ = a.Store.DeleteListing(listingId)
+		})
+	})
+}
+
+func TestGeo(t *testing.T) {
+	Convey("Given two members near each other in Bristol and a gazetteer", t, func() {
+		_, _ = a.Store.SavePlaces([]store.Place{{Name: "BS8 1TH", Key: "BS8 1TH", Latitude: 51.4584, Longitude: -2.6030}})
+		finder := ensureTestUserExists("test-geo-finder@example.com")
+		neighbour := ensureTestUserExists("test-geo-neighbour@example.com")
+		finderToken := userTokenFromLoginResponse(loginToUserJSON(finder.Email))
+		neighbourToken := userTokenFromLoginResponse(loginToUserJSON(neighbour.Email))
+		profile := func(user *store.User, location string) string {
+			return fmt.Sprintf(`{"FirstName":"Geo","Email":"%s","Location":"%s"}`, user.Email, location)
+		}
+		So(apiRequest(finderToken, "PUT", "/users/"+uintToString(finder.ID), profile(finder, "BS8 1TH")).Code, ShouldEqual, http.StatusOK)
+		located := strings.Replace(profile(neighbour, "Clifton"), `}`, `,"Latitude":51.45678,"Longitude":-2.61234}`, 1)
+		So(apiRequest(neighbourToken, "PUT", "/users/"+uintToString(neighbour.ID), located).Code, ShouldEqual, http.StatusOK)
+
+		Convey("A location in the gazetteer sets the coordinates and the member sees them exactly", func() {
+			user := store.PrivilegedUserWithBalance{}
+			_ = json.Unmarshal(apiRequest(neighbourToken, "GET", "/users/0", "").Body.Bytes(), &user)
+			So(*user.Latitude, ShouldEqual, 51.45678)
+			self, _ := a.Store.FindUser(finder.Email)
+			So(*self.Latitude, ShouldEqual, 51.4584)
+		})
+
+		Convey("Other members only see rounded coordinates", func() {
+			var users []store.NearbyUser
+			response := apiRequest(finderToken, "GET", "/users?near=bs81th&radius=5", "")
+			So(response.Code, ShouldEqual, http.StatusOK)
+			_ = json.Unmarshal(response.Body.Bytes(), &users)
+			So(len(users), ShouldEqual, 1)
+			So(users[0].ID, ShouldEqual, neighbour.ID)
+			So(users[0].Latitude, ShouldEqual, 51.46)
+			So(users[0].Longitude, ShouldEqual, -2.61)
+			So(users[0].DistanceKm, ShouldBeLessThan, 5)
+		})
+
+		Convey("A tiny radius cannot pin down a member's exact location", func() {
+			So(apiRequest(finderToken, "GET", "/users?near=51.45678,-2.61234&radius=0.001", "").Code, ShouldEqual, http.StatusBadRequest)
+			users, err := a.Store.ListUsersNear(51.45678, -2.61234, 0.001, a.Config.Geo.PublicPrecision, 10)
+			So(err, ShouldBeNil)
+			So(users, ShouldBeEmpty)
+		})
+
+		Convey("Listings can be searched near a point", func() {
+			expiresAt := time.Now().Add(24 * time.Hour).Unix()
+			body := fmt.Sprintf(`{"Kind":%d,"Category":"geo","Title":"Dog walking","EstimatedSeconds":3600,"Multiplier":1,"Location":"Clifton","ExpiresAt":%d,"Latitude":51.45678,"Longitude":-2.61234}`,
+				store.ListingOffer, expiresAt)
+			response := apiRequest(neighbourToken, "POST", "/listings", body)
+			So(response.Code, ShouldEqual, http.StatusCreated)
+			created := map[string]interface{}{}
+			_ = json.Unmarshal(response.Body.Bytes(), &created)
+			listingId := uint(created["resourceId"].(float64))
+			var listings []store.Listing
+			_ = json.Unmarshal(apiRequest(finderToken, "GET", "/listings?category=geo&near=51.4584,-2.6030&radius=5", "").Body.Bytes(), &listings)
+			So(len(listings), ShouldEqual, 1)
+			So(*listings[0].Latitude, ShouldEqual, 51.46)
+			So(listings[0].DistanceKm, ShouldBeGreaterThan, 0)
+			_ = json.Unmarshal(apiRequest(finderToken, "GET", "/listings?category=geo&near=51.5074,-0.1278&radius=5", "").Body.Bytes(), &listings)
+			So(listings, ShouldBeEmpty)
+			So(apiRequest(finderToken, "GET", "/listings?near=Atlantis", "").Code, ShouldEqual, http.StatusBadRequest)
+			So(apiRequest(finderToken, "GET", "/listings?near=51,0&radius=5000", "").Code, ShouldEqual, http.StatusBadRequest)
+			_ = a.Store.DeleteListing(listingId)
+		})
+
+		Convey("Latitude without longitude is rejected", func() {
+			partial := strings.Replace(profile(finder, "Bristol"), `}`, `,"Latitude":51.4}`, 1)
+			So(apiRequest(finderToken, "PUT", "/users/"+uintToString(finder.ID), partial).Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestFeedback(t *testing.T) {
+	Convey("Given a confirmed transaction and an editor", t, func() {
+		editor := ensureTestUserExists("test-feedback-editor@example.com")
+		editor.Permissions = store.UserPermissionsEditor
+		_, _ = a.Store.UpdateUser(editor)
+		payer := ensureTestUserExists("test-feedback-payer@example.com")
+		payee := ensureTestUserExists("test-feedback-payee@example.com")
+		transaction := store.Transaction{
+			FromUserId:    payer.ID,
+			ToUserId:      payee.ID,
+			InitiatedDate: store.PosixDateTime(time.Now()),
+			Seconds:       1 * 60 * 60,
+			TxFee:         1,
+			Multiplier:    1,
+			Description:   "Test Transaction",
+			Status:        store.TransactionOffered,
+		}
+		transactionId, _ := a.Store.InsertTransaction(&transaction)
+		_, _ = a.Store.PostTransaction(transactionId)
+		editorToken := userTokenFromLoginResponse(loginToUserJSON(editor.Email))
+		payerToken := userTokenFromLoginResponse(loginToUserJSON(payer.Email))
+		payeeToken := userTokenFromLoginResponse(loginToUserJSON(payee.Email))
+		feedbackPath := "/transactions/" + uintToString(transactionId) + "/feedback"
+
+		Convey("Only the parties can rate each other, once each, from 1 to 5", func() {
+			So(apiRequest(editorToken, "POST", feedbackPath, `{"Rating":5}`).Code, ShouldEqual, http.StatusNotFound)
+			So(apiRequest(payerToken, "POST", feedbackPath, `{"Rating":6}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(apiRequest(payerToken, "POST", feedbackPath, `{"Rating":4,"Comment":"Prompt and tidy"}`).Code, ShouldEqual, http.StatusCreated)
+			So(apiRequest(payerToken, "POST", feedbackPath, `{"Rating":5}`).Code, ShouldEqual, http.StatusConflict)
+			So(apiRequest(payeeToken, "POST", feedbackPath, `{"Rating":2}`).Code, ShouldEqual, http.StatusCreated)
+
+			user := store.PublicUserWithBalance{}
+			_ = json.Unmarshal(apiRequest(payerToken, "GET", "/users?Email="+payee.Email, "").Body.Bytes(), &user)
+			So(user.RatingCount, ShouldEqual, 1)
+			So(user.RatingAverage, ShouldEqual, 4)
+			So(apiRequest(payerToken, "GET", "/users/"+uintToString(payee.ID)+"/feedback", "").Body.String(), ShouldContainSubstring, "Prompt and tidy")
+		})
+
+		Convey("Editors hide abusive comments, which then stop counting", func() {
+			response := apiRequest(payerToken, "POST", feedbackPath, `{"Rating":1,"Comment":"Something abusive"}`)
+			created := map[string]interface{}{}
+			_ = json.Unmarshal(response.Body.Bytes(), &created)
+			moderatePath := "/admin/feedback/" + uintToString(uint(created["resourceId"].(float64)))
+			So(apiRequest(payeeToken, "PATCH", moderatePath+"/hide", `{"Reason":"Abusive"}`).Code, ShouldEqual, http.StatusForbidden)
+			So(apiRequest(editorToken, "PATCH", moderatePath+"/hide", `{}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(apiRequest(editorToken, "PATCH", moderatePath+"/hide", `{"Reason":"Abusive"}`).Code, ShouldEqual, http.StatusOK)
+
+			So(apiRequest(payeeToken, "GET", "/feedback?transaction="+uintToString(transactionId), "").Body.String(), ShouldNotContainSubstring, "Something abusive")
+			So(apiRequest(payerToken, "GET", "/users/"+uintToString(payee.ID)+"/feedback", "").Body.String(), ShouldEqual, "[]")
+			So(apiRequest(editorToken, "GET", "/admin/feedback?hidden=true", "").Body.String(), ShouldContainSubstring, "Something abusive")
+			reputation, _ := a.Store.ReputationFor(payee.ID)
+			So(reputation.RatingCount, ShouldEqual, 0)
+			So(apiRequest(editorToken, "PATCH", moderatePath+"/show", "").Code, ShouldEqual, http.StatusOK)
+		})
+
+		Reset(func() {
+			a.Store.PurgeTransaction(transaction)
+		})
+	})
+}
+
+func TestMessages(t *testing.T) {
+	Convey("Given two trading partners and an outsider", t, func() {
+		a.DeliverDueEmails()
+		testMailer.Reset()
+		sender := ensureTestUserExists("test-message-sender@example.com")
+		recipient := ensureTestUserExists("test-message-recipient@example.com")
+		outsider := ensureTestUserExists("test-message-outsider@example.com")
+		senderToken := userTokenFromLoginResponse(loginToUserJSON(sender.Email))
+		recipientToken := userTokenFromLoginResponse(loginToUserJSON(recipient.Email))
+		outsiderToken := userTokenFromLoginResponse(loginToUserJSON(outsider.Email))
+		transaction := store.Transaction{
+			FromUserId:    sender.ID,
+			ToUserId:      recipient.ID,
+			InitiatedDate: store.PosixDateTime(time.Now()),
+			Seconds:       1 * 60 * 60,
+			TxFee:         1,
+			Multiplier:    1,
+			Description:   "Plastering",
+			Status:        store.TransactionOffered,
+		}
+		transactionId, _ := a.Store.InsertTransaction(&transaction)
+		body := fmt.Sprintf(`{"ToUserId":%d,"TransactionId":%d,"Body":"When can you start?"}`, recipient.ID, transactionId)
+		response := apiRequest(senderToken, "POST", "/messages", body)
+		So(response.Code, ShouldEqual, http.StatusCreated)
+		created := map[string]interface{}{}
+		_ = json.Unmarshal(response.Body.Bytes(), &created)
+		threadPath := "/message_threads/" + uintToString(uint(created["threadId"].(float64)))
+
+		Convey("The recipient is emailed once and sees the message as unread", func() {
+			So(apiRequest(senderToken, "POST", threadPath+"/messages", `{"Body":"Any day suits me"}`).Code, ShouldEqual, http.StatusCreated)
+			a.DeliverDueEmails()
+			messages := testMailer.MessagesTo(recipient.Email)
+			So(len(messages), ShouldEqual, 1)
+			So(messages[0].Text, ShouldContainSubstring, "When can you start?")
+			So(messages[0].Text, ShouldContainSubstring, "Plastering")
+
+			So(apiRequest(recipientToken, "GET", "/messages/unread", "").Body.String(), ShouldEqual, `{"Unread":2}`)
+			thread := ThreadWithMessages{}
+			_ = json.Unmarshal(apiRequest(recipientToken, "GET", threadPath, "").Body.Bytes(), &thread)
+			So(len(thread.Messages), ShouldEqual, 2)
+			So(thread.Subject, ShouldEqual, "Plastering")
+			So(apiRequest(recipientToken, "GET", "/messages/unread", "").Body.String(), ShouldEqual, `{"Unread":0}`)
+		})
+
+		Convey("Only the participants can see or post to the thread", func() {
+			So(apiRequest(outsiderToken, "GET", threadPath, "").Code, ShouldEqual, http.StatusNotFound)
+			So(apiRequest(outsiderToken, "POST", threadPath+"/messages", `{"Body":"Hi"}`).Code, ShouldEqual, http.StatusNotFound)
+			var threads []store.MessageThread
+			_ = json.Unmarshal(apiRequest(outsiderToken, "GET", "/message_threads", "").Body.Bytes(), &threads)
+			So(threads, ShouldBeEmpty)
+			attached := fmt.Sprintf(`{"ToUserId":%d,"TransactionId":%d,"Body":"Hi"}`, recipient.ID, transactionId)
+			So(apiRequest(outsiderToken, "POST", "/messages", attached).Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("A blocked member can no longer send messages", func() {
+			So(apiRequest(recipientToken, "PUT", "/blocks/"+uintToString(sender.ID), "").Code, ShouldEqual, http.StatusOK)
+			So(apiRequest(senderToken, "POST", threadPath+"/messages", `{"Body":"Hello?"}`).Code, ShouldEqual, http.StatusForbidden)
+			So(apiRequest(recipientToken, "DELETE", "/blocks/"+uintToString(sender.ID), "").Code, ShouldEqual, http.StatusOK)
+			So(apiRequest(senderToken, "POST", threadPath+"/messages", `{"Body":"Hello?"}`).Code, ShouldEqual, http.StatusCreated)
+		})
+
+		Convey("A blocked member can not start a new thread", func() {
+			listing := store.Listing{UserId: sender.ID, Kind: store.ListingOffer, Category: "messages", Title: "Plastering",
+				EstimatedSeconds: 3600, Multiplier: 1, ExpiresAt: store.PosixDateTime(time.Now().Add(time.Hour))}
+			listingId, _ := a.Store.InsertListing(&listing)
+			empty := store.MessageThread{UserId: sender.ID, OtherUserId: recipient.ID, Subject: "Started before the block"}
+			_, err := a.Store.FindOrCreateMessageThread(&empty)
+			So(err, ShouldBeNil)
+			So(apiRequest(recipientToken, "PUT", "/blocks/"+uintToString(sender.ID), "").Code, ShouldEqual, http.StatusOK)
+			attached := fmt.Sprintf(`{"ToUserId":%d,"ListingId":%d,"Subject":"Let me in","Body":"Hello?"}`, recipient.ID, listingId)
+			So(apiRequest(senderToken, "POST", "/messages", attached).Code, ShouldEqual, http.StatusForbidden)
+			var threads []store.MessageThread
+			_ = json.Unmarshal(apiRequest(recipientToken, "GET", "/message_threads", "").Body.Bytes(), &threads)
+			So(len(threads), ShouldEqual, 1)
+			So(threads[0].Subject, ShouldEqual, "Plastering")
+			So(apiRequest(recipientToken, "DELETE", "/blocks/"+uintToString(sender.ID), "").Code, ShouldEqual, http.StatusOK)
+			_ = a.Store.DeleteListing(listingId)
+		})
+
+		Reset(func() {
+			a.Store.PurgeTransaction(transaction)
+			a.Store.PurgeUser(sender.Email)
+			testMailer.Reset()
+		})
+	})
+}
+
+// streamRecorder lets a test read what a streaming handler has written so far while it is still writing
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	mutex sync.Mutex
+}
+
+func (r *streamRecorder) Write(data []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.ResponseRecorder.Write(data)
+}
+
+func (r *streamRecorder) WriteString(data string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.ResponseRecorder.WriteString(data)
+}
+
+func (r *streamRecorder) Flush() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ResponseRecorder.Flush()
+}
+
+func (r *streamRecorder) body() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.Body.String()
+}
+
+// streamEvents holds /api/events open, authenticated by ?token=, until done returns and wantEvents events have been
+// streamed, or a few seconds have passed, and gives back what was streamed
+func streamEvents(token string, userId uint, lastEventId string, wantEvents int, done func()) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "/api/events?token="+token, nil)
+	if len(lastEventId) > 0 {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	response := &streamRecorder{ResponseRecorder: httptest.NewRecorder()}
+	finished := make(chan struct{})
+	go func() {
+		a.Router.ServeHTTP(response, req.WithContext(ctx))
+		close(finished)
+	}()
+	for a.Events.subscriberCount(userId) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done()
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(response.body(), "\nid: ") < wantEvents && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-finished
+	return response.body()
+}
+
+func TestEvents(t *testing.T) {
+	Convey("Given a member offering time to another", t, func() {
+		payer := ensureTestUserExists("test-events-payer@example.com")
+		payee := ensureTestUserExists("test-events-payee@example.com")
+		payerToken := userTokenFromLoginResponse(loginToUserJSON(payer.Email))
+		payeeToken := userTokenFromLoginResponse(loginToUserJSON(payee.Email))
+		transactionJSON := CreateTransactionJSON{}
+		transactionJSON.FromUserId = payer.ID
+		transactionJSON.ToUserId = payee.ID
+		transactionJSON.Status = store.TransactionOffered
+		transactionJSON.Seconds = 30 * 60
+		transactionJSON.Multiplier = 1
+		transactionJSON.TxFee = 1
+		data, _ := json.Marshal(transactionJSON)
+		response := apiRequest(payerToken, "POST", "/transactions", string(data))
+		So(response.Code, ShouldEqual, http.StatusCreated)
+		created := map[string]interface{}{}
+		_ = json.Unmarshal(response.Body.Bytes(), &created)
+		transactionPath := "/transactions/" + uintToString(uint(created["resourceId"].(float64)))
+
+		Convey("The stream needs a token", func() {
+			So(apiRequest("", "GET", "/events", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("The stream token is taken out of the query before the request is logged", func() {
+			router := gin.New()
+			router.Use(tokenFromQuery())
+			router.GET("/api/events", func(c *gin.Context) {
+				c.String(http.StatusOK, c.Request.URL.RawQuery+"|"+c.GetHeader("Authorization"))
+			})
+			req, _ := http.NewRequest("GET", "/api/events?token="+payerToken+"&lastEventId=3", nil)
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, req)
+			So(response.Body.String(), ShouldEqual, "lastEventId=3|Bearer "+payerToken)
+		})
+
+		Convey("The payer hears about the acceptance and their balance as it happens", func() {
+			body := streamEvents(payerToken, payer.ID, "", 2, func() {
+				So(apiRequest(payeeToken, "PATCH", transactionPath+"/accept", "").Code, ShouldEqual, http.StatusCreated)
+			})
+			So(body, ShouldStartWith, "retry: ")
+			So(body, ShouldContainSubstring, "event: "+EventTransactionAccepted+"\n")
+			So(body, ShouldContainSubstring, "event: "+EventBalanceChanged+"\n")
+			So(body, ShouldNotContainSubstring, EventTransactionPending)
+		})
+
+		Convey("A reconnecting payee is replayed what they missed after their Last-Event-ID", func() {
+			events, _ := a.Store.ListEventsSince(payee.ID, 0, 10)
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Type, ShouldEqual, EventTransactionPending)
+			replayFrom := strconv.Itoa(int(events[0].ID) - 1)
+			body := streamEvents(payeeToken, payee.ID, replayFrom, 1, func() {})
+			So(body, ShouldContainSubstring, fmt.Sprintf("id: %d\nevent: %s\n", events[0].ID, EventTransactionPending))
+
+			body = streamEvents(payeeToken, payee.ID, strconv.Itoa(int(events[0].ID)), 0, func() {
+				So(apiRequest(payeeToken, "PATCH", transactionPath+"/reject", "").Code, ShouldEqual, http.StatusCreated)
+			})
+			So(body, ShouldNotContainSubstring, EventTransactionPending)
+			rejected, _ := a.Store.ListEventsSince(payer.ID, 0, 10)
+			So(len(rejected), ShouldEqual, 1)
+			So(rejected[0].Type, ShouldEqual, EventTransactionRejected)
+		})
+
+		Convey("A replay longer than one page is sent in full", func() {
+			for i := 0; i < maxReplayedEvents+5; i++ {
+				_, _ = a.Store.InsertEvent(&store.Event{UserId: payee.ID, Type: EventBalanceChanged, Data: "{}"})
+			}
+			body := streamEvents(payeeToken, payee.ID, "0", maxReplayedEvents+6, func() {})
+			So(strings.Count(body, "\nid: "), ShouldEqual, maxReplayedEvents+6)
+		})
+
+		Convey("A stream that falls behind is closed rather than missing events", func() {
+			hub := NewEventHub()
+			events := hub.Subscribe(payee.ID)
+			for i := 1; i <= cap(events)+1; i++ {
+				event := store.Event{UserId: payee.ID}
+				event.ID = uint(i)
+				hub.Publish(event)
+			}
+			So(hub.subscriberCount(payee.ID), ShouldEqual, 0)
+			received := 0
+			for range events {
+				received++
+			}
+			So(received, ShouldEqual, cap(events))
+			hub.Unsubscribe(payee.ID, events)
+		})
+
+		Reset(func() {
+			a.Store.PurgeUser(payer.Email)
+			a.Store.PurgeUser(payee.Email)
+		})
+	})
+}
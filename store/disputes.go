@@ -0,0 +1,413 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamboardman/gorm"
+	"sort"
+	"time"
+)
+
+const (
+	DisputeUnknown = iota
+	DisputeOpen
+	DisputeUnderReview
+	DisputeReversed
+	DisputeDismissed
+)
+
+const (
+	AuditDisputeRaised       = "dispute_raised"
+	AuditDisputeReviewed     = "dispute_reviewed"
+	AuditDisputeDismissed    = "dispute_dismissed"
+	AuditTransactionReversed = "transaction_reversed"
+)
+
+var ErrTransactionNotPosted = errors.New("transaction has not been posted")
+var ErrDisputeOpen = errors.New("transaction already has an open dispute")
+var ErrTransactionReversed = errors.New("transaction has already been reversed")
+var ErrDisputeClosed = errors.New("dispute has already been resolved")
+
+// Dispute is raised by a party to a posted transaction and resolved by an editor, either by posting a reversal that
+// undoes it, ReversalTId, or by dismissing it. The disputed transaction itself is never changed.
+type Dispute struct {
+	gorm.Model
+	TransactionId uint
+	RaisedById    uint
+	Reason        string
+	Status        uint
+	ReviewerId    uint
+	Resolution    string
+	ReversalTId   uint
+	ResolvedDate  *PosixDateTime `gorm:"type:timestamp with time zone"`
+}
+
+func (d Dispute) IsOpen() bool {
+	return d.Status == DisputeOpen || d.Status == DisputeUnderReview
+}
+
+// AuditEntry records who did what to a dispute, feedback or transaction, entries are only ever added
+type AuditEntry struct {
+	gorm.Model
+	ActorId       uint
+	Action        string
+	TransactionId uint
+	DisputeId     uint
+	FeedbackId    uint
+	Details       string
+}
+
+// checkDisputable makes sure the transaction can be disputed given its earlier disputes
+func checkDisputable(transaction Transaction, disputes []Dispute) error {
+	if !transaction.IsPosted() || transaction.ReversesTId != 0 {
+		return ErrTransactionNotPosted
+	}
+	for _, dispute := range disputes {
+		if dispute.IsOpen() {
+			return ErrDisputeOpen
+		}
+		if dispute.Status == DisputeReversed {
+			return ErrTransactionReversed
+		}
+	}
+	return nil
+}
+
+// reversalOf is a pending transaction moving the seconds back, the fee paid on the original is not refunded
+func reversalOf(original Transaction, now time.Time) Transaction {
+	return Transaction{
+		InitiatedDate:   PosixDateTime(now.Truncate(time.Microsecond)),
+		FromUserId:      original.ToUserId,
+		ToUserId:        original.FromUserId,
+		Seconds:         original.Seconds,
+		Multiplier:      original.Multiplier,
+		CreditedSeconds: original.CreditedSeconds,
+		Description:     fmt.Sprintf("Reversal of transaction %d: %s", original.ID, original.Description),
+		Location:        original.Location,
+		Status:          TransactionOffered,
+		ReversesTId:     original.ID,
+	}
+}
+
+// resolve closes the dispute, returning the audit entry for it
+func (d *Dispute) resolve(status uint, reviewerId uint, resolution string, now time.Time) AuditEntry {
+	resolvedDate := PosixDateTime(now.Truncate(time.Microsecond))
+	d.Status = status
+	d.ReviewerId = reviewerId
+	d.Resolution = resolution
+	d.ResolvedDate = &resolvedDate
+	action := AuditDisputeDismissed
+	if status == DisputeReversed {
+		action = AuditTransactionReversed
+	}
+	return AuditEntry{ActorId: reviewerId, Action: action, TransactionId: d.TransactionId, DisputeId: d.ID, Details: resolution}
+}
+
+// RaiseDispute records a dispute against a posted transaction that has no open dispute and has not been reversed
+func (s *PostgresStore) RaiseDispute(dispute *Dispute) (uint, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	transaction := Transaction{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", dispute.TransactionId).Find(&transaction).Error
+	var disputes []Dispute
+	if err == nil {
+		err = tx.Where("transaction_id=?", dispute.TransactionId).Find(&disputes).Error
+	}
+	if err == nil {
+		err = checkDisputable(transaction, disputes)
+	}
+	if err == nil {
+		dispute.Status = DisputeOpen
+		err = tx.Create(dispute).Error
+	}
+	if err == nil {
+		err = tx.Create(&AuditEntry{ActorId: dispute.RaisedById, Action: AuditDisputeRaised, TransactionId: dispute.TransactionId, DisputeId: dispute.ID, Details: dispute.Reason}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return dispute.ID, tx.Commit().Error
+}
+
+func (s *PostgresStore) LoadDispute(id uint) (*Dispute, error) {
+	dispute := Dispute{}
+	err := s.db.Where("id=?", id).Take(&dispute).Error
+	if err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+// ListDisputes lists disputes with any of the statuses, or all of them, oldest first
+func (s *PostgresStore) ListDisputes(statuses []uint) ([]Dispute, error) {
+	var disputes []Dispute
+	query := s.db.Order("id")
+	if len(statuses) > 0 {
+		query = query.Where("status IN (?)", statuses)
+	}
+	err := query.Find(&disputes).Error
+	return disputes, err
+}
+
+// ListDisputesForUser lists the disputes on transactions the user was a party to
+func (s *PostgresStore) ListDisputesForUser(userId uint) ([]Dispute, error) {
+	var disputes []Dispute
+	err := s.db.Where("transaction_id IN (SELECT id FROM transactions WHERE from_user_id=? OR to_user_id=?)", userId, userId).Order("id").Find(&disputes).Error
+	return disputes, err
+}
+
+func (s *PostgresStore) lockOpenDispute(tx *gorm.DB, disputeId uint) (*Dispute, error) {
+	dispute := Dispute{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", disputeId).Find(&dispute).Error
+	if err != nil {
+		return nil, err
+	}
+	if !dispute.IsOpen() {
+		return nil, ErrDisputeClosed
+	}
+	return &dispute, nil
+}
+
+// ReviewDispute marks an open dispute as being looked at by reviewerId
+func (s *PostgresStore) ReviewDispute(disputeId uint, reviewerId uint, note string) (*Dispute, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	dispute, err := s.lockOpenDispute(tx, disputeId)
+	if err == nil {
+		dispute.Status = DisputeUnderReview
+		dispute.ReviewerId = reviewerId
+		err = tx.Save(dispute).Error
+	}
+	if err == nil {
+		err = tx.Create(&AuditEntry{ActorId: reviewerId, Action: AuditDisputeReviewed, TransactionId: dispute.TransactionId, DisputeId: dispute.ID, Details: note}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return dispute, tx.Commit().Error
+}
+
+// ResolveDispute dismisses an open dispute or upholds it, posting a reversal of the disputed transaction
+func (s *PostgresStore) ResolveDispute(disputeId uint, reviewerId uint, reverse bool, resolution string) (*Dispute, error) {
+	var dispute *Dispute
+	var err error
+	for attempt := 0; attempt < postTransactionAttempts; attempt++ {
+		dispute, err = s.resolveDispute(disputeId, reviewerId, reverse, resolution)
+		if !isSerializationFailure(err) {
+			break
+		}
+		time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+	}
+	return dispute, err
+}
+
+func (s *PostgresStore) resolveDispute(disputeId uint, reviewerId uint, reverse bool, resolution string) (*Dispute, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	dispute, err := s.resolveDisputeInTx(tx, disputeId, reviewerId, reverse, resolution)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return dispute, tx.Commit().Error
+}
+
+func (s *PostgresStore) resolveDisputeInTx(tx *gorm.DB, disputeId uint, reviewerId uint, reverse bool, resolution string) (*Dispute, error) {
+	err := tx.Exec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE").Error
+	if err != nil {
+		return nil, err
+	}
+	dispute, err := s.lockOpenDispute(tx, disputeId)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	status := uint(DisputeDismissed)
+	if reverse {
+		original := Transaction{}
+		err = tx.Where("id=?", dispute.TransactionId).Take(&original).Error
+		if err != nil {
+			return nil, err
+		}
+		reversal := reversalOf(original, now)
+		err = tx.Create(&reversal).Error
+		if err != nil {
+			return nil, err
+		}
+		posted, err := s.postTransactionInTx(tx, reversal.ID)
+		if err != nil {
+			return nil, err
+		}
+		dispute.ReversalTId = posted.ID
+		status = DisputeReversed
+	}
+	audit := dispute.resolve(status, reviewerId, resolution, now)
+	err = tx.Save(dispute).Error
+	if err == nil {
+		err = tx.Create(&audit).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dispute, nil
+}
+
+// ListAuditEntries lists the audit trail of a transaction, or everything when transactionId is 0, oldest first
+func (s *PostgresStore) ListAuditEntries(transactionId uint) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	query := s.db.Order("id")
+	if transactionId != 0 {
+		query = query.Where("transaction_id=?", transactionId)
+	}
+	err := query.Find(&entries).Error
+	return entries, err
+}
+
+func (s *MemoryStore) disputesFor(include func(dispute Dispute) bool) []Dispute {
+	var disputes []Dispute
+	for _, dispute := range s.disputes {
+		if include(dispute) {
+			disputes = append(disputes, dispute)
+		}
+	}
+	sort.Slice(disputes, func(i, j int) bool { return disputes[i].ID < disputes[j].ID })
+	return disputes
+}
+
+func (s *MemoryStore) audit(entry AuditEntry) {
+	s.saveModel(&entry.Model, func(id uint) bool { return false })
+	s.auditEntries[entry.ID] = entry
+}
+
+func (s *MemoryStore) RaiseDispute(dispute *Dispute) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transaction, ok := s.transactions[dispute.TransactionId]
+	if !ok {
+		return 0, gorm.ErrRecordNotFound
+	}
+	if _, ok := s.users[dispute.RaisedById]; !ok {
+		return 0, errForeignKey
+	}
+	err := checkDisputable(transaction, s.disputesFor(func(other Dispute) bool { return other.TransactionId == transaction.ID }))
+	if err != nil {
+		return 0, err
+	}
+	dispute.Status = DisputeOpen
+	s.saveModel(&dispute.Model, func(id uint) bool { _, ok := s.disputes[id]; return ok })
+	s.disputes[dispute.ID] = *dispute
+	s.audit(AuditEntry{ActorId: dispute.RaisedById, Action: AuditDisputeRaised, TransactionId: dispute.TransactionId, DisputeId: dispute.ID, Details: dispute.Reason})
+	return dispute.ID, nil
+}
+
+func (s *MemoryStore) LoadDispute(id uint) (*Dispute, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dispute, ok := s.disputes[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &dispute, nil
+}
+
+func (s *MemoryStore) ListDisputes(statuses []uint) ([]Dispute, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.disputesFor(func(dispute Dispute) bool {
+		for _, status := range statuses {
+			if dispute.Status == status {
+				return true
+			}
+		}
+		return len(statuses) == 0
+	}), nil
+}
+
+func (s *MemoryStore) ListDisputesForUser(userId uint) ([]Dispute, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.disputesFor(func(dispute Dispute) bool {
+		transaction := s.transactions[dispute.TransactionId]
+		return transaction.FromUserId == userId || transaction.ToUserId == userId
+	}), nil
+}
+
+func (s *MemoryStore) openDispute(disputeId uint) (Dispute, error) {
+	dispute, ok := s.disputes[disputeId]
+	if !ok {
+		return dispute, gorm.ErrRecordNotFound
+	}
+	if !dispute.IsOpen() {
+		return dispute, ErrDisputeClosed
+	}
+	return dispute, nil
+}
+
+func (s *MemoryStore) ReviewDispute(disputeId uint, reviewerId uint, note string) (*Dispute, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dispute, err := s.openDispute(disputeId)
+	if err != nil {
+		return nil, err
+	}
+	dispute.Status = DisputeUnderReview
+	dispute.ReviewerId = reviewerId
+	s.saveModel(&dispute.Model, func(id uint) bool { return true })
+	s.disputes[dispute.ID] = dispute
+	s.audit(AuditEntry{ActorId: reviewerId, Action: AuditDisputeReviewed, TransactionId: dispute.TransactionId, DisputeId: dispute.ID, Details: note})
+	return &dispute, nil
+}
+
+func (s *MemoryStore) ResolveDispute(disputeId uint, reviewerId uint, reverse bool, resolution string) (*Dispute, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dispute, err := s.openDispute(disputeId)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	status := uint(DisputeDismissed)
+	if reverse {
+		original, ok := s.transactions[dispute.TransactionId]
+		if !ok {
+			return nil, gorm.ErrRecordNotFound
+		}
+		reversal := reversalOf(original, now)
+		_, err = s.saveTransaction(&reversal)
+		if err == nil {
+			err = s.postTransaction(&reversal)
+		}
+		if err != nil {
+			delete(s.transactions, reversal.ID)
+			return nil, err
+		}
+		dispute.ReversalTId = reversal.ID
+		status = DisputeReversed
+	}
+	audit := dispute.resolve(status, reviewerId, resolution, now)
+	s.saveModel(&dispute.Model, func(id uint) bool { return true })
+	s.disputes[dispute.ID] = dispute
+	s.audit(audit)
+	return &dispute, nil
+}
+
+func (s *MemoryStore) ListAuditEntries(transactionId uint) ([]AuditEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var entries []AuditEntry
+	for _, entry := range s.auditEntries {
+		if transactionId == 0 || entry.TransactionId == transactionId {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
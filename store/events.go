@@ -0,0 +1,74 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"sort"
+	"time"
+)
+
+// Event is something a member is told about over /api/events, kept for a while so a client that reconnects can
+// catch up on what it missed. Data is JSON.
+type Event struct {
+	gorm.Model
+	UserId uint
+	Type   string
+	Data   string
+}
+
+func (s *PostgresStore) InsertEvent(event *Event) (uint, error) {
+	err := s.db.Create(event).Error
+	return event.ID, err
+}
+
+// ListEventsSince lists the member's events after afterId, oldest first
+func (s *PostgresStore) ListEventsSince(userId uint, afterId uint, limit int) ([]Event, error) {
+	var events []Event
+	err := s.db.Where("user_id=? AND id>?", userId, afterId).Order("id").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// PurgeEventsBefore deletes the events created before the time, returning how many there were
+func (s *PostgresStore) PurgeEventsBefore(before time.Time) (int, error) {
+	query := s.db.Unscoped().Where("created_at<?", before).Delete(Event{})
+	return int(query.RowsAffected), query.Error
+}
+
+func (s *MemoryStore) InsertEvent(event *Event) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.users[event.UserId]; !ok {
+		return 0, errForeignKey
+	}
+	s.saveModel(&event.Model, func(id uint) bool { _, ok := s.events[id]; return ok })
+	s.events[event.ID] = *event
+	return event.ID, nil
+}
+
+func (s *MemoryStore) ListEventsSince(userId uint, afterId uint, limit int) ([]Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var events []Event
+	for _, event := range s.events {
+		if event.UserId == userId && event.ID > afterId {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (s *MemoryStore) PurgeEventsBefore(before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	purged := 0
+	for id, event := range s.events {
+		if event.CreatedAt.Before(before) {
+			delete(s.events, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
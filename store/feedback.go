@@ -0,0 +1,262 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"sort"
+	"time"
+)
+
+const (
+	MinRating = 1
+	MaxRating = 5
+)
+
+const (
+	AuditFeedbackHidden = "feedback_hidden"
+	AuditFeedbackShown  = "feedback_shown"
+)
+
+var ErrFeedbackNotAllowed = errors.New("feedback can only be left by a party to a confirmed transaction")
+var ErrFeedbackClosed = errors.New("the time for leaving feedback on this transaction has passed")
+var ErrFeedbackExists = errors.New("feedback has already been left on this transaction")
+
+// Feedback is one party's rating, 1 to 5, and comment on the other party to a confirmed transaction. Editors hide
+// abusive feedback, which then no longer counts towards reputation.
+type Feedback struct {
+	gorm.Model
+	TransactionId    uint
+	FromUserId       uint
+	ToUserId         uint
+	Rating           uint
+	Comment          string
+	Hidden           bool
+	ModeratorId      uint
+	ModerationReason string
+}
+
+// Reputation sums up the visible feedback a member has received
+type Reputation struct {
+	RatingCount   int
+	RatingAverage float64
+}
+
+// checkFeedback makes sure fromUserId can still leave feedback on the transaction, returning who it is about
+func checkFeedback(transaction Transaction, fromUserId uint, existing []Feedback, confirmedAfter time.Time) (uint, error) {
+	if transaction.Status != TransactionOfferApproved && transaction.Status != TransactionRequestApproved {
+		return 0, ErrFeedbackNotAllowed
+	}
+	toUserId := transaction.ToUserId
+	if transaction.ToUserId == fromUserId {
+		toUserId = transaction.FromUserId
+	} else if transaction.FromUserId != fromUserId {
+		return 0, ErrFeedbackNotAllowed
+	}
+	if !time.Time(transaction.ConfirmedDate).After(confirmedAfter) {
+		return 0, ErrFeedbackClosed
+	}
+	for _, feedback := range existing {
+		if feedback.FromUserId == fromUserId {
+			return 0, ErrFeedbackExists
+		}
+	}
+	return toUserId, nil
+}
+
+// moderate hides or shows the feedback, returning the audit entry for it
+func (f *Feedback) moderate(moderatorId uint, hidden bool, reason string) AuditEntry {
+	f.Hidden = hidden
+	f.ModeratorId = moderatorId
+	f.ModerationReason = reason
+	action := AuditFeedbackShown
+	if hidden {
+		action = AuditFeedbackHidden
+	}
+	return AuditEntry{ActorId: moderatorId, Action: action, TransactionId: f.TransactionId, FeedbackId: f.ID, Details: reason}
+}
+
+// LeaveFeedback records a party's feedback on a transaction confirmed after confirmedAfter, once per party
+func (s *PostgresStore) LeaveFeedback(feedback *Feedback, confirmedAfter time.Time) (uint, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	transaction := Transaction{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", feedback.TransactionId).Find(&transaction).Error
+	var existing []Feedback
+	if err == nil {
+		err = tx.Where("transaction_id=?", feedback.TransactionId).Find(&existing).Error
+	}
+	if err == nil {
+		feedback.ToUserId, err = checkFeedback(transaction, feedback.FromUserId, existing, confirmedAfter)
+	}
+	if err == nil {
+		err = tx.Create(feedback).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return feedback.ID, tx.Commit().Error
+}
+
+func (s *PostgresStore) LoadFeedback(id uint) (*Feedback, error) {
+	feedback := Feedback{}
+	err := s.db.Where("id=?", id).Take(&feedback).Error
+	if err != nil {
+		return nil, err
+	}
+	return &feedback, nil
+}
+
+// ListFeedbackForUser lists the feedback left about a member, newest first
+func (s *PostgresStore) ListFeedbackForUser(userId uint) ([]Feedback, error) {
+	var feedback []Feedback
+	err := s.db.Where("to_user_id=?", userId).Order("id DESC").Find(&feedback).Error
+	return feedback, err
+}
+
+func (s *PostgresStore) ListFeedbackForTransaction(transactionId uint) ([]Feedback, error) {
+	var feedback []Feedback
+	err := s.db.Where("transaction_id=?", transactionId).Order("id").Find(&feedback).Error
+	return feedback, err
+}
+
+// ListFeedback lists the most recent feedback for moderation, or only the hidden feedback
+func (s *PostgresStore) ListFeedback(hiddenOnly bool, limit int) ([]Feedback, error) {
+	var feedback []Feedback
+	query := s.db.Order("id DESC").Limit(limit)
+	if hiddenOnly {
+		query = query.Where("hidden")
+	}
+	err := query.Find(&feedback).Error
+	return feedback, err
+}
+
+// ModerateFeedback hides or shows feedback, recording the moderator and their reason in the audit log
+func (s *PostgresStore) ModerateFeedback(feedbackId uint, moderatorId uint, hidden bool, reason string) (*Feedback, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	feedback := Feedback{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", feedbackId).Take(&feedback).Error
+	if err == nil {
+		audit := feedback.moderate(moderatorId, hidden, reason)
+		err = tx.Save(&feedback).Error
+		if err == nil {
+			err = tx.Create(&audit).Error
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &feedback, tx.Commit().Error
+}
+
+func (s *PostgresStore) ReputationFor(userId uint) (Reputation, error) {
+	reputation := Reputation{}
+	err := s.db.Raw("SELECT COUNT(*) AS rating_count, COALESCE(AVG(rating), 0) AS rating_average FROM feedbacks WHERE to_user_id=? AND NOT hidden AND deleted_at IS NULL",
+		userId).Scan(&reputation).Error
+	return reputation, err
+}
+
+func (s *MemoryStore) feedbackFor(include func(feedback Feedback) bool) []Feedback {
+	var feedback []Feedback
+	for _, f := range s.feedback {
+		if include(f) {
+			feedback = append(feedback, f)
+		}
+	}
+	sort.Slice(feedback, func(i, j int) bool { return feedback[i].ID < feedback[j].ID })
+	return feedback
+}
+
+func newestFirst(feedback []Feedback) []Feedback {
+	for i, j := 0, len(feedback)-1; i < j; i, j = i+1, j-1 {
+		feedback[i], feedback[j] = feedback[j], feedback[i]
+	}
+	return feedback
+}
+
+func (s *MemoryStore) LeaveFeedback(feedback *Feedback, confirmedAfter time.Time) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transaction, ok := s.transactions[feedback.TransactionId]
+	if !ok {
+		return 0, gorm.ErrRecordNotFound
+	}
+	existing := s.feedbackFor(func(other Feedback) bool { return other.TransactionId == transaction.ID })
+	toUserId, err := checkFeedback(transaction, feedback.FromUserId, existing, confirmedAfter)
+	if err != nil {
+		return 0, err
+	}
+	feedback.ToUserId = toUserId
+	s.saveModel(&feedback.Model, func(id uint) bool { _, ok := s.feedback[id]; return ok })
+	s.feedback[feedback.ID] = *feedback
+	return feedback.ID, nil
+}
+
+func (s *MemoryStore) LoadFeedback(id uint) (*Feedback, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	feedback, ok := s.feedback[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &feedback, nil
+}
+
+func (s *MemoryStore) ListFeedbackForUser(userId uint) ([]Feedback, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return newestFirst(s.feedbackFor(func(feedback Feedback) bool { return feedback.ToUserId == userId })), nil
+}
+
+func (s *MemoryStore) ListFeedbackForTransaction(transactionId uint) ([]Feedback, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.feedbackFor(func(feedback Feedback) bool { return feedback.TransactionId == transactionId }), nil
+}
+
+func (s *MemoryStore) ListFeedback(hiddenOnly bool, limit int) ([]Feedback, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	feedback := newestFirst(s.feedbackFor(func(feedback Feedback) bool { return feedback.Hidden || !hiddenOnly }))
+	if len(feedback) > limit {
+		feedback = feedback[:limit]
+	}
+	return feedback, nil
+}
+
+func (s *MemoryStore) ModerateFeedback(feedbackId uint, moderatorId uint, hidden bool, reason string) (*Feedback, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	feedback, ok := s.feedback[feedbackId]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	audit := feedback.moderate(moderatorId, hidden, reason)
+	s.saveModel(&feedback.Model, func(id uint) bool { return true })
+	s.feedback[feedback.ID] = feedback
+	s.audit(audit)
+	return &feedback, nil
+}
+
+func (s *MemoryStore) ReputationFor(userId uint) (Reputation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reputation := Reputation{}
+	total := 0
+	for _, feedback := range s.feedback {
+		if feedback.ToUserId == userId && !feedback.Hidden {
+			reputation.RatingCount++
+			total += int(feedback.Rating)
+		}
+	}
+	if reputation.RatingCount > 0 {
+		reputation.RatingAverage = float64(total) / float64(reputation.RatingCount)
+	}
+	return reputation, nil
+}
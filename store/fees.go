@@ -0,0 +1,121 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+// FeeReport is the income of the fee account from fees on transactions posted between From and To
+type FeeReport struct {
+	FeeUserId uint
+	From      time.Time
+	To        time.Time
+	Postings  int
+	Collected int64
+	Balance   int64
+}
+
+// LedgerTotals sums the latest balance of every account. Fees posted before there was a fee account left the ledger
+// so the balances plus those uncollected fees must be zero.
+type LedgerTotals struct {
+	Accounts        int
+	Balances        int64
+	UncollectedFees int64
+	Balanced        bool
+}
+
+var postedStatuses = []uint{TransactionOfferApproved, TransactionRequestApproved, TransactionReversal}
+
+func (totals *LedgerTotals) check() *LedgerTotals {
+	totals.Balanced = totals.Balances+totals.UncollectedFees == 0
+	return totals
+}
+
+// SetFeeAccount credits the fees on transactions posted from now on to the user
+func (s *PostgresStore) SetFeeAccount(userId uint) {
+	s.feeUserId = userId
+}
+
+func (s *PostgresStore) FeeIncome(from time.Time, to time.Time) (*FeeReport, error) {
+	report := FeeReport{FeeUserId: s.feeUserId, From: from, To: to}
+	if s.feeUserId == 0 {
+		return &report, nil
+	}
+	err := s.db.Raw("SELECT COUNT(*), COALESCE(SUM(tx_fee), 0) FROM transactions WHERE deleted_at IS NULL AND status IN (?) AND fee_user_id=? AND confirmed_date >= ? AND confirmed_date <= ?",
+		postedStatuses, s.feeUserId, from, to).Row().Scan(&report.Postings, &report.Collected)
+	if err != nil {
+		return nil, err
+	}
+	last, err := lastPostedTransactionForUser(s.db, s.feeUserId)
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	report.Balance = last.Balance(s.feeUserId)
+	return &report, nil
+}
+
+func (s *PostgresStore) LedgerTotals() (*LedgerTotals, error) {
+	totals := LedgerTotals{}
+	err := s.db.Raw(`SELECT COUNT(*), COALESCE(SUM(balance), 0) FROM (
+	SELECT DISTINCT ON (user_id) user_id, balance FROM (
+		SELECT from_user_id AS user_id, from_user_balance AS balance, confirmed_date, id FROM transactions WHERE deleted_at IS NULL AND status IN (?)
+		UNION ALL SELECT to_user_id, to_user_balance, confirmed_date, id FROM transactions WHERE deleted_at IS NULL AND status IN (?)
+		UNION ALL SELECT fee_user_id, fee_user_balance, confirmed_date, id FROM transactions WHERE deleted_at IS NULL AND status IN (?) AND fee_user_id <> 0
+	) AS entries ORDER BY user_id, confirmed_date DESC, id DESC
+) AS latest`, postedStatuses, postedStatuses, postedStatuses).Row().Scan(&totals.Accounts, &totals.Balances)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Raw("SELECT COALESCE(SUM(tx_fee), 0) FROM transactions WHERE deleted_at IS NULL AND status IN (?) AND fee_user_id = 0",
+		postedStatuses).Row().Scan(&totals.UncollectedFees)
+	if err != nil {
+		return nil, err
+	}
+	return totals.check(), nil
+}
+
+func (s *MemoryStore) SetFeeAccount(userId uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.feeUserId = userId
+}
+
+func (s *MemoryStore) FeeIncome(from time.Time, to time.Time) (*FeeReport, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	report := FeeReport{FeeUserId: s.feeUserId, From: from, To: to}
+	if s.feeUserId == 0 {
+		return &report, nil
+	}
+	for _, transaction := range s.transactions {
+		confirmed := time.Time(transaction.ConfirmedDate)
+		if transaction.IsPosted() && transaction.FeeUserId == s.feeUserId && !confirmed.Before(from) && !confirmed.After(to) {
+			report.Postings++
+			report.Collected += int64(transaction.TxFee)
+		}
+	}
+	last, _ := s.lastPostedTransactionForUser(s.feeUserId)
+	report.Balance = last.Balance(s.feeUserId)
+	return &report, nil
+}
+
+func (s *MemoryStore) LedgerTotals() (*LedgerTotals, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	totals := LedgerTotals{}
+	balances := map[uint]int64{}
+	for _, transaction := range s.sortedTransactions(Transaction.IsPosted, byConfirmedDate) {
+		balances[transaction.FromUserId] = transaction.FromUserBalance
+		balances[transaction.ToUserId] = transaction.ToUserBalance
+		if transaction.FeeUserId != 0 {
+			balances[transaction.FeeUserId] = transaction.FeeUserBalance
+		} else {
+			totals.UncollectedFees += int64(transaction.TxFee)
+		}
+	}
+	totals.Accounts = len(balances)
+	for _, balance := range balances {
+		totals.Balances += balance
+	}
+	return totals.check(), nil
+}
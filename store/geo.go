@@ -0,0 +1,201 @@
+package store
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/adamboardman/gorm"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// earthRadiusKm is the mean radius PostGIS uses for distances on a sphere
+const earthRadiusKm = 6371.0088
+
+// kmPerDegree is the length of a degree of latitude, and the most a degree of longitude can be
+const kmPerDegree = 111.32
+
+// publicPointSQL is the stored point blurred the way BlurPoint does it, the two parameters are the precision
+const publicPointSQL = "ST_MakePoint(ROUND(longitude::numeric, ?)::float8, ROUND(latitude::numeric, ?)::float8)::geography"
+
+// Place is a gazetteer entry, a town or postcode with the point it is at, looked up by its Key
+type Place struct {
+	gorm.Model
+	Name      string
+	Key       string
+	Latitude  float64
+	Longitude float64
+}
+
+// NearbyUser is a member found by a proximity search with how far they are from the point searched
+type NearbyUser struct {
+	PublicUser
+	Latitude   float64
+	Longitude  float64
+	DistanceKm float64
+}
+
+// PlaceKey normalises a place name or postcode so "BS1 4DJ" and "bs14dj" find the same place
+func PlaceKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+func ValidCoordinates(latitude float64, longitude float64) bool {
+	return latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+// DistanceKm is the great circle distance between two points
+func DistanceKm(latitude1 float64, longitude1 float64, latitude2 float64, longitude2 float64) float64 {
+	radians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLatitude := radians(latitude2 - latitude1)
+	dLongitude := radians(longitude2 - longitude1)
+	a := math.Sin(dLatitude/2)*math.Sin(dLatitude/2) +
+		math.Cos(radians(latitude1))*math.Cos(radians(latitude2))*math.Sin(dLongitude/2)*math.Sin(dLongitude/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// BlurPoint rounds a point to precision decimal places, as closely as other members may know where it is
+func BlurPoint(latitude float64, longitude float64, precision int) (float64, float64) {
+	scale := math.Pow(10, float64(precision))
+	return math.Round(latitude*scale) / scale, math.Round(longitude*scale) / scale
+}
+
+// BlurCellKm is the size of the cells points are rounded to at precision decimal places, no blurred point is
+// further than this from the point it came from
+func BlurCellKm(precision int) float64 {
+	return kmPerDegree * math.Pow(10, -float64(precision))
+}
+
+// ReadPlacesCSV reads name,latitude,longitude lines, skipping a header line if there is one
+func ReadPlacesCSV(reader io.Reader) ([]Place, error) {
+	lines := csv.NewReader(reader)
+	lines.FieldsPerRecord = 3
+	lines.TrimLeadingSpace = true
+	var places []Place
+	for line := 1; ; line++ {
+		record, err := lines.Read()
+		if err == io.EOF {
+			return places, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		latitude, latErr := strconv.ParseFloat(record[1], 64)
+		longitude, lngErr := strconv.ParseFloat(record[2], 64)
+		if line == 1 && (latErr != nil || lngErr != nil) {
+			continue
+		}
+		if latErr != nil || lngErr != nil || !ValidCoordinates(latitude, longitude) || len(PlaceKey(record[0])) == 0 {
+			return nil, fmt.Errorf("line %d: expected a name, latitude and longitude", line)
+		}
+		places = append(places, Place{Name: strings.TrimSpace(record[0]), Key: PlaceKey(record[0]), Latitude: latitude, Longitude: longitude})
+	}
+}
+
+var errNoPlaces = errors.New("no places to save")
+
+// SavePlaces adds places to the gazetteer, replacing any with the same key
+func (s *PostgresStore) SavePlaces(places []Place) (int, error) {
+	if len(places) == 0 {
+		return 0, errNoPlaces
+	}
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	now := time.Now()
+	for _, place := range places {
+		err := tx.Exec(`INSERT INTO places (created_at, updated_at, name, key, latitude, longitude) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (key) DO UPDATE SET updated_at=EXCLUDED.updated_at, name=EXCLUDED.name, latitude=EXCLUDED.latitude, longitude=EXCLUDED.longitude, deleted_at=NULL`,
+			now, now, place.Name, PlaceKey(place.Key), place.Latitude, place.Longitude).Error
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(places), tx.Commit().Error
+}
+
+func (s *PostgresStore) LookupPlace(name string) (*Place, error) {
+	place := Place{}
+	err := s.db.Where("key=?", PlaceKey(name)).Take(&place).Error
+	if err != nil {
+		return nil, err
+	}
+	return &place, nil
+}
+
+// ListUsersNear finds the members within radiusKm of the point, nearest first. Members are placed at their location
+// blurred to precision decimal places, so a search can never find anyone more closely than they are shown. The
+// indexed geo_point narrows the search to the members that could be in range before they are blurred.
+func (s *PostgresStore) ListUsersNear(latitude float64, longitude float64, radiusKm float64, precision int, limit int) ([]NearbyUser, error) {
+	var users []NearbyUser
+	err := s.db.Raw(`SELECT id, created_at, updated_at, deleted_at, first_name, mid_names, last_name, location, photo_id, latitude, longitude,
+	ST_Distance(public_point, ST_MakePoint(?, ?)::geography, false) / 1000 AS distance_km
+FROM (SELECT *, `+publicPointSQL+` AS public_point FROM users
+	WHERE deleted_at IS NULL AND geo_point IS NOT NULL AND ST_DWithin(geo_point, ST_MakePoint(?, ?)::geography, ?, false)) AS candidates
+WHERE ST_DWithin(public_point, ST_MakePoint(?, ?)::geography, ?, false)
+ORDER BY distance_km, id LIMIT ?`, longitude, latitude, precision, precision, longitude, latitude, (radiusKm+BlurCellKm(precision))*1000,
+		longitude, latitude, radiusKm*1000, limit).Scan(&users).Error
+	return users, err
+}
+
+func (s *MemoryStore) SavePlaces(places []Place) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(places) == 0 {
+		return 0, errNoPlaces
+	}
+	for _, place := range places {
+		place.Key = PlaceKey(place.Key)
+		if existing, ok := s.places[place.Key]; ok {
+			place.Model = existing.Model
+		}
+		s.saveModel(&place.Model, func(id uint) bool { return id != 0 })
+		s.places[place.Key] = place
+	}
+	return len(places), nil
+}
+
+func (s *MemoryStore) LookupPlace(name string) (*Place, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	place, ok := s.places[PlaceKey(name)]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &place, nil
+}
+
+func (s *MemoryStore) ListUsersNear(latitude float64, longitude float64, radiusKm float64, precision int, limit int) ([]NearbyUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var users []NearbyUser
+	for _, user := range s.users {
+		if user.Latitude == nil || user.Longitude == nil {
+			continue
+		}
+		publicLatitude, publicLongitude := BlurPoint(*user.Latitude, *user.Longitude, precision)
+		distance := DistanceKm(latitude, longitude, publicLatitude, publicLongitude)
+		if distance <= radiusKm {
+			users = append(users, NearbyUser{user.PublicUser, *user.Latitude, *user.Longitude, distance})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].DistanceKm < users[j].DistanceKm || (users[i].DistanceKm == users[j].DistanceKm && users[i].ID < users[j].ID)
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
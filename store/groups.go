@@ -0,0 +1,352 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"sort"
+	"time"
+)
+
+const (
+	TransactionGroupUnknown = iota
+	TransactionGroupPending
+	TransactionGroupPosted
+	TransactionGroupRejected
+	TransactionGroupCancelled
+	TransactionGroupExpired
+)
+
+// ErrTransactionInGroup is returned when a leg is posted or closed on its own rather than with its group
+var ErrTransactionInGroup = errors.New("transaction is part of a group")
+
+// TransactionGroup links legs that all offer from, or all request to, UserId. It posts once every counterparty has
+// approved their leg, all legs together or none.
+type TransactionGroup struct {
+	gorm.Model
+	UserId      uint
+	Status      uint
+	Description string
+	Legs        []Transaction `gorm:"-"`
+}
+
+// legStatus is the status a pending leg moves to when its group is closed with status
+func (t Transaction) legStatus(groupStatus uint) uint {
+	switch groupStatus {
+	case TransactionGroupRejected:
+		return t.RejectedStatus()
+	case TransactionGroupExpired:
+		return t.ExpiredStatus()
+	}
+	return t.CancelledStatus()
+}
+
+// approveLeg records the counterparty's approval of the leg, true when every leg of the group has been approved
+func approveLeg(legs []Transaction, transactionId uint, now time.Time) (*Transaction, bool, error) {
+	var approved *Transaction
+	allApproved := true
+	for i := range legs {
+		if legs[i].ID == transactionId {
+			if !legs[i].IsPending() {
+				return nil, false, ErrTransactionNotPending
+			}
+			if legs[i].ApprovedDate == nil {
+				approvedDate := PosixDateTime(now.Truncate(time.Microsecond))
+				legs[i].ApprovedDate = &approvedDate
+			}
+			approved = &legs[i]
+		}
+		allApproved = allApproved && legs[i].ApprovedDate != nil
+	}
+	if approved == nil {
+		return nil, false, gorm.ErrRecordNotFound
+	}
+	return approved, allApproved, nil
+}
+
+// InsertTransactionGroup inserts the group and its pending legs together
+func (s *PostgresStore) InsertTransactionGroup(group *TransactionGroup, legs []Transaction) (uint, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	group.Status = TransactionGroupPending
+	err := tx.Create(group).Error
+	for i := 0; err == nil && i < len(legs); i++ {
+		legs[i].GroupId = group.ID
+		err = tx.Create(&legs[i]).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	group.Legs = legs
+	return group.ID, tx.Commit().Error
+}
+
+func (s *PostgresStore) LoadTransactionGroup(id uint) (*TransactionGroup, error) {
+	group := TransactionGroup{}
+	err := s.db.Where("id=?", id).Take(&group).Error
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Where("group_id=?", id).Order("id").Find(&group.Legs).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (s *PostgresStore) ListTransactionGroups(ids []uint) ([]TransactionGroup, error) {
+	var groups []TransactionGroup
+	if len(ids) == 0 {
+		return groups, nil
+	}
+	err := s.db.Where("id IN (?)", ids).Order("id").Find(&groups).Error
+	return groups, err
+}
+
+// ApproveGroupTransaction records the counterparty's approval of a leg and posts every leg of the group once they
+// have all been approved. A leg that can not be posted leaves the whole group, and this approval, unchanged.
+func (s *PostgresStore) ApproveGroupTransaction(transactionId uint) (*TransactionGroup, error) {
+	var group *TransactionGroup
+	var err error
+	for attempt := 0; attempt < postTransactionAttempts; attempt++ {
+		group, err = s.approveGroupTransaction(transactionId)
+		if !isSerializationFailure(err) {
+			break
+		}
+		time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+	}
+	return group, err
+}
+
+func (s *PostgresStore) approveGroupTransaction(transactionId uint) (*TransactionGroup, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	group, err := s.approveGroupTransactionInTx(tx, transactionId)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return group, tx.Commit().Error
+}
+
+func (s *PostgresStore) lockTransactionGroup(tx *gorm.DB, groupId uint) (*TransactionGroup, error) {
+	group := TransactionGroup{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", groupId).Find(&group).Error
+	if err != nil {
+		return nil, err
+	}
+	if group.Status != TransactionGroupPending {
+		return nil, ErrTransactionNotPending
+	}
+	err = tx.Set("gorm:query_option", "FOR UPDATE").Where("group_id=?", groupId).Order("id").Find(&group.Legs).Error
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (s *PostgresStore) approveGroupTransactionInTx(tx *gorm.DB, transactionId uint) (*TransactionGroup, error) {
+	err := tx.Exec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE").Error
+	if err != nil {
+		return nil, err
+	}
+	leg := Transaction{}
+	err = tx.Where("id=? AND group_id<>0", transactionId).Take(&leg).Error
+	if err != nil {
+		return nil, err
+	}
+	group, err := s.lockTransactionGroup(tx, leg.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	approved, allApproved, err := approveLeg(group.Legs, transactionId, time.Now())
+	if err == nil {
+		err = tx.Save(approved).Error
+	}
+	if err != nil || !allApproved {
+		return group, err
+	}
+
+	// every party is locked up front, in id order, so posting the legs one by one can not deadlock
+	userIds := []uint{group.UserId}
+	if s.feeUserId != 0 {
+		userIds = append(userIds, s.feeUserId)
+	}
+	for _, leg := range group.Legs {
+		userIds = append(userIds, leg.CounterpartyId())
+	}
+	err = lockUsers(tx, userIds...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range group.Legs {
+		posted, err := s.postTransactionInTx(tx, group.Legs[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		group.Legs[i] = *posted
+	}
+	group.Status = TransactionGroupPosted
+	err = tx.Save(group).Error
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// CloseTransactionGroup rejects, cancels or expires a pending group along with its pending legs
+func (s *PostgresStore) CloseTransactionGroup(groupId uint, status uint) (*TransactionGroup, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	group, err := s.lockTransactionGroup(tx, groupId)
+	if err == nil {
+		now := time.Now()
+		for i := 0; err == nil && i < len(group.Legs); i++ {
+			if group.Legs[i].IsPending() {
+				group.Legs[i].close(group.Legs[i].legStatus(status), now)
+				err = tx.Save(&group.Legs[i]).Error
+			}
+		}
+	}
+	if err == nil {
+		group.Status = status
+		err = tx.Save(group).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return group, tx.Commit().Error
+}
+
+func (s *MemoryStore) InsertTransactionGroup(group *TransactionGroup, legs []Transaction) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.users[group.UserId]; !ok {
+		return 0, errForeignKey
+	}
+	for _, leg := range legs {
+		_, fromExists := s.users[leg.FromUserId]
+		_, toExists := s.users[leg.ToUserId]
+		if !fromExists || !toExists {
+			return 0, errForeignKey
+		}
+	}
+	group.Status = TransactionGroupPending
+	group.Legs = nil
+	s.saveModel(&group.Model, func(id uint) bool { _, ok := s.transactionGroups[id]; return ok })
+	s.transactionGroups[group.ID] = *group
+	for i := range legs {
+		legs[i].GroupId = group.ID
+		_, _ = s.saveTransaction(&legs[i])
+	}
+	group.Legs = legs
+	return group.ID, nil
+}
+
+func (s *MemoryStore) loadTransactionGroup(id uint) (*TransactionGroup, error) {
+	group, ok := s.transactionGroups[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	group.Legs = s.sortedTransactions(func(transaction Transaction) bool {
+		return transaction.GroupId == id
+	}, func(a, b Transaction) (bool, bool) { return false, false })
+	return &group, nil
+}
+
+func (s *MemoryStore) LoadTransactionGroup(id uint) (*TransactionGroup, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loadTransactionGroup(id)
+}
+
+func (s *MemoryStore) ListTransactionGroups(ids []uint) ([]TransactionGroup, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var groups []TransactionGroup
+	for _, id := range ids {
+		if group, ok := s.transactionGroups[id]; ok {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups, nil
+}
+
+func (s *MemoryStore) ApproveGroupTransaction(transactionId uint) (*TransactionGroup, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	leg, ok := s.transactions[transactionId]
+	if !ok || leg.GroupId == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	group, err := s.loadTransactionGroup(leg.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	if group.Status != TransactionGroupPending {
+		return nil, ErrTransactionNotPending
+	}
+	approved, allApproved, err := approveLeg(group.Legs, transactionId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !allApproved {
+		_, err = s.saveTransaction(approved)
+		return group, err
+	}
+
+	// posting is undone if any leg fails, leaving the group as it was before this approval
+	original := map[uint]Transaction{}
+	for _, leg := range group.Legs {
+		original[leg.ID] = s.transactions[leg.ID]
+	}
+	for i := range group.Legs {
+		err = s.postTransaction(&group.Legs[i])
+		if err != nil {
+			for id, leg := range original {
+				s.transactions[id] = leg
+			}
+			return nil, err
+		}
+	}
+	group.Status = TransactionGroupPosted
+	stored := *group
+	stored.Legs = nil
+	s.saveModel(&stored.Model, func(id uint) bool { return true })
+	s.transactionGroups[group.ID] = stored
+	group.UpdatedAt = stored.UpdatedAt
+	return group, nil
+}
+
+func (s *MemoryStore) CloseTransactionGroup(groupId uint, status uint) (*TransactionGroup, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	group, err := s.loadTransactionGroup(groupId)
+	if err != nil {
+		return nil, err
+	}
+	if group.Status != TransactionGroupPending {
+		return nil, ErrTransactionNotPending
+	}
+	now := time.Now()
+	for i := range group.Legs {
+		if group.Legs[i].IsPending() {
+			group.Legs[i].close(group.Legs[i].legStatus(status), now)
+			_, _ = s.saveTransaction(&group.Legs[i])
+		}
+	}
+	group.Status = status
+	stored := *group
+	stored.Legs = nil
+	s.saveModel(&stored.Model, func(id uint) bool { return true })
+	s.transactionGroups[group.ID] = stored
+	return group, nil
+}
@@ -0,0 +1,224 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+const (
+	TransactionDirectionAny = ""
+	TransactionDirectionIn  = "in"
+	TransactionDirectionOut = "out"
+)
+
+// TransactionFilter selects a page of a user's transactions, zero values leave a filter unset
+type TransactionFilter struct {
+	UserId         uint
+	Statuses       []uint
+	CounterpartyId uint
+	Direction      string
+	From           time.Time
+	To             time.Time
+	MinSeconds     uint64
+	MaxSeconds     uint64
+	Descending     bool
+	After          *TransactionCursor
+	Limit          int
+}
+
+// TransactionCursor is the position of the last transaction on a page in the history ordering
+type TransactionCursor struct {
+	ConfirmedDate time.Time
+	InitiatedDate time.Time
+	ID            uint
+}
+
+type TransactionPage struct {
+	Transactions []Transaction
+	Total        int
+	Next         *TransactionCursor
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// transactionDateSQL matches Transaction.Date
+const transactionDateSQL = "(CASE WHEN confirmed_date > '0001-01-01 00:00:00+00' THEN confirmed_date ELSE initiated_date END)"
+
+// Date is when the transaction was posted, or when it was initiated if it has not been
+func (t Transaction) Date() time.Time {
+	if time.Time(t.ConfirmedDate).IsZero() {
+		return time.Time(t.InitiatedDate)
+	}
+	return time.Time(t.ConfirmedDate)
+}
+
+func CursorFor(transaction Transaction) *TransactionCursor {
+	return &TransactionCursor{
+		ConfirmedDate: time.Time(transaction.ConfirmedDate),
+		InitiatedDate: time.Time(transaction.InitiatedDate),
+		ID:            transaction.ID,
+	}
+}
+
+func (c TransactionCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeTransactionCursor(encoded string) (*TransactionCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	cursor := TransactionCursor{}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || cursor.ID == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// matches applies every filter except the cursor
+func (f TransactionFilter) matches(transaction Transaction) bool {
+	switch f.Direction {
+	case TransactionDirectionIn:
+		if transaction.ToUserId != f.UserId {
+			return false
+		}
+	case TransactionDirectionOut:
+		if transaction.FromUserId != f.UserId {
+			return false
+		}
+	default:
+		if transaction.FromUserId != f.UserId && transaction.ToUserId != f.UserId {
+			return false
+		}
+	}
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, status := range f.Statuses {
+			found = found || transaction.Status == status
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.CounterpartyId > 0 && !(transaction.FromUserId == f.UserId && transaction.ToUserId == f.CounterpartyId) &&
+		!(transaction.ToUserId == f.UserId && transaction.FromUserId == f.CounterpartyId) {
+		return false
+	}
+	date := transaction.Date()
+	if (!f.From.IsZero() && date.Before(f.From)) || (!f.To.IsZero() && date.After(f.To)) {
+		return false
+	}
+	if transaction.Seconds < f.MinSeconds || (f.MaxSeconds > 0 && transaction.Seconds > f.MaxSeconds) {
+		return false
+	}
+	return true
+}
+
+// historyBefore orders transactions by confirmed date, then initiated date, then id
+func historyBefore(a *TransactionCursor, b *TransactionCursor) bool {
+	if !a.ConfirmedDate.Equal(b.ConfirmedDate) {
+		return a.ConfirmedDate.Before(b.ConfirmedDate)
+	}
+	if !a.InitiatedDate.Equal(b.InitiatedDate) {
+		return a.InitiatedDate.Before(b.InitiatedDate)
+	}
+	return a.ID < b.ID
+}
+
+func (s *PostgresStore) ListTransactions(filter TransactionFilter) (*TransactionPage, error) {
+	query := s.db.Model(&Transaction{})
+	switch filter.Direction {
+	case TransactionDirectionIn:
+		query = query.Where("to_user_id=?", filter.UserId)
+	case TransactionDirectionOut:
+		query = query.Where("from_user_id=?", filter.UserId)
+	default:
+		query = query.Where("from_user_id=? OR to_user_id=?", filter.UserId, filter.UserId)
+	}
+	if len(filter.Statuses) > 0 {
+		query = query.Where("status IN (?)", filter.Statuses)
+	}
+	if filter.CounterpartyId > 0 {
+		query = query.Where("(from_user_id=? AND to_user_id=?) OR (to_user_id=? AND from_user_id=?)",
+			filter.UserId, filter.CounterpartyId, filter.UserId, filter.CounterpartyId)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where(transactionDateSQL+" >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where(transactionDateSQL+" <= ?", filter.To)
+	}
+	if filter.MinSeconds > 0 {
+		query = query.Where("seconds >= ?", filter.MinSeconds)
+	}
+	if filter.MaxSeconds > 0 {
+		query = query.Where("seconds <= ?", filter.MaxSeconds)
+	}
+
+	page := TransactionPage{}
+	err := query.Count(&page.Total).Error
+	if err != nil {
+		return nil, err
+	}
+
+	order := "confirmed_date, initiated_date, id"
+	comparison := ">"
+	if filter.Descending {
+		order = "confirmed_date DESC, initiated_date DESC, id DESC"
+		comparison = "<"
+	}
+	if filter.After != nil {
+		query = query.Where("(confirmed_date, initiated_date, id) "+comparison+" (?, ?, ?)",
+			filter.After.ConfirmedDate, filter.After.InitiatedDate, filter.After.ID)
+	}
+	query = query.Order(order)
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit + 1)
+	}
+	err = query.Find(&page.Transactions).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	if filter.Limit > 0 && len(page.Transactions) > filter.Limit {
+		page.Transactions = page.Transactions[:filter.Limit]
+		page.Next = CursorFor(page.Transactions[filter.Limit-1])
+	}
+	return &page, nil
+}
+
+func (s *MemoryStore) ListTransactions(filter TransactionFilter) (*TransactionPage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	matching := s.sortedTransactions(filter.matches, func(a, b Transaction) (bool, bool) {
+		cursorA, cursorB := CursorFor(a), CursorFor(b)
+		if historyBefore(cursorA, cursorB) {
+			return !filter.Descending, true
+		}
+		if historyBefore(cursorB, cursorA) {
+			return filter.Descending, true
+		}
+		return false, false
+	})
+
+	page := TransactionPage{Total: len(matching)}
+	for _, transaction := range matching {
+		if filter.After != nil {
+			cursor := CursorFor(transaction)
+			if (!filter.Descending && !historyBefore(filter.After, cursor)) || (filter.Descending && !historyBefore(cursor, filter.After)) {
+				continue
+			}
+		}
+		if filter.Limit > 0 && len(page.Transactions) == filter.Limit {
+			page.Next = CursorFor(page.Transactions[filter.Limit-1])
+			break
+		}
+		page.Transactions = append(page.Transactions, transaction)
+	}
+	return &page, nil
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/adamboardman/gorm"
+	"strconv"
+	"time"
+)
+
+const (
+	LedgerBrokenLink   = "broken_link"
+	LedgerMissingEntry = "missing_entry"
+	LedgerBalanceJump  = "balance_jump"
+	LedgerHashMismatch = "hash_mismatch"
+)
+
+type LedgerProblem struct {
+	TransactionId uint
+	Kind          string
+	Detail        string
+}
+
+type LedgerReport struct {
+	UserId   uint
+	Entries  int
+	Balance  int64
+	Valid    bool
+	Problems []LedgerProblem
+}
+
+// ledgerHash chains a posted transaction to the previous entries in each parties ledgers, the confirmed date is
+// hashed at microsecond precision as that is what postgres stores. The fee account is only hashed when it collected
+// the fee so entries posted before there was one still verify.
+func (t Transaction) ledgerHash(fromPreviousHash string, toPreviousHash string, feePreviousHash string) string {
+	content := fmt.Sprintf("%d|%d|%d|%d|%d|%s|%d|%d|%d|%d|%d|%d|%q|%q|%s|%s",
+		t.ID,
+		time.Time(t.ConfirmedDate).UnixNano()/int64(time.Microsecond),
+		t.FromUserId,
+		t.ToUserId,
+		t.Seconds,
+		strconv.FormatFloat(float64(t.Multiplier), 'f', -1, 32),
+		t.TxFee,
+		t.Status,
+		t.FromPreviousTId,
+		t.ToPreviousTId,
+		t.FromUserBalance,
+		t.ToUserBalance,
+		t.Description,
+		t.Location,
+		fromPreviousHash,
+		toPreviousHash)
+	if t.FeeUserId != 0 {
+		content += fmt.Sprintf("|%d|%d|%d|%s", t.FeeUserId, t.FeePreviousTId, t.FeeUserBalance, feePreviousHash)
+	}
+	if t.ReversesTId != 0 {
+		content += fmt.Sprintf("|reverses|%d", t.ReversesTId)
+	}
+	if t.CreditedSeconds != t.Seconds {
+		content += fmt.Sprintf("|credited|%d", t.CreditedSeconds)
+	}
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t Transaction) previousTId(userId uint) uint {
+	if userId == t.FromUserId {
+		return t.FromPreviousTId
+	} else if userId == t.FeeUserId && userId != t.ToUserId {
+		return t.FeePreviousTId
+	}
+	return t.ToPreviousTId
+}
+
+// BalanceChange is how much posting the transaction moves the user's balance
+func (t Transaction) BalanceChange(userId uint) int64 {
+	var change int64
+	if userId == t.FromUserId {
+		change -= int64(t.CreditedSeconds)
+	}
+	if userId == t.ToUserId {
+		change += int64(t.CreditedSeconds)
+	}
+	if userId == t.InitiatorId() {
+		change -= int64(t.TxFee)
+	}
+	if userId == t.FeeUserId {
+		change += int64(t.TxFee)
+	}
+	return change
+}
+
+// VerifyLedger walks the chain of posted transactions for a user checking that each entry links to the one before
+// it, that the running balance only moves by the amount posted and that the content hash still matches
+func (s *PostgresStore) VerifyLedger(userId uint) (*LedgerReport, error) {
+	var transactions []Transaction
+	err := s.db.Where("status IN (?) AND (from_user_id=? OR to_user_id=? OR fee_user_id=?)", postedStatuses, userId, userId, userId).Order("confirmed_date, id").Find(&transactions).Error
+	if err != nil {
+		return nil, err
+	}
+	return verifyLedger(userId, transactions, func(id uint) (*Transaction, error) {
+		transaction := Transaction{}
+		err := s.db.Unscoped().Where("id=?", id).Find(&transaction).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return &transaction, err
+	})
+}
+
+func verifyLedger(userId uint, transactions []Transaction, loadTransaction func(id uint) (*Transaction, error)) (*LedgerReport, error) {
+	report := LedgerReport{UserId: userId, Entries: len(transactions)}
+	var previous *Transaction
+	for i := range transactions {
+		transaction := &transactions[i]
+		var expectedPreviousId uint
+		var previousBalance int64
+		var previousHash string
+		if previous != nil {
+			expectedPreviousId = previous.ID
+			previousBalance = previous.Balance(userId)
+			previousHash = previous.Hash
+		}
+
+		previousId := transaction.previousTId(userId)
+		if previousId != expectedPreviousId {
+			linked, err := loadTransaction(previousId)
+			if err != nil {
+				return nil, err
+			}
+			if previousId != 0 && (linked == nil || linked.DeletedAt != nil) {
+				report.Problems = append(report.Problems, LedgerProblem{transaction.ID, LedgerMissingEntry,
+					fmt.Sprintf("previous entry %d is missing from the ledger", previousId)})
+			} else {
+				report.Problems = append(report.Problems, LedgerProblem{transaction.ID, LedgerBrokenLink,
+					fmt.Sprintf("links to previous entry %d, expected %d", previousId, expectedPreviousId)})
+			}
+		}
+
+		expectedBalance := previousBalance + transaction.BalanceChange(userId)
+		if transaction.Balance(userId) != expectedBalance {
+			report.Problems = append(report.Problems, LedgerProblem{transaction.ID, LedgerBalanceJump,
+				fmt.Sprintf("balance %d, expected %d", transaction.Balance(userId), expectedBalance)})
+		}
+
+		previousHashFor := func(partyId uint) (string, error) {
+			if partyId == userId {
+				return previousHash, nil
+			}
+			partyPreviousId := transaction.previousTId(partyId)
+			if partyPreviousId == 0 {
+				return "", nil
+			}
+			partyPrevious, err := loadTransaction(partyPreviousId)
+			if err != nil || partyPrevious == nil {
+				return "", err
+			}
+			return partyPrevious.Hash, nil
+		}
+		var previousHashes [3]string
+		for i, partyId := range []uint{transaction.FromUserId, transaction.ToUserId, transaction.FeeUserId} {
+			if partyId != 0 {
+				hash, err := previousHashFor(partyId)
+				if err != nil {
+					return nil, err
+				}
+				previousHashes[i] = hash
+			}
+		}
+		if transaction.Hash != transaction.ledgerHash(previousHashes[0], previousHashes[1], previousHashes[2]) {
+			report.Problems = append(report.Problems, LedgerProblem{transaction.ID, LedgerHashMismatch,
+				"content does not match the recorded hash"})
+		}
+
+		previous = transaction
+	}
+	if previous != nil {
+		report.Balance = previous.Balance(userId)
+	}
+	report.Valid = len(report.Problems) == 0
+	return &report, nil
+}
@@ -0,0 +1,218 @@
+package store
+
+import (
+	"fmt"
+	"github.com/adamboardman/gorm"
+	"sort"
+)
+
+// NoLimit turns off a credit limit or balance cap
+const NoLimit int64 = -1
+
+const (
+	CreditLimitSourceDefault = "default"
+	CreditLimitSourceTier    = "tier"
+	CreditLimitSourceMember  = "member"
+)
+
+// CreditLimit is how far below zero a balance may go and the highest balance allowed, in seconds. It applies to a
+// member when UserId is set, otherwise to every member with the Permissions tier.
+type CreditLimit struct {
+	gorm.Model
+	UserId      uint
+	Permissions UserPermissions
+	CreditLimit int64
+	BalanceCap  int64
+	Source      string `gorm:"-"`
+}
+
+const (
+	LimitKindCredit     = "credit_limit"
+	LimitKindBalanceCap = "balance_cap"
+)
+
+// LimitError is returned when posting a transaction would take a balance past a limit, Shortfall is by how much
+type LimitError struct {
+	UserId    uint
+	Kind      string
+	Limit     int64
+	Balance   int64
+	Shortfall int64
+}
+
+func (e *LimitError) Error() string {
+	if e.Kind == LimitKindBalanceCap {
+		return fmt.Sprintf("balance of user %d would be %d, over the balance cap of %d by %d", e.UserId, e.Balance, e.Limit, e.Shortfall)
+	}
+	return fmt.Sprintf("balance of user %d would be %d, past the credit limit of %d by %d", e.UserId, e.Balance, e.Limit, e.Shortfall)
+}
+
+// AvailableCredit is how much the balance can still go down by, NoLimit when there is no credit limit
+func (l CreditLimit) AvailableCredit(balance int64) int64 {
+	if l.CreditLimit == NoLimit {
+		return NoLimit
+	}
+	if balance+l.CreditLimit < 0 {
+		return 0
+	}
+	return balance + l.CreditLimit
+}
+
+// resolveCreditLimit prefers the member's own limit, then their tier's, then the default
+func resolveCreditLimit(userId uint, permissions UserPermissions, limits []CreditLimit, defaults CreditLimit) CreditLimit {
+	resolved := defaults
+	resolved.Source = CreditLimitSourceDefault
+	for _, limit := range limits {
+		if limit.UserId == userId {
+			limit.Source = CreditLimitSourceMember
+			return limit
+		}
+		if limit.UserId == 0 && limit.Permissions == permissions {
+			resolved = limit
+			resolved.Source = CreditLimitSourceTier
+		}
+	}
+	return resolved
+}
+
+// checkLimits makes sure posting the transaction does not take the payer past their credit limit or the payee over
+// their balance cap, the fee account is not limited and neither are reversals, which only undo an earlier posting
+func (t Transaction) checkLimits(feeUserId uint, limitFor func(userId uint) (CreditLimit, error)) error {
+	if t.ReversesTId != 0 {
+		return nil
+	}
+	for _, userId := range []uint{t.FromUserId, t.ToUserId} {
+		change := t.BalanceChange(userId)
+		if userId == feeUserId || change == 0 {
+			continue
+		}
+		limit, err := limitFor(userId)
+		if err != nil {
+			return err
+		}
+		balance := t.Balance(userId)
+		if change < 0 && limit.CreditLimit != NoLimit && balance < -limit.CreditLimit {
+			return &LimitError{userId, LimitKindCredit, limit.CreditLimit, balance, -limit.CreditLimit - balance}
+		}
+		if change > 0 && limit.BalanceCap != NoLimit && balance > limit.BalanceCap {
+			return &LimitError{userId, LimitKindBalanceCap, limit.BalanceCap, balance, balance - limit.BalanceCap}
+		}
+	}
+	return nil
+}
+
+// SetDefaultCreditLimit applies to members without a limit of their own or for their tier
+func (s *PostgresStore) SetDefaultCreditLimit(creditLimit int64, balanceCap int64) {
+	s.defaultLimit = CreditLimit{CreditLimit: creditLimit, BalanceCap: balanceCap}
+}
+
+func creditLimitFor(db *gorm.DB, userId uint, defaults CreditLimit) (CreditLimit, error) {
+	user := User{}
+	err := db.Where("id=?", userId).Take(&user).Error
+	if err != nil {
+		return CreditLimit{}, err
+	}
+	var limits []CreditLimit
+	err = db.Where("user_id=? OR (user_id=0 AND permissions=?)", userId, user.Permissions).Find(&limits).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return CreditLimit{}, err
+	}
+	return resolveCreditLimit(userId, user.Permissions, limits, defaults), nil
+}
+
+func (s *PostgresStore) CreditLimitFor(userId uint) (CreditLimit, error) {
+	return creditLimitFor(s.db, userId, s.defaultLimit)
+}
+
+func (s *PostgresStore) ListCreditLimits() ([]CreditLimit, error) {
+	var limits []CreditLimit
+	err := s.db.Order("user_id, permissions").Find(&limits).Error
+	return limits, err
+}
+
+// SaveCreditLimit replaces the limit for the member or tier
+func (s *PostgresStore) SaveCreditLimit(limit *CreditLimit) (uint, error) {
+	existing := CreditLimit{}
+	err := s.db.Where("user_id=? AND permissions=?", limit.UserId, limit.Permissions).Take(&existing).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return 0, err
+	}
+	limit.ID = existing.ID
+	limit.CreatedAt = existing.CreatedAt
+	err = s.db.Save(limit).Error
+	return limit.ID, err
+}
+
+func (s *PostgresStore) DeleteCreditLimit(userId uint, permissions UserPermissions) error {
+	query := s.db.Unscoped().Where("user_id=? AND permissions=?", userId, permissions).Delete(CreditLimit{})
+	if query.Error == nil && query.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return query.Error
+}
+
+func (s *MemoryStore) SetDefaultCreditLimit(creditLimit int64, balanceCap int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultLimit = CreditLimit{CreditLimit: creditLimit, BalanceCap: balanceCap}
+}
+
+func (s *MemoryStore) creditLimitFor(userId uint) (CreditLimit, error) {
+	user, ok := s.users[userId]
+	if !ok {
+		return CreditLimit{}, gorm.ErrRecordNotFound
+	}
+	var limits []CreditLimit
+	for _, limit := range s.creditLimits {
+		limits = append(limits, limit)
+	}
+	return resolveCreditLimit(userId, user.Permissions, limits, s.defaultLimit), nil
+}
+
+func (s *MemoryStore) CreditLimitFor(userId uint) (CreditLimit, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.creditLimitFor(userId)
+}
+
+func (s *MemoryStore) ListCreditLimits() ([]CreditLimit, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var limits []CreditLimit
+	for _, limit := range s.creditLimits {
+		limits = append(limits, limit)
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].UserId != limits[j].UserId {
+			return limits[i].UserId < limits[j].UserId
+		}
+		return limits[i].Permissions < limits[j].Permissions
+	})
+	return limits, nil
+}
+
+func (s *MemoryStore) SaveCreditLimit(limit *CreditLimit) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, existing := range s.creditLimits {
+		if existing.UserId == limit.UserId && existing.Permissions == limit.Permissions {
+			limit.ID = existing.ID
+			limit.CreatedAt = existing.CreatedAt
+		}
+	}
+	s.saveModel(&limit.Model, func(id uint) bool { _, ok := s.creditLimits[id]; return ok })
+	s.creditLimits[limit.ID] = *limit
+	return limit.ID, nil
+}
+
+func (s *MemoryStore) DeleteCreditLimit(userId uint, permissions UserPermissions) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, limit := range s.creditLimits {
+		if limit.UserId == userId && limit.Permissions == permissions {
+			delete(s.creditLimits, id)
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ListingUnknown = iota
+	ListingOffer
+	ListingWant
+)
+
+// Listing is a member saying what they can do, an offer, or what they need done, a want. The category can be
+// linked to the Concept that explains it.
+type Listing struct {
+	gorm.Model
+	UserId           uint
+	Kind             uint
+	Category         string
+	ConceptId        uint
+	Title            string
+	Description      string
+	EstimatedSeconds uint64 `gorm:"type:bigint"`
+	Multiplier       float32
+	Location         string
+	ExpiresAt        PosixDateTime `gorm:"type:timestamp with time zone"`
+	Latitude         *float64
+	Longitude        *float64
+	DistanceKm       float64 `gorm:"-" json:",omitempty"`
+}
+
+// ListingFilter narrows a listing search, zero values match everything. Query is matched against the title and
+// description, Location against the location. Listings that expired before Now are left out. A RadiusKm keeps only
+// listings within that distance of the Near point, nearest first, measured to each listing's point blurred to
+// Precision decimal places so a search never places a listing more closely than it is shown.
+type ListingFilter struct {
+	Kind          uint
+	UserId        uint
+	Category      string
+	ConceptId     uint
+	Query         string
+	Location      string
+	NearLatitude  float64
+	NearLongitude float64
+	RadiusKm      float64
+	Precision     int
+	Now           time.Time
+	Limit         int
+}
+
+func (l Listing) IsExpired(now time.Time) bool {
+	return !time.Time(l.ExpiresAt).After(now)
+}
+
+func (f ListingFilter) matches(listing Listing) bool {
+	contains := func(text string, part string) bool {
+		return strings.Contains(strings.ToLower(text), strings.ToLower(part))
+	}
+	return (f.Kind == 0 || listing.Kind == f.Kind) &&
+		(f.UserId == 0 || listing.UserId == f.UserId) &&
+		(len(f.Category) == 0 || strings.EqualFold(listing.Category, f.Category)) &&
+		(f.ConceptId == 0 || listing.ConceptId == f.ConceptId) &&
+		(len(f.Query) == 0 || contains(listing.Title, f.Query) || contains(listing.Description, f.Query)) &&
+		(len(f.Location) == 0 || contains(listing.Location, f.Location)) &&
+		(f.RadiusKm == 0 || (listing.Latitude != nil && listing.Longitude != nil && f.distanceTo(listing) <= f.RadiusKm)) &&
+		!listing.IsExpired(f.Now)
+}
+
+func (f ListingFilter) distanceTo(listing Listing) float64 {
+	latitude, longitude := BlurPoint(*listing.Latitude, *listing.Longitude, f.Precision)
+	return DistanceKm(f.NearLatitude, f.NearLongitude, latitude, longitude)
+}
+
+// likePattern escapes the LIKE wildcards in text so it only matches itself
+func likePattern(text string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%"
+}
+
+func (s *PostgresStore) InsertListing(listing *Listing) (uint, error) {
+	err := s.db.Create(listing).Error
+	return listing.ID, err
+}
+
+func (s *PostgresStore) UpdateListing(listing *Listing) (uint, error) {
+	err := s.db.Save(listing).Error
+	return listing.ID, err
+}
+
+func (s *PostgresStore) LoadListing(id uint) (*Listing, error) {
+	listing := Listing{}
+	err := s.db.Where("id=?", id).Take(&listing).Error
+	if err != nil {
+		return nil, err
+	}
+	return &listing, nil
+}
+
+func (s *PostgresStore) DeleteListing(id uint) error {
+	query := s.db.Where("id=?", id).Delete(Listing{})
+	if query.Error == nil && query.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return query.Error
+}
+
+// SearchListings finds the listings matching the filter, newest first or nearest first when searching near a point
+func (s *PostgresStore) SearchListings(filter ListingFilter) ([]Listing, error) {
+	query := s.db.Where("expires_at > ?", filter.Now)
+	if filter.Kind != 0 {
+		query = query.Where("kind=?", filter.Kind)
+	}
+	if filter.UserId != 0 {
+		query = query.Where("user_id=?", filter.UserId)
+	}
+	if len(filter.Category) > 0 {
+		query = query.Where("LOWER(category)=LOWER(?)", filter.Category)
+	}
+	if filter.ConceptId != 0 {
+		query = query.Where("concept_id=?", filter.ConceptId)
+	}
+	if len(filter.Query) > 0 {
+		query = query.Where("(title ILIKE ? OR description ILIKE ?)", likePattern(filter.Query), likePattern(filter.Query))
+	}
+	if len(filter.Location) > 0 {
+		query = query.Where("location ILIKE ?", likePattern(filter.Location))
+	}
+	var order interface{} = "created_at DESC, id DESC"
+	if filter.RadiusKm > 0 {
+		query = query.Where("ST_DWithin(geo_point, ST_MakePoint(?, ?)::geography, ?, false)",
+			filter.NearLongitude, filter.NearLatitude, (filter.RadiusKm+BlurCellKm(filter.Precision))*1000).
+			Where("ST_DWithin("+publicPointSQL+", ST_MakePoint(?, ?)::geography, ?, false)",
+				filter.Precision, filter.Precision, filter.NearLongitude, filter.NearLatitude, filter.RadiusKm*1000)
+		order = gorm.Expr("ST_Distance("+publicPointSQL+", ST_MakePoint(?, ?)::geography, false), id",
+			filter.Precision, filter.Precision, filter.NearLongitude, filter.NearLatitude)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	var listings []Listing
+	err := query.Order(order).Find(&listings).Error
+	for i := range listings {
+		if filter.RadiusKm > 0 {
+			listings[i].DistanceKm = filter.distanceTo(listings[i])
+		}
+	}
+	return listings, err
+}
+
+func (s *MemoryStore) saveListing(listing *Listing) (uint, error) {
+	if _, ok := s.users[listing.UserId]; !ok {
+		return 0, errForeignKey
+	}
+	s.saveModel(&listing.Model, func(id uint) bool { _, ok := s.listings[id]; return ok })
+	s.listings[listing.ID] = *listing
+	return listing.ID, nil
+}
+
+func (s *MemoryStore) InsertListing(listing *Listing) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveListing(listing)
+}
+
+func (s *MemoryStore) UpdateListing(listing *Listing) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveListing(listing)
+}
+
+func (s *MemoryStore) LoadListing(id uint) (*Listing, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	listing, ok := s.listings[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &listing, nil
+}
+
+func (s *MemoryStore) DeleteListing(id uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.listings[id]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delete(s.listings, id)
+	return nil
+}
+
+func (s *MemoryStore) SearchListings(filter ListingFilter) ([]Listing, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var listings []Listing
+	for _, listing := range s.listings {
+		if filter.matches(listing) {
+			listings = append(listings, listing)
+		}
+	}
+	if filter.RadiusKm > 0 {
+		for i := range listings {
+			listings[i].DistanceKm = filter.distanceTo(listings[i])
+		}
+		sort.Slice(listings, func(i, j int) bool {
+			return listings[i].DistanceKm < listings[j].DistanceKm ||
+				(listings[i].DistanceKm == listings[j].DistanceKm && listings[i].ID < listings[j].ID)
+		})
+	} else {
+		sort.Slice(listings, func(i, j int) bool { return listings[i].ID > listings[j].ID })
+	}
+	if filter.Limit > 0 && len(listings) > filter.Limit {
+		listings = listings[:filter.Limit]
+	}
+	return listings, nil
+}
@@ -0,0 +1,693 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in maps, mirroring the behaviour of PostgresStore including its foreign keys,
+// unique emails, ordering and not found errors, so tests can run without a database
+type MemoryStore struct {
+	mutex                 sync.Mutex
+	lastId                uint
+	users                 map[uint]User
+	concepts              map[uint]Concept
+	conceptTags           map[uint]ConceptTag
+	transactions          map[uint]Transaction
+	outboundEmails        map[uint]OutboundEmail
+	creditLimits          map[uint]CreditLimit
+	feeUserId             uint
+	defaultLimit          CreditLimit
+	scaleByMultiplier     bool
+	recurringTransactions map[uint]RecurringTransaction
+	transactionGroups     map[uint]TransactionGroup
+	disputes              map[uint]Dispute
+	auditEntries          map[uint]AuditEntry
+	listings              map[uint]Listing
+	places                map[string]Place
+	feedback              map[uint]Feedback
+	messageThreads        map[uint]MessageThread
+	messages              map[uint]Message
+	userBlocks            map[uint]UserBlock
+	events                map[uint]Event
+}
+
+var errForeignKey = errors.New("violates foreign key constraint")
+var errUniqueEmail = errors.New("duplicate key value violates unique constraint \"uix_users_email\"")
+
+var _ Store = &MemoryStore{}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:                 map[uint]User{},
+		concepts:              map[uint]Concept{},
+		conceptTags:           map[uint]ConceptTag{},
+		transactions:          map[uint]Transaction{},
+		outboundEmails:        map[uint]OutboundEmail{},
+		creditLimits:          map[uint]CreditLimit{},
+		defaultLimit:          CreditLimit{CreditLimit: NoLimit, BalanceCap: NoLimit},
+		recurringTransactions: map[uint]RecurringTransaction{},
+		transactionGroups:     map[uint]TransactionGroup{},
+		disputes:              map[uint]Dispute{},
+		auditEntries:          map[uint]AuditEntry{},
+		listings:              map[uint]Listing{},
+		places:                map[string]Place{},
+		feedback:              map[uint]Feedback{},
+		messageThreads:        map[uint]MessageThread{},
+		messages:              map[uint]Message{},
+		userBlocks:            map[uint]UserBlock{},
+		events:                map[uint]Event{},
+	}
+}
+
+// saveModel gives a new record an id and timestamps the way gorm's Create and Save do
+func (s *MemoryStore) saveModel(model *gorm.Model, exists func(id uint) bool) {
+	now := time.Now()
+	if model.ID == 0 || !exists(model.ID) {
+		if model.ID == 0 {
+			s.lastId++
+			model.ID = s.lastId
+		}
+		model.CreatedAt = now
+	}
+	model.UpdatedAt = now
+}
+
+func (s *MemoryStore) saveUser(user *User) (uint, error) {
+	for id, other := range s.users {
+		if other.Email == user.Email && id != user.ID {
+			return 0, errUniqueEmail
+		}
+	}
+	s.saveModel(&user.Model, func(id uint) bool { _, ok := s.users[id]; return ok })
+	s.users[user.ID] = *user
+	return user.ID, nil
+}
+
+func (s *MemoryStore) InsertUser(user *User) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.users[user.ID]; ok && user.ID != 0 {
+		return 0, errors.New("duplicate key value violates unique constraint \"users_pkey\"")
+	}
+	return s.saveUser(user)
+}
+
+func (s *MemoryStore) UpdateUser(user *User) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveUser(user)
+}
+
+func (s *MemoryStore) findUser(email string) (*User, error) {
+	for _, id := range s.sortedUserIds() {
+		if s.users[id].Email == email {
+			user := s.users[id]
+			return &user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *MemoryStore) FindUser(email string) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.findUser(email)
+}
+
+func (s *MemoryStore) PurgeUser(email string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, err := s.findUser(email)
+	if err != nil {
+		return
+	}
+	for id, transaction := range s.transactions {
+		if transaction.FromUserId == user.ID || transaction.ToUserId == user.ID {
+			delete(s.transactions, id)
+		}
+	}
+	for id, recurring := range s.recurringTransactions {
+		if recurring.UserId == user.ID || recurring.FromUserId == user.ID || recurring.ToUserId == user.ID {
+			delete(s.recurringTransactions, id)
+		}
+	}
+	for id, group := range s.transactionGroups {
+		if group.UserId == user.ID {
+			delete(s.transactionGroups, id)
+		}
+	}
+	for id, dispute := range s.disputes {
+		if _, ok := s.transactions[dispute.TransactionId]; !ok {
+			delete(s.disputes, id)
+		}
+	}
+	for id, feedback := range s.feedback {
+		if _, ok := s.transactions[feedback.TransactionId]; !ok {
+			delete(s.feedback, id)
+		}
+	}
+	for id, listing := range s.listings {
+		if listing.UserId == user.ID {
+			delete(s.listings, id)
+		}
+	}
+	for id, thread := range s.messageThreads {
+		if thread.HasParticipant(user.ID) {
+			delete(s.messageThreads, id)
+		}
+	}
+	for id, message := range s.messages {
+		if _, ok := s.messageThreads[message.ThreadId]; !ok {
+			delete(s.messages, id)
+		}
+	}
+	for id, block := range s.userBlocks {
+		if block.UserId == user.ID || block.BlockedUserId == user.ID {
+			delete(s.userBlocks, id)
+		}
+	}
+	for id, event := range s.events {
+		if event.UserId == user.ID {
+			delete(s.events, id)
+		}
+	}
+	delete(s.users, user.ID)
+}
+
+func (s *MemoryStore) RecordFailedLogin(userId uint, attemptTime time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.users[userId]
+	if !ok {
+		return 0, gorm.ErrRecordNotFound
+	}
+	user.AttemptCount++
+	user.LastAttempt = attemptTime.Format(time.RFC3339)
+	user.UpdatedAt = time.Now()
+	s.users[userId] = user
+	return user.AttemptCount, nil
+}
+
+func (s *MemoryStore) LockUser(userId uint, until time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if user, ok := s.users[userId]; ok {
+		user.AttemptCount = 0
+		user.Locked = until.Format(time.RFC3339)
+		user.UpdatedAt = time.Now()
+		s.users[userId] = user
+	}
+	return nil
+}
+
+func (s *MemoryStore) ResetLoginAttempts(userId uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if user, ok := s.users[userId]; ok {
+		user.AttemptCount = 0
+		user.LastAttempt = ""
+		user.Locked = ""
+		user.UpdatedAt = time.Now()
+		s.users[userId] = user
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListUsersWithFailedLogins() ([]User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var users []User
+	for _, id := range s.sortedUserIds() {
+		if user := s.users[id]; user.AttemptCount > 0 || len(user.Locked) > 0 {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) LoadPublicUser(id uint) (*PublicUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	publicUser := PublicUser{}
+	publicUser.ID = user.ID
+	publicUser.FirstName = user.FirstName
+	publicUser.MidNames = user.MidNames
+	publicUser.LastName = user.LastName
+	publicUser.Location = user.Location
+	publicUser.PhotoID = user.PhotoID
+	return &publicUser, nil
+}
+
+func (s *MemoryStore) LoadPrivilegedUserAsSelf(userId uint, loggedInUserId uint) (*PrivilegedUser, error) {
+	user, err := s.LoadUserAsSelf(userId, loggedInUserId)
+	if err != nil {
+		return nil, err
+	}
+	return &user.PrivilegedUser, nil
+}
+
+func (s *MemoryStore) LoadUserAsSelf(userId uint, loggedInUserId uint) (*User, error) {
+	if userId != loggedInUserId {
+		return nil, errors.New("cannot load others users")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.users[userId]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func (s *MemoryStore) sortedUserIds() []uint {
+	var ids []uint
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *MemoryStore) saveConcept(concept *Concept) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.saveModel(&concept.Model, func(id uint) bool { _, ok := s.concepts[id]; return ok })
+	s.concepts[concept.ID] = *concept
+	return concept.ID, nil
+}
+
+func (s *MemoryStore) InsertConcept(concept *Concept) (uint, error) {
+	return s.saveConcept(concept)
+}
+
+func (s *MemoryStore) UpdateConcept(concept *Concept) (uint, error) {
+	return s.saveConcept(concept)
+}
+
+func (s *MemoryStore) PurgeConcept(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, concept := range s.concepts {
+		if concept.Name == name {
+			delete(s.concepts, id)
+			for tagId, conceptTag := range s.conceptTags {
+				if conceptTag.ConceptId == id {
+					delete(s.conceptTags, tagId)
+				}
+			}
+		}
+	}
+}
+
+func (s *MemoryStore) LoadConcept(id uint) (*Concept, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	concept, ok := s.concepts[id]
+	if !ok {
+		return &Concept{}, gorm.ErrRecordNotFound
+	}
+	return &concept, nil
+}
+
+// sortedConcepts orders by name, then by id as postgres would for a table that is only ever appended to
+func (s *MemoryStore) sortedConcepts() []Concept {
+	var concepts []Concept
+	for _, concept := range s.concepts {
+		concepts = append(concepts, concept)
+	}
+	sort.Slice(concepts, func(i, j int) bool {
+		if concepts[i].Name != concepts[j].Name {
+			return concepts[i].Name < concepts[j].Name
+		}
+		return concepts[i].ID < concepts[j].ID
+	})
+	return concepts
+}
+
+func (s *MemoryStore) FindConcept(name string) (*Concept, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, concept := range s.sortedConcepts() {
+		if concept.Name == name {
+			return &concept, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *MemoryStore) ListConcepts() ([]Concept, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	concepts := s.sortedConcepts()
+	if len(concepts) > 200 {
+		concepts = concepts[:200]
+	}
+	return concepts, nil
+}
+
+func (s *MemoryStore) saveConceptTag(conceptTag *ConceptTag) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.concepts[conceptTag.ConceptId]; !ok {
+		return 0, errForeignKey
+	}
+	s.saveModel(&conceptTag.Model, func(id uint) bool { _, ok := s.conceptTags[id]; return ok })
+	s.conceptTags[conceptTag.ID] = *conceptTag
+	return conceptTag.ID, nil
+}
+
+func (s *MemoryStore) InsertConceptTag(conceptTag *ConceptTag) (uint, error) {
+	return s.saveConceptTag(conceptTag)
+}
+
+func (s *MemoryStore) UpdateConceptTag(conceptTag *ConceptTag) (uint, error) {
+	return s.saveConceptTag(conceptTag)
+}
+
+// sortedConceptTags returns the tags accepted by include ordered by their order, then id
+func (s *MemoryStore) sortedConceptTags(include func(conceptTag ConceptTag) bool) []ConceptTag {
+	var conceptTags []ConceptTag
+	for _, conceptTag := range s.conceptTags {
+		if include(conceptTag) {
+			conceptTags = append(conceptTags, conceptTag)
+		}
+	}
+	sort.Slice(conceptTags, func(i, j int) bool {
+		if conceptTags[i].Order != conceptTags[j].Order {
+			return conceptTags[i].Order < conceptTags[j].Order
+		}
+		return conceptTags[i].ID < conceptTags[j].ID
+	})
+	return conceptTags
+}
+
+func (s *MemoryStore) ConceptTagsAsStrings(concept *Concept) ([]string, error) {
+	conceptTags, err := s.ConceptTagsForConceptId(concept.ID)
+	var names []string
+	for _, conceptTag := range conceptTags {
+		names = append(names, conceptTag.Tag)
+	}
+	return names, err
+}
+
+func (s *MemoryStore) FindConceptTag(tag string) (*ConceptTag, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	conceptTags := s.sortedConceptTags(func(conceptTag ConceptTag) bool { return conceptTag.Tag == tag })
+	if len(conceptTags) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &conceptTags[0], nil
+}
+
+func (s *MemoryStore) ConceptTagsForConceptId(conceptId uint) ([]ConceptTag, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sortedConceptTags(func(conceptTag ConceptTag) bool { return conceptTag.ConceptId == conceptId }), nil
+}
+
+func (s *MemoryStore) ListConceptTags() ([]ConceptTag, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sortedConceptTags(func(conceptTag ConceptTag) bool { return true }), nil
+}
+
+func (s *MemoryStore) DeleteConceptTag(id uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conceptTags, id)
+	return nil
+}
+
+func (s *MemoryStore) PurgeConceptTag(tag string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, conceptTag := range s.conceptTags {
+		if conceptTag.Tag == tag {
+			delete(s.conceptTags, id)
+		}
+	}
+}
+
+func (s *MemoryStore) saveTransaction(transaction *Transaction) (uint, error) {
+	_, fromExists := s.users[transaction.FromUserId]
+	_, toExists := s.users[transaction.ToUserId]
+	if !fromExists || !toExists {
+		return 0, errForeignKey
+	}
+	s.saveModel(&transaction.Model, func(id uint) bool { _, ok := s.transactions[id]; return ok })
+	s.transactions[transaction.ID] = *transaction
+	return transaction.ID, nil
+}
+
+func (s *MemoryStore) InsertTransaction(transaction *Transaction) (uint, error) {
+	if transaction.Multiplier < 1 || transaction.Multiplier > 3 {
+		return 0, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveTransaction(transaction)
+}
+
+// sortedTransactions returns the transactions accepted by include ordered by less, then id
+func (s *MemoryStore) sortedTransactions(include func(transaction Transaction) bool, less func(a, b Transaction) (bool, bool)) []Transaction {
+	var transactions []Transaction
+	for _, transaction := range s.transactions {
+		if include(transaction) {
+			transactions = append(transactions, transaction)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		if isLess, decided := less(transactions[i], transactions[j]); decided {
+			return isLess
+		}
+		return transactions[i].ID < transactions[j].ID
+	})
+	return transactions
+}
+
+func compareTimes(a PosixDateTime, b PosixDateTime) (bool, bool) {
+	if time.Time(a).Equal(time.Time(b)) {
+		return false, false
+	}
+	return time.Time(a).Before(time.Time(b)), true
+}
+
+func involves(userId uint) func(transaction Transaction) bool {
+	return func(transaction Transaction) bool {
+		return transaction.FromUserId == userId || transaction.ToUserId == userId
+	}
+}
+
+// postedFor selects the entries in a user's ledger, including fees collected by the fee account
+func postedFor(userId uint) func(transaction Transaction) bool {
+	return func(transaction Transaction) bool {
+		return transaction.IsPosted() && (involves(userId)(transaction) || transaction.FeeUserId == userId)
+	}
+}
+
+func byConfirmedDate(a, b Transaction) (bool, bool) {
+	return compareTimes(a.ConfirmedDate, b.ConfirmedDate)
+}
+
+func (s *MemoryStore) ListTransactionsForUser(userId uint) ([]Transaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sortedTransactions(involves(userId), func(a, b Transaction) (bool, bool) {
+		if isLess, decided := compareTimes(a.ConfirmedDate, b.ConfirmedDate); decided {
+			return isLess, true
+		}
+		return compareTimes(a.InitiatedDate, b.InitiatedDate)
+	}), nil
+}
+
+func (s *MemoryStore) PurgeTransaction(transaction Transaction) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.transactions, transaction.ID)
+	for id, dispute := range s.disputes {
+		if dispute.TransactionId == transaction.ID {
+			delete(s.disputes, id)
+		}
+	}
+	for id, feedback := range s.feedback {
+		if feedback.TransactionId == transaction.ID {
+			delete(s.feedback, id)
+		}
+	}
+}
+
+func (s *MemoryStore) LoadTransaction(id uint) (*Transaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transaction, ok := s.transactions[id]
+	if !ok {
+		return &Transaction{}, gorm.ErrRecordNotFound
+	}
+	return &transaction, nil
+}
+
+func (s *MemoryStore) UpdateTransaction(transaction *Transaction) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveTransaction(transaction)
+}
+
+func (s *MemoryStore) ListTransactionPartners(userId uint) ([]PublicUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	partners := map[uint]bool{}
+	for _, transaction := range s.transactions {
+		if involves(userId)(transaction) {
+			partners[transaction.FromUserId] = true
+			partners[transaction.ToUserId] = true
+		}
+	}
+	var users []PublicUser
+	for _, id := range s.sortedUserIds() {
+		if partners[id] {
+			users = append(users, s.users[id].PublicUser)
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) lastPostedTransactionForUser(userId uint) (Transaction, error) {
+	posted := s.sortedTransactions(postedFor(userId), byConfirmedDate)
+	if len(posted) == 0 {
+		return Transaction{}, gorm.ErrRecordNotFound
+	}
+	return posted[len(posted)-1], nil
+}
+
+func (s *MemoryStore) LastConfirmedTransactionForUser(userId uint) (Transaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastPostedTransactionForUser(userId)
+}
+
+func (s *MemoryStore) PostTransaction(transactionId uint) (*Transaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transaction, ok := s.transactions[transactionId]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if transaction.GroupId != 0 && transaction.IsPending() {
+		return nil, ErrTransactionInGroup
+	}
+	err := s.postTransaction(&transaction)
+	if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+func (s *MemoryStore) postTransaction(transaction *Transaction) error {
+	if !transaction.IsPending() {
+		return ErrTransactionNotPending
+	}
+	transaction.collectFeeFor(s.feeUserId)
+	transaction.CreditedSeconds = transaction.creditFor(s.scaleByMultiplier)
+	fromUserLastTransaction, _ := s.lastPostedTransactionForUser(transaction.FromUserId)
+	toUserLastTransaction, _ := s.lastPostedTransactionForUser(transaction.ToUserId)
+	feeUserLastTransaction := Transaction{}
+	if transaction.FeeUserId != 0 {
+		feeUserLastTransaction, _ = s.lastPostedTransactionForUser(transaction.FeeUserId)
+	}
+	transaction.post(fromUserLastTransaction, toUserLastTransaction, feeUserLastTransaction)
+	err := transaction.checkLimits(s.feeUserId, s.creditLimitFor)
+	if err != nil {
+		return err
+	}
+	_, err = s.saveTransaction(transaction)
+	return err
+}
+
+func (s *MemoryStore) VerifyLedger(userId uint) (*LedgerReport, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transactions := s.sortedTransactions(postedFor(userId), byConfirmedDate)
+	return verifyLedger(userId, transactions, func(id uint) (*Transaction, error) {
+		transaction, ok := s.transactions[id]
+		if !ok {
+			return nil, nil
+		}
+		return &transaction, nil
+	})
+}
+
+func (s *MemoryStore) saveOutboundEmail(email *OutboundEmail) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.saveModel(&email.Model, func(id uint) bool { _, ok := s.outboundEmails[id]; return ok })
+	s.outboundEmails[email.ID] = *email
+	return email.ID, nil
+}
+
+func (s *MemoryStore) InsertOutboundEmail(email *OutboundEmail) (uint, error) {
+	return s.saveOutboundEmail(email)
+}
+
+func (s *MemoryStore) UpdateOutboundEmail(email *OutboundEmail) (uint, error) {
+	return s.saveOutboundEmail(email)
+}
+
+func (s *MemoryStore) LoadOutboundEmail(id uint) (*OutboundEmail, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	email, ok := s.outboundEmails[id]
+	if !ok {
+		return &OutboundEmail{}, gorm.ErrRecordNotFound
+	}
+	return &email, nil
+}
+
+func (s *MemoryStore) ListOutboundEmails(status uint) ([]OutboundEmail, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var emails []OutboundEmail
+	for _, email := range s.outboundEmails {
+		if status == OutboundEmailUnknown || email.Status == status {
+			emails = append(emails, email)
+		}
+	}
+	sort.Slice(emails, func(i, j int) bool { return emails[i].ID > emails[j].ID })
+	if len(emails) > 200 {
+		emails = emails[:200]
+	}
+	return emails, nil
+}
+
+func (s *MemoryStore) ClaimDueOutboundEmails(now time.Time, limit int, lease time.Duration) ([]OutboundEmail, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var emails []OutboundEmail
+	for _, email := range s.outboundEmails {
+		if email.Status == OutboundEmailPending && !email.NextAttempt.After(now) {
+			emails = append(emails, email)
+		}
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		if !emails[i].NextAttempt.Equal(emails[j].NextAttempt) {
+			return emails[i].NextAttempt.Before(emails[j].NextAttempt)
+		}
+		return emails[i].ID < emails[j].ID
+	})
+	if len(emails) > limit {
+		emails = emails[:limit]
+	}
+	for i := range emails {
+		emails[i].NextAttempt = now.Add(lease)
+		s.outboundEmails[emails[i].ID] = emails[i]
+	}
+	return emails, nil
+}
@@ -0,0 +1,383 @@
+package store
+
+import (
+	"errors"
+	"github.com/adamboardman/gorm"
+	"sort"
+	"time"
+)
+
+var ErrNotParticipant = errors.New("only the two members in a thread can post to it")
+var ErrBlocked = errors.New("messages between these members are blocked")
+
+// MessageThread is a conversation between two members, optionally about a transaction or listing. UserId is the
+// lower of the two ids so each pair has one thread per subject.
+type MessageThread struct {
+	gorm.Model
+	UserId        uint
+	OtherUserId   uint
+	TransactionId uint
+	ListingId     uint
+	Subject       string
+	LastMessageAt PosixDateTime `gorm:"type:timestamp with time zone"`
+	UnreadCount   int           `gorm:"-"`
+}
+
+type Message struct {
+	gorm.Model
+	ThreadId   uint
+	FromUserId uint
+	ToUserId   uint
+	Body       string
+	ReadAt     *PosixDateTime `gorm:"type:timestamp with time zone"`
+}
+
+// UserBlock stops messages between UserId and BlockedUserId in either direction
+type UserBlock struct {
+	gorm.Model
+	UserId        uint
+	BlockedUserId uint
+}
+
+func (t MessageThread) HasParticipant(userId uint) bool {
+	return t.UserId == userId || t.OtherUserId == userId
+}
+
+// OtherParticipant is the member in the thread that is not userId
+func (t MessageThread) OtherParticipant(userId uint) uint {
+	if t.UserId == userId {
+		return t.OtherUserId
+	}
+	return t.UserId
+}
+
+func orderedPair(userId uint, otherUserId uint) (uint, uint) {
+	if otherUserId < userId {
+		return otherUserId, userId
+	}
+	return userId, otherUserId
+}
+
+// FindOrCreateMessageThread fills in the thread between the two members about the same transaction and listing,
+// starting one if there is none yet, unless either has blocked the other
+func (s *PostgresStore) FindOrCreateMessageThread(thread *MessageThread) (uint, error) {
+	thread.UserId, thread.OtherUserId = orderedPair(thread.UserId, thread.OtherUserId)
+	blocked, err := s.isBlocked(s.db, thread.UserId, thread.OtherUserId)
+	if err == nil && blocked {
+		err = ErrBlocked
+	}
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	err = s.db.Exec(`INSERT INTO message_threads (created_at, updated_at, user_id, other_user_id, transaction_id, listing_id, subject, last_message_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (user_id, other_user_id, transaction_id, listing_id) DO NOTHING`,
+		now, now, thread.UserId, thread.OtherUserId, thread.TransactionId, thread.ListingId, thread.Subject, now).Error
+	if err == nil {
+		err = s.db.Where("user_id=? AND other_user_id=? AND transaction_id=? AND listing_id=?",
+			thread.UserId, thread.OtherUserId, thread.TransactionId, thread.ListingId).Take(thread).Error
+	}
+	return thread.ID, err
+}
+
+func (s *PostgresStore) LoadMessageThread(id uint) (*MessageThread, error) {
+	thread := MessageThread{}
+	err := s.db.Where("id=?", id).Take(&thread).Error
+	if err != nil {
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// ListMessageThreadsForUser lists the member's threads with how many messages they have not read, latest first.
+// Threads with no messages between members where one has blocked the other are left out.
+func (s *PostgresStore) ListMessageThreadsForUser(userId uint) ([]MessageThread, error) {
+	var threads []MessageThread
+	err := s.db.Where("user_id=? OR other_user_id=?", userId, userId).
+		Where(`EXISTS (SELECT 1 FROM messages WHERE messages.thread_id=message_threads.id AND messages.deleted_at IS NULL)
+	OR NOT EXISTS (SELECT 1 FROM user_blocks WHERE user_blocks.deleted_at IS NULL AND
+		((user_blocks.user_id=message_threads.user_id AND user_blocks.blocked_user_id=message_threads.other_user_id) OR
+		(user_blocks.user_id=message_threads.other_user_id AND user_blocks.blocked_user_id=message_threads.user_id)))`).
+		Order("last_message_at DESC, id DESC").Find(&threads).Error
+	if err != nil {
+		return nil, err
+	}
+	var unread []struct {
+		ThreadId uint
+		Count    int
+	}
+	err = s.db.Raw("SELECT thread_id, COUNT(*) AS count FROM messages WHERE to_user_id=? AND read_at IS NULL AND deleted_at IS NULL GROUP BY thread_id",
+		userId).Scan(&unread).Error
+	counts := map[uint]int{}
+	for _, thread := range unread {
+		counts[thread.ThreadId] = thread.Count
+	}
+	for i := range threads {
+		threads[i].UnreadCount = counts[threads[i].ID]
+	}
+	return threads, err
+}
+
+func (s *PostgresStore) isBlocked(db *gorm.DB, userId uint, otherUserId uint) (bool, error) {
+	count := 0
+	err := db.Model(&UserBlock{}).Where("(user_id=? AND blocked_user_id=?) OR (user_id=? AND blocked_user_id=?)",
+		userId, otherUserId, otherUserId, userId).Count(&count).Error
+	return count > 0, err
+}
+
+// InsertMessage posts a message to its thread from one participant to the other, unless either has blocked the other
+func (s *PostgresStore) InsertMessage(message *Message) (uint, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	thread := MessageThread{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", message.ThreadId).Take(&thread).Error
+	if err == nil && !thread.HasParticipant(message.FromUserId) {
+		err = ErrNotParticipant
+	}
+	if err == nil {
+		message.ToUserId = thread.OtherParticipant(message.FromUserId)
+		var blocked bool
+		blocked, err = s.isBlocked(tx, message.FromUserId, message.ToUserId)
+		if err == nil && blocked {
+			err = ErrBlocked
+		}
+	}
+	if err == nil {
+		err = tx.Create(message).Error
+	}
+	if err == nil {
+		err = tx.Model(&thread).Update("last_message_at", message.CreatedAt).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return message.ID, tx.Commit().Error
+}
+
+// ListMessages lists the messages in a thread, oldest first
+func (s *PostgresStore) ListMessages(threadId uint) ([]Message, error) {
+	var messages []Message
+	err := s.db.Where("thread_id=?", threadId).Order("id").Find(&messages).Error
+	return messages, err
+}
+
+// MarkThreadRead marks the messages sent to userId in the thread as read, returning how many were unread
+func (s *PostgresStore) MarkThreadRead(threadId uint, userId uint, now time.Time) (int, error) {
+	query := s.db.Model(&Message{}).Where("thread_id=? AND to_user_id=? AND read_at IS NULL", threadId, userId).
+		Update("read_at", now.Truncate(time.Microsecond))
+	return int(query.RowsAffected), query.Error
+}
+
+func (s *PostgresStore) UnreadMessageCount(userId uint) (int, error) {
+	count := 0
+	err := s.db.Model(&Message{}).Where("to_user_id=? AND read_at IS NULL", userId).Count(&count).Error
+	return count, err
+}
+
+func (s *PostgresStore) BlockUser(userId uint, blockedUserId uint) error {
+	now := time.Now()
+	return s.db.Exec("INSERT INTO user_blocks (created_at, updated_at, user_id, blocked_user_id) VALUES (?, ?, ?, ?) ON CONFLICT (user_id, blocked_user_id) DO NOTHING",
+		now, now, userId, blockedUserId).Error
+}
+
+func (s *PostgresStore) UnblockUser(userId uint, blockedUserId uint) error {
+	query := s.db.Unscoped().Where("user_id=? AND blocked_user_id=?", userId, blockedUserId).Delete(UserBlock{})
+	if query.Error == nil && query.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return query.Error
+}
+
+func (s *PostgresStore) ListBlockedUsers(userId uint) ([]UserBlock, error) {
+	var blocks []UserBlock
+	err := s.db.Where("user_id=?", userId).Order("id").Find(&blocks).Error
+	return blocks, err
+}
+
+func (s *PostgresStore) IsBlocked(userId uint, otherUserId uint) (bool, error) {
+	return s.isBlocked(s.db, userId, otherUserId)
+}
+
+func (s *MemoryStore) FindOrCreateMessageThread(thread *MessageThread) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	thread.UserId, thread.OtherUserId = orderedPair(thread.UserId, thread.OtherUserId)
+	if _, ok := s.users[thread.UserId]; !ok {
+		return 0, errForeignKey
+	}
+	if _, ok := s.users[thread.OtherUserId]; !ok {
+		return 0, errForeignKey
+	}
+	if s.isBlocked(thread.UserId, thread.OtherUserId) {
+		return 0, ErrBlocked
+	}
+	for _, existing := range s.messageThreads {
+		if existing.UserId == thread.UserId && existing.OtherUserId == thread.OtherUserId &&
+			existing.TransactionId == thread.TransactionId && existing.ListingId == thread.ListingId {
+			*thread = existing
+			return thread.ID, nil
+		}
+	}
+	thread.LastMessageAt = PosixDateTime(time.Now())
+	s.saveModel(&thread.Model, func(id uint) bool { _, ok := s.messageThreads[id]; return ok })
+	s.messageThreads[thread.ID] = *thread
+	return thread.ID, nil
+}
+
+func (s *MemoryStore) LoadMessageThread(id uint) (*MessageThread, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	thread, ok := s.messageThreads[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &thread, nil
+}
+
+func (s *MemoryStore) ListMessageThreadsForUser(userId uint) ([]MessageThread, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var threads []MessageThread
+	for _, thread := range s.messageThreads {
+		if thread.HasParticipant(userId) {
+			empty := true
+			for _, message := range s.messages {
+				if message.ThreadId == thread.ID {
+					empty = false
+					if message.ToUserId == userId && message.ReadAt == nil {
+						thread.UnreadCount++
+					}
+				}
+			}
+			if !empty || !s.isBlocked(thread.UserId, thread.OtherUserId) {
+				threads = append(threads, thread)
+			}
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		a, b := time.Time(threads[i].LastMessageAt), time.Time(threads[j].LastMessageAt)
+		return a.After(b) || (a.Equal(b) && threads[i].ID > threads[j].ID)
+	})
+	return threads, nil
+}
+
+func (s *MemoryStore) isBlocked(userId uint, otherUserId uint) bool {
+	for _, block := range s.userBlocks {
+		if (block.UserId == userId && block.BlockedUserId == otherUserId) || (block.UserId == otherUserId && block.BlockedUserId == userId) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) InsertMessage(message *Message) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	thread, ok := s.messageThreads[message.ThreadId]
+	if !ok {
+		return 0, gorm.ErrRecordNotFound
+	}
+	if !thread.HasParticipant(message.FromUserId) {
+		return 0, ErrNotParticipant
+	}
+	message.ToUserId = thread.OtherParticipant(message.FromUserId)
+	if s.isBlocked(message.FromUserId, message.ToUserId) {
+		return 0, ErrBlocked
+	}
+	s.saveModel(&message.Model, func(id uint) bool { _, ok := s.messages[id]; return ok })
+	s.messages[message.ID] = *message
+	thread.LastMessageAt = PosixDateTime(message.CreatedAt)
+	s.messageThreads[thread.ID] = thread
+	return message.ID, nil
+}
+
+func (s *MemoryStore) ListMessages(threadId uint) ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var messages []Message
+	for _, message := range s.messages {
+		if message.ThreadId == threadId {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+func (s *MemoryStore) MarkThreadRead(threadId uint, userId uint, now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	readAt := PosixDateTime(now.Truncate(time.Microsecond))
+	marked := 0
+	for id, message := range s.messages {
+		if message.ThreadId == threadId && message.ToUserId == userId && message.ReadAt == nil {
+			message.ReadAt = &readAt
+			s.messages[id] = message
+			marked++
+		}
+	}
+	return marked, nil
+}
+
+func (s *MemoryStore) UnreadMessageCount(userId uint) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, message := range s.messages {
+		if message.ToUserId == userId && message.ReadAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) BlockUser(userId uint, blockedUserId uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.users[blockedUserId]; !ok {
+		return errForeignKey
+	}
+	for _, block := range s.userBlocks {
+		if block.UserId == userId && block.BlockedUserId == blockedUserId {
+			return nil
+		}
+	}
+	block := UserBlock{UserId: userId, BlockedUserId: blockedUserId}
+	s.saveModel(&block.Model, func(id uint) bool { return false })
+	s.userBlocks[block.ID] = block
+	return nil
+}
+
+func (s *MemoryStore) UnblockUser(userId uint, blockedUserId uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, block := range s.userBlocks {
+		if block.UserId == userId && block.BlockedUserId == blockedUserId {
+			delete(s.userBlocks, id)
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (s *MemoryStore) ListBlockedUsers(userId uint) ([]UserBlock, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var blocks []UserBlock
+	for _, block := range s.userBlocks {
+		if block.UserId == userId {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].ID < blocks[j].ID })
+	return blocks, nil
+}
+
+func (s *MemoryStore) IsBlocked(userId uint, otherUserId uint) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.isBlocked(userId, otherUserId), nil
+}
@@ -0,0 +1,627 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt *time.Time
+}
+
+var ErrSchemaOutOfDate = errors.New("database schema is out of date")
+
+// migrationLockId serialises migrations run from several processes at once
+const migrationLockId = 7306204
+
+// migrations must only ever be appended to, an applied migration is never edited
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		// written to also adopt databases previously created by AutoMigrate
+		Up: `
+CREATE TABLE IF NOT EXISTS users (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	first_name text,
+	mid_names text,
+	last_name text,
+	location text,
+	photo_id integer,
+	email text,
+	mobile text,
+	confirmed boolean,
+	attempt_count integer,
+	last_attempt text,
+	locked text,
+	permissions integer,
+	salt text,
+	password text,
+	confirm_verifier text,
+	recover_verifier text,
+	recover_token_expiry text
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale text;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS concepts (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	name text,
+	summary text,
+	"full" text
+);
+CREATE INDEX IF NOT EXISTS idx_concepts_deleted_at ON concepts (deleted_at);
+
+CREATE TABLE IF NOT EXISTS concept_tags (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	tag text,
+	concept_id integer,
+	"order" integer
+);
+CREATE INDEX IF NOT EXISTS idx_concept_tags_deleted_at ON concept_tags (deleted_at);
+
+CREATE TABLE IF NOT EXISTS transactions (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	initiated_date timestamp with time zone,
+	confirmed_date timestamp with time zone,
+	from_user_id integer,
+	to_user_id integer,
+	seconds bigint,
+	multiplier numeric,
+	tx_fee integer,
+	description text,
+	location text,
+	to_previous_t_id integer,
+	from_previous_t_id integer,
+	status integer,
+	from_user_balance bigint,
+	to_user_balance bigint
+);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS hash text;
+CREATE INDEX IF NOT EXISTS idx_transactions_deleted_at ON transactions (deleted_at);
+
+CREATE TABLE IF NOT EXISTS outbound_emails (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	recipient text,
+	subject text,
+	text text,
+	html text,
+	status integer,
+	attempts integer,
+	next_attempt timestamp with time zone,
+	last_error text,
+	sent_at timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS idx_outbound_emails_deleted_at ON outbound_emails (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_outbound_emails_status ON outbound_emails (status);
+CREATE INDEX IF NOT EXISTS idx_outbound_emails_next_attempt ON outbound_emails (next_attempt);
+
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'concept_tags_concept_id_concepts_id_foreign') THEN
+		ALTER TABLE concept_tags ADD CONSTRAINT concept_tags_concept_id_concepts_id_foreign
+			FOREIGN KEY (concept_id) REFERENCES concepts(id) ON DELETE CASCADE ON UPDATE RESTRICT;
+	END IF;
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'transactions_from_user_id_users_id_foreign') THEN
+		ALTER TABLE transactions ADD CONSTRAINT transactions_from_user_id_users_id_foreign
+			FOREIGN KEY (from_user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE RESTRICT;
+	END IF;
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'transactions_to_user_id_users_id_foreign') THEN
+		ALTER TABLE transactions ADD CONSTRAINT transactions_to_user_id_users_id_foreign
+			FOREIGN KEY (to_user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE RESTRICT;
+	END IF;
+END
+$$;
+`,
+		Down: `
+DROP TABLE IF EXISTS outbound_emails;
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS concept_tags;
+DROP TABLE IF EXISTS concepts;
+DROP TABLE IF EXISTS users;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "transaction_history_indexes",
+		Up: `
+CREATE INDEX IF NOT EXISTS idx_transactions_from_user_history ON transactions (from_user_id, confirmed_date, initiated_date, id);
+CREATE INDEX IF NOT EXISTS idx_transactions_to_user_history ON transactions (to_user_id, confirmed_date, initiated_date, id);
+CREATE INDEX IF NOT EXISTS idx_transactions_status ON transactions (status);
+`,
+		Down: `
+DROP INDEX IF EXISTS idx_transactions_status;
+DROP INDEX IF EXISTS idx_transactions_to_user_history;
+DROP INDEX IF EXISTS idx_transactions_from_user_history;
+`,
+	},
+	{
+		Version: 3,
+		Name:    "fee_account",
+		Up: `
+ALTER TABLE transactions ADD COLUMN fee_user_id integer NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN fee_previous_t_id integer NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN fee_user_balance bigint NOT NULL DEFAULT 0;
+CREATE INDEX idx_transactions_fee_user_history ON transactions (fee_user_id, confirmed_date, id);
+`,
+		Down: `
+DROP INDEX IF EXISTS idx_transactions_fee_user_history;
+ALTER TABLE transactions DROP COLUMN fee_user_balance;
+ALTER TABLE transactions DROP COLUMN fee_previous_t_id;
+ALTER TABLE transactions DROP COLUMN fee_user_id;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "credit_limits",
+		Up: `
+CREATE TABLE credit_limits (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	user_id integer NOT NULL DEFAULT 0,
+	permissions integer NOT NULL DEFAULT 0,
+	credit_limit bigint NOT NULL,
+	balance_cap bigint NOT NULL
+);
+CREATE INDEX idx_credit_limits_deleted_at ON credit_limits (deleted_at);
+CREATE UNIQUE INDEX uix_credit_limits_user_id_permissions ON credit_limits (user_id, permissions);
+`,
+		Down: `
+DROP TABLE IF EXISTS credit_limits;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "transaction_performed_date",
+		Up: `
+ALTER TABLE transactions ADD COLUMN performed_date timestamp with time zone;
+`,
+		Down: `
+ALTER TABLE transactions DROP COLUMN performed_date;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "recurring_transactions",
+		Up: `
+CREATE TABLE recurring_transactions (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	from_user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	to_user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	status integer NOT NULL,
+	seconds bigint NOT NULL,
+	multiplier numeric NOT NULL,
+	tx_fee integer NOT NULL,
+	description text,
+	location text,
+	schedule text NOT NULL,
+	start_date timestamp with time zone NOT NULL,
+	next_run_at timestamp with time zone,
+	last_run_at timestamp with time zone,
+	runs integer NOT NULL DEFAULT 0,
+	paused boolean NOT NULL DEFAULT false
+);
+CREATE INDEX idx_recurring_transactions_deleted_at ON recurring_transactions (deleted_at);
+CREATE INDEX idx_recurring_transactions_next_run_at ON recurring_transactions (next_run_at) WHERE NOT paused;
+ALTER TABLE transactions ADD COLUMN recurring_transaction_id integer NOT NULL DEFAULT 0;
+`,
+		Down: `
+ALTER TABLE transactions DROP COLUMN recurring_transaction_id;
+DROP TABLE IF EXISTS recurring_transactions;
+`,
+	},
+	{
+		Version: 7,
+		Name:    "transaction_groups",
+		Up: `
+CREATE TABLE transaction_groups (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	status integer NOT NULL,
+	description text
+);
+CREATE INDEX idx_transaction_groups_deleted_at ON transaction_groups (deleted_at);
+ALTER TABLE transactions ADD COLUMN group_id integer NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN approved_date timestamp with time zone;
+CREATE INDEX idx_transactions_group_id ON transactions (group_id) WHERE group_id <> 0;
+`,
+		Down: `
+DROP INDEX IF EXISTS idx_transactions_group_id;
+ALTER TABLE transactions DROP COLUMN approved_date;
+ALTER TABLE transactions DROP COLUMN group_id;
+DROP TABLE IF EXISTS transaction_groups;
+`,
+	},
+	{
+		Version: 8,
+		Name:    "disputes",
+		Up: `
+ALTER TABLE transactions ADD COLUMN reverses_t_id integer NOT NULL DEFAULT 0;
+CREATE TABLE disputes (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	transaction_id integer NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+	raised_by_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	reason text NOT NULL,
+	status integer NOT NULL,
+	reviewer_id integer NOT NULL DEFAULT 0,
+	resolution text,
+	reversal_t_id integer NOT NULL DEFAULT 0,
+	resolved_date timestamp with time zone
+);
+CREATE INDEX idx_disputes_deleted_at ON disputes (deleted_at);
+CREATE INDEX idx_disputes_transaction_id ON disputes (transaction_id);
+CREATE INDEX idx_disputes_status ON disputes (status);
+CREATE TABLE audit_entries (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	actor_id integer NOT NULL,
+	action text NOT NULL,
+	transaction_id integer NOT NULL DEFAULT 0,
+	dispute_id integer NOT NULL DEFAULT 0,
+	details text
+);
+CREATE INDEX idx_audit_entries_deleted_at ON audit_entries (deleted_at);
+CREATE INDEX idx_audit_entries_transaction_id ON audit_entries (transaction_id);
+`,
+		Down: `
+DROP TABLE IF EXISTS audit_entries;
+DROP TABLE IF EXISTS disputes;
+ALTER TABLE transactions DROP COLUMN reverses_t_id;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "transaction_credited_seconds",
+		Up: `
+ALTER TABLE transactions ADD COLUMN credited_seconds bigint NOT NULL DEFAULT 0;
+UPDATE transactions SET credited_seconds = seconds;
+`,
+		Down: `
+ALTER TABLE transactions DROP COLUMN credited_seconds;
+`,
+	},
+	{
+		Version: 10,
+		Name:    "listings",
+		Up: `
+CREATE TABLE listings (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	kind integer NOT NULL,
+	category text NOT NULL,
+	concept_id integer NOT NULL DEFAULT 0,
+	title text NOT NULL,
+	description text,
+	estimated_seconds bigint NOT NULL DEFAULT 0,
+	multiplier real NOT NULL DEFAULT 1,
+	location text,
+	expires_at timestamp with time zone NOT NULL
+);
+CREATE INDEX idx_listings_deleted_at ON listings (deleted_at);
+CREATE INDEX idx_listings_user_id ON listings (user_id);
+CREATE INDEX idx_listings_category ON listings (LOWER(category));
+CREATE INDEX idx_listings_expires_at ON listings (expires_at);
+ALTER TABLE transactions ADD COLUMN listing_id integer NOT NULL DEFAULT 0;
+`,
+		Down: `
+ALTER TABLE transactions DROP COLUMN listing_id;
+DROP TABLE IF EXISTS listings;
+`,
+	},
+	{
+		Version: 11,
+		Name:    "geo",
+		Up: `
+CREATE EXTENSION IF NOT EXISTS postgis;
+ALTER TABLE users ADD COLUMN latitude double precision, ADD COLUMN longitude double precision,
+	ADD COLUMN geo_point geography(Point, 4326) GENERATED ALWAYS AS
+		(CASE WHEN latitude IS NULL OR longitude IS NULL THEN NULL ELSE ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography END) STORED;
+CREATE INDEX idx_users_geo_point ON users USING GIST (geo_point);
+ALTER TABLE listings ADD COLUMN latitude double precision, ADD COLUMN longitude double precision,
+	ADD COLUMN geo_point geography(Point, 4326) GENERATED ALWAYS AS
+		(CASE WHEN latitude IS NULL OR longitude IS NULL THEN NULL ELSE ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography END) STORED;
+CREATE INDEX idx_listings_geo_point ON listings USING GIST (geo_point);
+CREATE TABLE places (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	name text NOT NULL,
+	key text NOT NULL UNIQUE,
+	latitude double precision NOT NULL,
+	longitude double precision NOT NULL
+);
+CREATE INDEX idx_places_deleted_at ON places (deleted_at);
+`,
+		Down: `
+DROP TABLE IF EXISTS places;
+ALTER TABLE listings DROP COLUMN geo_point, DROP COLUMN latitude, DROP COLUMN longitude;
+ALTER TABLE users DROP COLUMN geo_point, DROP COLUMN latitude, DROP COLUMN longitude;
+`,
+	},
+	{
+		Version: 12,
+		Name:    "feedback",
+		Up: `
+CREATE TABLE feedbacks (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	transaction_id integer NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+	from_user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	to_user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	rating integer NOT NULL CHECK (rating BETWEEN 1 AND 5),
+	comment text,
+	hidden boolean NOT NULL DEFAULT false,
+	moderator_id integer NOT NULL DEFAULT 0,
+	moderation_reason text,
+	UNIQUE (transaction_id, from_user_id)
+);
+CREATE INDEX idx_feedbacks_deleted_at ON feedbacks (deleted_at);
+CREATE INDEX idx_feedbacks_to_user_id ON feedbacks (to_user_id);
+ALTER TABLE audit_entries ADD COLUMN feedback_id integer NOT NULL DEFAULT 0;
+`,
+		Down: `
+ALTER TABLE audit_entries DROP COLUMN feedback_id;
+DROP TABLE IF EXISTS feedbacks;
+`,
+	},
+	{
+		Version: 13,
+		Name:    "messages",
+		Up: `
+CREATE TABLE message_threads (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	other_user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	transaction_id integer NOT NULL DEFAULT 0,
+	listing_id integer NOT NULL DEFAULT 0,
+	subject text,
+	last_message_at timestamp with time zone NOT NULL,
+	UNIQUE (user_id, other_user_id, transaction_id, listing_id)
+);
+CREATE INDEX idx_message_threads_deleted_at ON message_threads (deleted_at);
+CREATE INDEX idx_message_threads_other_user_id ON message_threads (other_user_id);
+CREATE TABLE messages (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	thread_id integer NOT NULL REFERENCES message_threads(id) ON DELETE CASCADE,
+	from_user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	to_user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	body text NOT NULL,
+	read_at timestamp with time zone
+);
+CREATE INDEX idx_messages_deleted_at ON messages (deleted_at);
+CREATE INDEX idx_messages_thread_id ON messages (thread_id);
+CREATE INDEX idx_messages_unread ON messages (to_user_id) WHERE read_at IS NULL;
+CREATE TABLE user_blocks (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	blocked_user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	UNIQUE (user_id, blocked_user_id)
+);
+CREATE INDEX idx_user_blocks_deleted_at ON user_blocks (deleted_at);
+`,
+		Down: `
+DROP TABLE IF EXISTS user_blocks;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS message_threads;
+`,
+	},
+	{
+		Version: 14,
+		Name:    "events",
+		Up: `
+CREATE TABLE events (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone,
+	user_id integer NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	type text NOT NULL,
+	data text NOT NULL
+);
+CREATE INDEX idx_events_deleted_at ON events (deleted_at);
+CREATE INDEX idx_events_user_id ON events (user_id, id);
+CREATE INDEX idx_events_created_at ON events (created_at);
+`,
+		Down: `
+DROP TABLE IF EXISTS events;
+`,
+	},
+}
+
+const createSchemaMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer PRIMARY KEY,
+	name text NOT NULL,
+	applied_at timestamp with time zone NOT NULL DEFAULT now()
+)`
+
+func appliedMigrations(q interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}) (map[uint]time.Time, error) {
+	rows, err := q.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[uint]time.Time{}
+	for rows.Next() {
+		var version uint
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func (s *PostgresStore) MigrationStatus() ([]MigrationStatus, error) {
+	_, err := s.db.DB().Exec(createSchemaMigrations)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(s.db.DB())
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, migration := range migrations {
+		status := MigrationStatus{Migration: migration}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// CheckSchema returns ErrSchemaOutOfDate unless every migration has been applied
+func (s *PostgresStore) CheckSchema() error {
+	statuses, err := s.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	var pending []uint
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Version)
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("Migrations %v have not been applied", pending)
+		return ErrSchemaOutOfDate
+	}
+	return nil
+}
+
+// MigrateUp applies all pending migrations in order, each in its own transaction, returning those applied
+func (s *PostgresStore) MigrateUp() ([]Migration, error) {
+	var done []Migration
+	for _, migration := range migrations {
+		applied, err := s.runMigration(migration, true)
+		if err != nil {
+			return done, fmt.Errorf("migration %d %s: %s", migration.Version, migration.Name, err.Error())
+		}
+		if applied {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+// MigrateDown reverts the latest steps applied migrations, returning those reverted
+func (s *PostgresStore) MigrateDown(steps int) ([]Migration, error) {
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := migrations[i]
+		reverted, err := s.runMigration(migration, false)
+		if err != nil {
+			return done, fmt.Errorf("migration %d %s: %s", migration.Version, migration.Name, err.Error())
+		}
+		if reverted {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+// runMigration applies or reverts the migration unless it already has been, reporting whether it ran
+func (s *PostgresStore) runMigration(migration Migration, up bool) (bool, error) {
+	tx, err := s.db.DB().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockId)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(createSchemaMigrations)
+	if err != nil {
+		return false, err
+	}
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return false, err
+	}
+	_, isApplied := applied[migration.Version]
+	if isApplied == up {
+		return false, nil
+	}
+
+	if up {
+		_, err = tx.Exec(migration.Up)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+		}
+	} else {
+		_, err = tx.Exec(migration.Down)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
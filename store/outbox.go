@@ -0,0 +1,76 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+const (
+	OutboundEmailUnknown = iota
+	OutboundEmailPending
+	OutboundEmailSent
+	OutboundEmailDead
+)
+
+type OutboundEmail struct {
+	gorm.Model
+	Recipient   string
+	Subject     string
+	Text        string
+	HTML        string
+	Status      uint `gorm:"index"`
+	Attempts    int
+	NextAttempt time.Time `gorm:"index"`
+	LastError   string
+	SentAt      *time.Time
+}
+
+func (s *PostgresStore) InsertOutboundEmail(email *OutboundEmail) (uint, error) {
+	err := s.db.Create(email).Error
+	return email.ID, err
+}
+
+func (s *PostgresStore) UpdateOutboundEmail(email *OutboundEmail) (uint, error) {
+	err := s.db.Save(email).Error
+	return email.ID, err
+}
+
+func (s *PostgresStore) LoadOutboundEmail(id uint) (*OutboundEmail, error) {
+	email := OutboundEmail{}
+	err := s.db.Where("id=?", id).Find(&email).Error
+	return &email, err
+}
+
+func (s *PostgresStore) ListOutboundEmails(status uint) ([]OutboundEmail, error) {
+	var emails []OutboundEmail
+	query := s.db.Order("id DESC").Limit(200)
+	if status != OutboundEmailUnknown {
+		query = query.Where("status=?", status)
+	}
+	err := query.Find(&emails).Error
+	return emails, err
+}
+
+// ClaimDueOutboundEmails returns pending emails whose next attempt is due and pushes their next attempt back by the
+// lease so that another worker will not pick up the same emails while they are being delivered
+func (s *PostgresStore) ClaimDueOutboundEmails(now time.Time, limit int, lease time.Duration) ([]OutboundEmail, error) {
+	var emails []OutboundEmail
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").Where("status=? AND next_attempt<=?", OutboundEmailPending, now).Order("next_attempt, id").Limit(limit).Find(&emails).Error
+	if err == nil && len(emails) > 0 {
+		var ids []uint
+		for i := range emails {
+			ids = append(ids, emails[i].ID)
+			emails[i].NextAttempt = now.Add(lease)
+		}
+		err = tx.Model(&OutboundEmail{}).Where("id IN (?)", ids).UpdateColumn("next_attempt", now.Add(lease)).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return emails, tx.Commit().Error
+}
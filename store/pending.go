@@ -0,0 +1,99 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"time"
+)
+
+var pendingStatuses = []uint{TransactionOffered, TransactionRequested}
+
+// close ends a pending transaction without posting it, the confirmed date records when
+func (t *Transaction) close(status uint, now time.Time) {
+	t.Status = status
+	t.ConfirmedDate = PosixDateTime(now.Truncate(time.Microsecond))
+}
+
+// ClosePendingTransaction moves a transaction that is still pending to status, the row is locked so it can not also
+// be posted
+func (s *PostgresStore) ClosePendingTransaction(transactionId uint, status uint) (*Transaction, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	transaction := Transaction{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", transactionId).Find(&transaction).Error
+	if err == nil && !transaction.IsPending() {
+		err = ErrTransactionNotPending
+	}
+	if err == nil && transaction.GroupId != 0 {
+		err = ErrTransactionInGroup
+	}
+	if err == nil {
+		transaction.close(status, time.Now())
+		err = tx.Save(&transaction).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// ExpirePendingTransactions expires up to limit transactions created before createdBefore that are still pending,
+// returning them. Rows locked by a posting in progress are left for the next sweep.
+func (s *PostgresStore) ExpirePendingTransactions(createdBefore time.Time, limit int) ([]Transaction, error) {
+	var transactions []Transaction
+	now := time.Now().Truncate(time.Microsecond)
+	err := s.db.Raw(`UPDATE transactions SET status = CASE status WHEN ? THEN ? ELSE ? END, confirmed_date = ?, updated_at = ?
+WHERE id IN (SELECT id FROM transactions WHERE deleted_at IS NULL AND status IN (?) AND created_at < ? ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED)
+RETURNING *`, TransactionOffered, TransactionOfferExpired, TransactionRequestExpired, now, now, pendingStatuses, createdBefore, limit).Scan(&transactions).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+func (s *MemoryStore) ClosePendingTransaction(transactionId uint, status uint) (*Transaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transaction, ok := s.transactions[transactionId]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if !transaction.IsPending() {
+		return nil, ErrTransactionNotPending
+	}
+	if transaction.GroupId != 0 {
+		return nil, ErrTransactionInGroup
+	}
+	transaction.close(status, time.Now())
+	_, err := s.saveTransaction(&transaction)
+	if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+func (s *MemoryStore) ExpirePendingTransactions(createdBefore time.Time, limit int) ([]Transaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stale := s.sortedTransactions(func(transaction Transaction) bool {
+		return transaction.IsPending() && transaction.CreatedAt.Before(createdBefore)
+	}, func(a, b Transaction) (bool, bool) { return false, false })
+	if len(stale) > limit {
+		stale = stale[:limit]
+	}
+	now := time.Now()
+	for i := range stale {
+		stale[i].close(stale[i].ExpiredStatus(), now)
+		_, err := s.saveTransaction(&stale[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stale, nil
+}
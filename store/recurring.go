@@ -0,0 +1,245 @@
+package store
+
+import (
+	"github.com/adamboardman/gorm"
+	"sort"
+	"time"
+)
+
+// RecurringTransaction is a template the scheduler turns into a pending offer or request on each occurrence of its
+// Schedule. UserId set it up and initiates each transaction, NextRunAt is nil once the schedule has finished.
+type RecurringTransaction struct {
+	gorm.Model
+	UserId      uint
+	FromUserId  uint
+	ToUserId    uint
+	Status      uint
+	Seconds     uint64 `gorm:"type:bigint"`
+	Multiplier  float32
+	TxFee       uint
+	Description string
+	Location    string
+	Schedule    string
+	StartDate   PosixDateTime  `gorm:"type:timestamp with time zone"`
+	NextRunAt   *PosixDateTime `gorm:"type:timestamp with time zone"`
+	LastRunAt   *PosixDateTime `gorm:"type:timestamp with time zone"`
+	Runs        uint
+	Paused      bool
+}
+
+// ScheduleNext sets NextRunAt to the first occurrence at or after from, or nil once the schedule has finished
+func (r *RecurringTransaction) ScheduleNext(from time.Time) {
+	r.NextRunAt = nil
+	schedule, err := ParseSchedule(r.Schedule)
+	if err != nil || (schedule.Count > 0 && r.Runs >= schedule.Count) {
+		return
+	}
+	next, ok := schedule.Next(time.Time(r.StartDate), from)
+	if ok {
+		nextRunAt := PosixDateTime(next)
+		r.NextRunAt = &nextRunAt
+	}
+}
+
+// advance uses up the occurrence at NextRunAt
+func (r *RecurringTransaction) advance() {
+	occurrence := *r.NextRunAt
+	r.LastRunAt = &occurrence
+	r.Runs++
+	r.ScheduleNext(time.Time(occurrence).Add(time.Second))
+}
+
+func (s *PostgresStore) InsertRecurringTransaction(recurring *RecurringTransaction) (uint, error) {
+	err := s.db.Create(recurring).Error
+	return recurring.ID, err
+}
+
+func (s *PostgresStore) UpdateRecurringTransaction(recurring *RecurringTransaction) (uint, error) {
+	err := s.db.Save(recurring).Error
+	return recurring.ID, err
+}
+
+func (s *PostgresStore) LoadRecurringTransaction(id uint) (*RecurringTransaction, error) {
+	recurring := RecurringTransaction{}
+	err := s.db.Where("id=?", id).Take(&recurring).Error
+	if err != nil {
+		return nil, err
+	}
+	return &recurring, nil
+}
+
+func (s *PostgresStore) ListRecurringTransactionsForUser(userId uint) ([]RecurringTransaction, error) {
+	var recurring []RecurringTransaction
+	err := s.db.Where("from_user_id=? OR to_user_id=?", userId, userId).Order("id").Find(&recurring).Error
+	return recurring, err
+}
+
+// PauseRecurringTransaction writes only the paused column, so it can not undo the scheduler moving the template on
+func (s *PostgresStore) PauseRecurringTransaction(id uint) error {
+	query := s.db.Model(&RecurringTransaction{}).Where("id=?", id).Update("paused", true)
+	if query.Error == nil && query.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return query.Error
+}
+
+func (s *PostgresStore) DeleteRecurringTransaction(id uint) error {
+	query := s.db.Where("id=?", id).Delete(RecurringTransaction{})
+	if query.Error == nil && query.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return query.Error
+}
+
+// RunDueRecurringTransactions hands up to limit templates that are due to create, with NextRunAt the occurrence to
+// create. The transaction create returns is inserted and the template moved on to its following occurrence in one
+// database transaction, so an occurrence is never lost or created twice. A nil transaction skips the occurrence and
+// an error leaves the template due to be tried again. It returns how many transactions were inserted and how many
+// templates were moved on.
+func (s *PostgresStore) RunDueRecurringTransactions(now time.Time, limit int, create func(recurring RecurringTransaction) (*Transaction, error)) (int, int, error) {
+	var due []RecurringTransaction
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return 0, 0, tx.Error
+	}
+	err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").Where("paused=? AND next_run_at<=?", false, now).Order("next_run_at, id").Limit(limit).Find(&due).Error
+	inserted, advanced := 0, 0
+	for i := 0; err == nil && i < len(due); i++ {
+		transaction, createErr := create(due[i])
+		if createErr != nil {
+			continue
+		}
+		if transaction != nil {
+			err = tx.Create(transaction).Error
+			if err != nil {
+				break
+			}
+			inserted++
+		}
+		claimed := due[i]
+		claimed.advance()
+		err = tx.Save(&claimed).Error
+		advanced++
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	return inserted, advanced, tx.Commit().Error
+}
+
+func (s *MemoryStore) saveRecurringTransaction(recurring *RecurringTransaction) (uint, error) {
+	_, fromExists := s.users[recurring.FromUserId]
+	_, toExists := s.users[recurring.ToUserId]
+	if !fromExists || !toExists {
+		return 0, errForeignKey
+	}
+	s.saveModel(&recurring.Model, func(id uint) bool { _, ok := s.recurringTransactions[id]; return ok })
+	s.recurringTransactions[recurring.ID] = *recurring
+	return recurring.ID, nil
+}
+
+func (s *MemoryStore) InsertRecurringTransaction(recurring *RecurringTransaction) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveRecurringTransaction(recurring)
+}
+
+func (s *MemoryStore) UpdateRecurringTransaction(recurring *RecurringTransaction) (uint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveRecurringTransaction(recurring)
+}
+
+func (s *MemoryStore) LoadRecurringTransaction(id uint) (*RecurringTransaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	recurring, ok := s.recurringTransactions[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &recurring, nil
+}
+
+func (s *MemoryStore) sortedRecurringTransactions(include func(recurring RecurringTransaction) bool) []RecurringTransaction {
+	var matching []RecurringTransaction
+	for _, recurring := range s.recurringTransactions {
+		if include(recurring) {
+			matching = append(matching, recurring)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+	return matching
+}
+
+func (s *MemoryStore) ListRecurringTransactionsForUser(userId uint) ([]RecurringTransaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sortedRecurringTransactions(func(recurring RecurringTransaction) bool {
+		return recurring.FromUserId == userId || recurring.ToUserId == userId
+	}), nil
+}
+
+func (s *MemoryStore) PauseRecurringTransaction(id uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	recurring, ok := s.recurringTransactions[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	recurring.Paused = true
+	_, err := s.saveRecurringTransaction(&recurring)
+	return err
+}
+
+func (s *MemoryStore) DeleteRecurringTransaction(id uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.recurringTransactions[id]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delete(s.recurringTransactions, id)
+	return nil
+}
+
+// RunDueRecurringTransactions calls create without holding the lock, as create may use the store, and then checks
+// each template has not been moved on in the meantime before inserting its transaction
+func (s *MemoryStore) RunDueRecurringTransactions(now time.Time, limit int, create func(recurring RecurringTransaction) (*Transaction, error)) (int, int, error) {
+	s.mutex.Lock()
+	due := s.sortedRecurringTransactions(func(recurring RecurringTransaction) bool {
+		return !recurring.Paused && recurring.NextRunAt != nil && !time.Time(*recurring.NextRunAt).After(now)
+	})
+	s.mutex.Unlock()
+	sort.SliceStable(due, func(i, j int) bool { return time.Time(*due[i].NextRunAt).Before(time.Time(*due[j].NextRunAt)) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	inserted, advanced := 0, 0
+	for _, recurring := range due {
+		transaction, err := create(recurring)
+		if err != nil {
+			continue
+		}
+		s.mutex.Lock()
+		current, ok := s.recurringTransactions[recurring.ID]
+		if !ok || current.Paused || current.NextRunAt == nil || !time.Time(*current.NextRunAt).Equal(time.Time(*recurring.NextRunAt)) {
+			s.mutex.Unlock()
+			continue
+		}
+		if transaction != nil {
+			if _, err = s.saveTransaction(transaction); err != nil {
+				s.mutex.Unlock()
+				return inserted, advanced, err
+			}
+			inserted++
+		}
+		current.advance()
+		_, err = s.saveRecurringTransaction(&current)
+		s.mutex.Unlock()
+		if err != nil {
+			return inserted, advanced, err
+		}
+		advanced++
+	}
+	return inserted, advanced, nil
+}
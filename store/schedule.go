@@ -0,0 +1,233 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScheduleDaily   = "DAILY"
+	ScheduleWeekly  = "WEEKLY"
+	ScheduleMonthly = "MONTHLY"
+)
+
+// maxSchedulePeriods bounds the search for the next occurrence of a schedule that can never match again
+const maxSchedulePeriods = 1000
+
+// Schedule is the subset of an iCalendar RRULE used for recurring transactions: FREQ of DAILY, WEEKLY or MONTHLY,
+// INTERVAL, BYDAY for weekly schedules, BYMONTHDAY for monthly ones, COUNT and UNTIL. Occurrences fall at the time
+// of day of the start date, weeks start on Monday.
+type Schedule struct {
+	Frequency  string
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonthDay []int
+	Count      uint
+	Until      time.Time
+}
+
+var scheduleWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+func parseScheduleWeekday(day string) (time.Weekday, error) {
+	for weekday, name := range scheduleWeekdays {
+		if name == day {
+			return time.Weekday(weekday), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown BYDAY %q", day)
+}
+
+func ParseSchedule(rule string) (Schedule, error) {
+	schedule := Schedule{Interval: 1}
+	rule = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:")
+	seen := map[string]bool{}
+	for _, part := range strings.Split(rule, ";") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 || len(pair[1]) == 0 {
+			return Schedule{}, fmt.Errorf("invalid rule part %q", part)
+		}
+		name, value := pair[0], pair[1]
+		if seen[name] {
+			return Schedule{}, fmt.Errorf("%s is given more than once", name)
+		}
+		seen[name] = true
+		switch name {
+		case "FREQ":
+			if value != ScheduleDaily && value != ScheduleWeekly && value != ScheduleMonthly {
+				return Schedule{}, fmt.Errorf("FREQ must be DAILY, WEEKLY or MONTHLY")
+			}
+			schedule.Frequency = value
+		case "INTERVAL":
+			interval, err := strconv.Atoi(value)
+			if err != nil || interval < 1 || interval > 366 {
+				return Schedule{}, fmt.Errorf("INTERVAL must be between 1 and 366")
+			}
+			schedule.Interval = interval
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				weekday, err := parseScheduleWeekday(day)
+				if err != nil {
+					return Schedule{}, err
+				}
+				schedule.ByDay = append(schedule.ByDay, weekday)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				monthDay, err := strconv.Atoi(day)
+				if err != nil || monthDay == 0 || monthDay < -31 || monthDay > 31 {
+					return Schedule{}, fmt.Errorf("BYMONTHDAY must be between 1 and 31 or -31 and -1")
+				}
+				schedule.ByMonthDay = append(schedule.ByMonthDay, monthDay)
+			}
+		case "COUNT":
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || count == 0 {
+				return Schedule{}, fmt.Errorf("COUNT must be a positive number")
+			}
+			schedule.Count = uint(count)
+		case "UNTIL":
+			until, err := time.Parse("20060102T150405Z", value)
+			if err != nil {
+				// a date alone includes the whole of that day
+				until, err = time.Parse("20060102", value)
+				until = until.Add(24*time.Hour - time.Second)
+			}
+			if err != nil {
+				return Schedule{}, fmt.Errorf("UNTIL must be YYYYMMDD or YYYYMMDDTHHMMSSZ")
+			}
+			schedule.Until = until
+		default:
+			return Schedule{}, fmt.Errorf("%s is not supported", name)
+		}
+	}
+	if len(schedule.Frequency) == 0 {
+		return Schedule{}, fmt.Errorf("FREQ is required")
+	}
+	if len(schedule.ByDay) > 0 && schedule.Frequency != ScheduleWeekly {
+		return Schedule{}, fmt.Errorf("BYDAY is only supported with FREQ=WEEKLY")
+	}
+	if len(schedule.ByMonthDay) > 0 && schedule.Frequency != ScheduleMonthly {
+		return Schedule{}, fmt.Errorf("BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	return schedule, nil
+}
+
+func (s Schedule) String() string {
+	parts := []string{"FREQ=" + s.Frequency}
+	if s.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(s.Interval))
+	}
+	if len(s.ByDay) > 0 {
+		var days []string
+		for _, weekday := range s.ByDay {
+			days = append(days, scheduleWeekdays[weekday])
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(s.ByMonthDay) > 0 {
+		var days []string
+		for _, monthDay := range s.ByMonthDay {
+			days = append(days, strconv.Itoa(monthDay))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if s.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.FormatUint(uint64(s.Count), 10))
+	}
+	if !s.Until.IsZero() {
+		parts = append(parts, "UNTIL="+s.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+func civilDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func daysBetween(a time.Time, b time.Time) int {
+	return int(civilDate(b).Sub(civilDate(a)).Hours() / 24)
+}
+
+// periodDays lists the days of the period that starts on day, in order
+func (s Schedule) periodDays(day time.Time, start time.Time) []time.Time {
+	var days []time.Time
+	switch s.Frequency {
+	case ScheduleDaily:
+		days = append(days, day)
+	case ScheduleWeekly:
+		weekdays := s.ByDay
+		if len(weekdays) == 0 {
+			weekdays = []time.Weekday{start.Weekday()}
+		}
+		for _, weekday := range weekdays {
+			days = append(days, day.AddDate(0, 0, (int(weekday)+6)%7))
+		}
+	case ScheduleMonthly:
+		monthDays := s.ByMonthDay
+		if len(monthDays) == 0 {
+			monthDays = []int{start.Day()}
+		}
+		length := day.AddDate(0, 1, -1).Day()
+		for _, monthDay := range monthDays {
+			if monthDay < 0 {
+				monthDay = length + monthDay + 1
+			}
+			// months without the day are skipped, as in RFC 5545
+			if monthDay >= 1 && monthDay <= length {
+				days = append(days, day.AddDate(0, 0, monthDay-1))
+			}
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days
+}
+
+// Next returns the first occurrence at or after from of the schedule starting at start, false when UNTIL has passed.
+// COUNT is left to the caller, who knows how many occurrences have been used.
+func (s Schedule) Next(start time.Time, from time.Time) (time.Time, bool) {
+	from = from.In(start.Location())
+	startDate := civilDate(start)
+	var firstPeriod time.Time
+	var periods int
+	switch s.Frequency {
+	case ScheduleDaily:
+		firstPeriod = startDate
+		periods = daysBetween(start, from) / s.Interval
+	case ScheduleWeekly:
+		firstPeriod = startDate.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		periods = daysBetween(firstPeriod, from) / 7 / s.Interval
+	case ScheduleMonthly:
+		firstPeriod = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+		periods = ((from.Year()-start.Year())*12 + int(from.Month()) - int(start.Month())) / s.Interval
+	default:
+		return time.Time{}, false
+	}
+	if periods < 0 {
+		periods = 0
+	}
+	for i := 0; i < maxSchedulePeriods; i++ {
+		var period time.Time
+		switch s.Frequency {
+		case ScheduleDaily:
+			period = firstPeriod.AddDate(0, 0, (periods+i)*s.Interval)
+		case ScheduleWeekly:
+			period = firstPeriod.AddDate(0, 0, (periods+i)*s.Interval*7)
+		case ScheduleMonthly:
+			period = firstPeriod.AddDate(0, (periods+i)*s.Interval, 0)
+		}
+		for _, day := range s.periodDays(period, start) {
+			occurrence := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+			if occurrence.Before(start) || occurrence.Before(from) {
+				continue
+			}
+			if !s.Until.IsZero() && occurrence.After(s.Until) {
+				return time.Time{}, false
+			}
+			return occurrence, true
+		}
+	}
+	return time.Time{}, false
+}
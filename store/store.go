@@ -5,15 +5,130 @@ import (
 	"errors"
 	"github.com/adamboardman/gorm"
 	_ "github.com/adamboardman/gorm/dialects/postgres"
-	"io/ioutil"
+	"github.com/lib/pq"
 	"log"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
-type Store struct {
-	db *gorm.DB
-}
+// Store is implemented by PostgresStore and, for tests and development without a database, MemoryStore
+type Store interface {
+	InsertUser(user *User) (uint, error)
+	UpdateUser(user *User) (uint, error)
+	FindUser(email string) (*User, error)
+	PurgeUser(email string)
+	RecordFailedLogin(userId uint, attemptTime time.Time) (int, error)
+	LockUser(userId uint, until time.Time) error
+	ResetLoginAttempts(userId uint) error
+	ListUsersWithFailedLogins() ([]User, error)
+	LoadPublicUser(id uint) (*PublicUser, error)
+	LoadPrivilegedUserAsSelf(userId uint, loggedInUserId uint) (*PrivilegedUser, error)
+	LoadUserAsSelf(userId uint, loggedInUserId uint) (*User, error)
+
+	InsertConcept(concept *Concept) (uint, error)
+	UpdateConcept(concept *Concept) (uint, error)
+	PurgeConcept(name string)
+	LoadConcept(id uint) (*Concept, error)
+	FindConcept(name string) (*Concept, error)
+	ListConcepts() ([]Concept, error)
+	InsertConceptTag(conceptTag *ConceptTag) (uint, error)
+	UpdateConceptTag(conceptTag *ConceptTag) (uint, error)
+	ConceptTagsAsStrings(concept *Concept) ([]string, error)
+	FindConceptTag(tag string) (*ConceptTag, error)
+	ConceptTagsForConceptId(conceptId uint) ([]ConceptTag, error)
+	ListConceptTags() ([]ConceptTag, error)
+	DeleteConceptTag(id uint) error
+	PurgeConceptTag(tag string)
+
+	InsertTransaction(transaction *Transaction) (uint, error)
+	ListTransactionsForUser(userId uint) ([]Transaction, error)
+	ListTransactions(filter TransactionFilter) (*TransactionPage, error)
+	PurgeTransaction(transaction Transaction)
+	LoadTransaction(id uint) (*Transaction, error)
+	UpdateTransaction(transaction *Transaction) (uint, error)
+	ListTransactionPartners(userId uint) ([]PublicUser, error)
+	LastConfirmedTransactionForUser(userId uint) (Transaction, error)
+	PostTransaction(transactionId uint) (*Transaction, error)
+	ClosePendingTransaction(transactionId uint, status uint) (*Transaction, error)
+	ExpirePendingTransactions(createdBefore time.Time, limit int) ([]Transaction, error)
+	VerifyLedger(userId uint) (*LedgerReport, error)
+	SetDefaultCreditLimit(creditLimit int64, balanceCap int64)
+	CreditLimitFor(userId uint) (CreditLimit, error)
+	ListCreditLimits() ([]CreditLimit, error)
+	SaveCreditLimit(limit *CreditLimit) (uint, error)
+	DeleteCreditLimit(userId uint, permissions UserPermissions) error
+	SetFeeAccount(userId uint)
+	SetScaleByMultiplier(scale bool)
+	ValueReport(userId uint, period string, from time.Time, to time.Time) (*ValueReport, error)
+	FeeIncome(from time.Time, to time.Time) (*FeeReport, error)
+	LedgerTotals() (*LedgerTotals, error)
+	InsertRecurringTransaction(recurring *RecurringTransaction) (uint, error)
+	UpdateRecurringTransaction(recurring *RecurringTransaction) (uint, error)
+	LoadRecurringTransaction(id uint) (*RecurringTransaction, error)
+	ListRecurringTransactionsForUser(userId uint) ([]RecurringTransaction, error)
+	DeleteRecurringTransaction(id uint) error
+	PauseRecurringTransaction(id uint) error
+	RunDueRecurringTransactions(now time.Time, limit int, create func(recurring RecurringTransaction) (*Transaction, error)) (int, int, error)
+	InsertTransactionGroup(group *TransactionGroup, legs []Transaction) (uint, error)
+	LoadTransactionGroup(id uint) (*TransactionGroup, error)
+	ListTransactionGroups(ids []uint) ([]TransactionGroup, error)
+	ApproveGroupTransaction(transactionId uint) (*TransactionGroup, error)
+	CloseTransactionGroup(groupId uint, status uint) (*TransactionGroup, error)
+	RaiseDispute(dispute *Dispute) (uint, error)
+	LoadDispute(id uint) (*Dispute, error)
+	ListDisputes(statuses []uint) ([]Dispute, error)
+	ListDisputesForUser(userId uint) ([]Dispute, error)
+	ReviewDispute(disputeId uint, reviewerId uint, note string) (*Dispute, error)
+	ResolveDispute(disputeId uint, reviewerId uint, reverse bool, resolution string) (*Dispute, error)
+	ListAuditEntries(transactionId uint) ([]AuditEntry, error)
+	InsertListing(listing *Listing) (uint, error)
+	UpdateListing(listing *Listing) (uint, error)
+	LoadListing(id uint) (*Listing, error)
+	DeleteListing(id uint) error
+	SearchListings(filter ListingFilter) ([]Listing, error)
+	SavePlaces(places []Place) (int, error)
+	LookupPlace(name string) (*Place, error)
+	ListUsersNear(latitude float64, longitude float64, radiusKm float64, precision int, limit int) ([]NearbyUser, error)
+	LeaveFeedback(feedback *Feedback, confirmedAfter time.Time) (uint, error)
+	LoadFeedback(id uint) (*Feedback, error)
+	ListFeedbackForUser(userId uint) ([]Feedback, error)
+	ListFeedbackForTransaction(transactionId uint) ([]Feedback, error)
+	ListFeedback(hiddenOnly bool, limit int) ([]Feedback, error)
+	ModerateFeedback(feedbackId uint, moderatorId uint, hidden bool, reason string) (*Feedback, error)
+	ReputationFor(userId uint) (Reputation, error)
+	FindOrCreateMessageThread(thread *MessageThread) (uint, error)
+	LoadMessageThread(id uint) (*MessageThread, error)
+	ListMessageThreadsForUser(userId uint) ([]MessageThread, error)
+	InsertMessage(message *Message) (uint, error)
+	ListMessages(threadId uint) ([]Message, error)
+	MarkThreadRead(threadId uint, userId uint, now time.Time) (int, error)
+	UnreadMessageCount(userId uint) (int, error)
+	BlockUser(userId uint, blockedUserId uint) error
+	UnblockUser(userId uint, blockedUserId uint) error
+	ListBlockedUsers(userId uint) ([]UserBlock, error)
+	IsBlocked(userId uint, otherUserId uint) (bool, error)
+	InsertEvent(event *Event) (uint, error)
+	ListEventsSince(userId uint, afterId uint, limit int) ([]Event, error)
+	PurgeEventsBefore(before time.Time) (int, error)
+
+	InsertOutboundEmail(email *OutboundEmail) (uint, error)
+	UpdateOutboundEmail(email *OutboundEmail) (uint, error)
+	LoadOutboundEmail(id uint) (*OutboundEmail, error)
+	ListOutboundEmails(status uint) ([]OutboundEmail, error)
+	ClaimDueOutboundEmails(now time.Time, limit int, lease time.Duration) ([]OutboundEmail, error)
+}
+
+type PostgresStore struct {
+	db                *gorm.DB
+	feeUserId         uint
+	defaultLimit      CreditLimit
+	scaleByMultiplier bool
+}
+
+var _ Store = &PostgresStore{}
 
 type PublicUser struct {
 	gorm.Model
@@ -26,7 +141,8 @@ type PublicUser struct {
 
 type PublicUserWithBalance struct {
 	PublicUser
-	Balance   int64
+	Balance int64
+	Reputation
 }
 
 func (PublicUser) TableName() string {
@@ -52,18 +168,24 @@ type User struct {
 
 type PrivilegedUser struct {
 	PublicUser
-	Email              string `gorm:"unique_index"`
-	Mobile             string
-	Confirmed          bool
-	AttemptCount       int    `json:"-"`
-	LastAttempt        string `json:"-"`
-	Locked             string `json:"-"`
-	Permissions        UserPermissions
+	Email        string `gorm:"unique_index"`
+	Mobile       string
+	Confirmed    bool
+	AttemptCount int    `json:"-"`
+	LastAttempt  string `json:"-"`
+	Locked       string `json:"-"`
+	Permissions  UserPermissions
+	Locale       string
+	Latitude     *float64
+	Longitude    *float64
 }
 
 type PrivilegedUserWithBalance struct {
 	PrivilegedUser
-	Balance   int64
+	Balance         int64
+	CreditLimit     int64
+	BalanceCap      int64
+	AvailableCredit int64
 }
 
 type Concept struct {
@@ -88,6 +210,11 @@ const (
 	TransactionRequestApproved
 	TransactionOfferRejected
 	TransactionRequestRejected
+	TransactionOfferCancelled
+	TransactionRequestCancelled
+	TransactionOfferExpired
+	TransactionRequestExpired
+	TransactionReversal
 )
 
 type PosixDateTime time.Time
@@ -120,82 +247,167 @@ func (d *PosixDateTime) Scan(src interface{}) error {
 	return nil
 }
 
+
+
+
 type Transaction struct {
 	gorm.Model
-	InitiatedDate   PosixDateTime `gorm:"type:timestamp with time zone"`
-	ConfirmedDate   PosixDateTime `gorm:"type:timestamp with time zone"`
-	FromUserId      uint
-	ToUserId        uint
-	Seconds         uint64 `gorm:"type:bigint"`
-	Multiplier      float32
-	TxFee           uint
-	Description     string
-	Location        string
-	ToPreviousTId   uint
-	FromPreviousTId uint
-	Status          uint
-	FromUserBalance int64 `gorm:"type:bigint"`
-	ToUserBalance   int64 `gorm:"type:bigint"`
+	InitiatedDate          PosixDateTime  `gorm:"type:timestamp with time zone"`
+	ConfirmedDate          PosixDateTime  `gorm:"type:timestamp with time zone"`
+	PerformedDate          *PosixDateTime `gorm:"type:timestamp with time zone"`
+	FromUserId             uint
+	ToUserId               uint
+	Seconds                uint64 `gorm:"type:bigint"`
+	Multiplier             float32
+	CreditedSeconds        uint64 `gorm:"type:bigint"`
+	TxFee                  uint
+	Description            string
+	Location               string
+	ToPreviousTId          uint
+	FromPreviousTId        uint
+	Status                 uint
+	FromUserBalance        int64 `gorm:"type:bigint"`
+	ToUserBalance          int64 `gorm:"type:bigint"`
+	FeeUserId              uint
+	FeePreviousTId         uint
+	FeeUserBalance         int64 `gorm:"type:bigint"`
+	Hash                   string
+	RecurringTransactionId uint
+	GroupId                uint
+	ApprovedDate           *PosixDateTime `gorm:"type:timestamp with time zone"`
+	GroupStatus            uint           `gorm:"-"`
+	ReversesTId            uint
+	ListingId              uint
 }
 
 func (t Transaction) Balance(userId uint) int64 {
 	if userId == t.FromUserId {
 		return t.FromUserBalance
+	} else if userId == t.FeeUserId && userId != t.ToUserId {
+		return t.FeeUserBalance
 	} else {
 		return t.ToUserBalance
 	}
 }
 
-func readPostgresArgs() string {
-	const postgresArgsFileName = "postgres_args.txt"
-	postgresArgs, err := ioutil.ReadFile(postgresArgsFileName)
-	if err != nil {
-		postgresArgs, err = ioutil.ReadFile("../" + postgresArgsFileName)
-		if err != nil {
-			postgresArgs = []byte("host=myhost port=myport sslmode=disable user=thinkglobally dbname=concepts password=mypassword")
-			err = ioutil.WriteFile(postgresArgsFileName, postgresArgs, 0666)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
+func (t Transaction) IsPending() bool {
+	return t.Status == TransactionOffered || t.Status == TransactionRequested
+}
+
+func (t Transaction) IsPosted() bool {
+	return t.Status == TransactionOfferApproved || t.Status == TransactionRequestApproved || t.Status == TransactionReversal
+}
+
+// ApprovedStatus is the status a pending transaction moves to once the counterparty accepts it
+func (t Transaction) ApprovedStatus() uint {
+	if t.ReversesTId != 0 {
+		return TransactionReversal
 	}
-	return string(postgresArgs)
+	if t.Status == TransactionRequested {
+		return TransactionRequestApproved
+	}
+	return TransactionOfferApproved
 }
 
-func (s *Store) StoreInit(dbName string) {
-	db, err := gorm.Open("postgres", readPostgresArgs())
+// IsRequest is true when the transaction was initiated by the member it pays
+func (t Transaction) IsRequest() bool {
+	switch t.Status {
+	case TransactionRequested, TransactionRequestApproved, TransactionRequestRejected, TransactionRequestCancelled, TransactionRequestExpired:
+		return true
+	}
+	return false
+}
 
-	if err != nil {
-		log.Fatal(err)
+// InitiatorId is whoever offered or requested the transaction, they pay the fee
+func (t Transaction) InitiatorId() uint {
+	if t.IsRequest() {
+		return t.ToUserId
 	}
-	s.db = db
+	return t.FromUserId
+}
+
+// CounterpartyId is whoever has to accept the transaction
+func (t Transaction) CounterpartyId() uint {
+	if t.IsRequest() {
+		return t.FromUserId
+	}
+	return t.ToUserId
+}
+
+// RejectedStatus is the status a pending transaction moves to when the counterparty turns it down
+func (t Transaction) RejectedStatus() uint {
+	if t.IsRequest() {
+		return TransactionRequestRejected
+	}
+	return TransactionOfferRejected
+}
 
-	_, _ = db.DB().Exec("CREATE EXTENSION postgis;")
+// CancelledStatus is the status a pending transaction moves to when its initiator withdraws it
+func (t Transaction) CancelledStatus() uint {
+	if t.IsRequest() {
+		return TransactionRequestCancelled
+	}
+	return TransactionOfferCancelled
+}
+
+// ExpiredStatus is the status a pending transaction moves to when it is not accepted in time
+func (t Transaction) ExpiredStatus() uint {
+	if t.IsRequest() {
+		return TransactionRequestExpired
+	}
+	return TransactionOfferExpired
+}
+
+// FeeFor is how much of the fee on the transaction was paid by the user
+func (t Transaction) FeeFor(userId uint) int64 {
+	if userId == t.InitiatorId() {
+		return int64(t.TxFee)
+	}
+	return 0
+}
+
+var ErrTransactionNotPending = errors.New("transaction not offered or requested")
+
+// withDatabaseName points the connection string at dbName, for both key=value and postgres:// url forms
+func withDatabaseName(dsn string, dbName string) string {
+	if len(dbName) == 0 {
+		return dsn
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			u.Path = "/" + dbName
+			return u.String()
+		}
+	}
+	return dsn + " dbname=" + dbName
+}
+
+// StoreInit connects to the database, the schema is managed by MigrateUp
+func (s *PostgresStore) StoreInit(dsn string, dbName string) {
+	db, err := gorm.Open("postgres", withDatabaseName(dsn, dbName))
 
-	err = db.AutoMigrate(&User{}, &Concept{}, &ConceptTag{}, &Transaction{}).Error
 	if err != nil {
 		log.Fatal(err)
 	}
+	s.db = db
+	s.defaultLimit = CreditLimit{CreditLimit: NoLimit, BalanceCap: NoLimit}
 
 	//DEBUG - add/remove to investigate SQL queries being executed
 	//db.LogMode(true)
-
-	db.Model(&ConceptTag{}).AddForeignKey("concept_id", "concepts(id)", "CASCADE", "RESTRICT")
-	db.Model(&Transaction{}).AddForeignKey("from_user_id", "users(id)", "CASCADE", "RESTRICT")
-	db.Model(&Transaction{}).AddForeignKey("to_user_id", "users(id)", "CASCADE", "RESTRICT")
 }
 
-func (s *Store) InsertUser(user *User) (uint, error) {
+func (s *PostgresStore) InsertUser(user *User) (uint, error) {
 	err := s.db.Create(user).Error
 	return user.ID, err
 }
 
-func (s *Store) UpdateUser(user *User) (uint, error) {
+func (s *PostgresStore) UpdateUser(user *User) (uint, error) {
 	err := s.db.Save(user).Error
 	return user.ID, err
 }
 
-func (s *Store) FindUser(email string) (*User, error) {
+func (s *PostgresStore) FindUser(email string) (*User, error) {
 	user := User{}
 	err := s.db.Where("email=?", email).Find(&user).Error
 	if err != nil {
@@ -204,7 +416,7 @@ func (s *Store) FindUser(email string) (*User, error) {
 	return &user, err
 }
 
-func (s *Store) PurgeUser(email string) {
+func (s *PostgresStore) PurgeUser(email string) {
 	user := User{}
 	err := s.db.Where("email=?", email).Find(&user).Error
 	if err != nil {
@@ -213,7 +425,42 @@ func (s *Store) PurgeUser(email string) {
 	s.db.Unscoped().Where("email=?", email).Delete(User{})
 }
 
-func (s *Store) LoadPublicUser(id uint) (*PublicUser, error) {
+// RecordFailedLogin counts a failed login attempt in the database so that concurrent attempts are not lost
+func (s *PostgresStore) RecordFailedLogin(userId uint, attemptTime time.Time) (int, error) {
+	err := s.db.Model(&User{}).Where("id=?", userId).Updates(map[string]interface{}{
+		"attempt_count": gorm.Expr("attempt_count + 1"),
+		"last_attempt":  attemptTime.Format(time.RFC3339),
+	}).Error
+	if err != nil {
+		return 0, err
+	}
+	user := User{}
+	err = s.db.Where("id=?", userId).Find(&user).Error
+	return user.AttemptCount, err
+}
+
+func (s *PostgresStore) LockUser(userId uint, until time.Time) error {
+	return s.db.Model(&User{}).Where("id=?", userId).Updates(map[string]interface{}{
+		"attempt_count": 0,
+		"locked":        until.Format(time.RFC3339),
+	}).Error
+}
+
+func (s *PostgresStore) ResetLoginAttempts(userId uint) error {
+	return s.db.Model(&User{}).Where("id=?", userId).Updates(map[string]interface{}{
+		"attempt_count": 0,
+		"last_attempt":  "",
+		"locked":        "",
+	}).Error
+}
+
+func (s *PostgresStore) ListUsersWithFailedLogins() ([]User, error) {
+	var users []User
+	err := s.db.Where("attempt_count > 0 OR locked <> ''").Order("id").Find(&users).Error
+	return users, err
+}
+
+func (s *PostgresStore) LoadPublicUser(id uint) (*PublicUser, error) {
 	user := User{}
 	err := s.db.Where("id=?", id).Find(&user).Error
 	if err != nil {
@@ -229,7 +476,7 @@ func (s *Store) LoadPublicUser(id uint) (*PublicUser, error) {
 	return &publicUser, err
 }
 
-func (s *Store) LoadPrivilegedUserAsSelf(userId uint, loggedInUserId uint) (*PrivilegedUser, error) {
+func (s *PostgresStore) LoadPrivilegedUserAsSelf(userId uint, loggedInUserId uint) (*PrivilegedUser, error) {
 	if userId != loggedInUserId {
 		return nil, errors.New("cannot load others users")
 	}
@@ -241,7 +488,7 @@ func (s *Store) LoadPrivilegedUserAsSelf(userId uint, loggedInUserId uint) (*Pri
 	return &user, err
 }
 
-func (s *Store) LoadUserAsSelf(userId uint, loggedInUserId uint) (*User, error) {
+func (s *PostgresStore) LoadUserAsSelf(userId uint, loggedInUserId uint) (*User, error) {
 	if userId != loggedInUserId {
 		return nil, errors.New("cannot load others users")
 	}
@@ -253,27 +500,27 @@ func (s *Store) LoadUserAsSelf(userId uint, loggedInUserId uint) (*User, error)
 	return &user, err
 }
 
-func (s *Store) InsertConcept(concept *Concept) (uint, error) {
+func (s *PostgresStore) InsertConcept(concept *Concept) (uint, error) {
 	err := s.db.Create(concept).Error
 	return concept.ID, err
 }
 
-func (s *Store) UpdateConcept(concept *Concept) (uint, error) {
+func (s *PostgresStore) UpdateConcept(concept *Concept) (uint, error) {
 	err := s.db.Save(concept).Error
 	return concept.ID, err
 }
 
-func (s *Store) PurgeConcept(email string) {
-	s.db.Unscoped().Where("name=?", email).Delete(Concept{})
+func (s *PostgresStore) PurgeConcept(name string) {
+	s.db.Unscoped().Where("name=?", name).Delete(Concept{})
 }
 
-func (s *Store) LoadConcept(id uint) (*Concept, error) {
+func (s *PostgresStore) LoadConcept(id uint) (*Concept, error) {
 	concept := Concept{}
 	err := s.db.Where("id=?", id).Find(&concept).Error
 	return &concept, err
 }
 
-func (s *Store) FindConcept(name string) (*Concept, error) {
+func (s *PostgresStore) FindConcept(name string) (*Concept, error) {
 	concept := Concept{}
 	err := s.db.Where("name=?", name).Find(&concept).Error
 	if err != nil {
@@ -282,7 +529,7 @@ func (s *Store) FindConcept(name string) (*Concept, error) {
 	return &concept, err
 }
 
-func (s *Store) ListConcepts() ([]Concept, error) {
+func (s *PostgresStore) ListConcepts() ([]Concept, error) {
 	var concepts []Concept
 	err := s.db.Limit(200).Order("name").Find(&concepts).Error
 	if err != nil {
@@ -291,17 +538,17 @@ func (s *Store) ListConcepts() ([]Concept, error) {
 	return concepts, err
 }
 
-func (s *Store) InsertConceptTag(conceptTag *ConceptTag) (uint, error) {
+func (s *PostgresStore) InsertConceptTag(conceptTag *ConceptTag) (uint, error) {
 	err := s.db.Create(conceptTag).Error
 	return conceptTag.ID, err
 }
 
-func (s *Store) UpdateConceptTag(conceptTag *ConceptTag) (uint, error) {
+func (s *PostgresStore) UpdateConceptTag(conceptTag *ConceptTag) (uint, error) {
 	err := s.db.Save(conceptTag).Error
 	return conceptTag.ID, err
 }
 
-func (s *Store) ConceptTagsAsStrings(concept *Concept) ([]string, error) {
+func (s *PostgresStore) ConceptTagsAsStrings(concept *Concept) ([]string, error) {
 	var names []string
 	var conceptTags []ConceptTag
 	err := s.db.Where("concept_id=?", concept.ID).Order("order").Find(&conceptTags).Error
@@ -314,7 +561,7 @@ func (s *Store) ConceptTagsAsStrings(concept *Concept) ([]string, error) {
 	return nil, err
 }
 
-func (s *Store) FindConceptTag(tag string) (*ConceptTag, error) {
+func (s *PostgresStore) FindConceptTag(tag string) (*ConceptTag, error) {
 	conceptTag := ConceptTag{}
 	err := s.db.Where("tag=?", tag).Find(&conceptTag).Error
 	if err != nil {
@@ -323,28 +570,28 @@ func (s *Store) FindConceptTag(tag string) (*ConceptTag, error) {
 	return &conceptTag, err
 }
 
-func (s *Store) ConceptTagsForConceptId(conceptId uint) ([]ConceptTag, error) {
+func (s *PostgresStore) ConceptTagsForConceptId(conceptId uint) ([]ConceptTag, error) {
 	var conceptTags []ConceptTag
 	err := s.db.Where("concept_id=?", conceptId).Order("order").Find(&conceptTags).Error
 	return conceptTags, err
 }
 
-func (s *Store) ListConceptTags() ([]ConceptTag, error) {
+func (s *PostgresStore) ListConceptTags() ([]ConceptTag, error) {
 	var conceptTags []ConceptTag
 	err := s.db.Order("order").Find(&conceptTags).Error
 	return conceptTags, err
 }
 
-func (s *Store) DeleteConceptTag(id uint) error {
+func (s *PostgresStore) DeleteConceptTag(id uint) error {
 	err := s.db.Unscoped().Where("id=?", id).Delete(ConceptTag{}).Error
 	return err
 }
 
-func (s *Store) PurgeConceptTag(tag string) {
+func (s *PostgresStore) PurgeConceptTag(tag string) {
 	s.db.Unscoped().Where("tag=?", tag).Delete(ConceptTag{})
 }
 
-func (s *Store) InsertTransaction(transaction *Transaction) (uint, error) {
+func (s *PostgresStore) InsertTransaction(transaction *Transaction) (uint, error) {
 	if transaction.Multiplier < 1 || transaction.Multiplier > 3 {
 		return 0, nil
 	}
@@ -352,36 +599,182 @@ func (s *Store) InsertTransaction(transaction *Transaction) (uint, error) {
 	return transaction.ID, err
 }
 
-func (s *Store) ListTransactionsForUser(userId uint) ([]Transaction, error) {
+func (s *PostgresStore) ListTransactionsForUser(userId uint) ([]Transaction, error) {
 	var transactions []Transaction
 	err := s.db.Where("from_user_id=? OR to_user_id=?", userId, userId).Order("confirmed_date,initiated_date").Find(&transactions).Error
 	return transactions, err
 }
 
-func (s *Store) PurgeTransaction(transaction Transaction) {
+func (s *PostgresStore) PurgeTransaction(transaction Transaction) {
 	s.db.Unscoped().Where("id=?", transaction.ID).Delete(Transaction{})
 }
 
-func (s *Store) LoadTransaction(id uint) (*Transaction, error) {
+func (s *PostgresStore) LoadTransaction(id uint) (*Transaction, error) {
 	transaction := Transaction{}
 	err := s.db.Where("id=?", id).Find(&transaction).Error
 	return &transaction, err
 }
 
-func (s *Store) UpdateTransaction(transaction *Transaction) (uint, error) {
+func (s *PostgresStore) UpdateTransaction(transaction *Transaction) (uint, error) {
 	err := s.db.Save(transaction).Error
 	return transaction.ID, err
 }
 
-func (s *Store) ListTransactionPartners(userId uint) ([]PublicUser, error) {
+func (s *PostgresStore) ListTransactionPartners(userId uint) ([]PublicUser, error) {
 	var users []PublicUser
 	err := s.db.Raw("SELECT * FROM users WHERE users.deleted_at IS NULL AND users.id IN (SELECT to_user_id AS user_id FROM transactions WHERE transactions.deleted_at IS NULL AND ((from_user_id=? OR to_user_id=?)) UNION SELECT from_user_id AS user_id FROM transactions WHERE transactions.deleted_at IS NULL AND ((from_user_id=? OR to_user_id=?))) ORDER BY users.id", userId, userId, userId, userId).Scan(&users).Error
 	return users, err
 }
 
-func (s *Store) LastConfirmedTransactionForUser(userId uint) (Transaction, error) {
+func (s *PostgresStore) LastConfirmedTransactionForUser(userId uint) (Transaction, error) {
+	return lastPostedTransactionForUser(s.db, userId)
+}
+
+func lastPostedTransactionForUser(db *gorm.DB, userId uint) (Transaction, error) {
 	var transaction Transaction
-	err := s.db.Where("status > 2 AND (from_user_id=? OR to_user_id=?)", userId, userId).Order("confirmed_date DESC").Take(&transaction).Error
+	err := db.Where("status IN (?) AND (from_user_id=? OR to_user_id=? OR fee_user_id=?)", postedStatuses, userId, userId, userId).Order("confirmed_date DESC, id DESC").Take(&transaction).Error
 	return transaction, err
+}
+
+const postTransactionAttempts = 10
 
+// PostTransaction approves a pending transaction and records the new running balances of both parties. Both users
+// rows are locked inside a serializable database transaction so concurrent postings for the same user can not both
+// start from the same previous balance, serialization failures are retried.
+func (s *PostgresStore) PostTransaction(transactionId uint) (*Transaction, error) {
+	var transaction *Transaction
+	var err error
+	for attempt := 0; attempt < postTransactionAttempts; attempt++ {
+		transaction, err = s.postTransaction(transactionId)
+		if !isSerializationFailure(err) {
+			break
+		}
+		time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+	}
+	return transaction, err
+}
+
+// collectFeeFor credits any fee on the transaction to the fee account when it is posted
+func (t *Transaction) collectFeeFor(feeUserId uint) {
+	t.FeeUserId = 0
+	if t.TxFee > 0 {
+		t.FeeUserId = feeUserId
+	}
+}
+
+// post approves the pending transaction, chaining it after the last transaction posted for each party, the fee
+// account is a party when FeeUserId is set
+func (t *Transaction) post(fromUserLastTransaction Transaction, toUserLastTransaction Transaction, feeUserLastTransaction Transaction) {
+	t.Status = t.ApprovedStatus()
+	t.FromUserBalance = fromUserLastTransaction.Balance(t.FromUserId) + t.BalanceChange(t.FromUserId)
+	t.ToUserBalance = toUserLastTransaction.Balance(t.ToUserId) + t.BalanceChange(t.ToUserId)
+	t.ConfirmedDate = PosixDateTime(time.Now().Truncate(time.Microsecond))
+	t.FromPreviousTId = fromUserLastTransaction.ID
+	t.ToPreviousTId = toUserLastTransaction.ID
+	t.FeePreviousTId = 0
+	t.FeeUserBalance = 0
+	if t.FeeUserId != 0 {
+		t.FeeUserBalance = feeUserLastTransaction.Balance(t.FeeUserId) + t.BalanceChange(t.FeeUserId)
+		t.FeePreviousTId = feeUserLastTransaction.ID
+	}
+	t.Hash = t.ledgerHash(fromUserLastTransaction.Hash, toUserLastTransaction.Hash, feeUserLastTransaction.Hash)
+}
+
+func (s *PostgresStore) postTransaction(transactionId uint) (*Transaction, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	err := tx.Exec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE").Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	transaction, err := s.postTransactionInTx(tx, transactionId)
+	if err == nil && transaction.GroupId != 0 {
+		err = ErrTransactionInGroup
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// postTransactionInTx posts within tx, which must be serializable
+func (s *PostgresStore) postTransactionInTx(tx *gorm.DB, transactionId uint) (*Transaction, error) {
+	transaction := Transaction{}
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id=?", transactionId).Find(&transaction).Error
+	if err != nil {
+		return nil, err
+	}
+	if !transaction.IsPending() {
+		return nil, ErrTransactionNotPending
+	}
+	transaction.collectFeeFor(s.feeUserId)
+	transaction.CreditedSeconds = transaction.creditFor(s.scaleByMultiplier)
+	userIds := []uint{transaction.FromUserId, transaction.ToUserId}
+	if transaction.FeeUserId != 0 {
+		userIds = append(userIds, transaction.FeeUserId)
+	}
+	err = lockUsers(tx, userIds...)
+	if err != nil {
+		return nil, err
+	}
+
+	fromUserLastTransaction, err := lastPostedTransactionForUser(tx, transaction.FromUserId)
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	toUserLastTransaction, err := lastPostedTransactionForUser(tx, transaction.ToUserId)
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+
+	feeUserLastTransaction := Transaction{}
+	if transaction.FeeUserId != 0 {
+		feeUserLastTransaction, err = lastPostedTransactionForUser(tx, transaction.FeeUserId)
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return nil, err
+		}
+	}
+
+	transaction.post(fromUserLastTransaction, toUserLastTransaction, feeUserLastTransaction)
+	err = transaction.checkLimits(s.feeUserId, func(userId uint) (CreditLimit, error) {
+		return creditLimitFor(tx, userId, s.defaultLimit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Save(&transaction).Error
+	if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// lockUsers takes row locks on the users in id order so that concurrent postings can not deadlock each other
+func lockUsers(tx *gorm.DB, userIds ...uint) error {
+	ids := append([]uint{}, userIds...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var users []User
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id IN (?)", ids).Order("id").Find(&users).Error
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func isSerializationFailure(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return false
 }
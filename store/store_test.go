@@ -1,25 +1,105 @@
 package store
 
 import (
+	"errors"
+	"github.com/adamboardman/thinkglobally/config"
 	. "github.com/smartystreets/goconvey/convey"
 	"golang.org/x/crypto/bcrypt"
+	"log"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-var s Store
+// testStore adds the helpers the tests use to reach behind the Store interface
+type testStore interface {
+	Store
+	purgeTransactionsForUser(userId uint)
+	setToUserBalance(transactionId uint, balance int64)
+	purgeOutboundEmailsTo(recipient string)
+}
+
+var s testStore
 
+// TestMain runs every test against the in memory store and, when a database is configured, again against postgres
 func TestMain(m *testing.M) {
-	s = Store{}
-	s.StoreInit("test-db")
+	backends := map[string]testStore{"memory": NewMemoryStore()}
+	cfg, _, err := config.Load(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var postgresStore *PostgresStore
+	if len(cfg.Database.DSN) > 0 {
+		postgresStore = &PostgresStore{}
+		postgresStore.StoreInit(cfg.Database.DSN, cfg.Database.Name)
+		_, err = postgresStore.MigrateUp()
+		if err != nil {
+			log.Fatal(err)
+		}
+		backends["postgres"] = postgresStore
+	}
 
-	code := m.Run()
+	code := 0
+	for _, name := range []string{"memory", "postgres"} {
+		backend, ok := backends[name]
+		if !ok {
+			continue
+		}
+		log.Printf("Testing the %s store", name)
+		s = backend
+		if result := m.Run(); result != 0 {
+			code = result
+		}
+	}
 
-	_ = s.db.Close()
+	if postgresStore != nil {
+		_ = postgresStore.db.Close()
+	}
 	os.Exit(code)
 }
 
+func (s *PostgresStore) purgeTransactionsForUser(userId uint) {
+	s.db.Unscoped().Where("from_user_id=? OR to_user_id=? OR fee_user_id=?", userId, userId, userId).Delete(Transaction{})
+}
+
+func (s *PostgresStore) setToUserBalance(transactionId uint, balance int64) {
+	s.db.Model(&Transaction{}).Where("id=?", transactionId).UpdateColumn("to_user_balance", balance)
+}
+
+func (s *PostgresStore) purgeOutboundEmailsTo(recipient string) {
+	s.db.Unscoped().Where("recipient=?", recipient).Delete(OutboundEmail{})
+}
+
+func (s *MemoryStore) purgeTransactionsForUser(userId uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, transaction := range s.transactions {
+		if involves(userId)(transaction) || transaction.FeeUserId == userId {
+			delete(s.transactions, id)
+		}
+	}
+}
+
+func (s *MemoryStore) setToUserBalance(transactionId uint, balance int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	transaction := s.transactions[transactionId]
+	transaction.ToUserBalance = balance
+	s.transactions[transactionId] = transaction
+}
+
+func (s *MemoryStore) purgeOutboundEmailsTo(recipient string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, email := range s.outboundEmails {
+		if email.Recipient == recipient {
+			delete(s.outboundEmails, id)
+		}
+	}
+}
+
 func ensureTestUserExists(emailAddress string) *User {
 	user, err := s.FindUser(emailAddress)
 	if err != nil {
@@ -246,11 +326,9 @@ func getTransactionFromTransactions(transactions []Transaction, id uint) *Transa
 func TestStore_TransactionCreation(t *testing.T) {
 	Convey("Create a transaction", t, func() {
 		user1 := ensureTestUserExists("user1@example.com")
-		s.db.Unscoped().Where("from_user_id=?", user1.ID).Delete(Transaction{})
-		s.db.Unscoped().Where("to_user_id=?", user1.ID).Delete(Transaction{})
+		s.purgeTransactionsForUser(user1.ID)
 		user2 := ensureTestUserExists("user2@example.com")
-		s.db.Unscoped().Where("from_user_id=?", user2.ID).Delete(Transaction{})
-		s.db.Unscoped().Where("to_user_id=?", user2.ID).Delete(Transaction{})
+		s.purgeTransactionsForUser(user2.ID)
 		transaction := Transaction{
 			InitiatedDate: PosixDateTime(time.Now()),
 			FromUserId:    user1.ID,
@@ -385,3 +463,1174 @@ func TestStore_TransactionPartners(t *testing.T) {
 		})
 	})
 }
+
+func TestStore_ConcurrentPostTransaction(t *testing.T) {
+	Convey("Given many pending transactions between three users", t, func() {
+		users := []*User{
+			ensureTestUserExists("concurrent1@example.com"),
+			ensureTestUserExists("concurrent2@example.com"),
+			ensureTestUserExists("concurrent3@example.com"),
+		}
+		for _, user := range users {
+			s.purgeTransactionsForUser(user.ID)
+		}
+		const transactionCount = 30
+		expected := map[uint]int64{}
+		var transactionIds []uint
+		for i := 0; i < transactionCount; i++ {
+			from := users[i%len(users)]
+			to := users[(i+1)%len(users)]
+			status := uint(TransactionOffered)
+			if i%2 == 1 {
+				status = TransactionRequested
+			}
+			transaction := Transaction{
+				InitiatedDate: PosixDateTime(time.Now()),
+				FromUserId:    from.ID,
+				ToUserId:      to.ID,
+				Seconds:       uint64(60 * (i + 1)),
+				TxFee:         1,
+				Multiplier:    1,
+				Description:   "Concurrent Transaction",
+				Status:        status,
+			}
+			transactionId, err := s.InsertTransaction(&transaction)
+			So(err, ShouldBeNil)
+			transactionIds = append(transactionIds, transactionId)
+			if status == TransactionOffered {
+				expected[from.ID] -= int64(transaction.Seconds) + 1
+				expected[to.ID] += int64(transaction.Seconds)
+			} else {
+				expected[from.ID] -= int64(transaction.Seconds)
+				expected[to.ID] += int64(transaction.Seconds) - 1
+			}
+		}
+
+		Convey("Accepting them all in parallel", func() {
+			var wg sync.WaitGroup
+			errs := make(chan error, transactionCount)
+			for _, transactionId := range transactionIds {
+				wg.Add(1)
+				go func(transactionId uint) {
+					defer wg.Done()
+					_, err := s.PostTransaction(transactionId)
+					errs <- err
+				}(transactionId)
+			}
+			wg.Wait()
+			close(errs)
+
+			Convey("Every posting should succeed and no balance update should be lost", func() {
+				for err := range errs {
+					So(err, ShouldBeNil)
+				}
+				for _, user := range users {
+					lastTransaction, err := s.LastConfirmedTransactionForUser(user.ID)
+					So(err, ShouldBeNil)
+					So(lastTransaction.Balance(user.ID), ShouldEqual, expected[user.ID])
+				}
+			})
+
+			Convey("Accepting the same transaction again should fail", func() {
+				_, err := s.PostTransaction(transactionIds[0])
+				So(err, ShouldEqual, ErrTransactionNotPending)
+			})
+		})
+	})
+}
+
+func TestStore_VerifyLedger(t *testing.T) {
+	Convey("Given a chain of posted transactions between two users", t, func() {
+		user1 := ensureTestUserExists("ledger1@example.com")
+		user2 := ensureTestUserExists("ledger2@example.com")
+		for _, user := range []*User{user1, user2} {
+			s.purgeTransactionsForUser(user.ID)
+		}
+		var posted []*Transaction
+		for i := 0; i < 3; i++ {
+			transaction := Transaction{
+				InitiatedDate: PosixDateTime(time.Now()),
+				FromUserId:    user1.ID,
+				ToUserId:      user2.ID,
+				Seconds:       60 * 60,
+				TxFee:         1,
+				Multiplier:    1,
+				Description:   "Ledger Transaction",
+				Status:        TransactionOffered,
+			}
+			transactionId, _ := s.InsertTransaction(&transaction)
+			postedTransaction, err := s.PostTransaction(transactionId)
+			So(err, ShouldBeNil)
+			posted = append(posted, postedTransaction)
+		}
+
+		Convey("Each entry should link to the previous one for both users", func() {
+			So(posted[0].FromPreviousTId, ShouldEqual, 0)
+			So(posted[1].FromPreviousTId, ShouldEqual, posted[0].ID)
+			So(posted[2].ToPreviousTId, ShouldEqual, posted[1].ID)
+			So(posted[2].Hash, ShouldNotEqual, "")
+		})
+
+		Convey("The ledger should verify", func() {
+			report, err := s.VerifyLedger(user1.ID)
+			So(err, ShouldBeNil)
+			So(report.Valid, ShouldBeTrue)
+			So(report.Entries, ShouldEqual, 3)
+			So(report.Balance, ShouldEqual, -3*(60*60+1))
+		})
+
+		Convey("Tampering with a balance should be reported", func() {
+			s.setToUserBalance(posted[1].ID, 1)
+			report, err := s.VerifyLedger(user2.ID)
+			So(err, ShouldBeNil)
+			So(report.Valid, ShouldBeFalse)
+			kinds := map[string]bool{}
+			for _, problem := range report.Problems {
+				kinds[problem.Kind] = true
+			}
+			So(kinds[LedgerBalanceJump], ShouldBeTrue)
+			So(kinds[LedgerHashMismatch], ShouldBeTrue)
+		})
+
+		Convey("Removing an entry should be reported", func() {
+			s.PurgeTransaction(*posted[1])
+			report, err := s.VerifyLedger(user1.ID)
+			So(err, ShouldBeNil)
+			So(report.Valid, ShouldBeFalse)
+			So(report.Problems[0].Kind, ShouldEqual, LedgerMissingEntry)
+		})
+	})
+}
+
+func TestStore_FeeAccount(t *testing.T) {
+	Convey("Given a fee account collecting the fees", t, func() {
+		user1 := ensureTestUserExists("fees1@example.com")
+		user2 := ensureTestUserExists("fees2@example.com")
+		feeUser := ensureTestUserExists("fees@example.com")
+		for _, user := range []*User{user1, user2, feeUser} {
+			s.purgeTransactionsForUser(user.ID)
+		}
+		before, err := s.LedgerTotals()
+		So(err, ShouldBeNil)
+		s.SetFeeAccount(feeUser.ID)
+		Reset(func() {
+			s.SetFeeAccount(0)
+		})
+
+		var posted []*Transaction
+		for _, status := range []uint{TransactionOffered, TransactionRequested} {
+			transaction := Transaction{
+				InitiatedDate: PosixDateTime(time.Now()),
+				FromUserId:    user1.ID,
+				ToUserId:      user2.ID,
+				Seconds:       60 * 60,
+				TxFee:         2,
+				Multiplier:    1,
+				Description:   "Fee Transaction",
+				Status:        status,
+			}
+			transactionId, _ := s.InsertTransaction(&transaction)
+			postedTransaction, err := s.PostTransaction(transactionId)
+			So(err, ShouldBeNil)
+			posted = append(posted, postedTransaction)
+		}
+
+		Convey("Each fee should be credited to the fee account in the same entry", func() {
+			So(posted[0].FeeUserId, ShouldEqual, feeUser.ID)
+			So(posted[0].FeeUserBalance, ShouldEqual, 2)
+			So(posted[1].FeePreviousTId, ShouldEqual, posted[0].ID)
+			So(posted[1].FeeUserBalance, ShouldEqual, 4)
+			So(posted[1].FromUserBalance, ShouldEqual, -(60*60+2)-60*60)
+			So(posted[1].ToUserBalance, ShouldEqual, 60*60+60*60-2)
+		})
+
+		Convey("Every ledger should verify", func() {
+			for _, user := range []*User{user1, user2, feeUser} {
+				report, err := s.VerifyLedger(user.ID)
+				So(err, ShouldBeNil)
+				So(report.Valid, ShouldBeTrue)
+			}
+			report, _ := s.VerifyLedger(feeUser.ID)
+			So(report.Entries, ShouldEqual, 2)
+			So(report.Balance, ShouldEqual, 4)
+		})
+
+		Convey("The fee income should be reported", func() {
+			report, err := s.FeeIncome(time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(report.FeeUserId, ShouldEqual, feeUser.ID)
+			So(report.Postings, ShouldEqual, 2)
+			So(report.Collected, ShouldEqual, 4)
+			So(report.Balance, ShouldEqual, 4)
+		})
+
+		Convey("No fees should have left the ledger", func() {
+			after, err := s.LedgerTotals()
+			So(err, ShouldBeNil)
+			So(after.UncollectedFees, ShouldEqual, before.UncollectedFees)
+			So(after.Balances, ShouldEqual, before.Balances)
+			So(after.Balanced, ShouldEqual, before.Balanced)
+		})
+	})
+}
+
+func TestStore_CreditLimits(t *testing.T) {
+	Convey("Given a default credit limit of 100 seconds", t, func() {
+		user1 := ensureTestUserExists("limits1@example.com")
+		user2 := ensureTestUserExists("limits2@example.com")
+		for _, user := range []*User{user1, user2} {
+			s.purgeTransactionsForUser(user.ID)
+			_ = s.DeleteCreditLimit(user.ID, 0)
+		}
+		s.SetDefaultCreditLimit(100, NoLimit)
+		Reset(func() {
+			s.SetDefaultCreditLimit(NoLimit, NoLimit)
+			for _, user := range []*User{user1, user2} {
+				_ = s.DeleteCreditLimit(user.ID, 0)
+			}
+		})
+		offer := func(seconds uint64) (uint, error) {
+			transaction := Transaction{
+				InitiatedDate: PosixDateTime(time.Now()),
+				FromUserId:    user1.ID,
+				ToUserId:      user2.ID,
+				Seconds:       seconds,
+				Multiplier:    1,
+				Description:   "Limited Transaction",
+				Status:        TransactionOffered,
+			}
+			transactionId, _ := s.InsertTransaction(&transaction)
+			_, err := s.PostTransaction(transactionId)
+			return transactionId, err
+		}
+		_, err := offer(60)
+		So(err, ShouldBeNil)
+
+		Convey("Going past the limit should be refused with the shortfall", func() {
+			transactionId, err := offer(60)
+			limitErr, ok := err.(*LimitError)
+			So(ok, ShouldBeTrue)
+			So(limitErr.UserId, ShouldEqual, user1.ID)
+			So(limitErr.Kind, ShouldEqual, LimitKindCredit)
+			So(limitErr.Shortfall, ShouldEqual, 20)
+			transaction, _ := s.LoadTransaction(transactionId)
+			So(transaction.IsPending(), ShouldBeTrue)
+		})
+
+		Convey("A member's own limit should override the default", func() {
+			_, err := s.SaveCreditLimit(&CreditLimit{UserId: user1.ID, CreditLimit: 1000, BalanceCap: NoLimit})
+			So(err, ShouldBeNil)
+			limit, err := s.CreditLimitFor(user1.ID)
+			So(err, ShouldBeNil)
+			So(limit.Source, ShouldEqual, CreditLimitSourceMember)
+			So(limit.AvailableCredit(-60), ShouldEqual, 940)
+			_, err = offer(60)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A balance cap should stop the payee holding more", func() {
+			_, err := s.SaveCreditLimit(&CreditLimit{UserId: user1.ID, CreditLimit: NoLimit, BalanceCap: NoLimit})
+			So(err, ShouldBeNil)
+			_, err = s.SaveCreditLimit(&CreditLimit{UserId: user2.ID, CreditLimit: NoLimit, BalanceCap: 100})
+			So(err, ShouldBeNil)
+			_, err = offer(60)
+			limitErr, ok := err.(*LimitError)
+			So(ok, ShouldBeTrue)
+			So(limitErr.UserId, ShouldEqual, user2.ID)
+			So(limitErr.Kind, ShouldEqual, LimitKindBalanceCap)
+			So(limitErr.Shortfall, ShouldEqual, 20)
+		})
+	})
+}
+
+func TestStore_CancelAndExpirePending(t *testing.T) {
+	Convey("Given a pending offer and request", t, func() {
+		user1 := ensureTestUserExists("pending1@example.com")
+		user2 := ensureTestUserExists("pending2@example.com")
+		var transactionIds []uint
+		for _, status := range []uint{TransactionOffered, TransactionRequested} {
+			transaction := Transaction{
+				InitiatedDate: PosixDateTime(time.Now()),
+				FromUserId:    user1.ID,
+				ToUserId:      user2.ID,
+				Seconds:       60,
+				Multiplier:    1,
+				Description:   "Pending Transaction",
+				Status:        status,
+			}
+			transactionId, _ := s.InsertTransaction(&transaction)
+			transactionIds = append(transactionIds, transactionId)
+		}
+
+		Convey("Cancelling should close it so it can no longer be posted", func() {
+			transaction, _ := s.LoadTransaction(transactionIds[0])
+			cancelled, err := s.ClosePendingTransaction(transaction.ID, transaction.CancelledStatus())
+			So(err, ShouldBeNil)
+			So(cancelled.Status, ShouldEqual, TransactionOfferCancelled)
+			_, err = s.ClosePendingTransaction(transaction.ID, transaction.CancelledStatus())
+			So(err, ShouldEqual, ErrTransactionNotPending)
+			_, err = s.PostTransaction(transaction.ID)
+			So(err, ShouldEqual, ErrTransactionNotPending)
+		})
+
+		Convey("Sweeping should expire both with the matching status", func() {
+			expired, err := s.ExpirePendingTransactions(time.Now().Add(time.Second), 1000)
+			So(err, ShouldBeNil)
+			So(len(expired), ShouldBeGreaterThanOrEqualTo, 2)
+			offer, _ := s.LoadTransaction(transactionIds[0])
+			So(offer.Status, ShouldEqual, TransactionOfferExpired)
+			request, _ := s.LoadTransaction(transactionIds[1])
+			So(request.Status, ShouldEqual, TransactionRequestExpired)
+			So(request.InitiatorId(), ShouldEqual, user2.ID)
+		})
+
+		Convey("Recent transactions should not be expired", func() {
+			_, err := s.ExpirePendingTransactions(time.Now().Add(-time.Hour), 1000)
+			So(err, ShouldBeNil)
+			offer, _ := s.LoadTransaction(transactionIds[0])
+			So(offer.IsPending(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestStore_FailedLogins(t *testing.T) {
+	Convey("Given a user", t, func() {
+		const emailAddress = "failed-logins@example.com"
+		s.PurgeUser(emailAddress)
+		user := ensureTestUserExists(emailAddress)
+
+		Convey("Failed logins should be counted", func() {
+			_, _ = s.RecordFailedLogin(user.ID, time.Now())
+			attempts, err := s.RecordFailedLogin(user.ID, time.Now())
+			So(err, ShouldBeNil)
+			So(attempts, ShouldEqual, 2)
+
+			Convey("Locking the user should be listed and reset clears it", func() {
+				err := s.LockUser(user.ID, time.Now().Add(time.Minute))
+				So(err, ShouldBeNil)
+				users, _ := s.ListUsersWithFailedLogins()
+				found := false
+				for _, lockedUser := range users {
+					if lockedUser.ID == user.ID {
+						found = len(lockedUser.Locked) > 0
+					}
+				}
+				So(found, ShouldBeTrue)
+
+				err = s.ResetLoginAttempts(user.ID)
+				So(err, ShouldBeNil)
+				reloadedUser, _ := s.FindUser(emailAddress)
+				So(reloadedUser.AttemptCount, ShouldEqual, 0)
+				So(reloadedUser.Locked, ShouldEqual, "")
+			})
+		})
+	})
+}
+
+func TestStore_ClaimDueOutboundEmails(t *testing.T) {
+	Convey("Given a due and a future outbound email", t, func() {
+		s.purgeOutboundEmailsTo("outbox@example.com")
+		now := time.Now()
+		due := OutboundEmail{Recipient: "outbox@example.com", Subject: "due", Status: OutboundEmailPending, NextAttempt: now.Add(-time.Minute)}
+		future := OutboundEmail{Recipient: "outbox@example.com", Subject: "future", Status: OutboundEmailPending, NextAttempt: now.Add(time.Hour)}
+		dueId, _ := s.InsertOutboundEmail(&due)
+		futureId, _ := s.InsertOutboundEmail(&future)
+
+		Convey("Only the due email should be claimed, and only once while leased", func() {
+			emails, err := s.ClaimDueOutboundEmails(now, 100, time.Minute)
+			So(err, ShouldBeNil)
+			var claimedIds []uint
+			for _, email := range emails {
+				claimedIds = append(claimedIds, email.ID)
+			}
+			So(claimedIds, ShouldContain, dueId)
+			So(claimedIds, ShouldNotContain, futureId)
+
+			emails, err = s.ClaimDueOutboundEmails(now, 100, time.Minute)
+			So(err, ShouldBeNil)
+			claimedIds = nil
+			for _, email := range emails {
+				claimedIds = append(claimedIds, email.ID)
+			}
+			So(claimedIds, ShouldNotContain, dueId)
+		})
+	})
+}
+
+func TestStore_Migrations(t *testing.T) {
+	postgresStore, ok := s.(*PostgresStore)
+	if !ok {
+		t.Skip("migrations only apply to the postgres store")
+	}
+	Convey("Given the schema has been migrated", t, func() {
+		Convey("Migrating up again should apply nothing", func() {
+			done, err := postgresStore.MigrateUp()
+			So(err, ShouldBeNil)
+			So(done, ShouldBeEmpty)
+		})
+
+		Convey("Every migration should be recorded as applied", func() {
+			statuses, err := postgresStore.MigrationStatus()
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, len(migrations))
+			for _, status := range statuses {
+				So(status.Applied, ShouldBeTrue)
+			}
+			So(postgresStore.CheckSchema(), ShouldBeNil)
+		})
+	})
+}
+
+func TestStore_ListTransactionsPaged(t *testing.T) {
+	Convey("Given a user with five transactions to two counterparties", t, func() {
+		user := ensureTestUserExists("history@example.com")
+		partner1 := ensureTestUserExists("history-partner1@example.com")
+		partner2 := ensureTestUserExists("history-partner2@example.com")
+		for _, u := range []*User{user, partner1, partner2} {
+			s.purgeTransactionsForUser(u.ID)
+		}
+		start := time.Now().Add(-time.Hour).Truncate(time.Second)
+		for i := 0; i < 5; i++ {
+			transaction := Transaction{
+				InitiatedDate: PosixDateTime(start.Add(time.Duration(i) * time.Minute)),
+				FromUserId:    user.ID,
+				ToUserId:      partner1.ID,
+				Seconds:       uint64(60 * (i + 1)),
+				Multiplier:    1,
+				Description:   "History Transaction",
+				Status:        TransactionOffered,
+			}
+			if i%2 == 1 {
+				transaction.FromUserId, transaction.ToUserId = partner2.ID, user.ID
+				transaction.Status = TransactionRequested
+			}
+			_, err := s.InsertTransaction(&transaction)
+			So(err, ShouldBeNil)
+		}
+
+		Convey("Paging two at a time should visit every transaction once in order", func() {
+			filter := TransactionFilter{UserId: user.ID, Limit: 2}
+			var seconds []uint64
+			pages := 0
+			for {
+				page, err := s.ListTransactions(filter)
+				So(err, ShouldBeNil)
+				So(page.Total, ShouldEqual, 5)
+				for _, transaction := range page.Transactions {
+					seconds = append(seconds, transaction.Seconds)
+				}
+				pages++
+				if page.Next == nil {
+					break
+				}
+				filter.After, err = DecodeTransactionCursor(page.Next.Encode())
+				So(err, ShouldBeNil)
+			}
+			So(pages, ShouldEqual, 3)
+			So(seconds, ShouldResemble, []uint64{60, 120, 180, 240, 300})
+		})
+
+		Convey("Descending order should start with the latest", func() {
+			page, err := s.ListTransactions(TransactionFilter{UserId: user.ID, Limit: 1, Descending: true})
+			So(err, ShouldBeNil)
+			So(page.Transactions[0].Seconds, ShouldEqual, 300)
+		})
+
+		Convey("Filters should combine", func() {
+			page, err := s.ListTransactions(TransactionFilter{UserId: user.ID, Direction: TransactionDirectionIn})
+			So(err, ShouldBeNil)
+			So(page.Total, ShouldEqual, 2)
+
+			page, err = s.ListTransactions(TransactionFilter{UserId: user.ID, CounterpartyId: partner1.ID, MinSeconds: 120})
+			So(err, ShouldBeNil)
+			So(page.Total, ShouldEqual, 2)
+
+			page, err = s.ListTransactions(TransactionFilter{UserId: user.ID, Statuses: []uint{TransactionRequested},
+				From: start.Add(2 * time.Minute), To: start.Add(4 * time.Minute)})
+			So(err, ShouldBeNil)
+			So(page.Total, ShouldEqual, 1)
+			So(page.Transactions[0].Seconds, ShouldEqual, 240)
+		})
+	})
+}
+
+func TestStore_Schedule(t *testing.T) {
+	Convey("Given a start on Wednesday 15 January 2020 at 10:00", t, func() {
+		start := time.Date(2020, time.January, 15, 10, 0, 0, 0, time.UTC)
+		next := func(rule string, from time.Time) time.Time {
+			schedule, err := ParseSchedule(rule)
+			So(err, ShouldBeNil)
+			occurrence, _ := schedule.Next(start, from)
+			return occurrence
+		}
+
+		Convey("Daily and weekly schedules keep the time of day", func() {
+			So(next("FREQ=DAILY", start), ShouldEqual, start)
+			So(next("FREQ=DAILY;INTERVAL=3", start.Add(time.Minute)), ShouldEqual, start.AddDate(0, 0, 3))
+			So(next("FREQ=WEEKLY", start.Add(time.Minute)), ShouldEqual, start.AddDate(0, 0, 7))
+			So(next("RRULE:FREQ=WEEKLY;BYDAY=MO,SA", start), ShouldEqual, time.Date(2020, time.January, 18, 10, 0, 0, 0, time.UTC))
+			So(next("FREQ=WEEKLY;INTERVAL=2;BYDAY=MO", start), ShouldEqual, time.Date(2020, time.January, 27, 10, 0, 0, 0, time.UTC))
+			So(next("FREQ=WEEKLY;INTERVAL=2;BYDAY=MO", time.Date(2021, time.March, 2, 0, 0, 0, 0, time.UTC)), ShouldEqual, time.Date(2021, time.March, 8, 10, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Monthly schedules skip months without the day", func() {
+			So(next("FREQ=MONTHLY", start.Add(time.Minute)), ShouldEqual, start.AddDate(0, 1, 0))
+			So(next("FREQ=MONTHLY;BYMONTHDAY=31", time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC)), ShouldEqual, time.Date(2020, time.March, 31, 10, 0, 0, 0, time.UTC))
+			So(next("FREQ=MONTHLY;BYMONTHDAY=-1", time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC)), ShouldEqual, time.Date(2020, time.February, 29, 10, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Schedules end at UNTIL", func() {
+			schedule, err := ParseSchedule("FREQ=DAILY;UNTIL=20200116")
+			So(err, ShouldBeNil)
+			_, ok := schedule.Next(start, start.AddDate(0, 0, 1))
+			So(ok, ShouldBeTrue)
+			_, ok = schedule.Next(start, start.AddDate(0, 0, 2))
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Unsupported or invalid rules are rejected", func() {
+			for _, rule := range []string{"", "FREQ=HOURLY", "FREQ=DAILY;BYDAY=MO", "FREQ=WEEKLY;BYDAY=XX", "FREQ=MONTHLY;BYMONTHDAY=32", "FREQ=DAILY;INTERVAL=0", "FREQ=DAILY;FREQ=WEEKLY", "FREQ=DAILY;BYHOUR=9"} {
+				_, err := ParseSchedule(rule)
+				So(err, ShouldNotBeNil)
+			}
+			schedule, _ := ParseSchedule("freq=weekly;byday=sa,mo;count=4")
+			So(schedule.String(), ShouldEqual, "FREQ=WEEKLY;BYDAY=SA,MO;COUNT=4")
+		})
+	})
+}
+
+func TestStore_RecurringTransactions(t *testing.T) {
+	Convey("Given a weekly recurring offer that is due", t, func() {
+		user1 := ensureTestUserExists("recurring1@example.com")
+		user2 := ensureTestUserExists("recurring2@example.com")
+		start := time.Now().Add(-7*24*time.Hour - time.Hour).Truncate(time.Second)
+		recurring := RecurringTransaction{
+			UserId:      user1.ID,
+			FromUserId:  user1.ID,
+			ToUserId:    user2.ID,
+			Status:      TransactionOffered,
+			Seconds:     2 * 60 * 60,
+			Multiplier:  1,
+			TxFee:       2,
+			Description: "Gardening",
+			Schedule:    "FREQ=WEEKLY;COUNT=2",
+			StartDate:   PosixDateTime(start),
+		}
+		recurring.ScheduleNext(start)
+		recurringId, err := s.InsertRecurringTransaction(&recurring)
+		So(err, ShouldBeNil)
+
+		occurrence := func(claimed RecurringTransaction) *Transaction {
+			return &Transaction{FromUserId: claimed.FromUserId, ToUserId: claimed.ToUserId, Seconds: claimed.Seconds,
+				Multiplier: claimed.Multiplier, Status: claimed.Status, RecurringTransactionId: claimed.ID}
+		}
+
+		Convey("Running should create each occurrence once and stop after COUNT", func() {
+			var occurrences []time.Time
+			for i := 0; i < 3; i++ {
+				_, _, err := s.RunDueRecurringTransactions(time.Now(), 1000, func(claimed RecurringTransaction) (*Transaction, error) {
+					if claimed.ID != recurringId {
+						return nil, errors.New("not this test's")
+					}
+					occurrences = append(occurrences, time.Time(*claimed.NextRunAt))
+					return occurrence(claimed), nil
+				})
+				So(err, ShouldBeNil)
+			}
+			So(len(occurrences), ShouldEqual, 2)
+			So(occurrences[0].Equal(start), ShouldBeTrue)
+			So(occurrences[1].Equal(start.AddDate(0, 0, 7)), ShouldBeTrue)
+			finished, _ := s.LoadRecurringTransaction(recurringId)
+			So(finished.Runs, ShouldEqual, 2)
+			So(finished.NextRunAt, ShouldBeNil)
+			created := 0
+			transactions, _ := s.ListTransactionsForUser(user1.ID)
+			for _, transaction := range transactions {
+				if transaction.RecurringTransactionId == recurringId {
+					created++
+				}
+			}
+			So(created, ShouldEqual, 2)
+		})
+
+		Convey("An occurrence that fails to be created is left due to be tried again", func() {
+			_, advanced, err := s.RunDueRecurringTransactions(time.Now(), 1000, func(claimed RecurringTransaction) (*Transaction, error) {
+				return nil, errors.New("not now")
+			})
+			So(err, ShouldBeNil)
+			So(advanced, ShouldEqual, 0)
+			unchanged, _ := s.LoadRecurringTransaction(recurringId)
+			So(unchanged.Runs, ShouldEqual, 0)
+			So(time.Time(*unchanged.NextRunAt).Equal(start), ShouldBeTrue)
+		})
+
+		Convey("A paused template is not run", func() {
+			So(s.PauseRecurringTransaction(recurringId), ShouldBeNil)
+			_, _, err = s.RunDueRecurringTransactions(time.Now(), 1000, func(claimed RecurringTransaction) (*Transaction, error) {
+				So(claimed.ID, ShouldNotEqual, recurringId)
+				return nil, errors.New("not this test's")
+			})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Pausing keeps an occurrence the scheduler created after the template was loaded", func() {
+			_, advanced, err := s.RunDueRecurringTransactions(time.Now(), 1000, func(claimed RecurringTransaction) (*Transaction, error) {
+				if claimed.ID != recurringId {
+					return nil, errors.New("not this test's")
+				}
+				return occurrence(claimed), nil
+			})
+			So(err, ShouldBeNil)
+			So(advanced, ShouldBeGreaterThanOrEqualTo, 1)
+			So(s.PauseRecurringTransaction(recurringId), ShouldBeNil)
+			paused, _ := s.LoadRecurringTransaction(recurringId)
+			So(paused.Paused, ShouldBeTrue)
+			So(paused.Runs, ShouldEqual, 1)
+			So(s.PauseRecurringTransaction(0), ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			_ = s.DeleteRecurringTransaction(recurringId)
+			s.purgeTransactionsForUser(user1.ID)
+		})
+	})
+}
+
+func TestStore_TransactionGroups(t *testing.T) {
+	Convey("Given a payer offering to two helpers as a group", t, func() {
+		payer := ensureTestUserExists("group-payer@example.com")
+		helper1 := ensureTestUserExists("group-helper1@example.com")
+		helper2 := ensureTestUserExists("group-helper2@example.com")
+		payerBalance, _ := s.LastConfirmedTransactionForUser(payer.ID)
+		var legs []Transaction
+		for _, helper := range []*User{helper1, helper2} {
+			legs = append(legs, Transaction{
+				InitiatedDate: PosixDateTime(time.Now()),
+				FromUserId:    payer.ID,
+				ToUserId:      helper.ID,
+				Seconds:       3 * 60 * 60,
+				Multiplier:    1,
+				TxFee:         3,
+				Description:   "Moving house",
+				Status:        TransactionOffered,
+			})
+		}
+		group := TransactionGroup{UserId: payer.ID, Description: "Moving house"}
+		groupId, err := s.InsertTransactionGroup(&group, legs)
+		So(err, ShouldBeNil)
+		So(legs[0].GroupId, ShouldEqual, groupId)
+
+		Convey("A leg can not be posted or cancelled on its own", func() {
+			_, err := s.PostTransaction(legs[0].ID)
+			So(err, ShouldEqual, ErrTransactionInGroup)
+			_, err = s.ClosePendingTransaction(legs[0].ID, TransactionOfferCancelled)
+			So(err, ShouldEqual, ErrTransactionInGroup)
+		})
+
+		Convey("Every leg posts once the last counterparty approves", func() {
+			approved, err := s.ApproveGroupTransaction(legs[0].ID)
+			So(err, ShouldBeNil)
+			So(approved.Status, ShouldEqual, TransactionGroupPending)
+			leg, _ := s.LoadTransaction(legs[0].ID)
+			So(leg.Status, ShouldEqual, TransactionOffered)
+			So(leg.ApprovedDate, ShouldNotBeNil)
+
+			posted, err := s.ApproveGroupTransaction(legs[1].ID)
+			So(err, ShouldBeNil)
+			So(posted.Status, ShouldEqual, TransactionGroupPosted)
+			first, _ := s.LoadTransaction(legs[0].ID)
+			second, _ := s.LoadTransaction(legs[1].ID)
+			So(first.IsPosted() && second.IsPosted(), ShouldBeTrue)
+			So(second.FromPreviousTId, ShouldEqual, first.ID)
+			So(second.FromUserBalance, ShouldEqual, payerBalance.Balance(payer.ID)-2*(3*60*60+3))
+
+			_, err = s.ApproveGroupTransaction(legs[1].ID)
+			So(err, ShouldEqual, ErrTransactionNotPending)
+			report, err := s.VerifyLedger(payer.ID)
+			So(err, ShouldBeNil)
+			So(report.Valid, ShouldBeTrue)
+		})
+
+		Convey("A leg breaking a limit leaves the whole group unposted", func() {
+			limit := CreditLimit{UserId: payer.ID, CreditLimit: -payerBalance.Balance(payer.ID) + 4*60*60, BalanceCap: NoLimit}
+			_, _ = s.SaveCreditLimit(&limit)
+			_, err := s.ApproveGroupTransaction(legs[0].ID)
+			So(err, ShouldBeNil)
+			_, err = s.ApproveGroupTransaction(legs[1].ID)
+			_, isLimitError := err.(*LimitError)
+			So(isLimitError, ShouldBeTrue)
+			for _, leg := range legs {
+				unposted, _ := s.LoadTransaction(leg.ID)
+				So(unposted.Status, ShouldEqual, TransactionOffered)
+			}
+			second, _ := s.LoadTransaction(legs[1].ID)
+			So(second.ApprovedDate, ShouldBeNil)
+			_ = s.DeleteCreditLimit(payer.ID, 0)
+		})
+
+		Convey("Rejecting the group rejects every leg", func() {
+			rejected, err := s.CloseTransactionGroup(groupId, TransactionGroupRejected)
+			So(err, ShouldBeNil)
+			So(rejected.Status, ShouldEqual, TransactionGroupRejected)
+			for _, leg := range legs {
+				closed, _ := s.LoadTransaction(leg.ID)
+				So(closed.Status, ShouldEqual, TransactionOfferRejected)
+			}
+			_, err = s.ApproveGroupTransaction(legs[0].ID)
+			So(err, ShouldEqual, ErrTransactionNotPending)
+		})
+	})
+}
+
+func TestStore_Disputes(t *testing.T) {
+	Convey("Given a posted transaction between two members", t, func() {
+		payer := ensureTestUserExists("dispute-payer@example.com")
+		payee := ensureTestUserExists("dispute-payee@example.com")
+		editor := ensureTestUserExists("dispute-editor@example.com")
+		transaction := Transaction{
+			InitiatedDate: PosixDateTime(time.Now()),
+			FromUserId:    payer.ID,
+			ToUserId:      payee.ID,
+			Seconds:       2 * 60 * 60,
+			Multiplier:    1,
+			TxFee:         2,
+			Description:   "Gardening",
+			Status:        TransactionOffered,
+		}
+		transactionId, _ := s.InsertTransaction(&transaction)
+		original, err := s.PostTransaction(transactionId)
+		So(err, ShouldBeNil)
+		dispute := Dispute{TransactionId: transactionId, RaisedById: payer.ID, Reason: "The garden was not touched"}
+		disputeId, err := s.RaiseDispute(&dispute)
+		So(err, ShouldBeNil)
+
+		Convey("Only one dispute can be open at a time", func() {
+			_, err := s.RaiseDispute(&Dispute{TransactionId: transactionId, RaisedById: payee.ID, Reason: "Me too"})
+			So(err, ShouldEqual, ErrDisputeOpen)
+		})
+
+		Convey("Upholding the dispute posts a reversal and leaves the original untouched", func() {
+			reviewed, err := s.ReviewDispute(disputeId, editor.ID, "Asking both members")
+			So(err, ShouldBeNil)
+			So(reviewed.Status, ShouldEqual, DisputeUnderReview)
+			resolved, err := s.ResolveDispute(disputeId, editor.ID, true, "No work was done")
+			So(err, ShouldBeNil)
+			So(resolved.Status, ShouldEqual, DisputeReversed)
+			So(resolved.ResolvedDate, ShouldNotBeNil)
+
+			unchanged, _ := s.LoadTransaction(transactionId)
+			So(unchanged.Hash, ShouldEqual, original.Hash)
+			reversal, _ := s.LoadTransaction(resolved.ReversalTId)
+			So(reversal.Status, ShouldEqual, TransactionReversal)
+			So(reversal.ReversesTId, ShouldEqual, transactionId)
+			So(reversal.FromUserId, ShouldEqual, payee.ID)
+			So(reversal.ToUserBalance, ShouldEqual, original.FromUserBalance+2*60*60)
+			report, err := s.VerifyLedger(payee.ID)
+			So(err, ShouldBeNil)
+			So(report.Valid, ShouldBeTrue)
+
+			_, err = s.ResolveDispute(disputeId, editor.ID, true, "Again")
+			So(err, ShouldEqual, ErrDisputeClosed)
+			_, err = s.RaiseDispute(&Dispute{TransactionId: transactionId, RaisedById: payer.ID, Reason: "Again"})
+			So(err, ShouldEqual, ErrTransactionReversed)
+			_, err = s.RaiseDispute(&Dispute{TransactionId: reversal.ID, RaisedById: payer.ID, Reason: "Reversal"})
+			So(err, ShouldEqual, ErrTransactionNotPosted)
+
+			entries, err := s.ListAuditEntries(transactionId)
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 3)
+			So(entries[0].Action, ShouldEqual, AuditDisputeRaised)
+			So(entries[1].Action, ShouldEqual, AuditDisputeReviewed)
+			So(entries[2].Action, ShouldEqual, AuditTransactionReversed)
+			So(entries[2].ActorId, ShouldEqual, editor.ID)
+		})
+
+		Convey("Dismissing the dispute posts nothing", func() {
+			resolved, err := s.ResolveDispute(disputeId, editor.ID, false, "The garden looks lovely")
+			So(err, ShouldBeNil)
+			So(resolved.Status, ShouldEqual, DisputeDismissed)
+			So(resolved.ReversalTId, ShouldEqual, 0)
+			last, _ := s.LastConfirmedTransactionForUser(payer.ID)
+			So(last.ID, ShouldEqual, transactionId)
+			disputes, _ := s.ListDisputesForUser(payee.ID)
+			So(len(disputes), ShouldEqual, 1)
+		})
+
+		Reset(func() {
+			reversals, _ := s.ListTransactionsForUser(payer.ID)
+			for _, reversal := range reversals {
+				s.PurgeTransaction(reversal)
+			}
+		})
+	})
+}
+
+func TestStore_MultiplierModes(t *testing.T) {
+	Convey("Given a worker paid for two hours at a double rate", t, func() {
+		payer := ensureTestUserExists("multiplier-payer@example.com")
+		worker := ensureTestUserExists("multiplier-worker@example.com")
+		post := func() *Transaction {
+			transaction := Transaction{
+				InitiatedDate: PosixDateTime(time.Now()),
+				FromUserId:    payer.ID,
+				ToUserId:      worker.ID,
+				Seconds:       2 * 60 * 60,
+				Multiplier:    2,
+				TxFee:         2,
+				Description:   "Plumbing",
+				Status:        TransactionOffered,
+			}
+			transactionId, _ := s.InsertTransaction(&transaction)
+			posted, err := s.PostTransaction(transactionId)
+			So(err, ShouldBeNil)
+			return posted
+		}
+		last, _ := s.LastConfirmedTransactionForUser(worker.ID)
+		startBalance := last.Balance(worker.ID)
+
+		Convey("By default the multiplier is only recorded", func() {
+			posted := post()
+			So(posted.CreditedSeconds, ShouldEqual, 2*60*60)
+			So(posted.ToUserBalance, ShouldEqual, startBalance+2*60*60)
+		})
+
+		Convey("Scaling credits the multiplied seconds and still verifies", func() {
+			s.SetScaleByMultiplier(true)
+			posted := post()
+			s.SetScaleByMultiplier(false)
+			So(posted.CreditedSeconds, ShouldEqual, 4*60*60)
+			So(posted.ToUserBalance, ShouldEqual, startBalance+4*60*60)
+			report, err := s.VerifyLedger(worker.ID)
+			So(err, ShouldBeNil)
+			So(report.Valid, ShouldBeTrue)
+
+			Convey("And the value report shows hours worked against their value", func() {
+				post()
+				from := time.Now().Add(-time.Minute)
+				report, err := s.ValueReport(worker.ID, "month", from, time.Now())
+				So(err, ShouldBeNil)
+				So(len(report.Lines), ShouldEqual, 1)
+				line := report.Lines[0]
+				So(line.Transactions, ShouldEqual, 2)
+				So(line.Seconds, ShouldEqual, 4*60*60)
+				So(line.MultipliedSeconds, ShouldEqual, 8*60*60)
+				So(line.CreditedSeconds, ShouldEqual, 6*60*60)
+				So(line.Period.Day(), ShouldEqual, 1)
+
+				_, err = s.ValueReport(worker.ID, "fortnight", from, time.Now())
+				So(err, ShouldEqual, ErrUnknownPeriod)
+			})
+		})
+
+		Reset(func() {
+			transactions, _ := s.ListTransactionsForUser(worker.ID)
+			for _, transaction := range transactions {
+				s.PurgeTransaction(transaction)
+			}
+		})
+	})
+}
+
+func TestStore_Listings(t *testing.T) {
+	Convey("Given an offer and a want from two members", t, func() {
+		teacher := ensureTestUserExists("listing-teacher@example.com")
+		builder := ensureTestUserExists("listing-builder@example.com")
+		now := time.Now()
+		offer := Listing{UserId: teacher.ID, Kind: ListingOffer, Category: "Music", Title: "Guitar lessons",
+			Description: "Beginners welcome", EstimatedSeconds: 3600, Multiplier: 1, Location: "Bristol",
+			ExpiresAt: PosixDateTime(now.Add(time.Hour))}
+		want := Listing{UserId: builder.ID, Kind: ListingWant, Category: "garden", Title: "Fence repair",
+			Description: "Two panels blown down", EstimatedSeconds: 7200, Multiplier: 1.5, Location: "Bath",
+			ExpiresAt: PosixDateTime(now.Add(time.Hour))}
+		_, err := s.InsertListing(&offer)
+		So(err, ShouldBeNil)
+		_, _ = s.InsertListing(&want)
+		search := func(filter ListingFilter) []uint {
+			filter.Now = now
+			listings, err := s.SearchListings(filter)
+			So(err, ShouldBeNil)
+			var ids []uint
+			for _, listing := range listings {
+				if listing.ID == offer.ID || listing.ID == want.ID {
+					ids = append(ids, listing.ID)
+				}
+			}
+			return ids
+		}
+
+		Convey("Searches filter by kind, category, text and location", func() {
+			So(search(ListingFilter{}), ShouldResemble, []uint{want.ID, offer.ID})
+			So(search(ListingFilter{Kind: ListingOffer}), ShouldResemble, []uint{offer.ID})
+			So(search(ListingFilter{Category: "GARDEN"}), ShouldResemble, []uint{want.ID})
+			So(search(ListingFilter{Query: "guitar"}), ShouldResemble, []uint{offer.ID})
+			So(search(ListingFilter{Query: "panels"}), ShouldResemble, []uint{want.ID})
+			So(search(ListingFilter{Location: "bat"}), ShouldResemble, []uint{want.ID})
+			So(search(ListingFilter{Query: "%"}), ShouldBeEmpty)
+		})
+
+		Convey("Expired and deleted listings are not found", func() {
+			offer.ExpiresAt = PosixDateTime(now.Add(-time.Minute))
+			_, err := s.UpdateListing(&offer)
+			So(err, ShouldBeNil)
+			So(search(ListingFilter{}), ShouldResemble, []uint{want.ID})
+			So(s.DeleteListing(want.ID), ShouldBeNil)
+			So(search(ListingFilter{}), ShouldBeEmpty)
+			_, err = s.LoadListing(want.ID)
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			_ = s.DeleteListing(offer.ID)
+			_ = s.DeleteListing(want.ID)
+		})
+	})
+}
+
+func TestStore_Geo(t *testing.T) {
+	Convey("Given members and listings placed around Bristol", t, func() {
+		point := func(value float64) *float64 { return &value }
+		centre := ensureTestUserExists("geo-centre@example.com")
+		centre.Latitude, centre.Longitude = point(51.4545), point(-2.5879)
+		_, err := s.UpdateUser(centre)
+		So(err, ShouldBeNil)
+		suburb := ensureTestUserExists("geo-suburb@example.com")
+		suburb.Latitude, suburb.Longitude = point(51.4816), point(-2.6095)
+		_, _ = s.UpdateUser(suburb)
+		london := ensureTestUserExists("geo-london@example.com")
+		london.Latitude, london.Longitude = point(51.5074), point(-0.1278)
+		_, _ = s.UpdateUser(london)
+		nearby := func(radiusKm float64) []uint {
+			users, err := s.ListUsersNear(51.4545, -2.5879, radiusKm, 2, 100)
+			So(err, ShouldBeNil)
+			var ids []uint
+			for _, user := range users {
+				if user.ID == centre.ID || user.ID == suburb.ID || user.ID == london.ID {
+					ids = append(ids, user.ID)
+				}
+			}
+			return ids
+		}
+
+		Convey("Members are found within the radius, nearest first", func() {
+			So(nearby(1), ShouldResemble, []uint{centre.ID})
+			So(nearby(10), ShouldResemble, []uint{centre.ID, suburb.ID})
+			So(nearby(200), ShouldResemble, []uint{centre.ID, suburb.ID, london.ID})
+			So(DistanceKm(51.4545, -2.5879, 51.5074, -0.1278), ShouldAlmostEqual, 171, 1)
+		})
+
+		Convey("Members are searched by their blurred point, not their exact one", func() {
+			found := func(precision int) bool {
+				users, err := s.ListUsersNear(*suburb.Latitude, *suburb.Longitude, 0.01, precision, 100)
+				So(err, ShouldBeNil)
+				for _, user := range users {
+					if user.ID == suburb.ID {
+						return true
+					}
+				}
+				return false
+			}
+			So(found(2), ShouldBeFalse)
+			So(found(4), ShouldBeTrue)
+		})
+
+		Convey("Listings near a point are sorted by distance", func() {
+			now := time.Now()
+			far := Listing{UserId: london.ID, Kind: ListingOffer, Category: "geo", Title: "Far", EstimatedSeconds: 60,
+				Multiplier: 1, ExpiresAt: PosixDateTime(now.Add(time.Hour)), Latitude: london.Latitude, Longitude: london.Longitude}
+			near := Listing{UserId: suburb.ID, Kind: ListingOffer, Category: "geo", Title: "Near", EstimatedSeconds: 60,
+				Multiplier: 1, ExpiresAt: PosixDateTime(now.Add(time.Hour)), Latitude: suburb.Latitude, Longitude: suburb.Longitude}
+			_, _ = s.InsertListing(&far)
+			_, _ = s.InsertListing(&near)
+			listings, err := s.SearchListings(ListingFilter{Category: "geo", NearLatitude: 51.4545, NearLongitude: -2.5879, RadiusKm: 500, Precision: 2, Now: now})
+			So(err, ShouldBeNil)
+			So(len(listings), ShouldEqual, 2)
+			So(listings[0].ID, ShouldEqual, near.ID)
+			So(listings[0].DistanceKm, ShouldBeLessThan, listings[1].DistanceKm)
+			listings, _ = s.SearchListings(ListingFilter{Category: "geo", NearLatitude: 51.4545, NearLongitude: -2.5879, RadiusKm: 10, Precision: 2, Now: now})
+			So(len(listings), ShouldEqual, 1)
+			_ = s.DeleteListing(far.ID)
+			_ = s.DeleteListing(near.ID)
+		})
+
+		Convey("Places are read from csv and looked up however the key is written", func() {
+			places, err := ReadPlacesCSV(strings.NewReader("name,latitude,longitude\nBS1 4DJ,51.4496,-2.5963\nBath,51.3811,-2.3590\n"))
+			So(err, ShouldBeNil)
+			So(len(places), ShouldEqual, 2)
+			count, err := s.SavePlaces(places)
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+			place, err := s.LookupPlace("bs14dj")
+			So(err, ShouldBeNil)
+			So(place.Name, ShouldEqual, "BS1 4DJ")
+			_, err = s.LookupPlace("Atlantis")
+			So(err, ShouldNotBeNil)
+			_, err = ReadPlacesCSV(strings.NewReader("Bath,51.3811,-2.3590\nNowhere,95,0\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestStore_Feedback(t *testing.T) {
+	Convey("Given a confirmed transaction between two members", t, func() {
+		helper := ensureTestUserExists("feedback-helper@example.com")
+		helped := ensureTestUserExists("feedback-helped@example.com")
+		editor := ensureTestUserExists("feedback-editor@example.com")
+		transaction := Transaction{
+			InitiatedDate: PosixDateTime(time.Now()),
+			FromUserId:    helped.ID,
+			ToUserId:      helper.ID,
+			Seconds:       60 * 60,
+			Multiplier:    1,
+			TxFee:         1,
+			Description:   "Shopping",
+			Status:        TransactionOffered,
+		}
+		transactionId, _ := s.InsertTransaction(&transaction)
+		weekAgo := time.Now().Add(-7 * 24 * time.Hour)
+
+		Convey("Feedback waits for the transaction to be confirmed", func() {
+			_, err := s.LeaveFeedback(&Feedback{TransactionId: transactionId, FromUserId: helped.ID, Rating: 5}, weekAgo)
+			So(err, ShouldEqual, ErrFeedbackNotAllowed)
+		})
+
+		Convey("Each party rates the other once", func() {
+			_, err := s.PostTransaction(transactionId)
+			So(err, ShouldBeNil)
+			fromHelped := Feedback{TransactionId: transactionId, FromUserId: helped.ID, Rating: 5, Comment: "Brilliant"}
+			_, err = s.LeaveFeedback(&fromHelped, weekAgo)
+			So(err, ShouldBeNil)
+			So(fromHelped.ToUserId, ShouldEqual, helper.ID)
+			_, err = s.LeaveFeedback(&Feedback{TransactionId: transactionId, FromUserId: helped.ID, Rating: 1}, weekAgo)
+			So(err, ShouldEqual, ErrFeedbackExists)
+			_, err = s.LeaveFeedback(&Feedback{TransactionId: transactionId, FromUserId: editor.ID, Rating: 1}, weekAgo)
+			So(err, ShouldEqual, ErrFeedbackNotAllowed)
+			_, err = s.LeaveFeedback(&Feedback{TransactionId: transactionId, FromUserId: helper.ID, Rating: 4}, time.Now().Add(time.Minute))
+			So(err, ShouldEqual, ErrFeedbackClosed)
+			_, err = s.LeaveFeedback(&Feedback{TransactionId: transactionId, FromUserId: helper.ID, Rating: 4}, weekAgo)
+			So(err, ShouldBeNil)
+
+			reputation, err := s.ReputationFor(helper.ID)
+			So(err, ShouldBeNil)
+			So(reputation, ShouldResemble, Reputation{RatingCount: 1, RatingAverage: 5})
+
+			Convey("Hidden feedback stops counting and the moderation is audited", func() {
+				hidden, err := s.ModerateFeedback(fromHelped.ID, editor.ID, true, "Abusive")
+				So(err, ShouldBeNil)
+				So(hidden.Hidden, ShouldBeTrue)
+				reputation, _ := s.ReputationFor(helper.ID)
+				So(reputation.RatingCount, ShouldEqual, 0)
+				feedback, _ := s.ListFeedback(true, 10)
+				So(feedback[0].ID, ShouldEqual, fromHelped.ID)
+				entries, _ := s.ListAuditEntries(transactionId)
+				So(entries[len(entries)-1].Action, ShouldEqual, AuditFeedbackHidden)
+				So(entries[len(entries)-1].FeedbackId, ShouldEqual, fromHelped.ID)
+				shown, _ := s.ModerateFeedback(fromHelped.ID, editor.ID, false, "")
+				So(shown.Hidden, ShouldBeFalse)
+			})
+		})
+
+		Reset(func() {
+			s.PurgeTransaction(transaction)
+		})
+	})
+}
+
+func TestStore_Messages(t *testing.T) {
+	Convey("Given a thread between two members", t, func() {
+		sender := ensureTestUserExists("message-sender@example.com")
+		recipient := ensureTestUserExists("message-recipient@example.com")
+		outsider := ensureTestUserExists("message-outsider@example.com")
+		thread := MessageThread{UserId: recipient.ID, OtherUserId: sender.ID, Subject: "Hedge trimming"}
+		threadId, err := s.FindOrCreateMessageThread(&thread)
+		So(err, ShouldBeNil)
+
+		Convey("The same pair and subject always share one thread", func() {
+			again := MessageThread{UserId: sender.ID, OtherUserId: recipient.ID}
+			againId, err := s.FindOrCreateMessageThread(&again)
+			So(err, ShouldBeNil)
+			So(againId, ShouldEqual, threadId)
+			other := MessageThread{UserId: sender.ID, OtherUserId: recipient.ID, ListingId: 99}
+			otherId, _ := s.FindOrCreateMessageThread(&other)
+			So(otherId, ShouldNotEqual, threadId)
+		})
+
+		Convey("Messages go to the other participant and are unread until the thread is read", func() {
+			message := Message{ThreadId: threadId, FromUserId: sender.ID, Body: "Saturday?"}
+			_, err := s.InsertMessage(&message)
+			So(err, ShouldBeNil)
+			So(message.ToUserId, ShouldEqual, recipient.ID)
+			_, err = s.InsertMessage(&Message{ThreadId: threadId, FromUserId: outsider.ID, Body: "Hello"})
+			So(err, ShouldEqual, ErrNotParticipant)
+
+			unread, _ := s.UnreadMessageCount(recipient.ID)
+			So(unread, ShouldEqual, 1)
+			threads, _ := s.ListMessageThreadsForUser(recipient.ID)
+			So(len(threads), ShouldEqual, 1)
+			So(threads[0].UnreadCount, ShouldEqual, 1)
+			marked, err := s.MarkThreadRead(threadId, recipient.ID, time.Now())
+			So(err, ShouldBeNil)
+			So(marked, ShouldEqual, 1)
+			unread, _ = s.UnreadMessageCount(recipient.ID)
+			So(unread, ShouldEqual, 0)
+		})
+
+		Convey("A block stops messages both ways until it is lifted", func() {
+			So(s.BlockUser(recipient.ID, sender.ID), ShouldBeNil)
+			So(s.BlockUser(recipient.ID, sender.ID), ShouldBeNil)
+			_, err := s.InsertMessage(&Message{ThreadId: threadId, FromUserId: sender.ID, Body: "Hello?"})
+			So(err, ShouldEqual, ErrBlocked)
+			_, err = s.InsertMessage(&Message{ThreadId: threadId, FromUserId: recipient.ID, Body: "Hello?"})
+			So(err, ShouldEqual, ErrBlocked)
+			blocks, _ := s.ListBlockedUsers(recipient.ID)
+			So(len(blocks), ShouldEqual, 1)
+			So(s.UnblockUser(recipient.ID, sender.ID), ShouldBeNil)
+			So(s.UnblockUser(recipient.ID, sender.ID), ShouldNotBeNil)
+			_, err = s.InsertMessage(&Message{ThreadId: threadId, FromUserId: sender.ID, Body: "Hello?"})
+			So(err, ShouldBeNil)
+		})
+
+		Reset(func() {
+			s.PurgeUser(sender.Email)
+			s.PurgeUser(recipient.Email)
+			s.PurgeUser(outsider.Email)
+		})
+	})
+}
+
+func TestStore_Events(t *testing.T) {
+	Convey("Given events logged for two members", t, func() {
+		user := ensureTestUserExists("event-user@example.com")
+		other := ensureTestUserExists("event-other@example.com")
+		var ids []uint
+		for _, eventType := range []string{"first", "second", "third"} {
+			id, err := s.InsertEvent(&Event{UserId: user.ID, Type: eventType, Data: "{}"})
+			So(err, ShouldBeNil)
+			ids = append(ids, id)
+		}
+		_, _ = s.InsertEvent(&Event{UserId: other.ID, Type: "other", Data: "{}"})
+
+		Convey("Only the member's events after the given id are listed, oldest first", func() {
+			events, err := s.ListEventsSince(user.ID, ids[0], 10)
+			So(err, ShouldBeNil)
+			So(len(events), ShouldEqual, 2)
+			So(events[0].Type, ShouldEqual, "second")
+			So(events[1].Type, ShouldEqual, "third")
+			events, _ = s.ListEventsSince(user.ID, 0, 1)
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Type, ShouldEqual, "first")
+		})
+
+		Convey("Events older than the retention are purged", func() {
+			purged, err := s.PurgeEventsBefore(time.Now().Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(purged, ShouldBeGreaterThanOrEqualTo, 4)
+			events, _ := s.ListEventsSince(user.ID, 0, 10)
+			So(events, ShouldBeEmpty)
+		})
+
+		Reset(func() {
+			s.PurgeUser(user.Email)
+			s.PurgeUser(other.Email)
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+var ErrUnknownPeriod = errors.New("period must be week, month or year")
+
+// ValueLine sums the work one member was paid for in a period starting at Period, reversals count against it.
+// Seconds is the time worked, MultipliedSeconds that time at its multiplier and CreditedSeconds what was actually
+// added to their balance.
+type ValueLine struct {
+	UserId            uint
+	Period            time.Time
+	Transactions      int64
+	Seconds           int64
+	MultipliedSeconds int64
+	CreditedSeconds   int64
+}
+
+type ValueReport struct {
+	UserId            uint
+	Period            string
+	From              time.Time
+	To                time.Time
+	ScaleByMultiplier bool
+	Lines             []ValueLine
+}
+
+// MultipliedSeconds is the time worked scaled by the multiplier agreed for it
+func (t Transaction) MultipliedSeconds() uint64 {
+	return uint64(math.Round(float64(t.Seconds) * float64(t.Multiplier)))
+}
+
+// creditFor is how many seconds move between the parties when the transaction is posted, a reversal moves back
+// whatever its original did
+func (t Transaction) creditFor(scaleByMultiplier bool) uint64 {
+	if t.ReversesTId != 0 {
+		return t.CreditedSeconds
+	}
+	if scaleByMultiplier {
+		return t.MultipliedSeconds()
+	}
+	return t.Seconds
+}
+
+// periodStart is the start, in UTC, of the week (from Monday), month or year containing date
+func periodStart(date time.Time, period string) (time.Time, error) {
+	date = date.UTC()
+	switch period {
+	case "week":
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)), nil
+	case "month":
+		return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	case "year":
+		return time.Date(date.Year(), 1, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	return date, ErrUnknownPeriod
+}
+
+// SetScaleByMultiplier decides whether transactions posted from now on credit their seconds times the multiplier
+// or only record the multiplier for reporting
+func (s *PostgresStore) SetScaleByMultiplier(scale bool) {
+	s.scaleByMultiplier = scale
+}
+
+// ValueReport sums the work paid to userId, or to every member when it is 0, per period between from and to
+func (s *PostgresStore) ValueReport(userId uint, period string, from time.Time, to time.Time) (*ValueReport, error) {
+	if _, err := periodStart(from, period); err != nil {
+		return nil, err
+	}
+	report := ValueReport{UserId: userId, Period: period, From: from, To: to, ScaleByMultiplier: s.scaleByMultiplier}
+	rows, err := s.db.Raw(`SELECT user_id, date_trunc(?, confirmed_date AT TIME ZONE 'UTC') AS period, SUM(entries)::bigint,
+	SUM(seconds)::bigint, SUM(multiplied)::bigint, SUM(credited)::bigint FROM (
+		SELECT to_user_id AS user_id, confirmed_date, 1 AS entries, seconds, ROUND(seconds * multiplier) AS multiplied, credited_seconds AS credited
+			FROM transactions WHERE deleted_at IS NULL AND status IN (?) AND reverses_t_id = 0
+		UNION ALL SELECT from_user_id, confirmed_date, -1, -seconds, -ROUND(seconds * multiplier), -credited_seconds
+			FROM transactions WHERE deleted_at IS NULL AND status IN (?) AND reverses_t_id <> 0
+	) AS work WHERE confirmed_date >= ? AND confirmed_date <= ? AND (? = 0 OR user_id = ?)
+	GROUP BY user_id, period ORDER BY period, user_id`, period, postedStatuses, postedStatuses, from, to, userId, userId).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		line := ValueLine{}
+		err = rows.Scan(&line.UserId, &line.Period, &line.Transactions, &line.Seconds, &line.MultipliedSeconds, &line.CreditedSeconds)
+		if err != nil {
+			return nil, err
+		}
+		line.Period = time.Date(line.Period.Year(), line.Period.Month(), line.Period.Day(), 0, 0, 0, 0, time.UTC)
+		report.Lines = append(report.Lines, line)
+	}
+	return &report, rows.Err()
+}
+
+func (s *MemoryStore) SetScaleByMultiplier(scale bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scaleByMultiplier = scale
+}
+
+func (s *MemoryStore) ValueReport(userId uint, period string, from time.Time, to time.Time) (*ValueReport, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := periodStart(from, period); err != nil {
+		return nil, err
+	}
+	report := ValueReport{UserId: userId, Period: period, From: from, To: to, ScaleByMultiplier: s.scaleByMultiplier}
+	type key struct {
+		userId uint
+		period time.Time
+	}
+	lines := map[key]*ValueLine{}
+	for _, transaction := range s.transactions {
+		confirmed := time.Time(transaction.ConfirmedDate)
+		if !transaction.IsPosted() || confirmed.Before(from) || confirmed.After(to) {
+			continue
+		}
+		worker, sign := transaction.ToUserId, int64(1)
+		if transaction.ReversesTId != 0 {
+			worker, sign = transaction.FromUserId, -1
+		}
+		if userId != 0 && worker != userId {
+			continue
+		}
+		start, _ := periodStart(confirmed, period)
+		line, ok := lines[key{worker, start}]
+		if !ok {
+			line = &ValueLine{UserId: worker, Period: start}
+			lines[key{worker, start}] = line
+		}
+		line.Transactions += sign
+		line.Seconds += sign * int64(transaction.Seconds)
+		line.MultipliedSeconds += sign * int64(transaction.MultipliedSeconds())
+		line.CreditedSeconds += sign * int64(transaction.CreditedSeconds)
+	}
+	for _, line := range lines {
+		report.Lines = append(report.Lines, *line)
+	}
+	sort.Slice(report.Lines, func(i, j int) bool {
+		a, b := report.Lines[i], report.Lines[j]
+		return a.Period.Before(b.Period) || (a.Period.Equal(b.Period) && a.UserId < b.UserId)
+	})
+	return &report, nil
+}
@@ -13,9 +13,7 @@ var tags []store.ConceptTag
 var concepts []store.Concept
 
 func TestMain(m *testing.M) {
-	s = store.Store{}
-
-	s.StoreInit("test-db")
+	s = store.NewMemoryStore()
 
 	code := m.Run()
 